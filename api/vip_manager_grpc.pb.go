@@ -0,0 +1,228 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/vip_manager.proto
+
+package api
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	VipManager_ListAssignments_FullMethodName = "/vipmanager.v1.VipManager/ListAssignments"
+	VipManager_Reconcile_FullMethodName       = "/vipmanager.v1.VipManager/Reconcile"
+	VipManager_DrainInstance_FullMethodName   = "/vipmanager.v1.VipManager/DrainInstance"
+	VipManager_PinVip_FullMethodName          = "/vipmanager.v1.VipManager/PinVip"
+)
+
+// VipManagerClient is the client API for VipManager service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type VipManagerClient interface {
+	// Lists the VIPs assigned to each instance, as of the last reconcile pass.
+	ListAssignments(ctx context.Context, in *ListAssignmentsRequest, opts ...grpc.CallOption) (*ListAssignmentsResponse, error)
+	// Starts a reconcile pass right away, instead of after -sleep.
+	Reconcile(ctx context.Context, in *ReconcileRequest, opts ...grpc.CallOption) (*ReconcileResponse, error)
+	// Excludes an instance: its VIPs move elsewhere, and it gets no new ones.
+	DrainInstance(ctx context.Context, in *DrainInstanceRequest, opts ...grpc.CallOption) (*DrainInstanceResponse, error)
+	// Pins a VIP to an instance, or unpins it.
+	PinVip(ctx context.Context, in *PinVipRequest, opts ...grpc.CallOption) (*PinVipResponse, error)
+}
+
+type vipManagerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewVipManagerClient(cc grpc.ClientConnInterface) VipManagerClient {
+	return &vipManagerClient{cc}
+}
+
+func (c *vipManagerClient) ListAssignments(ctx context.Context, in *ListAssignmentsRequest, opts ...grpc.CallOption) (*ListAssignmentsResponse, error) {
+	out := new(ListAssignmentsResponse)
+	err := c.cc.Invoke(ctx, VipManager_ListAssignments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vipManagerClient) Reconcile(ctx context.Context, in *ReconcileRequest, opts ...grpc.CallOption) (*ReconcileResponse, error) {
+	out := new(ReconcileResponse)
+	err := c.cc.Invoke(ctx, VipManager_Reconcile_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vipManagerClient) DrainInstance(ctx context.Context, in *DrainInstanceRequest, opts ...grpc.CallOption) (*DrainInstanceResponse, error) {
+	out := new(DrainInstanceResponse)
+	err := c.cc.Invoke(ctx, VipManager_DrainInstance_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *vipManagerClient) PinVip(ctx context.Context, in *PinVipRequest, opts ...grpc.CallOption) (*PinVipResponse, error) {
+	out := new(PinVipResponse)
+	err := c.cc.Invoke(ctx, VipManager_PinVip_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// VipManagerServer is the server API for VipManager service.
+// All implementations must embed UnimplementedVipManagerServer
+// for forward compatibility
+type VipManagerServer interface {
+	// Lists the VIPs assigned to each instance, as of the last reconcile pass.
+	ListAssignments(context.Context, *ListAssignmentsRequest) (*ListAssignmentsResponse, error)
+	// Starts a reconcile pass right away, instead of after -sleep.
+	Reconcile(context.Context, *ReconcileRequest) (*ReconcileResponse, error)
+	// Excludes an instance: its VIPs move elsewhere, and it gets no new ones.
+	DrainInstance(context.Context, *DrainInstanceRequest) (*DrainInstanceResponse, error)
+	// Pins a VIP to an instance, or unpins it.
+	PinVip(context.Context, *PinVipRequest) (*PinVipResponse, error)
+	mustEmbedUnimplementedVipManagerServer()
+}
+
+// UnimplementedVipManagerServer must be embedded to have forward compatible implementations.
+type UnimplementedVipManagerServer struct {
+}
+
+func (UnimplementedVipManagerServer) ListAssignments(context.Context, *ListAssignmentsRequest) (*ListAssignmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAssignments not implemented")
+}
+func (UnimplementedVipManagerServer) Reconcile(context.Context, *ReconcileRequest) (*ReconcileResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Reconcile not implemented")
+}
+func (UnimplementedVipManagerServer) DrainInstance(context.Context, *DrainInstanceRequest) (*DrainInstanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainInstance not implemented")
+}
+func (UnimplementedVipManagerServer) PinVip(context.Context, *PinVipRequest) (*PinVipResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PinVip not implemented")
+}
+func (UnimplementedVipManagerServer) mustEmbedUnimplementedVipManagerServer() {}
+
+// UnsafeVipManagerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to VipManagerServer will
+// result in compilation errors.
+type UnsafeVipManagerServer interface {
+	mustEmbedUnimplementedVipManagerServer()
+}
+
+func RegisterVipManagerServer(s grpc.ServiceRegistrar, srv VipManagerServer) {
+	s.RegisterService(&VipManager_ServiceDesc, srv)
+}
+
+func _VipManager_ListAssignments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAssignmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VipManagerServer).ListAssignments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VipManager_ListAssignments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VipManagerServer).ListAssignments(ctx, req.(*ListAssignmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VipManager_Reconcile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReconcileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VipManagerServer).Reconcile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VipManager_Reconcile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VipManagerServer).Reconcile(ctx, req.(*ReconcileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VipManager_DrainInstance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DrainInstanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VipManagerServer).DrainInstance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VipManager_DrainInstance_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VipManagerServer).DrainInstance(ctx, req.(*DrainInstanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VipManager_PinVip_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PinVipRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VipManagerServer).PinVip(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VipManager_PinVip_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VipManagerServer).PinVip(ctx, req.(*PinVipRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// VipManager_ServiceDesc is the grpc.ServiceDesc for VipManager service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var VipManager_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "vipmanager.v1.VipManager",
+	HandlerType: (*VipManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListAssignments",
+			Handler:    _VipManager_ListAssignments_Handler,
+		},
+		{
+			MethodName: "Reconcile",
+			Handler:    _VipManager_Reconcile_Handler,
+		},
+		{
+			MethodName: "DrainInstance",
+			Handler:    _VipManager_DrainInstance_Handler,
+		},
+		{
+			MethodName: "PinVip",
+			Handler:    _VipManager_PinVip_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "api/vip_manager.proto",
+}
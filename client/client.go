@@ -0,0 +1,273 @@
+package client
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Client for the admin API of a running vip_manager, for tools that check
+// status, drain instances, move VIPs and plan changes. The models mirror the
+// JSON of the API.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// PoolStatus is the state of a pool as of the last reconcile pass.
+type PoolStatus struct {
+	Pool string `json:"pool"`
+	// Pool VIPs by instance. Summarized into CIDR blocks, unless verbose.
+	Assignments   map[string][]string `json:"assignments"`
+	Spare         []string            `json:"spare"`
+	LastReconcile time.Time           `json:"last_reconcile"`
+	LastChanges   int                 `json:"last_changes"`
+	LastCycle     string              `json:"last_cycle"`
+	// State of each instance, e.g. "ok", "draining" or "quarantined".
+	States map[string]string `json:"states,omitempty"`
+}
+
+// Plan is the outcome of GET /plan: the operations a reconcile pass would
+// execute now.
+type Plan struct {
+	Time    time.Time     `json:"time"`
+	Steps   []PlannedStep `json:"steps"`
+	Adds    int           `json:"adds"`
+	Removes int           `json:"removes"`
+	// Why the pass would pause all changes instead, if it would.
+	Paused string `json:"paused,omitempty"`
+}
+
+// PlannedStep is one VIP to add to or remove from an instance.
+type PlannedStep struct {
+	Pool     string `json:"pool"`
+	Instance string `json:"instance"`
+	Ip       string `json:"ip"`
+	// "add" or "remove".
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+	Disruptive bool   `json:"disruptive"`
+}
+
+// Pin is a VIP pinned to an instance.
+type Pin struct {
+	Pool     string `json:"pool"`
+	Vip      string `json:"vip"`
+	Instance string `json:"instance"`
+	// "admin" or "config".
+	Source string `json:"source"`
+}
+
+// VipHistory is a change of a VIP.
+type VipHistory struct {
+	Time     time.Time `json:"time"`
+	Pool     string    `json:"pool"`
+	Action   string    `json:"action"`
+	Instance string    `json:"instance"`
+	// For moves, the other instance: the source of adds, the destination of
+	// removes.
+	Peer   string `json:"peer,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Result string `json:"result"`
+}
+
+// RefreshResult is the state of a refreshed instance in a pool.
+type RefreshResult struct {
+	Pool     string   `json:"pool"`
+	Instance string   `json:"instance"`
+	Zone     string   `json:"zone"`
+	AliasIps []string `json:"alias_ips"`
+}
+
+// Error is a response of the API other than 2xx.
+type Error struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %s %s", e.Method, e.Path, e.Status, e.Message)
+}
+
+// Client calls the admin API of a vip_manager.
+type Client struct {
+	// E.g. http://localhost:8080.
+	BaseURL string
+	// The admin token, see -admin_token.
+	Token string
+	HTTP  *http.Client
+}
+
+// New returns a client for the admin API at baseURL.
+func New(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token,
+		HTTP:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do calls the API, and decodes the response into out, unless nil.
+func (c *Client) do(ctx context.Context, method, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return &Error{Method: method, Path: path, StatusCode: resp.StatusCode, Status: resp.Status, Message: strings.TrimSpace(string(body))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("%s %s: %v", method, path, err)
+	}
+	return nil
+}
+
+// Status returns the state of the pools, or of one pool if pool is not empty.
+// Unless verbose, VIPs are summarized into CIDR blocks.
+func (c *Client) Status(ctx context.Context, pool string, verbose bool) ([]PoolStatus, error) {
+	query := url.Values{}
+	if pool != "" {
+		query.Set("pool", pool)
+	}
+	if verbose {
+		query.Set("verbose", "true")
+	}
+	path := "/status"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	pools := []PoolStatus{}
+	err := c.do(ctx, http.MethodGet, path, &pools)
+	return pools, err
+}
+
+// Plan returns the operations a reconcile pass would execute now, for all
+// pools, or for one pool if pool is not empty.
+func (c *Client) Plan(ctx context.Context, pool string) (*Plan, error) {
+	path := "/plan"
+	if pool != "" {
+		path += "?pool=" + url.QueryEscape(pool)
+	}
+	plan := &Plan{}
+	if err := c.do(ctx, http.MethodGet, path, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// Drain excludes an instance, so that its VIPs move to other instances.
+func (c *Client) Drain(ctx context.Context, instance string) error {
+	return c.do(ctx, http.MethodPost, "/instances/"+url.PathEscape(instance)+"/exclude", nil)
+}
+
+// Undrain ends the exclusion of an instance.
+func (c *Client) Undrain(ctx context.Context, instance string) error {
+	return c.do(ctx, http.MethodDelete, "/instances/"+url.PathEscape(instance)+"/exclude", nil)
+}
+
+// Refresh re-fetches an instance in all pools it is in.
+func (c *Client) Refresh(ctx context.Context, instance string) ([]RefreshResult, error) {
+	results := []RefreshResult{}
+	err := c.do(ctx, http.MethodPost, "/instances/"+url.PathEscape(instance)+"/refresh", &results)
+	return results, err
+}
+
+// Move pins a VIP to an instance, so that it moves there and stays.
+func (c *Client) Move(ctx context.Context, ip, instance string) error {
+	return c.do(ctx, http.MethodPost, "/vips/"+url.PathEscape(ip)+"/pin?instance="+url.QueryEscape(instance), nil)
+}
+
+// Unpin lets the VIP move again.
+func (c *Client) Unpin(ctx context.Context, ip string) error {
+	return c.do(ctx, http.MethodDelete, "/vips/"+url.PathEscape(ip)+"/pin", nil)
+}
+
+// Pins returns the pinned VIPs of all pools.
+func (c *Client) Pins(ctx context.Context) ([]Pin, error) {
+	pins := []Pin{}
+	err := c.do(ctx, http.MethodGet, "/pins", &pins)
+	return pins, err
+}
+
+// History returns the recent changes of a VIP.
+func (c *Client) History(ctx context.Context, ip string) ([]VipHistory, error) {
+	entries := []VipHistory{}
+	err := c.do(ctx, http.MethodGet, "/vips/"+url.PathEscape(ip)+"/history", &entries)
+	return entries, err
+}
+
+// Reconcile starts a reconcile pass now.
+func (c *Client) Reconcile(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/reconcile", nil)
+}
+
+// Pause pauses all changes.
+func (c *Client) Pause(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/pause", nil)
+}
+
+// Resume confirms the pending changes, and resumes.
+func (c *Client) Resume(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/resume", nil)
+}
+
+// bearer passes the admin token with each gRPC call.
+type bearer string
+
+func (b bearer) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(b)}, nil
+}
+
+func (b bearer) RequireTransportSecurity() bool {
+	return false
+}
+
+// DialGrpc connects to the gRPC control API at target, see -grpc_listen, with
+// the admin token. Without opts, the connection is in plain text, like the
+// server.
+func DialGrpc(target, token string, opts ...grpc.DialOption) (api.VipManagerClient, *grpc.ClientConn, error) {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	opts = append(opts, grpc.WithPerRPCCredentials(bearer(token)))
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return api.NewVipManagerClient(conn), conn, nil
+}
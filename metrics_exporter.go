@@ -17,17 +17,32 @@ package main
 // Metrics Exporter exports prometheus metrics to facilitate advanced load balancing.
 
 import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"cloud.google.com/go/compute/metadata"
 	"github.com/cakturk/go-netstat/netstat"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rafacas/sysstats"
@@ -35,11 +50,24 @@ import (
 )
 
 const (
-	Prefix      = "metrics_exporter_"
-	Nfs4Port    = 2049
-	DefaultPort = 9001
+	Prefix         = "metrics_exporter_"
+	Nfs4Port       = 2049
+	DefaultPort    = 9001
+	NfsdClientsDir = "/proc/fs/nfsd/clients"
+	RmtabFile      = "/var/lib/nfs/rmtab"
+	RpcbindAddr    = "127.0.0.1:111"
+	PortRangeFile  = "/proc/sys/net/ipv4/ip_local_port_range"
+	ConntrackCount = "/proc/sys/net/netfilter/nf_conntrack_count"
+	ConntrackMax   = "/proc/sys/net/netfilter/nf_conntrack_max"
+	NetDevFile     = "/proc/net/dev"
+	DiskStatsFile  = "/proc/diskstats"
+	ProbeTimeout   = 2 * time.Second
 )
 
+// Host maintenance that stops the instance, rather than live migrating it,
+// see instance/maintenance-event in the metadata server.
+const MaintenanceTerminate = "TERMINATE_ON_HOST_MAINTENANCE"
+
 var (
 	cpuUsagePercent = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: Prefix + "cpu_usage_percent",
@@ -65,16 +93,133 @@ var (
 		Name: Prefix + "ingress_tcp_connections_by_port",
 		Help: "Total number of ingress TCP connections, per port",
 	}, []string{"port"})
+	ingressTcpByLocalIp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ingress_tcp_connections_by_local_ip",
+		Help: "Number of ingress TCP connections, per local (alias) IP",
+	}, []string{"ip"})
 	egressTcpByPort = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: Prefix + "egress_tcp_connections_by_port",
 		Help: "Number of egress TCP connections, per port.",
 	}, []string{"port"})
+	ingressTcpByFamily = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "ingress_tcp_connections_by_family",
+		Help: "Number of ingress TCP connections, per address family (ipv4, ipv6).",
+	}, []string{"family"})
+	egressTcpByFamily = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "egress_tcp_connections_by_family",
+		Help: "Number of egress TCP connections, per address family (ipv4, ipv6).",
+	}, []string{"family"})
 	nfs4Connections = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: Prefix + "nfs_v4_connections_total",
 		Help: "Total number of inbound NFSv4 TCP connections.",
 	})
+	nfs4Clients = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "nfs_v4_clients",
+		Help: "Number of active NFSv4 clients, per minor version.",
+	}, []string{"minor_version"})
+	nfs4Sessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "nfs_v4_sessions_total",
+		Help: "Total number of NFSv4.1+ clients with a session.",
+	})
+	nfs4States = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "nfs_v4_states",
+		Help: "Number of NFSv4 states held by clients, per type (open, lock, deleg, layout).",
+	}, []string{"type"})
+	mountdMounts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "mountd_mounts",
+		Help: "Number of NFSv3 mounts recorded by rpc.mountd in rmtab.",
+	})
+	mountdMountsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: Prefix + "mountd_mounts_total",
+		Help: "Total number of NFSv3 mounts seen in rmtab.",
+	})
+	mountdUnmountsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: Prefix + "mountd_unmounts_total",
+		Help: "Total number of NFSv3 unmounts seen in rmtab.",
+	})
+	rpcbindServices = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "rpcbind_services_total",
+		Help: "Total number of services registered with rpcbind.",
+	})
+	rpcbindService = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "rpcbind_service_port",
+		Help: "Port of services registered with rpcbind, per program, version and protocol.",
+	}, []string{"program", "version", "protocol"})
+)
+
+var (
+	ephemeralPorts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "ephemeral_ports",
+		Help: "Number of ports in the local (ephemeral) port range.",
+	})
+	ephemeralPortsUsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "ephemeral_ports_used",
+		Help: "Number of ports in the local port range used by TCP sockets, including TIME_WAIT.",
+	})
+	conntrackEntries = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "conntrack_entries",
+		Help: "Number of entries in the conntrack table.",
+	})
+	conntrackEntriesLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "conntrack_entries_limit",
+		Help: "Max number of entries in the conntrack table.",
+	})
+)
+
+var (
+	nicUsagePercent = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "nic_usage_percent",
+		Help: "Usage of the network interfaces in percent of their speed, in the busier direction.",
+	})
+	diskUsagePercent = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "disk_usage_percent",
+		Help: "Time the busiest disk spent doing I/O, in percent.",
+	})
+	saturationScore = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: Prefix + "saturation_score",
+		Help: "Weighted average of CPU, memory, NIC, disk and connection usage in percent, see -saturation_weights.",
+	})
+)
+
+var (
+	peerUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "peer_up",
+		Help: "Whether a TCP connection to the peer backend succeeded (1) or not (0).",
+	}, []string{"peer"})
+	peerLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "peer_latency_seconds",
+		Help: "TCP connect latency to the peer backend, in seconds.",
+	}, []string{"peer"})
+)
+
+var (
+	collectorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: Prefix + "collector_errors_total",
+		Help: "Number of failed collections, per collector.",
+	}, []string{"collector"})
+	collectorLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "collector_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful collection, per collector.",
+	}, []string{"collector"})
+	terminationNotice = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: Prefix + "termination_notice",
+		Help: "1 while the instance is about to be terminated, per reason: preempted or maintenance.",
+	}, []string{"reason"})
 )
 
+// Collectors, for collector_errors_total.
+var allCollectors = []string{"cpu", "memory", "load", "tcp", "nfsd", "rmtab", "rpcbind", "ephemeral_ports", "conntrack", "saturation"}
+
+// Well known ONC RPC program numbers.
+var rpcPrograms = map[uint32]string{
+	100000: "portmapper",
+	100003: "nfs",
+	100005: "mountd",
+	100021: "nlockmgr",
+	100024: "status",
+	100227: "nfs_acl",
+}
+
 func getCPUPercent() (float64, error) {
 	average, err := sysstats.GetCpuStatsInterval(1)
 	if err != nil {
@@ -105,6 +250,25 @@ func getLoad() (sysstats.LoadAvg, error) {
 	return load, nil
 }
 
+// normalizeAddr converts an address to netip.Addr, unmapping IPv4-mapped IPv6
+// addresses (::ffff:10.0.0.1), as reported for IPv4 clients of dual-stack
+// sockets, and dropping the zone of link-local addresses.
+func normalizeAddr(ip net.IP) (netip.Addr, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return addr, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// addrFamily returns the family label of a normalized address.
+func addrFamily(addr netip.Addr) string {
+	if addr.Is4() {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
 func listLocalIPs() (ips []netip.Addr, err error) {
 	ifaces, err := net.Interfaces()
 	for _, i := range ifaces {
@@ -115,11 +279,11 @@ func listLocalIPs() (ips []netip.Addr, err error) {
 		for _, addr := range addrs {
 			switch v := addr.(type) {
 			case *net.IPNet:
-				if ip, ok := netip.AddrFromSlice(v.IP); ok {
+				if ip, ok := normalizeAddr(v.IP); ok {
 					ips = append(ips, ip)
 				}
 			case *net.IPAddr:
-				if ip, ok := netip.AddrFromSlice(v.IP); ok {
+				if ip, ok := normalizeAddr(v.IP); ok {
 					ips = append(ips, ip)
 				}
 			}
@@ -128,7 +292,25 @@ func listLocalIPs() (ips []netip.Addr, err error) {
 	return ips, err
 }
 
-func getTcpCounts() (ingress, egress map[uint16]int64, err error) {
+// tcpCounts are established TCP connections, by direction.
+type tcpCounts struct {
+	ingress, egress                 map[uint16]int64
+	byLocalIp                       map[string]int64
+	ingressByFamily, egressByFamily map[string]int64
+}
+
+// getTcpCounts returns the number of established TCP connections per port and
+// per address family, and ingress connections per local IP. Ingress
+// connections are to addresses not configured on an interface, i.e. alias IPs.
+// Loopback and link-local connections are skipped.
+func getTcpCounts() (counts tcpCounts, err error) {
+	counts = tcpCounts{
+		ingress:         map[uint16]int64{},
+		egress:          map[uint16]int64{},
+		byLocalIp:       map[string]int64{},
+		ingressByFamily: map[string]int64{},
+		egressByFamily:  map[string]int64{},
+	}
 	// Filter for established not loopback connections.
 	establishedNotLoopback := func(s *netstat.SockTabEntry) bool {
 		return s.State == netstat.Established && !s.LocalAddr.IP.IsLoopback()
@@ -136,63 +318,876 @@ func getTcpCounts() (ingress, egress map[uint16]int64, err error) {
 	// List established sockets.
 	socks4, err := netstat.TCPSocks(establishedNotLoopback)
 	if err != nil {
-		return ingress, egress, err
+		return counts, err
 	}
 	socks6, err := netstat.TCP6Socks(establishedNotLoopback)
 	if err != nil {
-		return ingress, egress, err
+		return counts, err
 	}
 	socks := append(socks4, socks6...)
 
 	localIPs, err := listLocalIPs()
 	if err != nil {
-		return ingress, egress, err
+		return counts, err
 	}
 
-	ingress = map[uint16]int64{}
-	egress = map[uint16]int64{}
 	for _, s := range socks {
-		ip, ok := netip.AddrFromSlice(s.LocalAddr.IP)
+		ip, ok := normalizeAddr(s.LocalAddr.IP)
 		if !ok {
-			return ingress, egress, fmt.Errorf("Failed to parse %v", s.LocalAddr.IP)
+			return counts, fmt.Errorf("Failed to parse %v", s.LocalAddr.IP)
 		}
+		// IPv4-mapped loopback, and link-local traffic (e.g. IPv6 neighbors)
+		// never goes through a virtual IP.
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		family := addrFamily(ip)
 		if slices.Contains(localIPs, ip) {
-			egress[s.RemoteAddr.Port] += 1
+			counts.egress[s.RemoteAddr.Port] += 1
+			counts.egressByFamily[family] += 1
 		} else {
-			ingress[s.LocalAddr.Port] += 1
+			counts.ingress[s.LocalAddr.Port] += 1
+			counts.ingressByFamily[family] += 1
+			counts.byLocalIp[ip.String()] += 1
+		}
+	}
+	return counts, nil
+}
+
+// getNfsdClients reads NFSv4 client information from /proc/fs/nfsd/clients
+// (Linux 5.3+): one directory per client, with "info" and "states" files.
+// Returns the number of clients per minor version and states per type.
+func getNfsdClients() (clients, states map[string]int64, err error) {
+	clients = map[string]int64{}
+	states = map[string]int64{}
+	dirs, err := os.ReadDir(NfsdClientsDir)
+	if err != nil {
+		return clients, states, err
+	}
+	for _, dir := range dirs {
+		info, err := os.ReadFile(filepath.Join(NfsdClientsDir, dir.Name(), "info"))
+		if err != nil {
+			// Clients may go away at any time.
+			continue
+		}
+		minorVersion := "unknown"
+		for _, line := range strings.Split(string(info), "\n") {
+			if key, value, ok := strings.Cut(line, ":"); ok && key == "minor version" {
+				minorVersion = strings.TrimSpace(value)
+			}
+		}
+		clients[minorVersion] += 1
+
+		stateData, err := os.ReadFile(filepath.Join(NfsdClientsDir, dir.Name(), "states"))
+		if err != nil {
+			continue
+		}
+		// Example line:
+		// - 0x00000001...: { type: open, access: rw, deny: --, ... }
+		for _, line := range strings.Split(string(stateData), "\n") {
+			_, rest, ok := strings.Cut(line, "type: ")
+			if !ok {
+				continue
+			}
+			if i := strings.IndexAny(rest, ", }"); i >= 0 {
+				rest = rest[:i]
+			}
+			states[rest] += 1
+		}
+	}
+	return clients, states, nil
+}
+
+// getEphemeralPorts returns the size of the local port range, and how many
+// ports in it are used by TCP sockets. Port exhaustion on gateway nodes looks
+// like load imbalance.
+func getEphemeralPorts() (used, total int, err error) {
+	data, err := os.ReadFile(PortRangeFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("Failed to parse %s: %q", PortRangeFile, data)
+	}
+	low, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	high, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	inRange := func(s *netstat.SockTabEntry) bool {
+		port := int(s.LocalAddr.Port)
+		return s.State != netstat.Listen && port >= low && port <= high
+	}
+	socks4, err := netstat.TCPSocks(inRange)
+	if err != nil {
+		return 0, 0, err
+	}
+	socks6, err := netstat.TCP6Socks(inRange)
+	if err != nil {
+		return 0, 0, err
+	}
+	ports := map[uint16]struct{}{}
+	for _, s := range append(socks4, socks6...) {
+		ports[s.LocalAddr.Port] = struct{}{}
+	}
+	return len(ports), high - low + 1, nil
+}
+
+// getConntrack returns the number of conntrack entries and the limit.
+// Missing if the nf_conntrack module is not loaded.
+func getConntrack() (count, max int64, err error) {
+	read := func(path string) (int64, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if count, err = read(ConntrackCount); err != nil {
+		return 0, 0, err
+	}
+	if max, err = read(ConntrackMax); err != nil {
+		return 0, 0, err
+	}
+	return count, max, nil
+}
+
+// saturation computes a composite saturation score of the host: the weighted
+// average of the usage of its resources in percent, so that load aware
+// rebalancing needs a single signal. Resources without a usage, e.g. the NIC
+// when its speed is unknown, are left out.
+type saturation struct {
+	// Weights by resource: cpu, memory, nic, disk, connections.
+	weights map[string]float64
+	// NIC speed, 0 to read it from /sys/class/net. Ingress connections at
+	// full usage, 0 to leave connections out.
+	nicSpeedMbps   float64
+	maxConnections float64
+	// Counters of the previous collection, for rates.
+	last      time.Time
+	nicBytes  uint64
+	diskTicks map[string]uint64
+}
+
+// parseWeights parses "RESOURCE=WEIGHT,...".
+func parseWeights(s string) (map[string]float64, error) {
+	weights := map[string]float64{}
+	for _, entry := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		resource, value, ok := strings.Cut(entry, "=")
+		weight, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q, use RESOURCE=WEIGHT", entry)
+		}
+		switch resource {
+		case "cpu", "memory", "nic", "disk", "connections":
+			weights[resource] = weight
+		default:
+			return nil, fmt.Errorf("unknown resource %q, use cpu, memory, nic, disk or connections", resource)
+		}
+	}
+	return weights, nil
+}
+
+// rates returns the usage of the NIC, i.e. the busiest direction, and of the
+// busiest disk since the previous call, -1 if unknown.
+func (s *saturation) rates(now time.Time) (nic, disk float64, err error) {
+	nicBytes, speed, err := readNetDev(s.nicSpeedMbps)
+	if err != nil {
+		return -1, -1, err
+	}
+	diskTicks, err := readDiskTicks()
+	if err != nil {
+		return -1, -1, err
+	}
+	nic, disk = -1, -1
+	if !s.last.IsZero() {
+		elapsed := now.Sub(s.last).Seconds()
+		if speed > 0 && nicBytes >= s.nicBytes {
+			nic = 100 * float64(nicBytes-s.nicBytes) * 8 / (speed * 1e6 * elapsed)
+		}
+		for name, ticks := range diskTicks {
+			if last, ok := s.diskTicks[name]; ok && ticks >= last {
+				// io_ticks are milliseconds spent doing I/O.
+				disk = math.Max(disk, 100*float64(ticks-last)/(1000*elapsed))
+			}
+		}
+	}
+	s.last, s.nicBytes, s.diskTicks = now, nicBytes, diskTicks
+	return nic, disk, nil
+}
+
+// score returns the weighted average of the usage of the resources, capped
+// at 100 each, leaving out negative (unknown) usage.
+func (s *saturation) score(usage map[string]float64) float64 {
+	total, weights := 0.0, 0.0
+	for resource, weight := range s.weights {
+		value, ok := usage[resource]
+		if !ok || value < 0 {
+			continue
+		}
+		total += weight * math.Min(value, 100)
+		weights += weight
+	}
+	if weights == 0 {
+		return 0
+	}
+	return total / weights
+}
+
+// readNetDev returns the bytes received or sent, whichever is more, by all
+// network interfaces but lo, and their total speed in Mbps, from
+// /sys/class/net unless given. The speed is 0 if unknown, e.g. on virtio.
+func readNetDev(speedMbps float64) (bytes uint64, speed float64, err error) {
+	data, err := os.ReadFile(NetDevFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	rx, tx := uint64(0), uint64(0)
+	known := true
+	for _, line := range strings.Split(string(data), "\n") {
+		name, counters, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		fields := strings.Fields(counters)
+		if !ok || name == "lo" || len(fields) < 9 {
+			continue
+		}
+		received, err1 := strconv.ParseUint(fields[0], 10, 64)
+		sent, err2 := strconv.ParseUint(fields[8], 10, 64)
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("Failed to parse %s: %q", NetDevFile, line)
+		}
+		rx, tx = rx+received, tx+sent
+		if speedMbps == 0 {
+			value, err := os.ReadFile(filepath.Join("/sys/class/net", name, "speed"))
+			mbps, _ := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+			if err != nil || mbps <= 0 {
+				known = false
+			}
+			speed += mbps
+		}
+	}
+	if speedMbps > 0 {
+		speed = speedMbps
+	} else if !known {
+		speed = 0
+	}
+	if rx > tx {
+		return rx, speed, nil
+	}
+	return tx, speed, nil
+}
+
+// readDiskTicks returns the milliseconds spent doing I/O of each disk in
+// /sys/block, i.e. without partitions, from /proc/diskstats.
+func readDiskTicks() (map[string]uint64, error) {
+	data, err := os.ReadFile(DiskStatsFile)
+	if err != nil {
+		return nil, err
+	}
+	ticks := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 13 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/block", name)); err != nil {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[12], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %q", DiskStatsFile, line)
+		}
+		ticks[name] = value
+	}
+	return ticks, nil
+}
+
+// getRmtab reads the mounts recorded by rpc.mountd. Each line is
+// host:path:count. Returns the set of host:path entries.
+func getRmtab() (map[string]struct{}, error) {
+	mounts := map[string]struct{}{}
+	data, err := os.ReadFile(RmtabFile)
+	if err != nil {
+		return mounts, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.LastIndex(line, ":"); i > 0 {
+			mounts[line[:i]] = struct{}{}
+		}
+	}
+	return mounts, nil
+}
+
+type rpcService struct {
+	Program  uint32
+	Version  uint32
+	Protocol uint32
+	Port     uint32
+}
+
+// getRpcbindServices lists services registered with rpcbind, using the
+// portmapper DUMP procedure (RFC 1833) over TCP.
+func getRpcbindServices() ([]rpcService, error) {
+	conn, err := net.DialTimeout("tcp", RpcbindAddr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Call: xid, CALL, RPC version 2, program 100000, version 2,
+	// procedure DUMP (4), AUTH_NONE credentials and verifier.
+	call := []uint32{1, 0, 2, 100000, 2, 4, 0, 0, 0, 0}
+	request := make([]byte, 4+4*len(call))
+	binary.BigEndian.PutUint32(request, 0x80000000|uint32(4*len(call)))
+	for i, v := range call {
+		binary.BigEndian.PutUint32(request[4+4*i:], v)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	// Read all record fragments of the reply.
+	reply := []byte{}
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		mark := binary.BigEndian.Uint32(header)
+		fragment := make([]byte, mark&0x7fffffff)
+		if _, err := io.ReadFull(conn, fragment); err != nil {
+			return nil, err
+		}
+		reply = append(reply, fragment...)
+		if mark&0x80000000 != 0 {
+			break
+		}
+	}
+	words := func(n int) ([]uint32, error) {
+		if len(reply) < 4*n {
+			return nil, fmt.Errorf("Short rpcbind reply")
+		}
+		values := make([]uint32, n)
+		for i := range values {
+			values[i] = binary.BigEndian.Uint32(reply[4*i:])
+		}
+		reply = reply[4*n:]
+		return values, nil
+	}
+	// Reply: xid, REPLY, MSG_ACCEPTED, verifier flavor and length.
+	head, err := words(5)
+	if err != nil {
+		return nil, err
+	}
+	if head[1] != 1 || head[2] != 0 {
+		return nil, fmt.Errorf("rpcbind denied DUMP request")
+	}
+	verifierLength := (int(head[4]) + 3) / 4
+	if _, err := words(verifierLength); err != nil {
+		return nil, err
+	}
+	status, err := words(1)
+	if err != nil {
+		return nil, err
+	}
+	if status[0] != 0 {
+		return nil, fmt.Errorf("rpcbind DUMP failed with status %d", status[0])
+	}
+	// List of (program, version, protocol, port), each preceded by a
+	// "value follows" boolean.
+	services := []rpcService{}
+	for {
+		follows, err := words(1)
+		if err != nil {
+			return nil, err
+		}
+		if follows[0] == 0 {
+			return services, nil
+		}
+		entry, err := words(4)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, rpcService{entry[0], entry[1], entry[2], entry[3]})
+	}
+}
+
+func (s rpcService) labels() []string {
+	program, ok := rpcPrograms[s.Program]
+	if !ok {
+		program = strconv.FormatUint(uint64(s.Program), 10)
+	}
+	protocol := strconv.FormatUint(uint64(s.Protocol), 10)
+	switch s.Protocol {
+	case syscall.IPPROTO_TCP:
+		protocol = "tcp"
+	case syscall.IPPROTO_UDP:
+		protocol = "udp"
+	}
+	return []string{program, strconv.FormatUint(uint64(s.Version), 10), protocol}
+}
+
+// targetGroup is the Prometheus HTTP service discovery format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// listPeers returns the static peers, plus peers from the service discovery
+// URL, if any. Local addresses are skipped.
+func listPeers(static []string, url string) ([]string, error) {
+	peers := append([]string{}, static...)
+	if url != "" {
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Get(url)
+		if err != nil {
+			return peers, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return peers, fmt.Errorf("Failed to get peers from %s: %s", url, resp.Status)
+		}
+		groups := []targetGroup{}
+		if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+			return peers, err
+		}
+		for _, group := range groups {
+			peers = append(peers, group.Targets...)
 		}
 	}
-	return ingress, egress, nil
+	localIPs, err := listLocalIPs()
+	if err != nil {
+		return peers, err
+	}
+	remote := []string{}
+	for _, peer := range peers {
+		if addrPort, err := netip.ParseAddrPort(peer); err == nil && slices.Contains(localIPs, addrPort.Addr().Unmap()) {
+			continue
+		}
+		remote = append(remote, peer)
+	}
+	return remote, nil
+}
+
+// probePeers measures TCP connect latency to peer backends, to catch network
+// issues between backends that skew load.
+func probePeers(static []string, url string) {
+	go func() {
+		allPeers := make(map[string]struct{})
+		for {
+			peers, err := listPeers(static, url)
+			if err != nil {
+				log.Printf("Error listing peers: %v", err)
+			}
+			collected("peers", err)
+			// Forget peers that went away.
+			for peer := range allPeers {
+				if !slices.Contains(peers, peer) {
+					peerUp.DeleteLabelValues(peer)
+					peerLatency.DeleteLabelValues(peer)
+					delete(allPeers, peer)
+				}
+			}
+			var wg sync.WaitGroup
+			for _, peer := range peers {
+				allPeers[peer] = struct{}{}
+				wg.Add(1)
+				go func(peer string) {
+					defer wg.Done()
+					start := time.Now()
+					conn, err := net.DialTimeout("tcp", peer, ProbeTimeout)
+					if err != nil {
+						peerUp.WithLabelValues(peer).Set(0)
+						return
+					}
+					conn.Close()
+					peerUp.WithLabelValues(peer).Set(1)
+					peerLatency.WithLabelValues(peer).Set(time.Since(start).Seconds())
+				}(peer)
+			}
+			wg.Wait()
+			time.Sleep(15 * time.Second)
+		}
+	}()
+}
+
+// registration is sent to vip_manager's /register endpoint.
+type registration struct {
+	Name         string   `json:"name"`
+	Zone         string   `json:"zone"`
+	Group        string   `json:"group"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Weight       float64  `json:"weight,omitempty"`
+	Cordoned     bool     `json:"cordoned,omitempty"`
+	Terminating  string   `json:"terminating,omitempty"`
+}
+
+// registerWithManager registers this instance with vip_manager, and renews
+// the registration every minute. Instance name and zone come from the GCE
+// metadata server.
+// AliasStatus tells whether an alias IP is assigned to this instance in the
+// metadata server, and whether the guest routes it locally.
+type AliasStatus struct {
+	Ip       string `json:"ip"`
+	Metadata bool   `json:"metadata"`
+	Local    bool   `json:"local"`
+}
+
+// getMetadataAliases returns the alias IP ranges of the first network
+// interface from the metadata server.
+func getMetadataAliases() ([]netip.Prefix, error) {
+	data, err := metadata.Get("instance/network-interfaces/0/ip-aliases/?recursive=true&alt=json")
+	if err != nil {
+		return nil, err
+	}
+	ranges := []string{}
+	if err := json.Unmarshal([]byte(data), &ranges); err != nil {
+		return nil, fmt.Errorf("Failed to parse ip-aliases %q: %v", data, err)
+	}
+	prefixes := []netip.Prefix{}
+	for _, r := range ranges {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// isLocal returns true if the guest routes an IP locally. Binding to an
+// address only works for local addresses, which includes alias IPs once the
+// guest agent added their routes.
+func isLocal(ip netip.Addr) bool {
+	listener, err := net.Listen("tcp", netip.AddrPortFrom(ip, 0).String())
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// handleAliases serves GET /aliases?ip=IP&ip=..., so that vip_manager can
+// verify an assignment from the guest side.
+func handleAliases(w http.ResponseWriter, r *http.Request) {
+	prefixes, err := getMetadataAliases()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get alias IPs from metadata: %v", err), http.StatusInternalServerError)
+		return
+	}
+	statuses := []AliasStatus{}
+	for _, value := range r.URL.Query()["ip"] {
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid IP %q", value), http.StatusBadRequest)
+			return
+		}
+		status := AliasStatus{Ip: ip.String(), Local: isLocal(ip)}
+		for _, prefix := range prefixes {
+			if prefix.Contains(ip) {
+				status.Metadata = true
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// addressAgent adds and removes VIPs on a host for vip_manager with -provider
+// static. The VIPs are the single addresses (/32 or /128) in the network on
+// the device.
+type addressAgent struct {
+	mu     sync.Mutex
+	device string
+	token  string
+	// Command run as "HOOK add|del IP DEVICE" instead of ip and arping, e.g.
+	// to announce VIPs by BGP.
+	hook string
+}
+
+// addresses is the body of GET and PUT /addresses.
+type addresses struct {
+	Network   string   `json:"network"`
+	Addresses []string `json:"addresses"`
+}
+
+// list returns the single addresses in the network on the device.
+func (a *addressAgent) list(network netip.Prefix) ([]netip.Addr, error) {
+	iface, err := net.InterfaceByName(a.device)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := []netip.Addr{}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ones, bits := ipnet.Mask.Size(); ones != bits {
+			continue
+		}
+		if ip, ok := normalizeAddr(ipnet.IP); ok && network.Contains(ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// plumb adds or deletes an address, and announces added IPv4 addresses with
+// gratuitous ARP, or runs the hook instead.
+func (a *addressAgent) plumb(action string, ip netip.Addr) error {
+	run := func(name string, args ...string) error {
+		out, err := exec.Command(name, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	if a.hook != "" {
+		return run(a.hook, action, ip.String(), a.device)
+	}
+	prefix := netip.PrefixFrom(ip, ip.BitLen()).String()
+	if err := run("ip", "addr", action, prefix, "dev", a.device); err != nil {
+		return err
+	}
+	if action == "add" && ip.Is4() {
+		if err := run("arping", "-U", "-c", "3", "-I", a.device, ip.String()); err != nil {
+			log.Printf("Warning: gratuitous ARP for %s failed: %v", ip, err)
+		}
+	}
+	return nil
+}
+
+// handleAddresses serves GET /addresses?network=CIDR, the VIPs in the
+// network on the device, and PUT /addresses?network=CIDR, which adds and
+// removes VIPs until the device has the addresses of the body.
+func (a *addressAgent) handleAddresses(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	network, err := netip.ParsePrefix(r.URL.Query().Get("network"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid network: %v", err), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		body := addresses{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid body: %v", err), http.StatusBadRequest)
+			return
+		}
+		want := []netip.Addr{}
+		for _, value := range body.Addresses {
+			ip, err := netip.ParseAddr(value)
+			if err != nil || !network.Contains(ip) {
+				http.Error(w, fmt.Sprintf("Invalid address %q in %s", value, network), http.StatusBadRequest)
+				return
+			}
+			want = append(want, ip)
+		}
+		have, err := a.list(network)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, ip := range have {
+			if !slices.Contains(want, ip) {
+				log.Printf("Remove VIP %s from %s", ip, a.device)
+				if err := a.plumb("del", ip); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		for _, ip := range want {
+			if !slices.Contains(have, ip) {
+				log.Printf("Add VIP %s to %s", ip, a.device)
+				if err := a.plumb("add", ip); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ips, err := a.list(network)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := addresses{Network: network.String(), Addresses: []string{}}
+	for _, ip := range ips {
+		resp.Addresses = append(resp.Addresses, ip.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func registerWithManager(url, token string, r registration, notices <-chan string) {
+	go func() {
+		for {
+			err := register(url, token, &r)
+			if err != nil {
+				log.Printf("Error registering with %s: %v", url, err)
+			}
+			// Tell vip_manager about termination notices right away.
+			select {
+			case r.Terminating = <-notices:
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+// watchTermination watches the metadata server for preemption, and for host
+// maintenance that stops the instance, and sends the reason, "preempted" or
+// "maintenance", on notices, or "" when the maintenance is called off.
+// Preemption leaves about 30 seconds, host maintenance about 60 seconds.
+func watchTermination(notices chan<- string) {
+	// No timeout: the metadata server holds requests until the value changes.
+	client := metadata.NewClient(&http.Client{})
+	// Without -register_url, nobody reads the notices.
+	notify := func(reason string) {
+		select {
+		case notices <- reason:
+		default:
+		}
+	}
+	watch := func(suffix, reason string, terminating func(value string) bool) {
+		terminationNotice.WithLabelValues(reason).Set(0)
+		for {
+			noticed := false
+			err := client.Subscribe(suffix, func(value string, ok bool) error {
+				if ok && terminating(value) != noticed {
+					noticed = !noticed
+					if noticed {
+						log.Printf("Termination notice: %s is %s", suffix, value)
+						terminationNotice.WithLabelValues(reason).Set(1)
+						notify(reason)
+					} else {
+						terminationNotice.WithLabelValues(reason).Set(0)
+						notify("")
+					}
+				}
+				return nil
+			})
+			log.Printf("Error watching %s: %v", suffix, err)
+			time.Sleep(15 * time.Second)
+		}
+	}
+	go watch("instance/preempted", "preempted", func(value string) bool {
+		return value == "TRUE"
+	})
+	go watch("instance/maintenance-event", "maintenance", func(value string) bool {
+		return value == MaintenanceTerminate
+	})
 }
 
-func exportMetrics() {
+func register(url, token string, r *registration) (err error) {
+	if r.Name == "" {
+		if r.Name, err = metadata.InstanceName(); err != nil {
+			return err
+		}
+	}
+	if r.Zone == "" {
+		if r.Zone, err = metadata.Zone(); err != nil {
+			return err
+		}
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Registration failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// collected records the outcome of a collection. Expected errors, e.g. for
+// services that are not installed, count as success.
+func collected(collector string, err error) {
+	if err != nil {
+		collectorErrors.WithLabelValues(collector).Inc()
+		return
+	}
+	collectorLastSuccess.WithLabelValues(collector).SetToCurrentTime()
+}
+
+func exportMetrics(sat *saturation) {
+	// Export zero errors, so that alerts on increase() see the first one.
+	for _, collector := range allCollectors {
+		collectorErrors.WithLabelValues(collector)
+	}
 	go func() {
 		allIngressPorts := make(map[string]struct{})
+		allLocalIps := make(map[string]struct{})
 		allEgressPorts := make(map[string]struct{})
+		allMinorVersions := make(map[string]struct{})
+		allStateTypes := make(map[string]struct{})
+		var previousMounts map[string]struct{}
 		for {
 			cpu, err := getCPUPercent()
 			if err != nil {
 				log.Printf("Error getting CPU usage: %v", err)
 			}
+			collected("cpu", err)
 			cpuUsagePercent.Set(cpu)
 
 			memory, err := getMemoryPercent()
 			if err != nil {
 				log.Printf("Error getting Memory usage: %v", err)
 			}
+			collected("memory", err)
 			memoryUsagePercent.Set(memory)
 
 			load, err := getLoad()
 			if err != nil {
 				log.Printf("Error getting Load value: %v", err)
 			}
+			collected("load", err)
 			systemLoad.Set(load.Avg1)
 
 			// TCP connections.
-			ingress, egress, err := getTcpCounts()
+			counts, err := getTcpCounts()
 			if err != nil {
 				log.Printf("Error getting TCP session count: %v", err)
 			}
+			collected("tcp", err)
+			ingress, egress, byLocalIp := counts.ingress, counts.egress, counts.byLocalIp
 			// Reset counts, for values that just went to 0.
 			for port, _ := range allIngressPorts {
 				ingressTcpByPort.WithLabelValues(port).Set(0)
@@ -200,6 +1195,9 @@ func exportMetrics() {
 			for port, _ := range allEgressPorts {
 				egressTcpByPort.WithLabelValues(port).Set(0)
 			}
+			for ip, _ := range allLocalIps {
+				ingressTcpByLocalIp.WithLabelValues(ip).Set(0)
+			}
 			ingressTotal, egressTotal := 0, 0
 			for k, v := range ingress {
 				ingressTotal += 1
@@ -213,11 +1211,134 @@ func exportMetrics() {
 				allEgressPorts[port] = struct{}{}
 				egressTcpByPort.WithLabelValues(port).Set(float64(v))
 			}
+			for ip, v := range byLocalIp {
+				allLocalIps[ip] = struct{}{}
+				ingressTcpByLocalIp.WithLabelValues(ip).Set(float64(v))
+			}
 			ingressTcpTotal.Set(float64(ingressTotal))
 			egressTcpTotal.Set(float64(egressTotal))
+			for _, family := range []string{"ipv4", "ipv6"} {
+				ingressTcpByFamily.WithLabelValues(family).Set(float64(counts.ingressByFamily[family]))
+				egressTcpByFamily.WithLabelValues(family).Set(float64(counts.egressByFamily[family]))
+			}
 			nfs4 := float64(ingress[Nfs4Port])
 			nfs4Connections.Set(nfs4)
 
+			// NFSv4 clients and states. Missing on hosts without nfsd.
+			clients, states, err := getNfsdClients()
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			if err != nil {
+				log.Printf("Error getting NFSv4 clients: %v", err)
+			}
+			collected("nfsd", err)
+			for version, _ := range allMinorVersions {
+				nfs4Clients.WithLabelValues(version).Set(0)
+			}
+			for stateType, _ := range allStateTypes {
+				nfs4States.WithLabelValues(stateType).Set(0)
+			}
+			sessions := int64(0)
+			for version, count := range clients {
+				allMinorVersions[version] = struct{}{}
+				nfs4Clients.WithLabelValues(version).Set(float64(count))
+				if version != "0" && version != "unknown" {
+					// NFSv4.1+ clients always have a session.
+					sessions += count
+				}
+			}
+			nfs4Sessions.Set(float64(sessions))
+			for stateType, count := range states {
+				allStateTypes[stateType] = struct{}{}
+				nfs4States.WithLabelValues(stateType).Set(float64(count))
+			}
+
+			// NFSv3 mounts, from the rpc.mountd rmtab.
+			mounts, err := getRmtab()
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			if err != nil {
+				log.Printf("Error getting mountd rmtab: %v", err)
+			}
+			collected("rmtab", err)
+			mountdMounts.Set(float64(len(mounts)))
+			if previousMounts != nil {
+				for mount := range mounts {
+					if _, ok := previousMounts[mount]; !ok {
+						mountdMountsTotal.Inc()
+					}
+				}
+				for mount := range previousMounts {
+					if _, ok := mounts[mount]; !ok {
+						mountdUnmountsTotal.Inc()
+					}
+				}
+			}
+			previousMounts = mounts
+
+			// Services registered with rpcbind. Missing if rpcbind is not running.
+			services, err := getRpcbindServices()
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				err = nil
+			}
+			if err != nil {
+				log.Printf("Error getting rpcbind services: %v", err)
+			}
+			collected("rpcbind", err)
+			rpcbindService.Reset()
+			for _, service := range services {
+				rpcbindService.WithLabelValues(service.labels()...).Set(float64(service.Port))
+			}
+			rpcbindServices.Set(float64(len(services)))
+
+			// Ephemeral ports and conntrack table.
+			used, total, err := getEphemeralPorts()
+			if err != nil {
+				log.Printf("Error getting ephemeral ports: %v", err)
+			}
+			collected("ephemeral_ports", err)
+			ephemeralPorts.Set(float64(total))
+			ephemeralPortsUsed.Set(float64(used))
+			entries, limit, err := getConntrack()
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			if err != nil {
+				log.Printf("Error getting conntrack entries: %v", err)
+			}
+			collected("conntrack", err)
+			conntrackEntries.Set(float64(entries))
+			conntrackEntriesLimit.Set(float64(limit))
+
+			// Saturation score, from the above and NIC and disk usage.
+			nic, disk, err := sat.rates(time.Now())
+			if err != nil {
+				log.Printf("Error getting NIC and disk usage: %v", err)
+			}
+			collected("saturation", err)
+			if nic >= 0 {
+				nicUsagePercent.Set(nic)
+			}
+			if disk >= 0 {
+				diskUsagePercent.Set(disk)
+			}
+			connections := -1.0
+			if sat.maxConnections > 0 {
+				connections = 0
+				for _, count := range ingress {
+					connections += 100 * float64(count) / sat.maxConnections
+				}
+			}
+			saturationScore.Set(sat.score(map[string]float64{
+				"cpu":         cpu,
+				"memory":      memory,
+				"nic":         nic,
+				"disk":        disk,
+				"connections": connections,
+			}))
+
 			time.Sleep(15 * time.Second)
 		}
 	}()
@@ -226,11 +1347,69 @@ func exportMetrics() {
 func main() {
 	port := DefaultPort
 	fs := flag.CommandLine
+	peers := ""
+	peersUrl := ""
 	fs.IntVar(&port, "p", DefaultPort, "TCP port for metrics export.")
+	fs.StringVar(&peers, "peers", "", "Peer backends to probe, as list of host:port.")
+	fs.StringVar(&peersUrl, "peers_url", "", "URL listing peer backends to probe, in Prometheus HTTP service discovery format.")
+	registerUrl := ""
+	registerToken := ""
+	capabilities := ""
+	r := registration{}
+	fs.StringVar(&registerUrl, "register_url", "", "vip_manager registration URL, e.g. http://MANAGER:8080/register. Empty disables.")
+	fs.StringVar(&registerToken, "register_token", os.Getenv("VIP_MANAGER_REGISTRATION_TOKEN"), "Bearer token for registration. Defaults to $VIP_MANAGER_REGISTRATION_TOKEN.")
+	fs.StringVar(&r.Group, "register_group", "", "Instance group to register with.")
+	fs.StringVar(&capabilities, "capabilities", "", "Capabilities to register, as list, e.g. nfs3,nfs4.")
+	fs.Float64Var(&r.Weight, "weight", 0, "Weight to register, for weighted VIP distribution.")
+	fs.BoolVar(&r.Cordoned, "cordon", false, "Register as cordoned: receive no new VIPs.")
+	termination := true
+	fs.BoolVar(&termination, "termination_notice", true, "On GCE, watch the metadata server for preemption and host maintenance that stops the instance, export it, and with -register_url, have vip_manager move the VIPs away right away.")
+	agent := &addressAgent{}
+	fs.StringVar(&agent.device, "address_device", "", "Network device to add and remove VIPs on for vip_manager -provider static, e.g. eth0, or lo with -address_hook. Empty disables.")
+	fs.StringVar(&agent.token, "address_token", os.Getenv("METRICS_EXPORTER_ADDRESS_TOKEN"), "Bearer token vip_manager uses to manage VIPs. Defaults to $METRICS_EXPORTER_ADDRESS_TOKEN.")
+	fs.StringVar(&agent.hook, "address_hook", "", "Command to run as \"HOOK add|del IP DEVICE\" instead of ip and arping, e.g. to announce VIPs by BGP.")
+	sat := &saturation{}
+	weights := ""
+	fs.StringVar(&weights, "saturation_weights", "cpu=1,memory=1,nic=1,disk=1,connections=1", "Weights of the resources in the saturation score, as list of RESOURCE=WEIGHT.")
+	fs.Float64Var(&sat.nicSpeedMbps, "nic_speed_mbps", 0, "Total speed of the network interfaces in Mbps, for the saturation score. 0 reads it from /sys/class/net, and leaves the NIC out if unknown, e.g. on virtio.")
+	fs.Float64Var(&sat.maxConnections, "saturation_max_connections", 0, "Ingress TCP connections at full usage, for the saturation score. 0 leaves connections out.")
 	flag.Parse()
+	var err error
+	if sat.weights, err = parseWeights(weights); err != nil {
+		log.Fatalf("Invalid -saturation_weights: %v", err)
+	}
 	log.Printf("Start Metrics Exporter on port %d", port)
-	exportMetrics()
+	exportMetrics(sat)
+	if peers != "" || peersUrl != "" {
+		collectorErrors.WithLabelValues("peers")
+		probePeers(strings.Fields(strings.ReplaceAll(peers, ",", " ")), peersUrl)
+	}
+	// Buffered, so that notices do not wait for a registration in progress.
+	notices := make(chan string, 4)
+	if termination && metadata.OnGCE() {
+		watchTermination(notices)
+	}
+	if registerUrl != "" {
+		if r.Group == "" {
+			log.Fatalf("Please specify instance group using -register_group")
+		}
+		r.Capabilities = strings.Fields(strings.ReplaceAll(capabilities, ",", " "))
+		registerWithManager(registerUrl, registerToken, r, notices)
+	}
+	// Metrics about the process itself, in addition to the defaults (CPU,
+	// RSS, open fds, goroutines): GC and scheduler details.
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsScheduler),
+	))
 	http.Handle("/metrics", promhttp.Handler())
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+	http.HandleFunc("/aliases", handleAliases)
+	if agent.device != "" {
+		if agent.token == "" {
+			log.Fatalf("Please specify the token for -address_device using -address_token")
+		}
+		http.HandleFunc("/addresses", agent.handleAddresses)
+	}
+	err = http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
 	log.Printf("Failed to start Metrics Exporter: %v", err)
 }
@@ -0,0 +1,1691 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The configuration of vip_manager: flags, the -config file, and the groups
+// and pools built from them.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+type Config struct {
+	Gcp          *utils.GcpConfig
+	Provider     string
+	Groups       []*Group
+	Workers      uint
+	SleepSeconds uint
+	IgnoreLabel  string
+	Serverless   bool
+	Listen       string
+	StateBucket  string
+	StateObject  string
+
+	// With ProviderStatic: the inventory file, and the bearer token of the
+	// agents on the hosts.
+	Inventory  string
+	AgentToken string
+
+	// Take the groups from VIPPool custom resources, in a Kubernetes
+	// cluster, see WatchVipPools.
+	KubeController bool
+
+	// Event driven passes: WatchOperations or WatchAssetFeed, from
+	// WatchSubscription. Idle loops then only resync every ResyncSeconds.
+	Watch             string
+	WatchSubscription string
+	ResyncSeconds     uint
+
+	AnomalySeconds  uint
+	AnomalyMaxMoves uint
+
+	ConfigFile   string
+	GroupConfigs []GroupConfig
+
+	LeaderLease  string
+	LeaderId     string
+	LeaseSeconds uint
+	lease        utils.Leader
+
+	// Running on a member of a managed instance group: the instance, and
+	// its group. The instance gets SelfWeight times its normal share of
+	// VIPs.
+	Self       bool
+	SelfWeight float64
+	self       *utils.Self
+
+	RegistrationToken   string
+	RegistrationSeconds uint
+	registry            *utils.Registry
+	claims              *Claims
+
+	IntentState string
+	intent      *utils.Intent
+	// Changes to keep per VIP, in the intent.
+	VipHistory uint
+
+	ExpansionThreshold float64
+	ExpansionWebhook   string
+
+	// Payload of the -move_webhook, as a text/template of utils.VipEvent.
+	MoveWebhookTemplate string
+	// Seconds between reading GCE quotas, and the fraction of a quota left
+	// to warn at. The write quota is per minute, 0 if unknown.
+	QuotaSeconds uint
+	QuotaWarning float64
+	WriteQuota   float64
+
+	// Seconds between passes while passes make changes, 0 for right away,
+	// and the fraction to randomize waits between passes by.
+	ActiveSeconds uint
+	Jitter        float64
+
+	// Attempts per GCE API call, the cap of the backoff between them, and
+	// the fraction of calls that may fail, see utils.RetryPolicy. Requests
+	// per second to the GCE API, 0 for no limit, and their burst. The
+	// deadline of calls on instances, including retries, 0 for none.
+	ApiAttempts       uint
+	ApiBackoffSeconds uint
+	ApiErrorBudget    float64
+	ApiQps            float64
+	ApiBurst          uint
+	ApiTimeoutSeconds uint
+	// Service account to impersonate in calls to Google APIs, empty to use
+	// the default credentials.
+	ImpersonateServiceAccount string
+
+	// Local file, or logging://LOG_ID for Cloud Logging, to append a record
+	// of every planned and executed operation to.
+	AuditLog string
+	// Pub/Sub topic for operation events, as TOPIC in the project, or
+	// projects/PROJECT/topics/TOPIC.
+	PubSubTopic string
+
+	ShutdownSeconds uint
+	DrainOnShutdown bool
+
+	// Max number of alias IPs per instance, 0 for no limit.
+	MaxIpsPerInstance uint
+
+	// How VIPs are placed on instances: PlacementBalanced, or the name of a
+	// Strategy. With balanced placement, the planner of the target
+	// distribution: PlannerRobinHood or PlannerMinMoves.
+	Placement string
+	Planner   string
+
+	// Alias IPs removed from a pool stay in place for QuarantineGrace, and
+	// are reported for QuarantineRetention after they are drained.
+	QuarantineGrace     uint
+	QuarantineRetention uint
+
+	// What to do with stray alias IPs, in the alias network but not in the
+	// pool: StrayQuarantine, StrayIgnore, StrayAlert or StrayRemove.
+	StrayPolicy string
+
+	// Ownership, for several deployments sharing instances and alias
+	// networks: only quarantine alias IPs that were VIPs of the pool, and
+	// with Strict, refuse operations that touch anything else.
+	OwnedOnly bool
+	Strict    bool
+
+	// Hysteresis: wait this long after moves, or after instances came or
+	// went, before moving VIPs again. And only move VIPs when the imbalance
+	// exceeds MinImbalance.
+	CooldownSeconds uint
+	MinImbalance    float64
+
+	// Seconds after an instance started before it takes VIPs, so that it
+	// can finish booting. 0 disables.
+	StartupGrace uint
+
+	// Default windows for disruptive moves, for pools without their own.
+	MoveWindows []string
+	// Default health check, for pools without their own.
+	HealthCheck string
+	// Default VIP check, for pools without their own. A VIP failing
+	// VipCheckFailures checks in a row fails over to another instance.
+	VipCheck         string
+	VipCheckFailures uint
+	failovers        *Failovers
+
+	// During rollouts, only place VIPs on instances with the template the
+	// instance group rolls out.
+	CurrentTemplateOnly bool
+
+	// Instance weights, for proportionally more VIPs on bigger instances.
+	WeightLabel  string
+	WeightByCpus bool
+
+	// Two instances for an active/standby failover pair, "NAME,NAME".
+	Pair string
+	// The first instance of the pair is the primary, see ReconcilePair.
+	PairPrimary bool
+	// The instances of the pair are in the managed instance group.
+	PairInGroup bool
+	// Seconds the primary must be available before VIPs return to it.
+	FailbackSeconds uint
+
+	// Spread the VIPs of a pool over zones, by the weight of their instances.
+	SpreadZones bool
+	// Spread the VIPs of a pool over physical hosts, as far as GCE reports
+	// them or group placement policies imply them.
+	SpreadHosts bool
+
+	// Shared VPC host project of -subnetwork NAME, defaults to -project.
+	HostProject string
+
+	// Load aware rebalancing with metrics_exporter data. Port 0 disables.
+	RebalancePort    uint
+	RebalanceSeconds uint
+	RebalanceHighCpu float64
+	RebalanceLowCpu  float64
+	RebalanceSignal  string
+
+	// Pool wide connection totals from metrics_exporter. Port 0 disables.
+	AggregatePort    uint
+	AggregateSeconds uint
+
+	// Hold rebalancing moves of VIPs with more than DrainConnections
+	// connections, per metrics_exporter, for up to DrainSeconds. Port 0
+	// disables.
+	DrainPort        uint
+	DrainConnections uint
+	DrainSeconds     uint
+
+	// Recommend a group size for the VIPs and the load, every SizeSeconds,
+	// and with SizeAutoscaler, set it as the minimum of the autoscaler.
+	SizeHints      bool
+	SizeTargetCpu  float64
+	SizeSeconds    uint
+	SizeAutoscaler bool
+
+	// Worker queue priority by operation class, e.g. "rebalance=3", see
+	// defaultPriorities. Lower runs first.
+	OperationPriority string
+	priorities        map[string]int
+
+	// Pause when a pass wants to move more than this fraction of a pool.
+	MaxMoveFraction float64
+	guard           *utils.Guardrail
+
+	// Instances under maintenance, from flags or config file, and from the
+	// admin API.
+	Exclude    []string
+	exclusions *Exclusions
+	AdminToken string
+	pins       *Pins
+
+	// Admin endpoints to simulate failures, for game days.
+	FaultInjection bool
+	faults         *Faults
+
+	// gRPC control API listen address, see api/vip_manager.proto.
+	GrpcListen string
+
+	// For subcommands: the admin API of a running vip_manager, a single
+	// pass for reconcile, ending a drain, and the operations recorded by
+	// plan instead of executed.
+	Manager string
+	Once    bool
+	Undo    bool
+	plan    *Plan
+
+	// List every IP, instead of summarizing them into CIDR blocks.
+	Verbose bool
+	// Prometheus job scraping metrics_exporter, for alert-rules.
+	ExporterJob string
+
+	// Cloud DNS managed zone with records pointing to VIPs, and whether to
+	// import them into the intent state (DnsImportApply), or only show what
+	// would be imported (DnsImportDryRun).
+	DnsZone string
+	// Announce planned drains with TXT records in DnsZone, or to a webhook,
+	// this many seconds before VIPs move.
+	MaintenanceTxt     bool
+	MaintenanceWebhook string
+	MaintenanceNotice  uint
+	DnsImport          string
+
+	// Keep the managed records in DnsZone pointing to assigned VIPs, and
+	// with DnsInstanceDomain, a record per instance with its VIPs.
+	DnsSync           bool
+	DnsInstanceDomain string
+
+	// Groups, alias networks and VIP lists from the command line, the flags
+	// given there, and the arguments after the flags.
+	groupNames    stringList
+	aliasNetworks stringList
+	vipLists      stringList
+	setFlags      map[string]bool
+	args          []string
+
+	// Shared by the configurations that replace this one on reload: the
+	// active configuration, for HTTP handlers, and group configurations
+	// from changed VIPPools, for RunLoops.
+	active         *atomic.Pointer[Config]
+	vipPoolUpdates chan []GroupConfig
+}
+
+// FileConfig is the format of the -config file. Flags given on the command
+// line override values from the file.
+type FileConfig struct {
+	Project           string        `json:"project"`
+	Zone              string        `json:"zone"`
+	Region            string        `json:"region"`
+	Workers           uint          `json:"workers"`
+	SleepSeconds      uint          `json:"sleep_seconds"`
+	IdleSeconds       uint          `json:"idle_interval_seconds"`
+	ActiveSeconds     uint          `json:"active_interval_seconds"`
+	Jitter            *float64      `json:"jitter"`
+	ResyncSeconds     uint          `json:"resync_seconds"`
+	WaitSeconds       uint          `json:"wait_seconds"`
+	IgnoreLabel       *string       `json:"ignore_label"`
+	AnomalySeconds    *uint         `json:"anomaly_interval_seconds"`
+	AnomalyMaxMoves   uint          `json:"anomaly_max_moves"`
+	Groups            []GroupConfig `json:"groups"`
+	Exclude           []string      `json:"exclude"`
+	MaxIpsPerInstance uint          `json:"max_ips_per_instance"`
+	MaxMoveFraction   *float64      `json:"max_move_fraction"`
+	WeightLabel       *string       `json:"weight_label"`
+	WeightByCpus      bool          `json:"weight_by_cpus"`
+	Placement         string        `json:"placement"`
+	Planner           string        `json:"balance_planner"`
+	SpreadZones       bool          `json:"spread_zones"`
+	SpreadHosts       bool          `json:"spread_hosts"`
+	HostProject       string        `json:"host_project"`
+	Subnetwork        string        `json:"subnetwork"`
+	BlockPrefix       int           `json:"block_prefix"`
+	CurrentTemplate   bool          `json:"current_template_only"`
+	CooldownSeconds   uint          `json:"cooldown_seconds"`
+	StartupGrace      uint          `json:"startup_grace_seconds"`
+	OwnedOnly         bool          `json:"owned_only"`
+	Strict            bool          `json:"strict"`
+	QuarantineGrace   *uint         `json:"quarantine_grace_seconds"`
+	QuarantineRetain  *uint         `json:"quarantine_retention_seconds"`
+	StrayPolicy       string        `json:"stray_policy"`
+	MinImbalance      float64       `json:"min_imbalance"`
+	VipCheckFailures  uint          `json:"vip_check_failures"`
+}
+
+type GroupConfig struct {
+	Name  string       `json:"name"`
+	Pools []PoolConfig `json:"pools"`
+	// Only use backends that registered themselves, the group is not a GCE
+	// instance group.
+	RegisteredOnly bool `json:"registered_only"`
+	// Select instances by labels, "KEY=VALUE,...", instead of a managed
+	// instance group. Defaults to -label_selector.
+	LabelSelector string `json:"label_selector"`
+	// GKE node pool, "CLUSTER/NODE_POOL" in -region or -zone, or
+	// "projects/PROJECT/locations/LOCATION/clusters/CLUSTER/nodePools/NODE_POOL",
+	// instead of a managed instance group. Defaults to -gke_node_pool.
+	NodePool string `json:"node_pool"`
+	// Select Kubernetes nodes by labels, "KEY=VALUE,...", when running in
+	// the cluster, instead of a managed instance group.
+	NodeSelector string `json:"node_selector"`
+	// Two instances, "NAME" or "ZONE/NAME", for an active/standby failover
+	// pair instead of an instance group. See ReconcilePair.
+	Pair []string `json:"pair"`
+	// The first instance of the pair is the primary: VIPs return to it when
+	// it is available again. Otherwise VIPs stay where they are.
+	PairPrimary bool `json:"pair_primary"`
+	// The instances of the pair are in the managed instance group of the
+	// group, and lose their VIPs when they leave it.
+	PairInGroup bool `json:"pair_in_group"`
+	// Instances in several groups, e.g. with overlapping label selectors,
+	// belong to the group with the highest precedence, and among equals to
+	// the first group. Other groups remove their VIPs from them.
+	Precedence int `json:"precedence"`
+}
+
+type PoolConfig struct {
+	AliasNetwork string   `json:"alias_network"`
+	VIPs         []string `json:"vips"`
+	// Windows for disruptive moves, see utils.Window. Defaults to
+	// -move_window.
+	MoveWindows []string `json:"move_windows"`
+	// Check instances before they receive VIPs, see utils.HealthCheck.
+	// Defaults to -health_check.
+	HealthCheck string `json:"health_check"`
+	// Check assigned VIPs, and fail over VIPs that stop answering. Defaults
+	// to -vip_check.
+	VipCheck string `json:"vip_check"`
+	// Subnetwork with the alias network, see utils.GcpConfig. Defaults to
+	// -subnetwork.
+	Subnetwork string `json:"subnetwork"`
+	// Assign the VIPs in blocks of this prefix length, e.g. 28, see
+	// utils.GcpConfig. Defaults to -block_prefix.
+	BlockPrefix int `json:"block_prefix"`
+	// Instances by VIP, for VIPs that always stay on one instance while it
+	// can take VIPs. Pins through the admin API take precedence.
+	Pins map[string]string `json:"pins"`
+	// Window to rotate all VIPs to other instances, e.g. "Sun 02:00-06:00"
+	// weekly, see RotateVips.
+	Rotation string `json:"rotation"`
+	// Sets of VIPs that are replicas of the same service, never placed on
+	// the same instance, nor with -spread_zones in the same zone if
+	// possible, see SpreadReplicas.
+	Replicas [][]string `json:"replicas"`
+}
+
+// Clouds, see utils.Provider.
+const (
+	ProviderGce    = "gce"
+	ProviderAws    = "aws"
+	ProviderStatic = "static"
+	// GCE instances, with VIPs as protocol forwarding rules.
+	ProviderForwarding = "forwarding"
+)
+
+// -leader_lease prefix of a Kubernetes Lease, see utils.KubeLease.
+const KubeLeasePrefix = "k8s://"
+
+const (
+	PlacementBalanced   = "balanced"
+	PlacementRendezvous = "rendezvous"
+)
+
+// Planners for balanced placement.
+const (
+	PlannerRobinHood = "robin_hood"
+	PlannerMinMoves  = "min_moves"
+)
+
+// Sources of changes, for event driven passes.
+const (
+	WatchOperations = "operations"
+	WatchAssetFeed  = "asset_feed"
+)
+
+// Load signals for load aware rebalancing.
+const (
+	SignalCpu        = "cpu"
+	SignalSaturation = "saturation"
+)
+
+// Policies for stray alias IPs.
+const (
+	StrayQuarantine = "quarantine"
+	StrayIgnore     = "ignore"
+	StrayAlert      = "alert"
+	StrayRemove     = "remove"
+)
+
+const (
+	DnsImportDryRun = "dry_run"
+	DnsImportApply  = "apply"
+)
+
+// Operation classes, for priorities in the worker queue.
+const (
+	ClassFailover   = "failover"
+	ClassEvacuate   = "evacuate"
+	ClassResume     = "resume"
+	ClassAllocate   = "allocate"
+	ClassQuarantine = "quarantine"
+	ClassRebalance  = "rebalance"
+	ClassDuplicate  = "duplicate"
+)
+
+// defaultPriorities run failovers, evacuations, interrupted moves and the
+// removal of duplicate VIPs before placing spare VIPs, and all of them before
+// draining quarantined IPs and rebalancing.
+var defaultPriorities = map[string]int{
+	ClassFailover:   utils.PriorityUrgent,
+	ClassEvacuate:   utils.PriorityUrgent,
+	ClassResume:     utils.PriorityUrgent,
+	ClassDuplicate:  utils.PriorityUrgent,
+	ClassAllocate:   utils.PriorityDefault,
+	ClassQuarantine: utils.PriorityLow,
+	ClassRebalance:  utils.PriorityLow,
+}
+
+// priorityClasses returns the operation classes, by default priority, then
+// by name.
+func priorityClasses() []string {
+	classes := maps.Keys(defaultPriorities)
+	sort.Slice(classes, func(i, j int) bool {
+		if defaultPriorities[classes[i]] != defaultPriorities[classes[j]] {
+			return defaultPriorities[classes[i]] < defaultPriorities[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	return classes
+}
+
+// defaultPrioritiesText lists the operation classes with their default
+// priorities, for the -operation_priority help.
+func defaultPrioritiesText() string {
+	entries := []string{}
+	for _, class := range priorityClasses() {
+		entries = append(entries, fmt.Sprintf("%s=%d", class, defaultPriorities[class]))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// stringList is a flag that may be specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+const (
+	DefaultWorkers       = 10
+	DefaultSleepSeconds  = 10
+	DefaultQuotaSecs     = 600
+	DefaultAggregateSecs = 60
+	DefaultNoticeSecs    = 300
+	DefaultFailbackSecs  = 60
+	DefaultVipHistory    = 20
+	DefaultSizeCpu       = 60
+	DefaultSizeSecs      = 300
+	MaintenanceTtl       = 60
+	MaintenancePrefix    = "_maintenance."
+	DnsSyncSeconds       = 60
+	DnsTtl               = 60
+	DefaultQuotaWarning  = 0.1
+	DefaultWaitSeconds   = 60
+	DefaultVerifySecs    = 300
+	DefaultIgnoreLabel   = "vip-manager=ignore"
+	DefaultWeightLabel   = "vip-weight"
+	DefaultPort          = "8080"
+	DefaultStateObject   = "vip_manager/state.json"
+	DefaultAnomalySecs   = 60
+	DefaultAnomalyMoves  = 3
+	DefaultLeaseSeconds  = 30
+	DefaultRegistration  = 180
+	DefaultExpansion     = 0.8
+	DefaultShutdownSecs  = 120
+	DefaultMoveFraction  = 0.5
+	DefaultMinImbalance  = 1
+	HealthInterval       = 10 * time.Second
+	DefaultVipFailures   = 3
+	MaxFailovers         = 100
+	DefaultPageSize      = 100
+	MaxPageSize          = 1000
+	DefaultQuarantine    = 600
+	DefaultRetention     = 86400
+	DefaultRebalanceSecs = 300
+	DefaultRebalanceHigh = 80
+	DefaultRebalanceLow  = 50
+	DefaultResyncSecs    = 300
+	DefaultApiBurst      = 10
+	DefaultJitter        = 0.1
+	DefaultDrainSecs     = 600
+	WatchInterval        = 5 * time.Second
+	GuardrailApproval    = 5 * time.Minute
+)
+
+// newFlagSet returns the vip_manager command line flags, which set cfg, and
+// the lists of -exclude.
+func newFlagSet(cfg *Config) (*flag.FlagSet, *stringList) {
+	excludeLists := &stringList{}
+	fs := flag.NewFlagSet("vip_manager", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&cfg.Gcp.Project, "project", "", "GCP project name.")
+	fs.StringVar(&cfg.Provider, "provider", ProviderGce, "Cloud of the instances: \"gce\", or \"aws\" for secondary private IPs of the instances of an Auto Scaling group. On AWS, -region is the AWS region, -zone an optional availability zone, -gce_instance_group the Auto Scaling group, and -alias_network the ID of the subnet of the VIPs. \"static\" manages the hosts of -inventory through metrics_exporter on each. \"forwarding\" moves protocol forwarding rules in the region, labelled vip-manager-pool=ALIAS_NETWORK, between the instances of -gce_instance_group.")
+	fs.StringVar(&cfg.Inventory, "inventory", "", "Inventory file with the groups of hosts and the networks of the VIPs, for -provider static.")
+	fs.StringVar(&cfg.AgentToken, "agent_token", os.Getenv("VIP_MANAGER_AGENT_TOKEN"), "Bearer token of metrics_exporter on the hosts, for -provider static. Defaults to $VIP_MANAGER_AGENT_TOKEN.")
+	fs.StringVar(&cfg.Gcp.Zone, "zone", "", "GCE zone name.")
+	fs.StringVar(&cfg.Gcp.Region, "region", "", "GCE region name, for regional instance groups.")
+	fs.Var(&cfg.groupNames, "gce_instance_group", "GCE instance group. Repeat for several groups.")
+	fs.StringVar(&cfg.Pair, "pair", "", "Two instances, NAME,NAME or ZONE/NAME,ZONE/NAME, for an active/standby failover pair instead of an instance group. All VIPs are on the active instance, and fail over to the other one.")
+	fs.BoolVar(&cfg.PairPrimary, "pair_primary", false, "The first instance of -pair is the primary. VIPs return to it when it is available again for -failback_delay seconds.")
+	fs.BoolVar(&cfg.PairInGroup, "pair_in_group", false, "The instances of -pair are in the managed instance group -gce_instance_group, and lose their VIPs when they leave it.")
+	fs.UintVar(&cfg.FailbackSeconds, "failback_delay", DefaultFailbackSecs, "Seconds the primary of a failover pair must be available before VIPs return to it, with -pair_primary.")
+	fs.StringVar(&cfg.Gcp.NodePool, "gke_node_pool", "", "Use the nodes of a GKE node pool, CLUSTER/NODE_POOL in -region or -zone, as the instances of each group, instead of a managed instance group. -gce_instance_group then only names the group.")
+	fs.BoolVar(&cfg.KubeController, "kube_controller", false, "Run in a Kubernetes cluster, and take the groups from VIPPool resources instead of -gce_instance_group or -config, reporting their status in the resources.")
+	fs.StringVar(&cfg.Gcp.LabelSelector, "label_selector", "", "Select the instances of each group by labels, e.g. role=nfs-server, instead of a managed instance group. -gce_instance_group then only names the group.")
+	fs.IntVar(&cfg.Gcp.BlockBits, "block_prefix", 0, "Carve the VIPs into blocks of this prefix length, e.g. 28, and assign each block as one alias IP range, for pools larger than the 100 alias IP ranges of an instance. 0 assigns single IPs.")
+	fs.StringVar(&cfg.Gcp.Subnetwork, "subnetwork", "", "Subnetwork with the alias networks, as NAME or projects/PROJECT/regions/REGION/subnetworks/NAME, e.g. in a Shared VPC host project. Selects the network interface of instances with several.")
+	fs.StringVar(&cfg.HostProject, "host_project", "", "Shared VPC host project of -subnetwork NAME. Defaults to -project.")
+	fs.Var(&cfg.aliasNetworks, "alias_network", "Alias network name. Repeat for several alias networks in one instance group.")
+	fs.Var(&cfg.vipLists, "vips", "Virtual IPv4 addresses, specified as list of ips or prefixes. Repeat once per instance group or alias network.")
+	fs.UintVar(&cfg.Workers, "workers", DefaultWorkers, "Worker: max concurrent requests.")
+	fs.UintVar(&cfg.SleepSeconds, "idle_interval", DefaultSleepSeconds, "Seconds between reconcile passes when there is nothing to do.")
+	fs.UintVar(&cfg.SleepSeconds, "sleep", DefaultSleepSeconds, "Deprecated: use -idle_interval.")
+	fs.UintVar(&cfg.ActiveSeconds, "active_interval", 0, "Seconds between reconcile passes while passes make changes. 0 to pass again right away.")
+	fs.Float64Var(&cfg.Jitter, "jitter", DefaultJitter, "Randomize the time between reconcile passes by up to this fraction, so that the loops of groups and managers spread out. 0 disables.")
+	fs.StringVar(&cfg.Watch, "watch", "", "Reconcile right away when instances or instance groups change: \"operations\" polls the Compute operations, \"asset_feed\" pulls Cloud Asset feed notifications from -watch_subscription. Idle groups then only resync every -resync seconds, unless they need passes for health checks or registrations.")
+	fs.StringVar(&cfg.WatchSubscription, "watch_subscription", "", "Pub/Sub subscription of a Cloud Asset feed on instances and instance group managers, as projects/PROJECT/subscriptions/SUBSCRIPTION, for -watch asset_feed.")
+	fs.UintVar(&cfg.ResyncSeconds, "resync", DefaultResyncSecs, "With -watch, seconds between passes without changes.")
+	fs.UintVar(&cfg.Gcp.WaitSeconds, "wait", DefaultWaitSeconds, "Seconds to wait for changes to occur.")
+	fs.UintVar(&cfg.Gcp.VerifyPort, "verify_port", 0, "Port of metrics_exporter on the instances, e.g. 9001. Enables verifying added alias IPs from the guest side. 0 disables.")
+	fs.UintVar(&cfg.Gcp.VerifySeconds, "verify_timeout", DefaultVerifySecs, "Seconds to wait for instances to serve added alias IPs, with -verify_port.")
+	fs.StringVar(&cfg.IgnoreLabel, "ignore_label", DefaultIgnoreLabel, "Never change alias IPs of instances with this label, specified as key=value or key. Empty disables.")
+	fs.BoolVar(&cfg.Serverless, "serverless", false, "Reconcile once per HTTP POST to /reconcile, instead of looping. For Cloud Run or Cloud Functions.")
+	fs.StringVar(&cfg.Listen, "listen", "", "HTTP listen address. Defaults to :$PORT or :"+DefaultPort+" in serverless mode, disabled otherwise.")
+	fs.StringVar(&cfg.StateBucket, "state_bucket", "", "GCS bucket for state in serverless mode. Empty disables.")
+	fs.StringVar(&cfg.StateObject, "state_object", DefaultStateObject, "GCS object name for state in serverless mode.")
+	fs.UintVar(&cfg.AnomalySeconds, "anomaly_interval", DefaultAnomalySecs, "Seconds between assignment snapshots for anomaly detection. 0 disables.")
+	fs.UintVar(&cfg.AnomalyMaxMoves, "anomaly_max_moves", DefaultAnomalyMoves, "Warn when a VIP moves more than this many times in an hour.")
+	fs.StringVar(&cfg.ConfigFile, "config", "", "JSON configuration file. Flags override values from the file.")
+	fs.StringVar(&cfg.LeaderLease, "leader_lease", "", "Lease for leader election between replicas: a GCS object as gs://BUCKET/OBJECT, or in a Kubernetes cluster a Lease as k8s://NAME in the namespace of the pod, or k8s://NAMESPACE/NAME. Empty disables.")
+	fs.StringVar(&cfg.LeaderId, "leader_id", "", "Identity for leader election. Defaults to the hostname.")
+	fs.UintVar(&cfg.LeaseSeconds, "lease_seconds", DefaultLeaseSeconds, "Duration of the leader lease, in seconds.")
+	fs.BoolVar(&cfg.Self, "self", false, "Run on a member of the managed instance group: project, zone and instance group default to those of the instance, and without -leader_lease, replicas on the other members elect a leader among themselves.")
+	fs.Float64Var(&cfg.SelfWeight, "self_weight", 1, "With -self, weigh the own instance by this factor, e.g. 0.5 for half as many VIPs as its peers.")
+	fs.StringVar(&cfg.RegistrationToken, "registration_token", os.Getenv("VIP_MANAGER_REGISTRATION_TOKEN"), "Bearer token for backend self-registration. Empty disables. Defaults to $VIP_MANAGER_REGISTRATION_TOKEN.")
+	fs.UintVar(&cfg.RegistrationSeconds, "registration_ttl", DefaultRegistration, "Seconds until a backend registration expires, unless renewed.")
+	fs.Float64Var(&cfg.ExpansionThreshold, "expansion_threshold", DefaultExpansion, "Propose a larger alias network when pool VIPs use more than this fraction of it. 0 disables.")
+	fs.StringVar(&cfg.Gcp.MoveWebhook, "move_webhook", "", "URL to POST to whenever a VIP is added to or removed from an instance. Empty disables.")
+	fs.StringVar(&cfg.MoveWebhookTemplate, "move_webhook_template", "", "Go template for the -move_webhook payload, with fields .Pool, .Ip, .Action, .Instance, .OldInstance, .NewInstance, .Reason and .Time. Defaults to the event as JSON.")
+	fs.UintVar(&cfg.QuotaSeconds, "quota_interval", DefaultQuotaSecs, "Seconds between reading GCE quotas, to export their headroom. 0 disables.")
+	fs.Float64Var(&cfg.QuotaWarning, "quota_warning", DefaultQuotaWarning, "Warn when less than this fraction of a GCE quota is left.")
+	fs.UintVar(&cfg.ApiAttempts, "api_attempts", uint(utils.DefaultRetryPolicy.Attempts), "Attempts per GCE API call. Rate limited calls, and reads failing with server or network errors, are retried with exponential backoff and jitter.")
+	fs.UintVar(&cfg.ApiBackoffSeconds, "api_backoff_max", uint(utils.DefaultRetryPolicy.Max/time.Second), "Max seconds between attempts of a GCE API call, and to hold off reconcile passes while calls keep failing.")
+	fs.Float64Var(&cfg.ApiErrorBudget, "api_error_budget", utils.DefaultRetryPolicy.Budget, "Fraction of GCE API calls in a minute that may fail after retries before vip_manager warns.")
+	fs.Float64Var(&cfg.ApiQps, "api_qps", 0, "Max GCE API requests per second of all workers and instance discovery together, including retries, to stay below the project quota. 0 for no limit.")
+	fs.UintVar(&cfg.ApiTimeoutSeconds, "api_timeout", uint(utils.DefaultCallTimeout/time.Second), "Seconds a call to list, get or update instances may take, including retries, so that a hung call can not stall a reconcile loop. 0 for no deadline.")
+	fs.UintVar(&cfg.ApiBurst, "api_burst", DefaultApiBurst, "Max GCE API requests in a burst, with -api_qps.")
+	fs.StringVar(&cfg.ImpersonateServiceAccount, "impersonate_service_account", "", "Email of a service account to impersonate in calls to Google APIs. The default credentials need the Service Account Token Creator role on it. Empty uses the default credentials.")
+	fs.Float64Var(&cfg.WriteQuota, "write_quota", 0, "GCE API write requests per minute of the project, shared with other automation. Warns when vip_manager alone uses 80% of it. 0 if unknown.")
+	fs.StringVar(&cfg.AuditLog, "audit_log", "", "Audit log of planned and executed alias IP operations: a local file for JSON lines, or logging://LOG_ID for Cloud Logging. Empty disables.")
+	fs.StringVar(&cfg.PubSubTopic, "pubsub_topic", "", "Cloud Pub/Sub topic to publish alias IP operations to, as TOPIC or projects/PROJECT/topics/TOPIC. Empty disables.")
+	fs.StringVar(&cfg.ExpansionWebhook, "expansion_webhook", "", "URL to POST expansion proposals to, as JSON. Proposals are logged regardless.")
+	fs.UintVar(&cfg.ShutdownSeconds, "shutdown_timeout", DefaultShutdownSecs, "Seconds to wait for in-flight operations on SIGTERM or SIGINT.")
+	fs.BoolVar(&cfg.DrainOnShutdown, "drain_on_shutdown", false, "On shutdown, remove VIPs from cordoned instances before exiting.")
+	fs.UintVar(&cfg.MaxIpsPerInstance, "max_ips_per_instance", 0, "Never assign more than this many alias IPs to an instance, even if VIPs remain unassigned. 0 for no limit.")
+	fs.BoolVar(&cfg.SpreadZones, "spread_zones", false, "With balanced placement, spread the VIPs of each pool over the zones of its instances first, so that a zone outage takes out as few VIPs as possible.")
+	fs.BoolVar(&cfg.SpreadHosts, "spread_hosts", false, "With balanced placement, spread the VIPs of each pool over the physical hosts of its instances, as reported by GCE for compact placement policies, within each zone with -spread_zones.")
+	fs.StringVar(&cfg.Placement, "placement", PlacementBalanced, "VIP placement: \"balanced\" moves as few VIPs as needed for an even distribution, \"rendezvous\" places each VIP on an instance chosen by consistent hashing, \"even\" and \"weighted\" give each instance its share of VIPs, by count or by weight, \"load\" by weight and how idle the instance is, see -rebalance_port.")
+	fs.StringVar(&cfg.Planner, "balance_planner", PlannerRobinHood, "With balanced placement: \"robin_hood\" takes VIPs from the richest instances, \"min_moves\" also picks the distribution and the VIPs to move so that the fewest move, keeping the longest-standing placements.")
+	fs.Var((*stringList)(&cfg.MoveWindows), "move_window", "Time window for moving VIPs between instances, e.g. \"Sat,Sun 02:00-04:00\" in UTC. May be repeated. Unassigned VIPs are placed at any time. Default: always.")
+	fs.StringVar(&cfg.HealthCheck, "health_check", "", "Health check instances must pass to receive VIPs: tcp:PORT, http:PORT/PATH, or gce for the health state of the instance group. Empty disables.")
+	fs.StringVar(&cfg.VipCheck, "vip_check", "", "Check each assigned VIP: tcp:PORT, http:PORT/PATH or nfs for an NFS NULL call. A VIP that stops answering while its instance is healthy moves to another instance. Empty disables.")
+	fs.UintVar(&cfg.VipCheckFailures, "vip_check_failures", DefaultVipFailures, "Consecutive failed VIP checks before a VIP fails over.")
+	fs.UintVar(&cfg.QuarantineGrace, "quarantine_grace", DefaultQuarantine, "Seconds before alias IPs removed from a pool are drained from their instance.")
+	fs.UintVar(&cfg.QuarantineRetention, "quarantine_retention", DefaultRetention, "Seconds to report drained alias IPs, before they are forgotten.")
+	fs.StringVar(&cfg.StrayPolicy, "stray_policy", StrayQuarantine, "Alias IPs in the alias network that are not VIPs of the pool: \"quarantine\" drains them after -quarantine_grace, \"remove\" drains them right away, \"alert\" logs them and \"ignore\" leaves them alone.")
+	fs.BoolVar(&cfg.OwnedOnly, "owned_only", false, "Only quarantine and drain alias IPs that were VIPs of the pool, as recorded in the intent. Leave other alias IPs in the alias network, e.g. of another vip_manager, alone.")
+	fs.BoolVar(&cfg.Strict, "strict", false, "Refuse to remove alias IPs that the pool does not own, and to update instances with alias ranges wider than one address in the alias network.")
+	fs.UintVar(&cfg.StartupGrace, "startup_grace", 0, "Seconds after an instance started, or was created, before it takes VIPs, so that it can finish booting. 0 disables.")
+	fs.UintVar(&cfg.CooldownSeconds, "cooldown", 0, "Seconds to wait after moving VIPs, or after instances came or went, before rebalancing again.")
+	fs.Float64Var(&cfg.MinImbalance, "min_imbalance", DefaultMinImbalance, "Only rebalance when the number of VIPs on the most and least loaded instance differ by more than this.")
+	fs.BoolVar(&cfg.CurrentTemplateOnly, "current_template_only", false, "During rollouts, move VIPs to instances with the instance template the group rolls out.")
+	fs.StringVar(&cfg.WeightLabel, "weight_label", DefaultWeightLabel, "Label with the relative weight of an instance. Instances with higher weight receive proportionally more VIPs. Empty disables.")
+	fs.BoolVar(&cfg.WeightByCpus, "weight_by_cpus", false, "Weigh instances without weight label by their number of vCPUs.")
+	fs.UintVar(&cfg.DrainPort, "drain_port", 0, "Port of metrics_exporter on the instances, e.g. 9001. Enables holding rebalancing moves of VIPs until their connections drain. 0 disables.")
+	fs.UintVar(&cfg.DrainConnections, "drain_connections", 0, "With -drain_port, move a VIP once its instance has at most this many connections to it.")
+	fs.UintVar(&cfg.DrainSeconds, "drain_timeout", DefaultDrainSecs, "With -drain_port, seconds to hold a move for connections to drain, before moving the VIP anyway.")
+	fs.UintVar(&cfg.RebalancePort, "rebalance_port", 0, "Port of metrics_exporter on the instances, e.g. 9001. Enables swapping busy VIPs from loaded to idle instances. 0 disables.")
+	fs.UintVar(&cfg.AggregatePort, "aggregate_port", 0, "Port of metrics_exporter on the instances, e.g. 9001. Enables exporting connections per service port for each pool, and the share of each instance. 0 disables.")
+	fs.UintVar(&cfg.AggregateSeconds, "aggregate_interval", DefaultAggregateSecs, "Seconds between scrapes for -aggregate_port.")
+	fs.BoolVar(&cfg.SizeHints, "size_hints", false, "Recommend a size for each instance group, from its VIPs, -max_ips_per_instance, and with -aggregate_port its CPU usage, exported as vip_manager_recommended_instances.")
+	fs.Float64Var(&cfg.SizeTargetCpu, "size_target_cpu", DefaultSizeCpu, "Average CPU usage in percent to size instance groups for, with -size_hints and -aggregate_port.")
+	fs.UintVar(&cfg.SizeSeconds, "size_interval", DefaultSizeSecs, "Seconds between size recommendations.")
+	fs.BoolVar(&cfg.SizeAutoscaler, "size_autoscaler", false, "Set the recommended size as the minimum number of replicas of the autoscaler of each managed instance group. Implies -size_hints.")
+	fs.UintVar(&cfg.RebalanceSeconds, "rebalance_interval", DefaultRebalanceSecs, "Seconds between load aware swaps in a pool, so that the load settles in between.")
+	fs.Float64Var(&cfg.RebalanceHighCpu, "rebalance_high_cpu", DefaultRebalanceHigh, "CPU usage percent above which an instance is overloaded.")
+	fs.Float64Var(&cfg.RebalanceLowCpu, "rebalance_low_cpu", DefaultRebalanceLow, "CPU usage percent below which an instance is idle.")
+	fs.StringVar(&cfg.RebalanceSignal, "rebalance_signal", SignalCpu, "Load of an instance, for -rebalance_high_cpu and -rebalance_low_cpu: \"cpu\" usage, or the \"saturation\" score of metrics_exporter, which falls back to CPU usage for older exporters.")
+	fs.StringVar(&cfg.OperationPriority, "operation_priority", "", "Worker queue priorities by operation class, lower runs first, e.g. \"allocate=0,rebalance=3\". Classes and defaults: "+defaultPrioritiesText()+".")
+	fs.Float64Var(&cfg.MaxMoveFraction, "max_move_fraction", DefaultMoveFraction, "Pause all changes when a pass wants to move more than this fraction of a pool's VIPs, until resumed with POST /resume. 0 disables.")
+	fs.Var(excludeLists, "exclude", "Instances under maintenance, as list. Their VIPs are removed, and they receive no new ones.")
+	fs.StringVar(&cfg.AdminToken, "admin_token", os.Getenv("VIP_MANAGER_ADMIN_TOKEN"), "Bearer token for the admin API. Empty disables. Defaults to $VIP_MANAGER_ADMIN_TOKEN.")
+	fs.StringVar(&cfg.GrpcListen, "grpc_listen", "", "gRPC control API listen address, e.g. :8081. Requires -admin_token. Empty disables.")
+	fs.BoolVar(&cfg.MaintenanceTxt, "maintenance_txt", false, "Announce planned drains with TXT records _maintenance.HOSTNAME in -dns_zone, for the hostnames of affected VIPs.")
+	fs.StringVar(&cfg.MaintenanceWebhook, "maintenance_webhook", "", "URL to POST planned drains to, as JSON. Empty disables.")
+	fs.UintVar(&cfg.MaintenanceNotice, "maintenance_notice", DefaultNoticeSecs, "Seconds between announcing a planned drain and moving VIPs, with -maintenance_txt or -maintenance_webhook.")
+	fs.StringVar(&cfg.DnsZone, "dns_zone", "", "Cloud DNS managed zone with records pointing to VIPs, in -project.")
+	fs.StringVar(&cfg.DnsImport, "dns_import", "", "Import the A and AAAA records of -dns_zone pointing to VIPs into -intent_state, then exit: \"dry_run\" shows what would be imported, \"apply\" imports.")
+	fs.BoolVar(&cfg.DnsSync, "dns_sync", false, "Keep the managed records of -dns_zone pointing to assigned VIPs only, see -dns_import.")
+	fs.StringVar(&cfg.DnsInstanceDomain, "dns_instance_domain", "", "With -dns_sync, keep a record INSTANCE.DOMAIN in -dns_zone with the VIPs of each instance. Other A and AAAA records in the domain are deleted. Empty disables.")
+	fs.StringVar(&cfg.Manager, "manager", "http://localhost:"+DefaultPort, "Admin API of the running vip_manager, for the status, reconcile and drain commands.")
+	fs.BoolVar(&cfg.FaultInjection, "fault_injection", false, "Enable the /faults admin endpoints, to simulate unhealthy instances, unreachable VIPs and slow operations. For game days, not for normal operation.")
+	fs.BoolVar(&cfg.Once, "once", false, "reconcile command: reconcile once, print the outcome, and exit.")
+	fs.BoolVar(&cfg.Undo, "undo", false, "drain/pin commands: end the drain, or remove the pin.")
+	fs.StringVar(&cfg.ExporterJob, "exporter_job", "metrics_exporter", "alert-rules command: Prometheus job that scrapes metrics_exporter.")
+	fs.BoolVar(&cfg.Verbose, "verbose", false, "List every IP in logs and status, instead of summarizing them into CIDR blocks.")
+	fs.StringVar(&cfg.IntentState, "intent_state", "", "Local file or gs://BUCKET/OBJECT to persist which VIP is intended for which instance. Empty keeps it in memory.")
+	fs.UintVar(&cfg.VipHistory, "vip_history", DefaultVipHistory, "Number of recent changes to keep per VIP, with the intent, for GET /vips/IP/history. 0 disables.")
+	return fs, excludeLists
+}
+
+// parseArgs parses command line flags, without the program name, and reads
+// the -config file.
+func parseArgs(args []string) (*Config, error) {
+	cfg := &Config{
+		Gcp:            &utils.GcpConfig{},
+		active:         &atomic.Pointer[Config]{},
+		vipPoolUpdates: make(chan []GroupConfig),
+		setFlags:       map[string]bool{},
+	}
+	fs, excludeLists := newFlagSet(cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		cfg.setFlags[f.Name] = true
+	})
+	cfg.args = fs.Args()
+	for _, list := range *excludeLists {
+		cfg.Exclude = append(cfg.Exclude, strings.Fields(strings.ReplaceAll(list, ",", " "))...)
+	}
+	cfg.exclusions = &Exclusions{instances: map[string]bool{}}
+	cfg.failovers = &Failovers{}
+	cfg.pins = &Pins{pins: map[string]map[string]string{}}
+	cfg.faults = &Faults{Unhealthy: map[string]bool{}, Unreachable: map[string]bool{}}
+	cfg.guard = utils.NewGuardrail(GuardrailApproval)
+	if cfg.ConfigFile != "" {
+		file, err := readConfigFile(cfg.ConfigFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+		}
+		applyConfigFile(cfg, file)
+	}
+	return cfg, nil
+}
+
+func readConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := &FileConfig{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(file); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fmt.Errorf("%s: expected %v, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// applyConfigFile copies values from the config file, except for values
+// specified on the command line.
+func applyConfigFile(cfg *Config, file *FileConfig) {
+	set := cfg.setFlags
+	if !set["project"] && file.Project != "" {
+		cfg.Gcp.Project = file.Project
+	}
+	if !set["zone"] && file.Zone != "" {
+		cfg.Gcp.Zone = file.Zone
+	}
+	if !set["region"] && file.Region != "" {
+		cfg.Gcp.Region = file.Region
+	}
+	if !set["workers"] && file.Workers != 0 {
+		cfg.Workers = file.Workers
+	}
+	if !set["idle_interval"] && !set["sleep"] {
+		if file.IdleSeconds != 0 {
+			cfg.SleepSeconds = file.IdleSeconds
+		} else if file.SleepSeconds != 0 {
+			cfg.SleepSeconds = file.SleepSeconds
+		}
+	}
+	if !set["active_interval"] && file.ActiveSeconds != 0 {
+		cfg.ActiveSeconds = file.ActiveSeconds
+	}
+	if !set["jitter"] && file.Jitter != nil {
+		cfg.Jitter = *file.Jitter
+	}
+	if !set["resync"] && file.ResyncSeconds != 0 {
+		cfg.ResyncSeconds = file.ResyncSeconds
+	}
+	if !set["wait"] && file.WaitSeconds != 0 {
+		cfg.Gcp.WaitSeconds = file.WaitSeconds
+	}
+	if !set["ignore_label"] && file.IgnoreLabel != nil {
+		cfg.IgnoreLabel = *file.IgnoreLabel
+	}
+	if !set["anomaly_interval"] && file.AnomalySeconds != nil {
+		cfg.AnomalySeconds = *file.AnomalySeconds
+	}
+	if !set["anomaly_max_moves"] && file.AnomalyMaxMoves != 0 {
+		cfg.AnomalyMaxMoves = file.AnomalyMaxMoves
+	}
+	if !set["max_ips_per_instance"] && file.MaxIpsPerInstance != 0 {
+		cfg.MaxIpsPerInstance = file.MaxIpsPerInstance
+	}
+	if !set["max_move_fraction"] && file.MaxMoveFraction != nil {
+		cfg.MaxMoveFraction = *file.MaxMoveFraction
+	}
+	if !set["placement"] && file.Placement != "" {
+		cfg.Placement = file.Placement
+	}
+	if !set["balance_planner"] && file.Planner != "" {
+		cfg.Planner = file.Planner
+	}
+	if !set["stray_policy"] && file.StrayPolicy != "" {
+		cfg.StrayPolicy = file.StrayPolicy
+	}
+	if !set["quarantine_grace"] && file.QuarantineGrace != nil {
+		cfg.QuarantineGrace = *file.QuarantineGrace
+	}
+	if !set["quarantine_retention"] && file.QuarantineRetain != nil {
+		cfg.QuarantineRetention = *file.QuarantineRetain
+	}
+	if !set["cooldown"] && file.CooldownSeconds != 0 {
+		cfg.CooldownSeconds = file.CooldownSeconds
+	}
+	if !set["startup_grace"] && file.StartupGrace != 0 {
+		cfg.StartupGrace = file.StartupGrace
+	}
+	if !set["min_imbalance"] && file.MinImbalance != 0 {
+		cfg.MinImbalance = file.MinImbalance
+	}
+	if !set["vip_check_failures"] && file.VipCheckFailures != 0 {
+		cfg.VipCheckFailures = file.VipCheckFailures
+	}
+	if !set["current_template_only"] && file.CurrentTemplate {
+		cfg.CurrentTemplateOnly = true
+	}
+	if !set["weight_label"] && file.WeightLabel != nil {
+		cfg.WeightLabel = *file.WeightLabel
+	}
+	if !set["weight_by_cpus"] && file.WeightByCpus {
+		cfg.WeightByCpus = true
+	}
+	if !set["spread_zones"] && file.SpreadZones {
+		cfg.SpreadZones = true
+	}
+	if !set["spread_hosts"] && file.SpreadHosts {
+		cfg.SpreadHosts = true
+	}
+	if !set["owned_only"] && file.OwnedOnly {
+		cfg.OwnedOnly = true
+	}
+	if !set["strict"] && file.Strict {
+		cfg.Strict = true
+	}
+	if !set["host_project"] && file.HostProject != "" {
+		cfg.HostProject = file.HostProject
+	}
+	if !set["block_prefix"] && file.BlockPrefix != 0 {
+		cfg.Gcp.BlockBits = file.BlockPrefix
+	}
+	if !set["subnetwork"] && file.Subnetwork != "" {
+		cfg.Gcp.Subnetwork = file.Subnetwork
+	}
+	if !set["exclude"] {
+		cfg.Exclude = file.Exclude
+	}
+	cfg.GroupConfigs = file.Groups
+}
+
+func checkArgs(cfg *Config) error {
+	if cfg.Provider == ProviderGce && cfg.Gcp.Zone == "" && cfg.Gcp.Region == "" {
+		return fmt.Errorf("Please specify GCE zone using -zone, or GCE region using -region")
+	}
+	switch {
+	case cfg.DnsImport != "" && cfg.DnsImport != DnsImportDryRun && cfg.DnsImport != DnsImportApply:
+		return fmt.Errorf("Please specify -dns_import as %s or %s", DnsImportDryRun, DnsImportApply)
+	case cfg.DnsImport != "" && cfg.DnsZone == "":
+		return fmt.Errorf("Please specify the Cloud DNS managed zone to import using -dns_zone")
+	case cfg.MaintenanceTxt && cfg.DnsZone == "":
+		return fmt.Errorf("Please specify the Cloud DNS managed zone for -maintenance_txt using -dns_zone")
+	case cfg.DnsSync && cfg.DnsZone == "":
+		return fmt.Errorf("Please specify the Cloud DNS managed zone for -dns_sync using -dns_zone")
+	case cfg.DnsInstanceDomain != "" && !cfg.DnsSync:
+		return fmt.Errorf("Please specify -dns_sync for -dns_instance_domain")
+	case cfg.DnsImport == DnsImportApply && cfg.IntentState == "":
+		return fmt.Errorf("Please specify -intent_state to import DNS records into")
+	}
+	if cfg.KubeController && cfg.Serverless {
+		return fmt.Errorf("-kube_controller does not work with -serverless")
+	}
+	if cfg.GrpcListen != "" && cfg.AdminToken == "" {
+		return fmt.Errorf("Please specify -admin_token for the gRPC control API")
+	}
+	if cfg.Serverless && cfg.AdminToken == "" {
+		return fmt.Errorf("Please specify -admin_token for POST /reconcile in serverless mode")
+	}
+	if cfg.SleepSeconds == 0 {
+		return fmt.Errorf("Invalid arguments: -idle_interval must be at least 1")
+	}
+	if cfg.Jitter < 0 || cfg.Jitter >= 1 {
+		return fmt.Errorf("Invalid arguments: -jitter must be at least 0 and less than 1")
+	}
+	if cfg.SelfWeight <= 0 {
+		return fmt.Errorf("Please specify -self_weight greater than 0")
+	}
+	switch cfg.Provider {
+	case ProviderGce, ProviderForwarding:
+		if cfg.Gcp.Zone != "" && cfg.Gcp.Region != "" {
+			return fmt.Errorf("Please specify either -zone or -region, not both")
+		}
+		if cfg.Provider == ProviderForwarding && cfg.Gcp.VerifyPort != 0 {
+			return fmt.Errorf("-verify_port checks alias IPs, not forwarding rules")
+		}
+	case ProviderAws, ProviderStatic:
+		switch {
+		case cfg.Provider == ProviderAws && cfg.Gcp.Region == "":
+			return fmt.Errorf("Please specify the AWS region using -region")
+		case cfg.Provider == ProviderStatic && cfg.Inventory == "":
+			return fmt.Errorf("Please specify the inventory file using -inventory")
+		case cfg.Provider == ProviderStatic && cfg.AgentToken == "":
+			return fmt.Errorf("Please specify the token of the agents using -agent_token")
+		case cfg.Self || cfg.PairInGroup:
+			return fmt.Errorf("-self and -pair_in_group need GCE managed instance groups")
+		case cfg.CurrentTemplateOnly || cfg.WeightByCpus || cfg.SizeAutoscaler || cfg.Gcp.VerifyPort != 0:
+			return fmt.Errorf("-current_template_only, -weight_by_cpus, -size_autoscaler and -verify_port are only supported on GCE")
+		}
+		// The quotas are GCE quotas.
+		cfg.QuotaSeconds = 0
+	default:
+		return fmt.Errorf("Please specify -provider as %s, %s, %s or %s", ProviderGce, ProviderAws, ProviderStatic, ProviderForwarding)
+	}
+	if cfg.SizeAutoscaler {
+		cfg.SizeHints = true
+	}
+	if cfg.PairInGroup && len(cfg.groupNames) == 0 {
+		return fmt.Errorf("Please specify the managed instance group of the pair using -gce_instance_group")
+	}
+	if cfg.Pair != "" && len(cfg.groupNames) == 0 {
+		// Name the group after the pair.
+		cfg.groupNames = append(cfg.groupNames, strings.ReplaceAll(cfg.Pair, ",", "-"))
+	}
+	if len(cfg.groupNames) > 0 || len(cfg.aliasNetworks) > 0 || len(cfg.vipLists) > 0 {
+		// The command line replaces all groups from the config file.
+		configs, err := groupConfigsFromFlags(cfg)
+		if err != nil {
+			return err
+		}
+		cfg.GroupConfigs = configs
+		if cfg.Pair != "" {
+			if len(cfg.GroupConfigs) != 1 {
+				return fmt.Errorf("Please specify one group for -pair")
+			}
+			cfg.GroupConfigs[0].Pair = strings.Split(cfg.Pair, ",")
+			cfg.GroupConfigs[0].PairPrimary = cfg.PairPrimary
+			cfg.GroupConfigs[0].PairInGroup = cfg.PairInGroup
+		} else if cfg.PairPrimary || cfg.PairInGroup {
+			return fmt.Errorf("Please specify the failover pair using -pair")
+		}
+	}
+	if len(cfg.GroupConfigs) == 0 && !cfg.KubeController {
+		return fmt.Errorf("Please specify GCE instance group using -gce_instance_group or -config")
+	}
+	if err := checkPlacement(cfg.Placement); err != nil {
+		return fmt.Errorf("Invalid arguments: %v", err)
+	}
+	if cfg.Placement == PlacementLoad && cfg.RebalancePort == 0 {
+		return fmt.Errorf("Please specify the port of metrics_exporter using -rebalance_port for -placement %s", PlacementLoad)
+	}
+	if err := checkStrayPolicy(cfg.StrayPolicy); err != nil {
+		return fmt.Errorf("Invalid arguments: %v", err)
+	}
+	if err := checkPlanner(cfg.Planner); err != nil {
+		return fmt.Errorf("Invalid arguments: %v", err)
+	}
+	if cfg.RebalanceSignal != SignalCpu && cfg.RebalanceSignal != SignalSaturation {
+		return fmt.Errorf("Invalid arguments: unknown -rebalance_signal %q, use %q or %q", cfg.RebalanceSignal, SignalCpu, SignalSaturation)
+	}
+	switch cfg.Watch {
+	case "":
+	case WatchOperations, WatchAssetFeed:
+		if cfg.Provider != ProviderGce {
+			return fmt.Errorf("-watch is only supported on GCE")
+		}
+		if cfg.Serverless {
+			return fmt.Errorf("-watch does not work with -serverless, trigger /reconcile instead")
+		}
+		if cfg.Watch == WatchAssetFeed && !strings.HasPrefix(cfg.WatchSubscription, "projects/") {
+			return fmt.Errorf("Please specify the subscription using -watch_subscription projects/PROJECT/subscriptions/SUBSCRIPTION")
+		}
+	default:
+		return fmt.Errorf("Invalid arguments: unknown -watch %q, use %q or %q", cfg.Watch, WatchOperations, WatchAssetFeed)
+	}
+	if cfg.MoveWebhookTemplate != "" {
+		tmpl, err := template.New("move_webhook").Parse(cfg.MoveWebhookTemplate)
+		if err != nil {
+			return fmt.Errorf("-move_webhook_template: %v", err)
+		}
+		cfg.Gcp.MoveTemplate = tmpl
+	}
+	priorities, err := parsePriorities(cfg.OperationPriority)
+	if err != nil {
+		return fmt.Errorf("-operation_priority: %v", err)
+	}
+	cfg.priorities = priorities
+	if cfg.Workers == 0 {
+		cfg.Workers = 1
+	}
+	if cfg.Serverless && cfg.Listen == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = DefaultPort
+		}
+		cfg.Listen = ":" + port
+	}
+	if cfg.LeaderLease != "" {
+		if cfg.LeaderId == "" {
+			cfg.LeaderId, _ = os.Hostname()
+		}
+		if cfg.LeaseSeconds == 0 {
+			cfg.LeaseSeconds = DefaultLeaseSeconds
+		}
+		duration := time.Duration(cfg.LeaseSeconds) * time.Second
+		if strings.HasPrefix(cfg.LeaderLease, KubeLeasePrefix) {
+			name := strings.TrimPrefix(cfg.LeaderLease, KubeLeasePrefix)
+			namespace, lease, found := strings.Cut(name, "/")
+			if !found {
+				namespace, lease = utils.KubeNamespace(), name
+			}
+			if lease == "" || strings.Contains(lease, "/") {
+				return fmt.Errorf("Please specify -leader_lease as k8s://NAME or k8s://NAMESPACE/NAME")
+			}
+			cfg.lease = utils.NewKubeLease(namespace, lease, cfg.LeaderId, duration)
+		} else {
+			bucket, object, ok := utils.ParseGcsUrl(cfg.LeaderLease)
+			if !ok {
+				return fmt.Errorf("Please specify -leader_lease as gs://BUCKET/OBJECT")
+			}
+			cfg.lease = utils.NewLease(bucket, object, cfg.LeaderId, duration)
+		}
+	} else if cfg.self != nil {
+		if cfg.Listen == "" {
+			cfg.Listen = ":" + DefaultPort
+		}
+		_, port, err := net.SplitHostPort(cfg.Listen)
+		if err != nil {
+			return fmt.Errorf("Invalid -listen %s: %v", cfg.Listen, err)
+		}
+		portNumber, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("Please specify -listen with a numeric port, got %s", cfg.Listen)
+		}
+		gcp := *cfg.Gcp
+		gcp.Zone, gcp.Region = cfg.self.Zone, cfg.self.Region
+		gcp.GceInstanceGroup = cfg.self.Group
+		if cfg.LeaseSeconds == 0 {
+			cfg.LeaseSeconds = DefaultLeaseSeconds
+		}
+		cfg.lease = utils.NewPeerElection(&gcp, cfg.self.Instance, portNumber, time.Duration(cfg.LeaseSeconds)*time.Second/3)
+	}
+	cfg.registry = utils.NewRegistry(time.Duration(cfg.RegistrationSeconds) * time.Second)
+	idle := cfg.SleepSeconds
+	if cfg.Watch != "" && cfg.ResyncSeconds > idle {
+		idle = cfg.ResyncSeconds
+	}
+	cfg.claims = NewClaims(3 * time.Duration(idle) * time.Second)
+	groups, err := buildGroups(cfg, cfg.GroupConfigs)
+	if err != nil {
+		if len(cfg.groupNames) == 0 {
+			return fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+		}
+		return fmt.Errorf("Invalid arguments: %v", err)
+	}
+	cfg.Groups = groups
+	return nil
+}
+
+func checkPlanner(planner string) error {
+	if planner != PlannerRobinHood && planner != PlannerMinMoves {
+		return fmt.Errorf("unknown balance planner %q, use %q or %q", planner, PlannerRobinHood, PlannerMinMoves)
+	}
+	return nil
+}
+
+func checkStrayPolicy(policy string) error {
+	switch policy {
+	case StrayQuarantine, StrayIgnore, StrayAlert, StrayRemove:
+		return nil
+	}
+	return fmt.Errorf("unknown stray policy %q, use %q, %q, %q or %q", policy, StrayQuarantine, StrayIgnore, StrayAlert, StrayRemove)
+}
+
+// chooseSelf derives project, location and instance group from the instance
+// the manager runs on, for settings not given explicitly.
+func chooseSelf(cfg *Config) error {
+	self, err := utils.GetSelf()
+	if err != nil {
+		return fmt.Errorf("-self: %v", err)
+	}
+	cfg.self = self
+	if cfg.Gcp.Project == "" {
+		cfg.Gcp.Project = self.Project
+	}
+	if cfg.Gcp.Zone == "" && cfg.Gcp.Region == "" {
+		cfg.Gcp.Zone, cfg.Gcp.Region = self.Zone, self.Region
+	}
+	if len(cfg.groupNames) == 0 && (len(cfg.aliasNetworks) > 0 || len(cfg.GroupConfigs) == 0) {
+		cfg.groupNames = append(cfg.groupNames, self.Group)
+	}
+	if cfg.LeaderId == "" {
+		cfg.LeaderId = self.Instance
+	}
+	return nil
+}
+
+// parsePriorities parses "CLASS=N,..." into priorities by class, starting
+// from the defaults.
+func parsePriorities(s string) (map[string]int, error) {
+	priorities := map[string]int{}
+	for class, priority := range defaultPriorities {
+		priorities[class] = priority
+	}
+	for _, entry := range strings.Fields(strings.ReplaceAll(s, ",", " ")) {
+		class, value, ok := strings.Cut(entry, "=")
+		if _, known := defaultPriorities[class]; !known || !ok {
+			classes := priorityClasses()
+			return nil, fmt.Errorf("invalid entry %q, expected CLASS=N with class %s or %s", entry,
+				strings.Join(classes[:len(classes)-1], ", "), classes[len(classes)-1])
+		}
+		priority, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority in %q: %v", entry, err)
+		}
+		priorities[class] = priority
+	}
+	return priorities, nil
+}
+
+// groupConfigsFromFlags pairs VIP lists with instance groups or alias
+// networks, in command line order.
+func groupConfigsFromFlags(cfg *Config) ([]GroupConfig, error) {
+	if len(cfg.groupNames) == 0 {
+		return nil, fmt.Errorf("Please specify GCE instance group using -gce_instance_group")
+	}
+	if len(cfg.aliasNetworks) == 0 {
+		return nil, fmt.Errorf("Please specify alias network group using -alias_network")
+	}
+	if len(cfg.vipLists) == 0 {
+		return nil, fmt.Errorf("Please specify virtual ips using -vips")
+	}
+	if len(cfg.groupNames) > 1 && len(cfg.aliasNetworks) > 1 {
+		return nil, fmt.Errorf("Please specify either several -gce_instance_group or several -alias_network, not both. Use -config for more complex setups.")
+	}
+	if len(cfg.aliasNetworks) > 1 && len(cfg.vipLists) != len(cfg.aliasNetworks) {
+		return nil, fmt.Errorf("Please specify -vips once per -alias_network, got %d alias networks and %d VIP lists",
+			len(cfg.aliasNetworks), len(cfg.vipLists))
+	}
+	if len(cfg.aliasNetworks) == 1 && len(cfg.vipLists) != len(cfg.groupNames) {
+		return nil, fmt.Errorf("Please specify -vips once per -gce_instance_group, got %d groups and %d VIP lists",
+			len(cfg.groupNames), len(cfg.vipLists))
+	}
+	groups := []GroupConfig{}
+	i := 0
+	for _, name := range cfg.groupNames {
+		group := GroupConfig{Name: name}
+		for _, network := range cfg.aliasNetworks {
+			group.Pools = append(group.Pools, PoolConfig{
+				AliasNetwork: network,
+				VIPs:         strings.Fields(strings.ReplaceAll(cfg.vipLists[i], ",", " ")),
+			})
+			i++
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// buildGroups validates group configurations and creates the groups. Errors
+// point to the offending field.
+func buildGroups(cfg *Config, configs []GroupConfig) ([]*Group, error) {
+	groups := []*Group{}
+	owner := map[string]string{}
+	seen := map[string]bool{}
+	for i, groupConfig := range configs {
+		path := fmt.Sprintf("groups[%d]", i)
+		if groupConfig.Name == "" {
+			return nil, fmt.Errorf("%s.name: missing instance group name", path)
+		}
+		if seen[groupConfig.Name] {
+			return nil, fmt.Errorf("%s.name: duplicate instance group %s", path, groupConfig.Name)
+		}
+		seen[groupConfig.Name] = true
+		if len(groupConfig.Pools) == 0 {
+			return nil, fmt.Errorf("%s.pools: missing pools", path)
+		}
+		group := &Group{
+			Name:       groupConfig.Name,
+			wake:       make(chan struct{}, 1),
+			refresh:    map[string]bool{},
+			precedence: groupConfig.Precedence,
+			index:      i,
+		}
+		for j, poolConfig := range groupConfig.Pools {
+			path := fmt.Sprintf("%s.pools[%d]", path, j)
+			if poolConfig.AliasNetwork == "" {
+				return nil, fmt.Errorf("%s.alias_network: missing alias network name", path)
+			}
+			bits := cfg.Gcp.BlockBits
+			if poolConfig.BlockPrefix != 0 {
+				bits = poolConfig.BlockPrefix
+			}
+			if bits > 0 && cfg.Provider != ProviderGce {
+				return nil, fmt.Errorf("%s.block_prefix: blocks of VIPs are only supported on GCE", path)
+			}
+			if bits > 0 && cfg.Gcp.VerifyPort != 0 {
+				return nil, fmt.Errorf("%s.block_prefix: blocks of VIPs can not be verified with -verify_port", path)
+			}
+			var vips []string
+			var err error
+			if bits > 0 {
+				vips, err = parseBlocks(poolConfig.VIPs, bits)
+			} else {
+				vips, err = parseVIPs(poolConfig.VIPs)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s.vips%v", path, err)
+			}
+			poolGcp := *cfg.Gcp
+			poolGcp.BlockBits = bits
+			poolGcp.GceInstanceGroup = groupConfig.Name
+			poolGcp.AliasNetwork = poolConfig.AliasNetwork
+			if groupConfig.LabelSelector != "" {
+				poolGcp.LabelSelector = groupConfig.LabelSelector
+			}
+			if groupConfig.NodePool != "" {
+				poolGcp.NodePool = groupConfig.NodePool
+			}
+			if poolGcp.NodePool != "" {
+				location := cfg.Gcp.Region
+				if location == "" {
+					location = cfg.Gcp.Zone
+				}
+				if poolGcp.NodePool, err = utils.NodePoolName(cfg.Gcp.Project, location, poolGcp.NodePool); err != nil {
+					return nil, fmt.Errorf("%s.node_pool: %v", path, err)
+				}
+				if groupConfig.RegisteredOnly || poolGcp.LabelSelector != "" {
+					return nil, fmt.Errorf("%s.node_pool: a group can not both use a node pool and select instances by labels or be registered_only", path)
+				}
+				if cfg.Provider != ProviderGce && cfg.Provider != ProviderForwarding {
+					return nil, fmt.Errorf("%s.node_pool: node pools are only supported on GCE", path)
+				}
+			}
+			if groupConfig.NodeSelector != "" {
+				poolGcp.NodeSelector = groupConfig.NodeSelector
+				if groupConfig.RegisteredOnly || poolGcp.LabelSelector != "" || poolGcp.NodePool != "" {
+					return nil, fmt.Errorf("%s.node_selector: a group can not both select nodes and select instances by labels, use a node pool or be registered_only", path)
+				}
+				if cfg.Provider != ProviderGce && cfg.Provider != ProviderForwarding {
+					return nil, fmt.Errorf("%s.node_selector: nodes are only supported on GCE", path)
+				}
+			}
+			if groupConfig.RegisteredOnly && poolGcp.LabelSelector != "" {
+				return nil, fmt.Errorf("%s.label_selector: a group can not both select instances by labels and be registered_only", path)
+			}
+			if cfg.Provider != ProviderGce && poolGcp.LabelSelector != "" {
+				return nil, fmt.Errorf("%s.label_selector: only GCE instances can be selected by labels", path)
+			}
+			if cfg.Provider != ProviderGce && (poolConfig.Subnetwork != "" || cfg.Gcp.Subnetwork != "") {
+				return nil, fmt.Errorf("%s.subnetwork: only GCE alias networks are in a subnetwork", path)
+			}
+			subnetwork, subnetworkPath := poolConfig.Subnetwork, path+".subnetwork"
+			if subnetwork == "" {
+				subnetwork, subnetworkPath = cfg.Gcp.Subnetwork, "-subnetwork"
+			}
+			if subnetwork != "" {
+				hostProject, region := cfg.HostProject, cfg.Gcp.Region
+				if hostProject == "" {
+					hostProject = cfg.Gcp.Project
+				}
+				if region == "" {
+					region = utils.ZoneRegion(cfg.Gcp.Zone)
+				}
+				if poolGcp.Subnetwork, err = utils.SubnetworkLink(hostProject, region, subnetwork); err != nil {
+					return nil, fmt.Errorf("%s: %v", subnetworkPath, err)
+				}
+			}
+			if err := checkPair(groupConfig, &poolGcp); err != nil {
+				return nil, fmt.Errorf("%s.pair: %v", path, err)
+			}
+			pool := &Pool{
+				Gcp:            &poolGcp,
+				VIPs:           vips,
+				RegisteredOnly: groupConfig.RegisteredOnly,
+				pair:           groupConfig.Pair,
+				pairPrimary:    groupConfig.PairPrimary,
+				pairInGroup:    groupConfig.PairInGroup,
+				strategy:       newStrategy(cfg),
+			}
+			if len(pool.VIPs) == 0 {
+				return nil, fmt.Errorf("%s.vips: missing virtual ips for %s", path, pool.Name())
+			}
+			if _, ok := owner[pool.Name()]; ok {
+				return nil, fmt.Errorf("%s.alias_network: duplicate alias network %s", path, poolConfig.AliasNetwork)
+			}
+			owner[pool.Name()] = pool.Name()
+			for _, vip := range pool.VIPs {
+				ips := []string{vip}
+				if bits > 0 {
+					// Blocks overlap if any of their addresses do.
+					addrs, _ := utils.ExpandNetworkPrefix(vip)
+					ips = []string{}
+					for _, addr := range addrs {
+						ips = append(ips, addr.String())
+					}
+				}
+				for _, ip := range ips {
+					if other, ok := owner[ip]; ok {
+						return nil, fmt.Errorf("%s.vips: virtual IP %s is in the pools of both %s and %s", path, ip, other, pool.Name())
+					}
+					owner[ip] = pool.Name()
+				}
+			}
+			for ip, instance := range poolConfig.Pins {
+				if !slices.Contains(pool.VIPs, ip) {
+					return nil, fmt.Errorf("%s.pins: %s is not a virtual IP of %s", path, ip, pool.Name())
+				}
+				if instance == "" {
+					return nil, fmt.Errorf("%s.pins: missing instance for %s", path, ip)
+				}
+			}
+			pool.pins = poolConfig.Pins
+			windows, windowsPath := poolConfig.MoveWindows, path+".move_windows"
+			if len(windows) == 0 {
+				windows, windowsPath = cfg.MoveWindows, "-move_window"
+			}
+			for k, entry := range windows {
+				window, err := utils.ParseWindow(entry)
+				if err != nil {
+					return nil, fmt.Errorf("%s[%d]: %v", windowsPath, k, err)
+				}
+				pool.windows = append(pool.windows, window)
+			}
+			if poolConfig.Rotation != "" {
+				rotation, err := utils.ParseWindow(poolConfig.Rotation)
+				if err != nil {
+					return nil, fmt.Errorf("%s.rotation: %v", path, err)
+				}
+				pool.rotation = &rotation
+			}
+			for k, set := range poolConfig.Replicas {
+				if len(set) < 2 {
+					return nil, fmt.Errorf("%s.replicas[%d]: at least two virtual IPs needed", path, k)
+				}
+				for _, ip := range set {
+					if !slices.Contains(pool.VIPs, ip) {
+						return nil, fmt.Errorf("%s.replicas[%d]: %s is not a virtual IP of %s", path, k, ip, pool.Name())
+					}
+					if _, ok := pool.replicas[ip]; ok {
+						return nil, fmt.Errorf("%s.replicas[%d]: %s is in several sets", path, k, ip)
+					}
+					if pool.replicas == nil {
+						pool.replicas = map[string][]string{}
+					}
+					for _, other := range set {
+						if other != ip {
+							pool.replicas[ip] = append(pool.replicas[ip], other)
+						}
+					}
+				}
+			}
+			healthCheck, healthPath := poolConfig.HealthCheck, path+".health_check"
+			if healthCheck == "" {
+				healthCheck, healthPath = cfg.HealthCheck, "-health_check"
+			}
+			if healthCheck != "" {
+				if pool.health, err = utils.ParseHealthCheck(healthCheck); err != nil {
+					return nil, fmt.Errorf("%s: %v", healthPath, err)
+				}
+				if pool.health.Type == utils.HealthGce && cfg.Provider != ProviderGce && cfg.Provider != ProviderForwarding {
+					return nil, fmt.Errorf("%s: only GCE instances can be checked with gce", healthPath)
+				}
+				if pool.health.Type == utils.HealthGce && (poolGcp.LabelSelector != "" || poolGcp.NodeSelector != "") {
+					return nil, fmt.Errorf("%s: instances selected by labels can not be checked with gce", healthPath)
+				}
+				if pool.health.Type == utils.HealthGce && len(pool.pair) > 0 && !pool.pairInGroup {
+					return nil, fmt.Errorf("%s: failover pairs outside a managed instance group can not be checked with gce", healthPath)
+				}
+			}
+			vipCheck, vipPath := poolConfig.VipCheck, path+".vip_check"
+			if vipCheck == "" {
+				vipCheck, vipPath = cfg.VipCheck, "-vip_check"
+			}
+			if vipCheck != "" {
+				if pool.vipCheck, err = utils.ParseHealthCheck(vipCheck); err != nil {
+					return nil, fmt.Errorf("%s: %v", vipPath, err)
+				}
+				if pool.vipCheck.Type == utils.HealthGce {
+					return nil, fmt.Errorf("%s: VIPs can not be checked with gce", vipPath)
+				}
+				if bits > 0 {
+					return nil, fmt.Errorf("%s: blocks of VIPs can not be checked", vipPath)
+				}
+			}
+			pool.detector = utils.NewAnomalyDetector(int(cfg.AnomalyMaxMoves), time.Hour)
+			pool.group = group
+			group.Pools = append(group.Pools, pool)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// checkPair validates the failover pair of a group, if any.
+func checkPair(group GroupConfig, gcp *utils.GcpConfig) error {
+	switch {
+	case len(group.Pair) == 0 && (group.PairPrimary || group.PairInGroup):
+		return errors.New("pair_primary and pair_in_group need a failover pair")
+	case len(group.Pair) == 0:
+		return nil
+	case len(group.Pair) != 2:
+		return fmt.Errorf("a failover pair has two instances, got %d", len(group.Pair))
+	case group.Pair[0] == group.Pair[1]:
+		return fmt.Errorf("duplicate instance %s", group.Pair[0])
+	case group.RegisteredOnly || gcp.LabelSelector != "" || gcp.NodeSelector != "":
+		return errors.New("a failover pair can not select instances by labels or be registered_only")
+	}
+	for _, member := range group.Pair {
+		if group.PairInGroup {
+			// The zone comes from the instance group.
+			continue
+		}
+		if gcp.Zone == "" && !strings.Contains(member, "/") {
+			return fmt.Errorf("please specify the zone of %s as ZONE/%s, or use -zone", member, member)
+		}
+	}
+	return nil
+}
+
+// parseVIPs expands a list of IPs and network prefixes into IPs. Errors
+// start with the index of the offending entry, e.g. "[2]: ...".
+func parseVIPs(entries []string) ([]string, error) {
+	addrs := []netip.Addr{}
+	for i, network := range entries {
+		// Try parsing as a single IP.
+		ip, err := netip.ParseAddr(network)
+		if err == nil {
+			addrs = append(addrs, ip)
+			continue
+		}
+
+		// If that didn't work, parse as network prefix: a.b.c.d/e
+		ips, err := utils.ExpandNetworkPrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: failed to parse IP or prefix %q", i, network)
+		}
+		addrs = append(addrs, ips...)
+	}
+	// Sort for readability. Not strictly necessary.
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Compare(addrs[j]) < 1
+	})
+	ips := []string{}
+	for _, addr := range addrs {
+		ips = append(ips, addr.String())
+	}
+	return ips, nil
+}
+
+// parseBlocks carves network prefixes into blocks of VIPs of the prefix
+// length bits, e.g. "10.0.16.16/28". Errors start with the index of the
+// offending entry.
+func parseBlocks(entries []string, bits int) ([]string, error) {
+	blocks := []netip.Prefix{}
+	for i, network := range entries {
+		split, err := utils.SplitNetworkPrefix(network, bits)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %v", i, err)
+		}
+		blocks = append(blocks, split...)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].Addr().Less(blocks[j].Addr())
+	})
+	vips := []string{}
+	for _, block := range blocks {
+		vips = append(vips, block.String())
+	}
+	return vips, nil
+}
+
+// vipAddr returns the address of a VIP, or the first address of a block of
+// VIPs, for sorting.
+func vipAddr(vip string) (netip.Addr, error) {
+	if block, err := netip.ParsePrefix(vip); err == nil {
+		return block.Addr(), nil
+	}
+	return netip.ParseAddr(vip)
+}
+
+func PrintConfig(cfg *Config) {
+	log.Printf("Configuration:")
+	switch {
+	case cfg.Provider == ProviderStatic:
+		log.Printf(" - Inventory: %v", cfg.Inventory)
+	case cfg.Provider == ProviderAws:
+		log.Printf(" - AWS region: %v", cfg.Gcp.Region)
+		if cfg.Gcp.Zone != "" {
+			log.Printf(" - AWS availability zone: %v", cfg.Gcp.Zone)
+		}
+	case cfg.Gcp.Region != "":
+		log.Printf(" - GCP project: %v", cfg.Gcp.Project)
+		log.Printf(" - GCE region: %v", cfg.Gcp.Region)
+	default:
+		log.Printf(" - GCP project: %v", cfg.Gcp.Project)
+		log.Printf(" - GCE zone: %v", cfg.Gcp.Zone)
+	}
+	if cfg.Provider == ProviderForwarding {
+		log.Printf(" - VIPs: protocol forwarding rules labelled %s", utils.ForwardingPoolLabel)
+	}
+	if cfg.KubeController {
+		log.Printf(" - Kubernetes controller: VIPPools in %s/%s", utils.VipPoolGroup, utils.VipPoolVersion)
+	}
+	for _, group := range cfg.Groups {
+		log.Printf(" - Instance group: %v", group.Name)
+		if len(group.Pools) > 0 && group.Pools[0].Gcp.NodePool != "" {
+			log.Printf("   node pool: %v", group.Pools[0].Gcp.NodePool)
+		}
+		if len(group.Pools) > 0 && len(group.Pools[0].pair) > 0 {
+			log.Printf("   failover pair: %v primary: %v in group: %v",
+				group.Pools[0].pair, group.Pools[0].pairPrimary, group.Pools[0].pairInGroup)
+		}
+		for _, pool := range group.Pools {
+			log.Printf("   alias network: %v virtual IPs: %v", pool.Gcp.AliasNetwork, pool.VIPs)
+			if pool.Gcp.BlockBits > 0 {
+				log.Printf("   blocks of VIPs: /%d", pool.Gcp.BlockBits)
+			}
+			if pool.Gcp.Subnetwork != "" {
+				log.Printf("   alias network: %v subnetwork: %v", pool.Gcp.AliasNetwork, pool.Gcp.Subnetwork)
+			}
+		}
+		for _, config := range cfg.GroupConfigs {
+			for _, poolConfig := range config.Pools {
+				if config.Name == group.Name && len(poolConfig.MoveWindows) > 0 {
+					log.Printf("   alias network: %v move windows: %v", poolConfig.AliasNetwork, poolConfig.MoveWindows)
+				}
+				if config.Name == group.Name && poolConfig.Rotation != "" {
+					log.Printf("   alias network: %v rotation: %v", poolConfig.AliasNetwork, poolConfig.Rotation)
+				}
+				if config.Name == group.Name && len(poolConfig.Replicas) > 0 {
+					log.Printf("   alias network: %v replicas: %v", poolConfig.AliasNetwork, poolConfig.Replicas)
+				}
+				if config.Name == group.Name && poolConfig.HealthCheck != "" {
+					log.Printf("   alias network: %v health check: %v", poolConfig.AliasNetwork, poolConfig.HealthCheck)
+				}
+				if config.Name == group.Name && poolConfig.VipCheck != "" {
+					log.Printf("   alias network: %v VIP check: %v", poolConfig.AliasNetwork, poolConfig.VipCheck)
+				}
+			}
+		}
+	}
+	log.Printf(" - Worker: %v", cfg.Workers)
+	log.Printf(" - Wait seconds: %v", cfg.Gcp.WaitSeconds)
+	if cfg.Gcp.VerifyPort != 0 {
+		log.Printf(" - Verify on port %v for %v seconds", cfg.Gcp.VerifyPort, cfg.Gcp.VerifySeconds)
+	}
+	if cfg.Gcp.MoveWebhook != "" {
+		log.Printf(" - Move webhook: %v", cfg.Gcp.MoveWebhook)
+	}
+	if cfg.AuditLog != "" {
+		log.Printf(" - Audit log: %v", cfg.AuditLog)
+	}
+	if cfg.PubSubTopic != "" {
+		log.Printf(" - Pub/Sub topic: %v", cfg.PubSubTopic)
+	}
+	switch cfg.Watch {
+	case WatchOperations:
+		log.Printf(" - Watch Compute operations, resync: %vs", cfg.ResyncSeconds)
+	case WatchAssetFeed:
+		log.Printf(" - Watch asset feed: %v, resync: %vs", cfg.WatchSubscription, cfg.ResyncSeconds)
+	}
+	if cfg.FaultInjection {
+		log.Printf(" - Fault injection: enabled")
+	}
+	log.Printf(" - Ignore label: %v", cfg.IgnoreLabel)
+	log.Printf(" - Placement: %v", cfg.Placement)
+	if cfg.Placement == PlacementBalanced && cfg.Planner != PlannerRobinHood {
+		log.Printf(" - Balance planner: %v", cfg.Planner)
+	}
+	if cfg.StrayPolicy != StrayQuarantine {
+		log.Printf(" - Stray policy: %v", cfg.StrayPolicy)
+	}
+	if cfg.SpreadHosts {
+		log.Printf(" - Spread hosts: %v", cfg.SpreadHosts)
+	}
+	if cfg.SpreadZones {
+		log.Printf(" - Spread zones: %v", cfg.SpreadZones)
+	}
+	if len(cfg.MoveWindows) > 0 {
+		log.Printf(" - Move windows: %v", cfg.MoveWindows)
+	}
+	if cfg.DnsSync {
+		log.Printf(" - DNS sync: zone %v, instance domain: %q", cfg.DnsZone, cfg.DnsInstanceDomain)
+	}
+	if cfg.HealthCheck != "" {
+		log.Printf(" - Health check: %v", cfg.HealthCheck)
+	}
+	if cfg.VipCheck != "" {
+		log.Printf(" - VIP check: %v, failover after %v failures", cfg.VipCheck, cfg.VipCheckFailures)
+	}
+	if cfg.CooldownSeconds > 0 || cfg.MinImbalance != DefaultMinImbalance {
+		log.Printf(" - Cooldown: %vs, min imbalance: %v", cfg.CooldownSeconds, cfg.MinImbalance)
+	}
+	if cfg.StartupGrace > 0 {
+		log.Printf(" - Startup grace: %vs", cfg.StartupGrace)
+	}
+	if cfg.CurrentTemplateOnly {
+		log.Printf(" - Current instance template only")
+	}
+	if cfg.WeightByCpus {
+		log.Printf(" - Weight label: %v, otherwise vCPUs", cfg.WeightLabel)
+	} else if cfg.WeightLabel != "" {
+		log.Printf(" - Weight label: %v", cfg.WeightLabel)
+	}
+	if cfg.RebalancePort > 0 {
+		log.Printf(" - Rebalance by load: port %v, %v above %v%% to below %v%%, every %vs",
+			cfg.RebalancePort, cfg.RebalanceSignal, cfg.RebalanceHighCpu, cfg.RebalanceLowCpu, cfg.RebalanceSeconds)
+	}
+	if cfg.DrainPort > 0 {
+		log.Printf(" - Drain connections: port %v, until at most %v, for up to %vs", cfg.DrainPort, cfg.DrainConnections, cfg.DrainSeconds)
+	}
+	if cfg.SizeHints {
+		log.Printf(" - Size hints: every %vs, target CPU %v%%, autoscaler: %v", cfg.SizeSeconds, cfg.SizeTargetCpu, cfg.SizeAutoscaler)
+	}
+	if cfg.AggregatePort > 0 {
+		log.Printf(" - Aggregate connections: port %v, every %vs", cfg.AggregatePort, cfg.AggregateSeconds)
+	}
+	if cfg.MaxIpsPerInstance > 0 {
+		log.Printf(" - Max IPs per instance: %v", cfg.MaxIpsPerInstance)
+	}
+	if len(cfg.Exclude) > 0 {
+		log.Printf(" - Excluded instances: %v", cfg.Exclude)
+	}
+	if cfg.self != nil {
+		log.Printf(" - Self: %v in %v, weight: %v", cfg.self.Instance, cfg.self.Group, cfg.SelfWeight)
+	}
+	if cfg.lease != nil && cfg.LeaderLease == "" {
+		log.Printf(" - Leader election between members of %v", cfg.self.Group)
+	} else if cfg.lease != nil {
+		log.Printf(" - Leader lease: %v id: %v", cfg.LeaderLease, cfg.LeaderId)
+	}
+	if cfg.Listen != "" {
+		log.Printf(" - Listen on: %v", cfg.Listen)
+	}
+	if cfg.IntentState != "" {
+		log.Printf(" - Intent state: %v", cfg.IntentState)
+	}
+	if cfg.RegistrationToken != "" {
+		log.Printf(" - Backend registration enabled, ttl: %vs", cfg.RegistrationSeconds)
+	}
+	if cfg.Serverless {
+		log.Printf(" - Serverless")
+		log.Printf(" - State: gs://%v/%v", cfg.StateBucket, cfg.StateObject)
+	}
+}
+
+// reloadConfig re-reads the -config file into a copy of cfg. Command line
+// flags still take precedence. The number of workers is not reloaded.
+func reloadConfig(cfg *Config) (*Config, error) {
+	if cfg.ConfigFile == "" {
+		return nil, errors.New("no configuration file, specify one using -config")
+	}
+	file, err := readConfigFile(cfg.ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+	}
+	newCfg := *cfg
+	gcp := *cfg.Gcp
+	newCfg.Gcp = &gcp
+	applyConfigFile(&newCfg, file)
+	newCfg.Workers = cfg.Workers
+	if len(cfg.groupNames) > 0 || cfg.KubeController {
+		// The command line, or VIPPools, replace all groups from the config
+		// file.
+		newCfg.GroupConfigs = cfg.GroupConfigs
+	}
+	if newCfg.Gcp.Zone != "" && newCfg.Gcp.Region != "" {
+		return nil, errors.New("please specify either zone or region, not both")
+	}
+	if err := checkPlacement(newCfg.Placement); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+	}
+	if newCfg.Placement == PlacementLoad && newCfg.RebalancePort == 0 {
+		return nil, fmt.Errorf("%s: placement %s needs -rebalance_port", cfg.ConfigFile, PlacementLoad)
+	}
+	if err := checkStrayPolicy(newCfg.StrayPolicy); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+	}
+	if err := checkPlanner(newCfg.Planner); err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+	}
+	groups, err := buildGroups(&newCfg, newCfg.GroupConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+	}
+	newCfg.Groups = groups
+	return &newCfg, nil
+}
@@ -0,0 +1,224 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Cloud DNS records pointing to VIPs.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// SyncDns keeps the records of -dns_zone in line with the VIP assignments,
+// every DnsSyncSeconds, until ctx is canceled.
+func SyncDns(ctx context.Context, cfg *Config) {
+	for {
+		syncDns(cfg.active.Load())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(DnsSyncSeconds * time.Second):
+		}
+	}
+}
+
+// syncDns points the managed records, see ImportDnsRecords, to their VIPs
+// that are assigned to an instance, so that clients do not resolve VIPs that
+// nobody answers. A record whose VIPs are all unassigned keeps them, rather
+// than going away. With -dns_instance_domain, each instance with VIPs gets a
+// record INSTANCE.DOMAIN, and other records in the domain are deleted. Until
+// all pools have reconciled once, the assignments are unknown, and nothing
+// changes.
+func syncDns(cfg *Config) {
+	pooled := map[string]bool{}
+	assigned := map[string]bool{}
+	byInstance := map[string][]string{}
+	for _, group := range cfg.Groups {
+		for _, pool := range group.Pools {
+			pool.statusMu.Lock()
+			status := pool.status
+			pool.statusMu.Unlock()
+			if status.LastReconcile.IsZero() {
+				return
+			}
+			for _, ip := range pool.VIPs {
+				pooled[ip] = true
+			}
+			for name, vips := range status.Assignments {
+				for _, ip := range vips {
+					assigned[ip] = true
+				}
+				byInstance[name] = append(byInstance[name], vips...)
+			}
+		}
+	}
+	key := func(record utils.DnsRecord) string {
+		return record.Name + " " + record.Type
+	}
+	desired := map[string]utils.DnsRecord{}
+	for _, record := range cfg.intent.DnsRecords() {
+		ips := []string{}
+		for _, ip := range record.Ips {
+			if !pooled[ip] || assigned[ip] {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			record.Ips = ips
+		}
+		if record.Ttl == 0 {
+			record.Ttl = DnsTtl
+		}
+		desired[key(record)] = record
+	}
+	domain := ""
+	if cfg.DnsInstanceDomain != "" {
+		domain = "." + strings.Trim(cfg.DnsInstanceDomain, ".") + "."
+	}
+	if domain != "" {
+		for name, vips := range byInstance {
+			for _, ip := range vips {
+				record := utils.DnsRecord{Name: name + domain, Type: "A", Ttl: DnsTtl}
+				if net.ParseIP(ip).To4() == nil {
+					record.Type = "AAAA"
+				}
+				if existing, ok := desired[key(record)]; ok {
+					record = existing
+				}
+				record.Ips = append(record.Ips, ip)
+				desired[key(record)] = record
+			}
+		}
+	}
+	records, err := utils.ListDnsRecords(cfg.Gcp.Project, cfg.DnsZone)
+	if err != nil {
+		log.Printf("Error listing records of %s: %v", cfg.DnsZone, err)
+		return
+	}
+	current := map[string]utils.DnsRecord{}
+	for _, record := range records {
+		current[key(record)] = record
+	}
+	sameIps := func(a, b []string) bool {
+		a, b = slices.Clone(a), slices.Clone(b)
+		sort.Strings(a)
+		sort.Strings(b)
+		return slices.Equal(a, b)
+	}
+	for k, record := range desired {
+		if existing, ok := current[k]; ok && sameIps(existing.Ips, record.Ips) {
+			continue
+		}
+		if err := utils.SetDnsRecord(cfg.Gcp.Project, cfg.DnsZone, record); err != nil {
+			log.Printf("Error syncing DNS: %v", err)
+			continue
+		}
+		log.Printf("DNS record %s %s: %v", record.Name, record.Type, record.Ips)
+	}
+	for k, record := range current {
+		if _, ok := desired[k]; ok || domain == "" || !strings.HasSuffix(record.Name, domain) {
+			continue
+		}
+		if err := utils.DeleteDnsRecord(cfg.Gcp.Project, cfg.DnsZone, record); err != nil {
+			log.Printf("Error syncing DNS: %v", err)
+			continue
+		}
+		log.Printf("Deleted DNS record %s %s", record.Name, record.Type)
+	}
+}
+
+// ImportDnsRecords adopts the existing DNS records pointing to VIPs as
+// managed records, instead of recreating them. Prints the difference between
+// the zone and the managed records, and with DnsImportApply, saves them.
+func ImportDnsRecords(cfg *Config) error {
+	records, err := utils.ListDnsRecords(cfg.Gcp.Project, cfg.DnsZone)
+	if err != nil {
+		return fmt.Errorf("Error listing records of %s: %v", cfg.DnsZone, err)
+	}
+	owner := map[string]string{}
+	for _, group := range cfg.Groups {
+		for _, pool := range group.Pools {
+			for _, ip := range pool.VIPs {
+				owner[ip] = pool.Name()
+			}
+		}
+	}
+	managed := map[string]utils.DnsRecord{}
+	for _, record := range cfg.intent.DnsRecords() {
+		managed[record.Type+" "+record.Name] = record
+	}
+	covered := map[string]bool{}
+	imports := 0
+	for _, record := range records {
+		vips, others := []string{}, []string{}
+		for _, ip := range record.Ips {
+			if _, ok := owner[ip]; ok {
+				vips = append(vips, ip)
+				covered[ip] = true
+			} else {
+				others = append(others, ip)
+			}
+		}
+		if len(vips) == 0 {
+			continue
+		}
+		current, ok := managed[record.Type+" "+record.Name]
+		switch {
+		case !ok:
+			fmt.Printf("+ %s %s %d %v\n", record.Name, record.Type, record.Ttl, record.Ips)
+		case current.Ttl != record.Ttl || !slices.Equal(current.Ips, record.Ips):
+			fmt.Printf("- %s %s %d %v\n", current.Name, current.Type, current.Ttl, current.Ips)
+			fmt.Printf("+ %s %s %d %v\n", record.Name, record.Type, record.Ttl, record.Ips)
+		default:
+			continue
+		}
+		if len(others) > 0 {
+			fmt.Printf("  warning: %s also points to %v, which are not VIPs\n", record.Name, others)
+		}
+		imports++
+		if cfg.DnsImport == DnsImportApply {
+			cfg.intent.SetDnsRecord(record)
+		}
+	}
+	uncovered := map[string][]string{}
+	for ip, pool := range owner {
+		if !covered[ip] {
+			uncovered[pool] = append(uncovered[pool], ip)
+		}
+	}
+	pools := maps.Keys(uncovered)
+	sort.Strings(pools)
+	for _, pool := range pools {
+		ips := uncovered[pool]
+		sort.Strings(ips)
+		fmt.Printf("  %s: %d VIPs without record: %v\n", pool, len(ips), ips)
+	}
+	if cfg.DnsImport != DnsImportApply {
+		log.Printf("Dry run: %d records of %s to import. Use -dns_import %s to import them.", imports, cfg.DnsZone, DnsImportApply)
+		return nil
+	}
+	cfg.intent.Save()
+	log.Printf("Imported %d records of %s into %s", imports, cfg.DnsZone, cfg.IntentState)
+	return nil
+}
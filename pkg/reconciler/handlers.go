@@ -0,0 +1,807 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The admin API: HTTP handlers, and the gRPC control API.
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/api"
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+// authorized checks the bearer token of a request. An empty token disables
+// access.
+func authorized(r *http.Request, token string) bool {
+	return validBearer(r.Header.Get("Authorization"), token)
+}
+
+// validBearer checks an authorization header value against a token.
+func validBearer(header, token string) bool {
+	bearer := strings.TrimPrefix(header, "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1
+}
+
+// RefreshResult is the state of a refreshed instance in a pool.
+type RefreshResult struct {
+	Pool     string   `json:"pool"`
+	Instance string   `json:"instance"`
+	Zone     string   `json:"zone"`
+	AliasIps []string `json:"alias_ips"`
+}
+
+// refreshInstance re-fetches an instance in all pools it is in, and wakes up
+// their reconcile loops.
+func refreshInstance(ctx context.Context, cfg *Config, name string) []RefreshResult {
+	current := cfg.active.Load()
+	results := []RefreshResult{}
+	for _, group := range current.Groups {
+		found := false
+		for _, pool := range group.Pools {
+			instances, err := GetInstances(ctx, current, pool)
+			if err != nil {
+				log.Printf("Error getting instances: %v", err)
+				continue
+			}
+			if instance, ok := instances[name]; ok {
+				found = true
+				results = append(results, RefreshResult{
+					Pool:     pool.Name(),
+					Instance: name,
+					Zone:     instance.Zone,
+					AliasIps: *instance.AliasIps,
+				})
+			}
+		}
+		if found {
+			group.Refresh(name)
+		}
+	}
+	return results
+}
+
+// HandleInstances serves the admin API for instances:
+// POST /instances/NAME/exclude excludes an instance for maintenance.
+// DELETE /instances/NAME/exclude ends the maintenance.
+// POST /instances/NAME/refresh re-fetches an instance, and reconciles its
+// pools right away, e.g. after an out-of-band fix.
+func HandleInstances(cfg *Config) {
+	http.HandleFunc("/instances/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+		if len(parts) != 2 || parts[0] == "" {
+			http.NotFound(w, r)
+			return
+		}
+		name, action := parts[0], parts[1]
+		switch {
+		case action == "exclude" && r.Method == http.MethodPost:
+			log.Printf("Exclude instance %s", name)
+			cfg.exclusions.Set(name, true)
+		case action == "exclude" && r.Method == http.MethodDelete:
+			log.Printf("End exclusion of instance %s", name)
+			cfg.exclusions.Set(name, false)
+		case action == "exclude":
+			http.Error(w, "Use POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		case action == "refresh" && r.Method == http.MethodPost:
+			results := refreshInstance(r.Context(), cfg, name)
+			if len(results) == 0 {
+				http.Error(w, "Instance not found in any pool", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(results)
+			return
+		case action == "refresh":
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// HandleGuardrail serves the admin API for the rate-of-change guardrail:
+// POST /pause pauses all changes, like a big red button.
+// POST /resume confirms the pending changes, and resumes.
+func HandleGuardrail(cfg *Config) {
+	handle := func(path string, action func(r *http.Request)) {
+		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if !authorized(r, cfg.AdminToken) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if r.Method != http.MethodPost {
+				http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			action(r)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	handle("/pause", func(r *http.Request) {
+		cfg.guard.Pause("paused by operator from " + r.RemoteAddr)
+		mutationsPaused.Set(1)
+	})
+	handle("/resume", func(r *http.Request) {
+		cfg.guard.Resume()
+		mutationsPaused.Set(0)
+	})
+}
+
+// ClientReport tells which VIP of a pool a client reaches, and which instance
+// currently holds it.
+type ClientReport struct {
+	Pool     string `json:"pool"`
+	Hash     string `json:"hash"`
+	Vip      string `json:"vip"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Hashes of client IPs to VIPs, for ClientReport.
+const (
+	HashRendezvous = "rendezvous"
+	HashModulo     = "modulo"
+)
+
+// clientVip maps a client IP to a VIP of the pool. Clients really pick a VIP
+// from round robin DNS, so this is what a client would reach with the given
+// hash: "rendezvous" (highest rendezvous score) or "modulo" (hash modulo the
+// number of VIPs, in sorted order).
+func clientVip(pool *Pool, client, hash string) string {
+	vips := append([]string{}, pool.VIPs...)
+	sort.Strings(vips)
+	switch hash {
+	case HashModulo:
+		h := fnv.New64a()
+		h.Write([]byte(client))
+		return vips[h.Sum64()%uint64(len(vips))]
+	default:
+		best, bestScore := "", 0.0
+		for _, vip := range vips {
+			if score := rendezvousScore(client, vip, 1); best == "" || score > bestScore {
+				best, bestScore = vip, score
+			}
+		}
+		return best
+	}
+}
+
+// HandleClient serves GET /client?ip=CLIENT_IP with the VIP a client reaches
+// in each pool, and which instance holds it, for support investigations.
+// Optional parameters: pool=NAME, hash=rendezvous|modulo.
+func HandleClient(cfg *Config) {
+	http.HandleFunc("/client", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		client, err := netip.ParseAddr(r.URL.Query().Get("ip"))
+		if err != nil {
+			http.Error(w, "Please specify a client IP with ?ip=", http.StatusBadRequest)
+			return
+		}
+		hash := r.URL.Query().Get("hash")
+		if hash == "" {
+			hash = HashRendezvous
+		}
+		if hash != HashRendezvous && hash != HashModulo {
+			http.Error(w, "Unknown hash, use rendezvous or modulo", http.StatusBadRequest)
+			return
+		}
+		current := cfg.active.Load()
+		reports := []ClientReport{}
+		for _, group := range current.Groups {
+			for _, pool := range group.Pools {
+				if name := r.URL.Query().Get("pool"); name != "" && name != pool.Name() {
+					continue
+				}
+				vip := clientVip(pool, client.String(), hash)
+				instance, _ := current.intent.Get(pool.Name(), vip)
+				reports = append(reports, ClientReport{
+					Pool:     pool.Name(),
+					Hash:     hash,
+					Vip:      vip,
+					Instance: instance,
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reports)
+	})
+}
+
+// HandleQuarantine serves GET /quarantine, listing the quarantined alias IPs.
+func HandleQuarantine(cfg *Config) {
+	http.HandleFunc("/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.active.Load().intent.Quarantined(""))
+	})
+}
+
+// HandleStatus serves GET /status, with the VIP assignments, spare VIPs and
+// last reconcile pass of each pool, and GET /operations, with the most
+// recent alias IP operations.
+func HandleStatus(cfg *Config) {
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		verbose := r.URL.Query().Get("verbose") == "true"
+		pools := []PoolStatus{}
+		for _, group := range cfg.active.Load().Groups {
+			for _, pool := range group.Pools {
+				if name := r.URL.Query().Get("pool"); name != "" && name != pool.Name() {
+					continue
+				}
+				status := pool.Status()
+				if !verbose {
+					status = status.Summarized()
+				}
+				pools = append(pools, status)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pools)
+	})
+	http.HandleFunc("/status/vips", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		page, err := statusPage(cfg, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	})
+	http.HandleFunc("/operations", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(utils.RecentOperations())
+	})
+}
+
+// VipStatusPage is a page of GET /status/vips.
+type VipStatusPage struct {
+	Vips []map[string]any `json:"vips"`
+	// Pass as page_token for the next page. Empty on the last page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// statusPage returns a page of VIP states, ordered by pool and address. The
+// query filters by pool, instance, state (assigned or spare) and health (see
+// instanceState), selects fields (e.g. fields=vip,instance), and pages with
+// page_size (default DefaultPageSize, at most MaxPageSize) and page_token.
+func statusPage(cfg *Config, query url.Values) (*VipStatusPage, error) {
+	size := DefaultPageSize
+	if value := query.Get("page_size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid page_size %q", value)
+		}
+		size = n
+	}
+	if size > MaxPageSize {
+		size = MaxPageSize
+	}
+	// The token is the pool and address of the last VIP of the previous
+	// page, so that pages neither skip nor repeat VIPs while VIPs move.
+	afterPool, afterVip := "", netip.Addr{}
+	if token := query.Get("page_token"); token != "" {
+		data, err := base64.RawURLEncoding.DecodeString(token)
+		pool, vip, found := strings.Cut(string(data), " ")
+		if err != nil || !found {
+			return nil, fmt.Errorf("invalid page_token")
+		}
+		if afterVip, err = vipAddr(vip); err != nil {
+			return nil, fmt.Errorf("invalid page_token")
+		}
+		afterPool = pool
+	}
+	fields := []string{}
+	for _, field := range strings.Split(query.Get("fields"), ",") {
+		switch field {
+		case "":
+		case "pool", "vip", "state", "instance", "health":
+			fields = append(fields, field)
+		default:
+			return nil, fmt.Errorf("invalid field %q, expected pool, vip, state, instance or health", field)
+		}
+	}
+	pools := []PoolStatus{}
+	for _, group := range cfg.active.Load().Groups {
+		for _, pool := range group.Pools {
+			if name := query.Get("pool"); name == "" || name == pool.Name() {
+				pools = append(pools, pool.Status())
+			}
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Pool < pools[j].Pool })
+	page := &VipStatusPage{Vips: []map[string]any{}}
+	last := ""
+	for _, pool := range pools {
+		if afterPool != "" && pool.Pool < afterPool {
+			continue
+		}
+		for _, vip := range pool.Vips() {
+			if (query.Get("instance") != "" && vip.Instance != query.Get("instance")) ||
+				(query.Get("state") != "" && vip.State != query.Get("state")) ||
+				(query.Get("health") != "" && vip.Health != query.Get("health")) {
+				continue
+			}
+			if addr, err := vipAddr(vip.Vip); pool.Pool == afterPool && (err != nil || !afterVip.Less(addr)) {
+				continue
+			}
+			if len(page.Vips) == size {
+				page.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+				return page, nil
+			}
+			last = vip.Pool + " " + vip.Vip
+			row := map[string]any{"pool": vip.Pool, "vip": vip.Vip, "state": vip.State, "instance": vip.Instance, "health": vip.Health}
+			if len(fields) > 0 {
+				selected := map[string]any{}
+				for _, field := range fields {
+					selected[field] = row[field]
+				}
+				row = selected
+			}
+			page.Vips = append(page.Vips, row)
+		}
+	}
+	return page, nil
+}
+
+// HandleFaults serves the admin API to simulate failures, for game days:
+// GET /faults lists the simulated failures, DELETE /faults ends them all.
+// POST /faults/unhealthy/NAME fails the health checks of an instance.
+// POST /faults/unreachable/IP fails the -vip_check of a VIP.
+// POST /faults/delay?seconds=N delays alias IP operations.
+// DELETE on any of these ends the simulated failure.
+func HandleFaults(cfg *Config) {
+	faults := cfg.faults
+	http.HandleFunc("/faults", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodDelete:
+			log.Printf("Fault injection: end all simulated failures")
+			faults.mu.Lock()
+			faults.Unhealthy, faults.Unreachable, faults.DelaySeconds = map[string]bool{}, map[string]bool{}, 0
+			faults.mu.Unlock()
+			utils.SetOperationDelay(0)
+		default:
+			http.Error(w, "Use GET or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(faults.Copy())
+	})
+	http.HandleFunc("/faults/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Use POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		set := r.Method == http.MethodPost
+		kind, target, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/faults/"), "/")
+		faults.mu.Lock()
+		defer faults.mu.Unlock()
+		switch {
+		case kind == "unhealthy" && target != "":
+			log.Printf("Fault injection: instance %s unhealthy: %v", target, set)
+			if set {
+				faults.Unhealthy[target] = true
+			} else {
+				delete(faults.Unhealthy, target)
+			}
+		case kind == "unreachable" && target != "":
+			log.Printf("Fault injection: VIP %s unreachable: %v", target, set)
+			if set {
+				faults.Unreachable[target] = true
+			} else {
+				delete(faults.Unreachable, target)
+			}
+		case kind == "delay" && target == "":
+			seconds := uint64(0)
+			if set {
+				var err error
+				seconds, err = strconv.ParseUint(r.URL.Query().Get("seconds"), 10, 32)
+				if err != nil {
+					http.Error(w, "Invalid seconds", http.StatusBadRequest)
+					return
+				}
+			}
+			log.Printf("Fault injection: delay operations by %d seconds", seconds)
+			faults.DelaySeconds = uint(seconds)
+			utils.SetOperationDelay(time.Duration(seconds) * time.Second)
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// HandleFailovers serves GET /failovers, listing the most recent failovers.
+func HandleFailovers(cfg *Config) {
+	http.HandleFunc("/failovers", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.active.Load().failovers.List())
+	})
+}
+
+// poolOfVip returns the pool with a VIP, or nil.
+func poolOfVip(cfg *Config, ip string) *Pool {
+	for _, group := range cfg.Groups {
+		for _, pool := range group.Pools {
+			if slices.Contains(pool.VIPs, ip) {
+				return pool
+			}
+		}
+	}
+	return nil
+}
+
+// HandleVips serves the admin API of single VIPs:
+//
+//	GET /vips/IP/history                 Recent changes, oldest first.
+//	POST /vips/IP/pin?instance=NAME      Pin the VIP to an instance.
+//	DELETE /vips/IP/pin                  Unpin the VIP.
+//
+// GET /pins lists the pins of all pools.
+func HandleVips(cfg *Config) {
+	http.HandleFunc("/pins", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		current := cfg.active.Load()
+		pins := []Pin{}
+		for _, group := range current.Groups {
+			for _, pool := range group.Pools {
+				pins = append(pins, allPins(current, pool)...)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pins)
+	})
+	http.HandleFunc("/vips/", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		ip, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/vips/"), "/")
+		current := cfg.active.Load()
+		if rest == "pin" && (r.Method == http.MethodPost || r.Method == http.MethodDelete) {
+			pool := poolOfVip(current, ip)
+			if pool == nil {
+				http.Error(w, "Unknown VIP", http.StatusNotFound)
+				return
+			}
+			instance := r.URL.Query().Get("instance")
+			if r.Method == http.MethodPost && instance == "" {
+				http.Error(w, "Missing instance", http.StatusBadRequest)
+				return
+			}
+			if r.Method == http.MethodDelete {
+				instance = ""
+				log.Printf("Unpin %s in %s", ip, pool.Name())
+			} else {
+				log.Printf("Pin %s in %s to %s", ip, pool.Name(), instance)
+			}
+			current.pins.Set(pool.Name(), ip, instance)
+			for _, group := range current.Groups {
+				if slices.Contains(group.Pools, pool) {
+					group.Wake()
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if rest != "history" || r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		entries := current.intent.History(ip)
+		if len(entries) == 0 && poolOfVip(current, ip) == nil {
+			http.Error(w, "Unknown VIP", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
+
+// controlServer implements the gRPC control API, see api/vip_manager.proto.
+// Like the HTTP handlers, it works on the active configuration.
+type controlServer struct {
+	api.UnimplementedVipManagerServer
+	cfg *Config
+}
+
+func (s controlServer) ListAssignments(ctx context.Context, req *api.ListAssignmentsRequest) (*api.ListAssignmentsResponse, error) {
+	resp := &api.ListAssignmentsResponse{}
+	for _, group := range s.cfg.active.Load().Groups {
+		for _, pool := range group.Pools {
+			if req.Pool != "" && req.Pool != pool.Name() {
+				continue
+			}
+			status := pool.Status()
+			assignments := &api.PoolAssignments{Pool: status.Pool, Spare: status.Spare}
+			for name, vips := range status.Assignments {
+				assignments.Instances = append(assignments.Instances, &api.InstanceAssignment{Instance: name, Vips: vips})
+			}
+			sort.Slice(assignments.Instances, func(i, j int) bool {
+				return assignments.Instances[i].Instance < assignments.Instances[j].Instance
+			})
+			resp.Pools = append(resp.Pools, assignments)
+		}
+	}
+	if req.Pool != "" && len(resp.Pools) == 0 {
+		return nil, grpcstatus.Errorf(codes.NotFound, "no pool %s", req.Pool)
+	}
+	return resp, nil
+}
+
+func (s controlServer) Reconcile(ctx context.Context, req *api.ReconcileRequest) (*api.ReconcileResponse, error) {
+	found := false
+	for _, group := range s.cfg.active.Load().Groups {
+		if req.Group == "" || req.Group == group.Name {
+			group.Wake()
+			found = true
+		}
+	}
+	if !found {
+		return nil, grpcstatus.Errorf(codes.NotFound, "no instance group %s", req.Group)
+	}
+	return &api.ReconcileResponse{}, nil
+}
+
+func (s controlServer) DrainInstance(ctx context.Context, req *api.DrainInstanceRequest) (*api.DrainInstanceResponse, error) {
+	if req.Instance == "" {
+		return nil, grpcstatus.Error(codes.InvalidArgument, "missing instance")
+	}
+	current := s.cfg.active.Load()
+	if req.Undo {
+		log.Printf("End exclusion of instance %s", req.Instance)
+	} else {
+		log.Printf("Exclude instance %s", req.Instance)
+	}
+	current.exclusions.Set(req.Instance, !req.Undo)
+	for _, group := range current.Groups {
+		group.Wake()
+	}
+	return &api.DrainInstanceResponse{}, nil
+}
+
+func (s controlServer) PinVip(ctx context.Context, req *api.PinVipRequest) (*api.PinVipResponse, error) {
+	current := s.cfg.active.Load()
+	for _, group := range current.Groups {
+		for _, pool := range group.Pools {
+			if pool.Name() != req.Pool {
+				continue
+			}
+			if !slices.Contains(pool.VIPs, req.Vip) {
+				return nil, grpcstatus.Errorf(codes.NotFound, "no VIP %s in pool %s", req.Vip, req.Pool)
+			}
+			if req.Instance == "" {
+				log.Printf("Unpin %s in %s", req.Vip, req.Pool)
+			} else {
+				log.Printf("Pin %s in %s to %s", req.Vip, req.Pool, req.Instance)
+			}
+			current.pins.Set(req.Pool, req.Vip, req.Instance)
+			group.Wake()
+			return &api.PinVipResponse{}, nil
+		}
+	}
+	return nil, grpcstatus.Errorf(codes.NotFound, "no pool %s", req.Pool)
+}
+
+// ServeGrpc serves the gRPC control API, authenticated by the admin token,
+// until it fails.
+func ServeGrpc(cfg *Config) error {
+	listener, err := net.Listen("tcp", cfg.GrpcListen)
+	if err != nil {
+		return fmt.Errorf("Error listening on %s: %v", cfg.GrpcListen, err)
+	}
+	auth := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := grpcmetadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			if validBearer(value, cfg.AdminToken) {
+				return handler(ctx, req)
+			}
+		}
+		return nil, grpcstatus.Error(codes.Unauthenticated, "Unauthorized")
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(auth))
+	api.RegisterVipManagerServer(server, controlServer{cfg: cfg})
+	log.Printf("Serve gRPC control API on %s", cfg.GrpcListen)
+	return server.Serve(listener)
+}
+
+// HandleWake serves POST /reconcile, which starts a reconcile pass of all
+// groups right away. In serverless mode, ServeReconcile handles /reconcile.
+func HandleWake(cfg *Config) {
+	http.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST to reconcile", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		for _, group := range cfg.active.Load().Groups {
+			group.Wake()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// HandleProbes serves liveness and readiness probes, e.g. for Kubernetes or a
+// systemd watchdog, without authentication. Both answer "ok", or 503 with
+// the reason.
+// GET /healthz fails when a reconcile loop has not completed a pass for much
+// longer than it should, e.g. when deadlocked, so that it gets restarted.
+// GET /readyz fails until every pool was reconciled once, while GCE API
+// calls keep failing, and with leader election, on standby replicas.
+func HandleProbes(cfg *Config) {
+	probe := func(path string, check func(current *Config) string) {
+		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			current := cfg.active.Load()
+			reason := "configuration not loaded"
+			if current != nil {
+				reason = check(current)
+			}
+			if reason != "" {
+				http.Error(w, reason, http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+	}
+	probe("/healthz", func(current *Config) string {
+		if current.Serverless || (current.lease != nil && !current.lease.IsLeader()) {
+			return ""
+		}
+		for _, group := range current.Groups {
+			for _, pool := range group.Pools {
+				last := pool.Status().LastReconcile
+				if !last.IsZero() && time.Since(last) > stuckAfter(current) {
+					return fmt.Sprintf("pool %s not reconciled since %v", pool.Name(), last.Format(time.RFC3339))
+				}
+			}
+		}
+		return ""
+	})
+	probe("/readyz", func(current *Config) string {
+		if !utils.ApiReachable() {
+			return "GCE API calls failing"
+		}
+		if current.lease != nil && !current.lease.IsLeader() {
+			return "standby"
+		}
+		if current.Serverless {
+			return ""
+		}
+		for _, group := range current.Groups {
+			for _, pool := range group.Pools {
+				if pool.Status().LastReconcile.IsZero() {
+					return fmt.Sprintf("pool %s not reconciled yet", pool.Name())
+				}
+			}
+		}
+		return ""
+	})
+}
+
+// stuckAfter returns how long a reconcile loop may go without completing a
+// pass before it counts as stuck: ten idle intervals, or with -watch, three
+// resyncs, and at least 15 minutes.
+func stuckAfter(cfg *Config) time.Duration {
+	stuck := 10 * time.Duration(cfg.SleepSeconds) * time.Second
+	if resync := 3 * time.Duration(cfg.ResyncSeconds) * time.Second; cfg.Watch != "" && resync > stuck {
+		stuck = resync
+	}
+	if stuck < 15*time.Minute {
+		stuck = 15 * time.Minute
+	}
+	return stuck
+}
+
+// HandleRegister lets backends register themselves, authenticated by a bearer
+// token. Backends must renew their registration before it expires.
+func HandleRegister(cfg *Config) {
+	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST to register", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, cfg.RegistrationToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		registration := utils.Registration{}
+		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse registration: %v", err), http.StatusBadRequest)
+			return
+		}
+		if registration.Name == "" || registration.Zone == "" || registration.Group == "" {
+			http.Error(w, "Please specify name, zone and group", http.StatusBadRequest)
+			return
+		}
+		previous, ok := cfg.registry.Get(registration.Name)
+		if !ok {
+			log.Printf("Backend registered: %s zone: %s group: %s", registration.Name, registration.Zone, registration.Group)
+		}
+		registration = cfg.registry.Register(registration)
+		if registration.Terminating != "" && previous.Terminating == "" {
+			// Evacuate without waiting for the next pass.
+			log.Printf("Backend %s is terminating (%s), evacuating its VIPs", registration.Name, registration.Terminating)
+			for _, group := range cfg.active.Load().Groups {
+				group.Wake()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registration)
+	})
+}
@@ -0,0 +1,660 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Instances of a pool, and which of them may hold VIPs.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/netip"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/slices"
+)
+
+// GetInstances discovers the instances of a pool: instances in the instance
+// group, plus backends that registered themselves with the group.
+func GetInstances(ctx context.Context, cfg *Config, pool *Pool) (map[string]*utils.GceInstance, error) {
+	instances := map[string]*utils.GceInstance{}
+	switch {
+	case len(pool.pair) > 0:
+		var zones map[string]string
+		if pool.pairInGroup {
+			var err error
+			zones, err = utils.ListInstancesInGroup(ctx, pool.Gcp)
+			if err != nil {
+				return instances, err
+			}
+		}
+		for _, member := range pool.pair {
+			zone, name, found := strings.Cut(member, "/")
+			if !found {
+				zone, name = pool.Gcp.Zone, member
+			}
+			if pool.pairInGroup {
+				if zone, found = zones[name]; !found {
+					// Left the group, e.g. deleted or abandoned.
+					continue
+				}
+			}
+			instance, err := utils.GetInstance(ctx, pool.Gcp, zone, name)
+			if err != nil {
+				log.Printf("Error getting instance %s of pair %s: %v", name, pool.Name(), err)
+				continue
+			}
+			if instance.Status == "RUNNING" {
+				instances[name] = instance
+			}
+		}
+	case pool.Gcp.LabelSelector != "":
+		var err error
+		instances, err = utils.GetInstancesByLabels(ctx, pool.Gcp)
+		if err != nil {
+			return instances, err
+		}
+	case pool.Gcp.NodeSelector != "":
+		var err error
+		instances, err = utils.GetInstancesByNodes(ctx, pool.Gcp)
+		if err != nil {
+			return instances, err
+		}
+	case !pool.RegisteredOnly:
+		var err error
+		instances, err = utils.GetInstancesFromMIG(ctx, pool.Gcp)
+		if err != nil {
+			return instances, err
+		}
+	}
+	for _, registration := range cfg.registry.List(pool.Gcp.GceInstanceGroup) {
+		if _, ok := instances[registration.Name]; ok {
+			continue
+		}
+		instance, err := utils.GetInstance(ctx, pool.Gcp, registration.Zone, registration.Name)
+		if err != nil {
+			log.Printf("Error getting registered instance: %v", err)
+			continue
+		}
+		instances[registration.Name] = instance
+	}
+	if pool.group != nil {
+		pool.yielded = cfg.claims.Observe(pool.group, instances)
+	}
+	if cfg.plan != nil {
+		instances = cfg.plan.apply(pool, instances)
+	}
+	return instances, nil
+}
+
+func PrintInstances(ctx context.Context, cfg *Config, pool *Pool) {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return
+	}
+	outdated := outdatedInstances(cfg, pool, instances)
+	unhealthy := unhealthyInstances(ctx, cfg, pool, instances)
+	log.Printf("Current state of %s:", pool.Name())
+	for name, instance := range instances {
+		switch {
+		case isIgnored(cfg, instance):
+			log.Printf(" - Instance: %s (ignored)", name)
+		case isExcluded(cfg, instance):
+			log.Printf(" - Instance: %s (excluded)", name)
+		case isCordoned(cfg, instance):
+			log.Printf(" - Instance: %s (cordoned)", name)
+		case lacksAliasNetwork(ctx, pool, instance):
+			log.Printf(" - Instance: %s (no alias network %s)", name, pool.Gcp.AliasNetwork)
+		case pool.yielded[name] != "":
+			log.Printf(" - Instance: %s (belongs to group %s)", name, pool.yielded[name])
+		case outdated[name]:
+			log.Printf(" - Instance: %s (outdated template %s)", name, path.Base(instance.Template))
+		case unhealthy[name]:
+			log.Printf(" - Instance: %s (unhealthy)", name)
+		default:
+			log.Printf(" - Instance: %s", name)
+		}
+		ips := *instance.AliasIps
+		if !cfg.Verbose {
+			ips = utils.SummarizeIps(ips)
+		}
+		log.Printf("   ips: %v", ips)
+		for _, network := range instance.OtherNetworks {
+			log.Printf("   other network name: %s cidr: %s", network.Name, network.Cidr)
+		}
+	}
+}
+
+// isIgnored returns true if the instance carries the opt-out label. Alias IPs
+// of ignored instances are never added or removed, but still count as used.
+func isIgnored(cfg *Config, instance *utils.GceInstance) bool {
+	if cfg.IgnoreLabel == "" {
+		return false
+	}
+	key, value, hasValue := strings.Cut(cfg.IgnoreLabel, "=")
+	v, ok := instance.Labels[key]
+	if !ok {
+		return false
+	}
+	return !hasValue || v == value
+}
+
+// isCordoned returns true if the instance registered itself as cordoned.
+// Like ignored instances, cordoned instances keep their alias IPs, but take no
+// part in balancing.
+func isCordoned(cfg *Config, instance *utils.GceInstance) bool {
+	registration, ok := cfg.registry.Get(instance.Name)
+	return ok && registration.Cordoned
+}
+
+// isTerminating returns true if the instance registered itself as about to
+// be stopped, e.g. on preemption or host maintenance.
+func isTerminating(cfg *Config, instance *utils.GceInstance) bool {
+	registration, ok := cfg.registry.Get(instance.Name)
+	return ok && registration.Terminating != ""
+}
+
+// lacksAliasNetwork returns true if the subnetwork of the instance does not
+// have the alias network of the pool, e.g. for instances created from an older
+// template. Such instances can not hold VIPs of the pool. Lookups are cached
+// per subnetwork. On errors, the instance is assumed to be fine. Instances
+// without an interface in the configured subnetwork, or on AWS in the alias
+// subnet, lack it too.
+func lacksAliasNetwork(ctx context.Context, pool *Pool, instance *utils.GceInstance) bool {
+	if instance.NetworkInterface == "" {
+		return true
+	}
+	if instance.AliasNetwork != "" || instance.Subnetwork == "" {
+		return false
+	}
+	if pool.hasAliasNetwork == nil {
+		pool.hasAliasNetwork = map[string]bool{}
+	}
+	has, ok := pool.hasAliasNetwork[instance.Subnetwork]
+	if !ok {
+		_, err := utils.GetSecondaryRange(ctx, instance.Subnetwork, pool.Gcp.AliasNetwork)
+		if err != nil && !errors.Is(err, utils.ErrNoSecondaryRange) {
+			log.Printf("Error getting alias network: %v", err)
+			return false
+		}
+		has = err == nil
+		pool.hasAliasNetwork[instance.Subnetwork] = has
+	}
+	return !has
+}
+
+// isExcluded returns true if the instance is under maintenance. Excluded
+// instances lose their VIPs, and receive no new ones.
+func isExcluded(cfg *Config, instance *utils.GceInstance) bool {
+	return slices.Contains(cfg.Exclude, instance.Name) || cfg.exclusions.Contains(instance.Name)
+}
+
+// outdatedInstances returns instances that run another instance template
+// than the group rolls out, with -current_template_only. As long as no
+// instance runs the current template, none is outdated, so that VIPs stay in
+// place.
+func outdatedInstances(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance) map[string]bool {
+	outdated := map[string]bool{}
+	if !cfg.CurrentTemplateOnly || pool.currentTemplate == "" {
+		return outdated
+	}
+	current := false
+	for name, instance := range instances {
+		if isIgnored(cfg, instance) || instance.Template == "" {
+			continue
+		}
+		if path.Base(instance.Template) == path.Base(pool.currentTemplate) {
+			current = true
+		} else {
+			outdated[name] = true
+		}
+	}
+	if !current {
+		return map[string]bool{}
+	}
+	return outdated
+}
+
+// exportTemplates exports the number of instances per instance template.
+func exportTemplates(pool *Pool, instances map[string]*utils.GceInstance) {
+	templates := map[string]int{}
+	for _, instance := range instances {
+		templates[path.Base(instance.Template)]++
+	}
+	instancesByTemplate.DeletePartialMatch(prometheus.Labels{"pool": pool.Name()})
+	for template, count := range templates {
+		instancesByTemplate.WithLabelValues(pool.Name(), template).Set(float64(count))
+	}
+}
+
+// unhealthyInstances returns the instances failing the health check of the
+// pool. Results are cached for HealthInterval, since a pass looks at the
+// instances several times, but new instances are checked right away.
+func unhealthyInstances(ctx context.Context, cfg *Config, pool *Pool, instances map[string]*utils.GceInstance) map[string]bool {
+	unhealthy := map[string]bool{}
+	for name := range instances {
+		if cfg.faults.IsUnhealthy(name) {
+			unhealthy[name] = true
+		}
+	}
+	for _, name := range trackIncarnations(pool, instances) {
+		// Health of a previous incarnation does not count.
+		delete(pool.healthy, name)
+	}
+	if pool.health == nil {
+		return unhealthy
+	}
+	if pool.healthy == nil {
+		pool.healthy = map[string]bool{}
+	}
+	stale := time.Since(pool.healthChecked) >= HealthInterval
+	check := map[string]*utils.GceInstance{}
+	for name, instance := range instances {
+		if _, ok := pool.healthy[name]; stale || !ok {
+			check[name] = instance
+		}
+	}
+	if stale {
+		pool.healthChecked = time.Now()
+		for name := range pool.healthy {
+			if _, ok := instances[name]; !ok {
+				delete(pool.healthy, name)
+			}
+		}
+	}
+	if len(check) > 0 {
+		for name, err := range probeHealth(ctx, pool, check) {
+			previous, known := pool.healthy[name]
+			if err != nil && (!known || previous) {
+				log.Printf("Instance %s fails health check %s of %s: %v", name, pool.health, pool.Name(), err)
+			} else if err == nil && known && !previous {
+				log.Printf("Instance %s passes health check %s of %s", name, pool.health, pool.Name())
+			}
+			pool.healthy[name] = err == nil
+		}
+	}
+	for name := range instances {
+		if healthy, ok := pool.healthy[name]; ok && !healthy {
+			unhealthy[name] = true
+		}
+	}
+	instancesUnhealthy.WithLabelValues(pool.Name()).Set(float64(len(unhealthy)))
+	return unhealthy
+}
+
+// Incarnation identifies a run of an instance. The ID changes when an
+// instance is recreated with the same name, the start time when the same
+// instance is started again.
+type Incarnation struct {
+	Id      uint64
+	Started string
+}
+
+// trackIncarnations compares instances with their last seen incarnation, and
+// returns the names of instances that restarted or were recreated since.
+func trackIncarnations(pool *Pool, instances map[string]*utils.GceInstance) (changed []string) {
+	if pool.incarnations == nil {
+		pool.incarnations = map[string]Incarnation{}
+	}
+	for name := range pool.incarnations {
+		if _, ok := instances[name]; !ok {
+			delete(pool.incarnations, name)
+		}
+	}
+	for name, instance := range instances {
+		current := Incarnation{Id: instance.Id, Started: instance.Started}
+		previous, known := pool.incarnations[name]
+		pool.incarnations[name] = current
+		switch {
+		case !known || previous == current:
+			continue
+		case previous.Id != current.Id:
+			log.Printf("Instance %s of %s was recreated at %s", name, pool.Name(), instance.Created)
+			instanceRestarts.WithLabelValues(pool.Name(), "recreated").Inc()
+		default:
+			log.Printf("Instance %s of %s was restarted at %s", name, pool.Name(), instance.Started)
+			instanceRestarts.WithLabelValues(pool.Name(), "restarted").Inc()
+		}
+		changed = append(changed, name)
+	}
+	return changed
+}
+
+// probeHealth checks instances in parallel. Returns nil errors for healthy
+// instances. Instances are left out if their state is unknown.
+func probeHealth(ctx context.Context, pool *Pool, instances map[string]*utils.GceInstance) map[string]error {
+	results := map[string]error{}
+	if pool.health.Type == utils.HealthGce {
+		if pool.RegisteredOnly {
+			return results
+		}
+		states, err := utils.GetManagedInstanceHealth(ctx, pool.Gcp)
+		if err != nil {
+			log.Printf("Error getting health of instances: %v", err)
+			return results
+		}
+		for name := range instances {
+			if healthy, ok := states[name]; ok && !healthy {
+				results[name] = errors.New("not HEALTHY in instance group")
+			} else if ok {
+				results[name] = nil
+			}
+		}
+		return results
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, instance := range instances {
+		wg.Add(1)
+		go func(name, ip string) {
+			defer wg.Done()
+			err := errors.New("no network IP")
+			if ip != "" {
+				err = pool.health.Probe(ip)
+			}
+			mu.Lock()
+			results[name] = err
+			mu.Unlock()
+		}(name, instance.NetworkIp)
+	}
+	wg.Wait()
+	return results
+}
+
+// managedInstances filters out ignored, excluded, cordoned, outdated and
+// unhealthy instances, and instances lacking the alias network of the pool.
+// The latter are reported once.
+func managedInstances(ctx context.Context, cfg *Config, pool *Pool, instances map[string]*utils.GceInstance) map[string]*utils.GceInstance {
+	managed := map[string]*utils.GceInstance{}
+	missing := map[string]bool{}
+	outdated := outdatedInstances(cfg, pool, instances)
+	unhealthy := unhealthyInstances(ctx, cfg, pool, instances)
+	for name, instance := range instances {
+		if lacksAliasNetwork(ctx, pool, instance) {
+			if !pool.missingAliasNetwork[name] {
+				subnetwork := instance.Subnetwork
+				if pool.Gcp.Subnetwork != "" {
+					subnetwork = pool.Gcp.Subnetwork
+				}
+				log.Printf("Warning: instance %s has no alias network %s in subnetwork %s, excluded from %s",
+					name, pool.Gcp.AliasNetwork, subnetwork, pool.Name())
+			}
+			missing[name] = true
+			continue
+		}
+		if !isIgnored(cfg, instance) && !isExcluded(cfg, instance) && !isCordoned(cfg, instance) && !isTerminating(cfg, instance) && !outdated[name] && !unhealthy[name] && !isStarting(cfg, instance) && pool.yielded[name] == "" {
+			managed[name] = instance
+		}
+	}
+	states := map[string]string{}
+	for name, instance := range instances {
+		states[name] = instanceState(cfg, instance, missing[name], outdated[name], unhealthy[name])
+		if pool.yielded[name] != "" && states[name] == "ok" {
+			states[name] = "yielded"
+		}
+	}
+	pool.statusMu.Lock()
+	pool.status.States = states
+	pool.statusMu.Unlock()
+	pool.missingAliasNetwork = missing
+	instancesMissingAliasNetwork.WithLabelValues(pool.Name()).Set(float64(len(missing)))
+	return managed
+}
+
+// instanceState describes why an instance can take VIPs or not: "ok",
+// "missing_alias_network", "ignored", "excluded", "terminating", "cordoned",
+// "outdated", "unhealthy" or "starting".
+func instanceState(cfg *Config, instance *utils.GceInstance, missing, outdated, unhealthy bool) string {
+	switch {
+	case missing:
+		return "missing_alias_network"
+	case isIgnored(cfg, instance):
+		return "ignored"
+	case isExcluded(cfg, instance):
+		return "excluded"
+	case isTerminating(cfg, instance):
+		return "terminating"
+	case isCordoned(cfg, instance):
+		return "cordoned"
+	case outdated:
+		return "outdated"
+	case unhealthy:
+		return "unhealthy"
+	case isStarting(cfg, instance):
+		return "starting"
+	}
+	return "ok"
+}
+
+// isStarting returns true if the instance started, or was created, less than
+// -startup_grace ago, according to its provider.
+func isStarting(cfg *Config, instance *utils.GceInstance) bool {
+	if cfg.StartupGrace == 0 {
+		return false
+	}
+	started := instance.Started
+	if started == "" {
+		started = instance.Created
+	}
+	t, err := time.Parse(time.RFC3339, started)
+	if err != nil {
+		return false
+	}
+	return time.Since(t) < time.Duration(cfg.StartupGrace)*time.Second
+}
+
+// belowCap returns true if an instance may receive another alias IP.
+func belowCap(cfg *Config, ips int) bool {
+	return cfg.MaxIpsPerInstance == 0 || ips < int(cfg.MaxIpsPerInstance)
+}
+
+// pinnedTo returns the instance a VIP is pinned to, through the admin API, or
+// else in the configuration file.
+func pinnedTo(cfg *Config, pool *Pool, ip string) (string, bool) {
+	if instance, ok := cfg.pins.Get(pool.Name(), ip); ok {
+		return instance, true
+	}
+	instance, ok := pool.pins[ip]
+	return instance, ok
+}
+
+// allPins returns the effective pins of a pool.
+func allPins(cfg *Config, pool *Pool) []Pin {
+	pins := cfg.pins.List(pool.Name())
+	for ip, instance := range pool.pins {
+		if _, ok := cfg.pins.Get(pool.Name(), ip); !ok {
+			pins = append(pins, Pin{Pool: pool.Name(), Vip: ip, Instance: instance, Source: "config"})
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Vip < pins[j].Vip })
+	return pins
+}
+
+// instanceWeight returns the relative capacity of an instance: the weight
+// label, the registered weight, or with -weight_by_cpus its number of vCPUs.
+// Defaults to 1.
+func instanceWeight(cfg *Config, instance *utils.GceInstance) float64 {
+	if value, ok := instance.Labels[cfg.WeightLabel]; ok && cfg.WeightLabel != "" {
+		if weight, err := strconv.ParseFloat(value, 64); err == nil && weight > 0 {
+			return weight
+		}
+	}
+	if registration, ok := cfg.registry.Get(instance.Name); ok && registration.Weight > 0 {
+		return registration.Weight
+	}
+	if cfg.WeightByCpus && instance.MachineType != "" {
+		cpus, err := utils.GetMachineTypeCpus(context.Background(), instance.MachineType)
+		if err != nil {
+			log.Printf("Error getting vCPUs of %s: %v", instance.Name, err)
+		} else if cpus > 0 {
+			return float64(cpus)
+		}
+	}
+	return 1
+}
+
+func instanceWeights(cfg *Config, instances map[string]*utils.GceInstance) map[string]float64 {
+	weights := map[string]float64{}
+	for name, instance := range instances {
+		weights[name] = instanceWeight(cfg, instance)
+		if cfg.self != nil && name == cfg.self.Instance {
+			weights[name] *= cfg.SelfWeight
+		}
+	}
+	return weights
+}
+
+// leastLoaded returns the instance below the cap which is the best home for
+// one more IP, considering its weight, or "" if all are at the cap.
+func leastLoaded(cfg *Config, instances map[string]*utils.GceInstance, weights map[string]float64, operations map[string]utils.Operation) string {
+	// With -spread_zones or -spread_hosts, pick the least loaded zone, and
+	// host, first.
+	domains := failureDomains(cfg)
+	domainIps, domainWeights := map[string]int{}, map[string]float64{}
+	for name, instance := range instances {
+		for _, domain := range domains {
+			key := domain(instance)
+			domainIps[key] += len(*instance.AliasIps) + len(operations[name].Ips)
+			domainWeights[key] += weights[name]
+		}
+	}
+	best := ""
+	var bestLoads []float64
+	for name, instance := range instances {
+		ips := len(*instance.AliasIps) + len(operations[name].Ips)
+		if !belowCap(cfg, ips) {
+			continue
+		}
+		loads := []float64{}
+		for _, domain := range domains {
+			key := domain(instance)
+			loads = append(loads, (float64(domainIps[key])+0.5)/domainWeights[key])
+		}
+		loads = append(loads, (float64(ips)+0.5)/weights[name])
+		if best == "" || slices.Compare(loads, bestLoads) < 0 {
+			best = name
+			bestLoads = loads
+		}
+	}
+	return best
+}
+
+func GetSpareIps(pool *Pool, instances map[string]*utils.GceInstance) []string {
+	used := map[string]bool{}
+	for _, ip := range pool.VIPs {
+		used[ip] = false
+	}
+	for _, instance := range instances {
+		for _, ip := range *instance.AliasIps {
+			if _, ok := used[ip]; ok {
+				used[ip] = true
+			}
+		}
+	}
+	spare := []string{}
+	for ip, inuse := range used {
+		if !inuse {
+			spare = append(spare, ip)
+		}
+	}
+	if len(spare) > 0 {
+		log.Printf("Spare IPs in %s: %v", pool.Name(), spare)
+	}
+	return spare
+}
+
+// exportUtilization exports how much of the pool is in use, and how many
+// addresses the alias network has. The latter is looked up once.
+func exportUtilization(ctx context.Context, pool *Pool, instances map[string]*utils.GceInstance, spare []string) {
+	poolVips.WithLabelValues(pool.Name()).Set(float64(len(pool.VIPs)))
+	poolVipsAssigned.WithLabelValues(pool.Name()).Set(float64(len(pool.VIPs) - len(spare)))
+	poolVipsSpare.WithLabelValues(pool.Name()).Set(float64(len(spare)))
+	instanceVips.DeletePartialMatch(prometheus.Labels{"pool": pool.Name()})
+	for name, instance := range withPoolIps(pool, instances) {
+		instanceVips.WithLabelValues(pool.Name(), name).Set(float64(len(*instance.AliasIps)))
+	}
+	if pool.rangeSize > 0 {
+		return
+	}
+	for _, instance := range instances {
+		subnetwork := instance.Subnetwork
+		if pool.Gcp.Subnetwork != "" {
+			subnetwork = pool.Gcp.Subnetwork
+		}
+		cidr, err := utils.GetAliasRange(ctx, pool.Gcp, subnetwork)
+		if err != nil {
+			log.Printf("Error getting alias network size: %v", err)
+			return
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Printf("Error parsing alias network %s: %v", cidr, err)
+			return
+		}
+		pool.rangeSize = 1 << (prefix.Addr().BitLen() - prefix.Bits())
+		pool.rangeCidr = cidr
+		pool.subnetwork = subnetwork
+		aliasRangeAddresses.WithLabelValues(pool.Name(), cidr).Set(float64(pool.rangeSize))
+		return
+	}
+}
+
+// ProposeExpansion proposes a twice as large alias network, when the pool
+// VIPs use more than -expansion_threshold of it. The proposal is logged, and
+// posted to -expansion_webhook, once.
+func ProposeExpansion(cfg *Config, pool *Pool) {
+	if cfg.ExpansionThreshold <= 0 || pool.rangeSize == 0 {
+		return
+	}
+	utilization := float64(pool.addresses()) / float64(pool.rangeSize)
+	if utilization < cfg.ExpansionThreshold {
+		return
+	}
+	prefix, err := netip.ParsePrefix(pool.rangeCidr)
+	if err != nil || prefix.Bits() == 0 {
+		return
+	}
+	suggested, err := prefix.Addr().Prefix(prefix.Bits() - 1)
+	if err != nil {
+		return
+	}
+	proposal := &ExpansionProposal{
+		Pool:          pool.Name(),
+		Subnetwork:    pool.subnetwork,
+		RangeName:     pool.Gcp.AliasNetwork,
+		CurrentCidr:   pool.rangeCidr,
+		SuggestedCidr: suggested.String(),
+		Utilization:   utilization,
+	}
+	if pool.proposal != nil && *pool.proposal == *proposal {
+		return
+	}
+	pool.proposal = proposal
+	log.Printf("Proposal: pool %s uses %.0f%% of alias network %s (%s). Consider expanding it to %s in subnetwork %s.",
+		proposal.Pool, 100*utilization, proposal.RangeName, proposal.CurrentCidr, proposal.SuggestedCidr, proposal.Subnetwork)
+	if cfg.ExpansionWebhook != "" {
+		if err := utils.PostJSON(cfg.ExpansionWebhook, proposal); err != nil {
+			log.Printf("Error posting expansion proposal: %v", err)
+		}
+	}
+}
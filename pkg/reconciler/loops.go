@@ -0,0 +1,393 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The reconcile loops of the instance groups, and what wakes them up.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Reconcile runs the main logic for one instance group, forever:
+// 1. Allocate unused / spare IPs.
+// 2. Remove IPs from nodes with too many IPs.
+// 3. Sleep when there is nothing to do.
+// Pools are reconciled one at a time, since they share network interfaces.
+// Returns when stop is closed, after completing the current pass.
+func Reconcile(ctx context.Context, cfg *Config, group *Group, stop <-chan struct{}) {
+	for _, pool := range group.Pools {
+		PrintInstances(ctx, cfg, pool)
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if cfg.lease != nil && !cfg.lease.IsLeader() {
+			// Hot standby: only the leader reconciles.
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		for name := range group.takeRefresh() {
+			log.Printf("Refresh instance %s", name)
+			for _, pool := range group.Pools {
+				delete(pool.healthy, name)
+			}
+		}
+		changes := 0
+		start := time.Now()
+		for _, pool := range group.Pools {
+			poolChanges := ReconcilePool(ctx, cfg, pool)
+			if poolChanges > 0 {
+				PrintInstances(ctx, cfg, pool)
+			}
+			DetectAnomalies(ctx, cfg, pool)
+			AggregateConnections(ctx, cfg, pool)
+			changes += poolChanges
+		}
+		RecommendSize(ctx, cfg, group)
+		reconcileDuration.WithLabelValues(group.Name).Observe(time.Since(start).Seconds())
+		// After changes, pass again soon, to follow up on them.
+		wait := time.Duration(cfg.ActiveSeconds) * time.Second
+		if changes == 0 {
+			wait = idleSleep(cfg, group)
+		}
+		if wait > 0 {
+			select {
+			case <-stop:
+				return
+			case <-group.wake:
+			case <-time.After(utils.Jitter(wait, cfg.Jitter)):
+			}
+		}
+	}
+}
+
+// idleSleep returns how long a loop waits for a wake up when there is nothing
+// to do: -idle_interval, or with -watch, -resync. Groups that only notice
+// failures, expired registrations, the end of startup grace periods or
+// drained connections in passes keep passing every -idle_interval. While GCE API calls keep failing,
+// loops back off up to -api_backoff_max.
+func idleSleep(cfg *Config, group *Group) time.Duration {
+	sleep := time.Duration(cfg.SleepSeconds) * time.Second
+	if backoff := utils.FailureBackoff(); backoff > sleep {
+		sleep = backoff
+	}
+	if cfg.Watch == "" || cfg.RegistrationToken != "" {
+		return sleep
+	}
+	for _, pool := range group.Pools {
+		if pool.health != nil || pool.vipCheck != nil || len(pool.pair) > 0 || pool.RegisteredOnly {
+			return sleep
+		}
+		// Nothing announces the end of a startup grace period, or drained
+		// connections.
+		if slices.Contains(maps.Values(pool.Status().States), "starting") || len(pool.drainSince) > 0 {
+			return sleep
+		}
+	}
+	return time.Duration(cfg.ResyncSeconds) * time.Second
+}
+
+// WatchChanges wakes up the reconcile loops of groups with changed instances
+// or instance groups, see -watch, until ctx is canceled.
+func WatchChanges(ctx context.Context, cfg *Config) {
+	changed := func(change utils.Change) {
+		for _, group := range cfg.active.Load().Groups {
+			if group.affectedBy(change) {
+				log.Printf("Wake up %s: %v changed", group.Name, change)
+				group.Wake()
+			}
+		}
+	}
+	switch cfg.Watch {
+	case WatchAssetFeed:
+		go utils.WatchAssetFeed(cfg.WatchSubscription, changed)
+	case WatchOperations:
+		go func() {
+			watcher := utils.NewOperationWatcher()
+			for {
+				projects := map[string]bool{}
+				for _, group := range cfg.active.Load().Groups {
+					for _, pool := range group.Pools {
+						projects[pool.Gcp.Project] = true
+					}
+				}
+				for project := range projects {
+					changes, err := watcher.Poll(ctx, project)
+					if err != nil {
+						log.Printf("%v", err)
+						continue
+					}
+					for _, change := range changes {
+						changed(change)
+					}
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(WatchInterval):
+				}
+			}
+		}()
+	}
+}
+
+// RunLoops runs one reconcile loop per instance group. On reload, e.g. on
+// SIGHUP, the configuration is reloaded, and if valid, the loops are
+// restarted with the new groups, which triggers an immediate reconcile. When
+// done is canceled, e.g. on SIGTERM, the loops stop starting new operations,
+// and RunLoops returns once in-flight operations completed, or
+// -shutdown_timeout passed.
+func RunLoops(done context.Context, cfg *Config, reload <-chan struct{}) {
+	// Canceled when in-flight operations outlast -shutdown_timeout. Not
+	// derived from done, so that operations in flight complete on shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		// The workers are shared by all loops.
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for _, group := range cfg.Groups {
+			wg.Add(1)
+			go func(group *Group) {
+				defer wg.Done()
+				Reconcile(ctx, cfg, group, stop)
+			}(group)
+		}
+		var newCfg *Config
+		for newCfg == nil {
+			select {
+			case <-done.Done():
+			case <-reload:
+				var err error
+				newCfg, err = reloadConfig(cfg)
+				if err != nil {
+					log.Printf("Error reloading configuration, keeping the current one: %v", err)
+				}
+				continue
+			case configs := <-cfg.vipPoolUpdates:
+				var err error
+				newCfg, err = withGroupConfigs(cfg, configs)
+				if err != nil {
+					log.Printf("Error applying VIPPools, keeping the current ones: %v", err)
+				}
+				continue
+			}
+			log.Printf("Stop reconciling, wait for in-flight operations to complete.")
+			close(stop)
+			if !waitTimeout(&wg, time.Duration(cfg.ShutdownSeconds)*time.Second) {
+				log.Printf("Gave up waiting for in-flight operations after %d seconds.", cfg.ShutdownSeconds)
+				cancel()
+				return
+			}
+			if cfg.DrainOnShutdown && (cfg.lease == nil || cfg.lease.IsLeader()) {
+				DrainCordoned(ctx, cfg)
+			}
+			log.Printf("Stop VIP Manager.")
+			return
+		}
+		log.Printf("Reload configuration, wait for current passes to complete.")
+		close(stop)
+		wg.Wait()
+		keepPoolState(newCfg.Groups, cfg.Groups)
+		cfg = newCfg
+		cfg.active.Store(cfg)
+		PrintConfig(cfg)
+	}
+}
+
+// withGroupConfigs returns the configuration with other groups.
+func withGroupConfigs(cfg *Config, configs []GroupConfig) (*Config, error) {
+	newCfg := *cfg
+	newCfg.GroupConfigs = configs
+	groups, err := buildGroups(&newCfg, configs)
+	if err != nil {
+		return nil, err
+	}
+	newCfg.Groups = groups
+	return &newCfg, nil
+}
+
+// vipPoolConfigs returns a group configuration per VIPPool resource, named
+// after the resource, and the errors of VIPPools that are not valid, by
+// name, which are left out.
+func vipPoolConfigs(cfg *Config, vipPools []utils.VipPool) ([]GroupConfig, map[string]string) {
+	configs := []GroupConfig{}
+	invalid := map[string]string{}
+	for _, vipPool := range vipPools {
+		selector := []string{}
+		for key, value := range vipPool.Spec.NodeSelector {
+			selector = append(selector, key+"="+value)
+		}
+		sort.Strings(selector)
+		config := GroupConfig{
+			Name:         vipPool.Metadata.Name,
+			NodeSelector: strings.Join(selector, ","),
+			Pools: []PoolConfig{{
+				AliasNetwork: vipPool.Spec.AliasRangeName,
+				VIPs:         []string{vipPool.Spec.Cidr},
+			}},
+		}
+		var err error
+		if config.NodeSelector == "" {
+			err = errors.New("spec.nodeSelector: missing node labels")
+		} else {
+			_, err = buildGroups(cfg, []GroupConfig{config})
+		}
+		if err != nil {
+			invalid[vipPool.Metadata.Name] = err.Error()
+			continue
+		}
+		configs = append(configs, config)
+	}
+	return configs, invalid
+}
+
+// WatchVipPools lists the VIPPool resources every idle interval, applies
+// changes to them, and reports the status of each pool in its resource,
+// until ctx is canceled.
+func WatchVipPools(ctx context.Context, cfg *Config) {
+	last := cfg.active.Load().GroupConfigs
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(cfg.SleepSeconds) * time.Second):
+		}
+		vipPools, err := utils.ListVipPools(ctx)
+		if err != nil {
+			log.Printf("Error watching VIPPools: %v", err)
+			continue
+		}
+		configs, invalid := vipPoolConfigs(cfg, vipPools)
+		if !reflect.DeepEqual(configs, last) {
+			log.Printf("VIPPools changed, %d valid, %d invalid", len(configs), len(invalid))
+			select {
+			case cfg.vipPoolUpdates <- configs:
+			case <-ctx.Done():
+				return
+			}
+			last = configs
+		}
+		groups := map[string]*Group{}
+		for _, group := range cfg.active.Load().Groups {
+			groups[group.Name] = group
+		}
+		for _, vipPool := range vipPools {
+			name := vipPool.Metadata.Name
+			status := utils.VipPoolStatus{ObservedGeneration: vipPool.Metadata.Generation, Error: invalid[name]}
+			if group, ok := groups[name]; ok && len(group.Pools) > 0 {
+				pool := group.Pools[0]
+				pool.statusMu.Lock()
+				status.Vips = len(pool.VIPs)
+				status.Spare = pool.status.Spare
+				status.Assignments = pool.status.Assignments
+				status.LastReconcile = pool.status.LastReconcile
+				pool.statusMu.Unlock()
+				for _, vips := range status.Assignments {
+					status.Assigned += len(vips)
+				}
+			}
+			if err := utils.SetVipPoolStatus(ctx, name, status); err != nil {
+				log.Printf("Error reporting VIPPool status: %v", err)
+			}
+		}
+	}
+}
+
+// WatchQuotas exports the GCE quotas of the projects and regions of all
+// pools, every -quota_interval, and warns about quotas that are nearly used
+// up, by vip_manager or by other automation, until ctx is canceled.
+func WatchQuotas(ctx context.Context, cfg *Config) {
+	for {
+		checked := map[string]bool{}
+		for _, group := range cfg.active.Load().Groups {
+			for _, pool := range group.Pools {
+				key := pool.Gcp.Project + "/" + pool.Gcp.Region + "/" + pool.Gcp.Zone
+				if checked[key] {
+					continue
+				}
+				checked[key] = true
+				quotas, err := utils.GetQuotas(ctx, pool.Gcp)
+				if err != nil {
+					log.Printf("Error getting quotas: %v", err)
+					continue
+				}
+				for _, q := range quotas {
+					gceQuotaLimit.WithLabelValues(q.Scope, q.Metric).Set(q.Limit)
+					gceQuotaHeadroom.WithLabelValues(q.Scope, q.Metric).Set(q.Limit - q.Usage)
+					if q.Limit > 0 && q.Usage > 0 && q.Limit-q.Usage < cfg.QuotaWarning*q.Limit {
+						log.Printf("Warning: quota %s in %s of project %s is nearly used up: %.0f of %.0f",
+							q.Metric, q.Scope, pool.Gcp.Project, q.Usage, q.Limit)
+					}
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(cfg.QuotaSeconds) * time.Second):
+		}
+	}
+}
+
+// waitTimeout waits for the wait group. Returns false on timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// DrainCordoned removes all pool VIPs from cordoned instances, so that
+// another replica can place them elsewhere.
+func DrainCordoned(ctx context.Context, cfg *Config) {
+	for _, group := range cfg.Groups {
+		for _, pool := range group.Pools {
+			instances, err := GetInstances(ctx, cfg, pool)
+			if err != nil {
+				log.Printf("Error getting instances: %v", err)
+				continue
+			}
+			removePoolIps(ctx, cfg, pool, instances, func(instance *utils.GceInstance) bool {
+				return isCordoned(cfg, instance) && !isIgnored(cfg, instance)
+			}, ClassEvacuate)
+		}
+	}
+}
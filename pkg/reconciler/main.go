@@ -0,0 +1,510 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// VIP Manager is a utility to manage a set of virtual ("alias") IPs with a
+// GCE Managed Instance Group. The vip_manager binary runs Main, other
+// programs can embed a Reconciler instead.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/client"
+	"github.com/bjornleffler/loadbalancing/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Subcommands. Without one, vip_manager runs.
+const (
+	CommandRun       = "run"
+	CommandStatus    = "status"
+	CommandReconcile = "reconcile"
+	CommandDrain     = "drain"
+	CommandValidate  = "validate-config"
+	CommandAlerts    = "alert-rules"
+	CommandHistory   = "history"
+	CommandPin       = "pin"
+	CommandPlan      = "plan"
+)
+
+const usage = `Usage: vip_manager [COMMAND] [FLAGS] [ARGS]
+
+Commands:
+  run                  Manage VIPs until stopped (default).
+  status               Show the status of a running vip_manager (-manager).
+  reconcile            Ask a running vip_manager to reconcile now.
+  reconcile -once      Reconcile once, print the outcome, and exit.
+  plan                 Show what a reconcile pass would change, and the
+                       resulting VIPs per instance, without changing it.
+  drain [-undo] NAME   Exclude an instance on a running vip_manager, or end
+                       the exclusion with -undo.
+  history IP           Show the recent changes of a VIP on a running
+                       vip_manager.
+  pin [-undo] IP NAME  Pin a VIP to an instance on a running vip_manager, or
+                       unpin it with -undo.
+  validate-config      Check flags and -config, and exit.
+  alert-rules          Print Prometheus alerting rules for the configured
+                       pools.
+
+Flags:
+`
+
+// setup connects to GCP, checks the configuration, and loads the intent.
+func setup(cfg *Config) error {
+	utils.SetCallTimeout(time.Duration(cfg.ApiTimeoutSeconds) * time.Second)
+	utils.SetImpersonation(cfg.ImpersonateServiceAccount)
+	switch cfg.Provider {
+	case ProviderAws:
+		utils.UseAws()
+	case ProviderStatic:
+		if err := utils.UseStatic(cfg.Inventory, cfg.AgentToken); err != nil {
+			return fmt.Errorf("Error loading inventory: %v", err)
+		}
+	default:
+		if cfg.Self {
+			if err := chooseSelf(cfg); err != nil {
+				return err
+			}
+		}
+		utils.SetRetryPolicy(utils.RetryPolicy{
+			Attempts: int(cfg.ApiAttempts),
+			Base:     utils.DefaultRetryPolicy.Base,
+			Max:      time.Duration(cfg.ApiBackoffSeconds) * time.Second,
+			Budget:   cfg.ApiErrorBudget,
+		})
+		utils.SetApiRateLimit(cfg.ApiQps, int(cfg.ApiBurst))
+		if err := utils.ConnectCompute(context.Background()); err != nil {
+			return err
+		}
+		utils.ChooseProject(context.Background(), cfg.Gcp)
+		utils.ChooseZone(cfg.Gcp)
+		if cfg.Provider == ProviderForwarding {
+			utils.UseForwarding()
+		}
+	}
+	connectKube := cfg.KubeController || strings.HasPrefix(cfg.LeaderLease, KubeLeasePrefix)
+	for _, config := range cfg.GroupConfigs {
+		connectKube = connectKube || config.NodeSelector != ""
+	}
+	if connectKube {
+		utils.ConnectKube()
+	}
+	if cfg.KubeController {
+		vipPools, err := utils.ListVipPools(context.Background())
+		if err != nil {
+			return err
+		}
+		cfg.GroupConfigs, _ = vipPoolConfigs(cfg, vipPools)
+	}
+	if err := checkArgs(cfg); err != nil {
+		return err
+	}
+	for _, group := range cfg.Groups {
+		if len(group.Pools) > 0 && group.Pools[0].Gcp.NodePool != "" {
+			utils.ConnectGke()
+			break
+		}
+	}
+	if cfg.PubSubTopic != "" {
+		if !strings.HasPrefix(cfg.PubSubTopic, "projects/") {
+			cfg.PubSubTopic = "projects/" + cfg.Gcp.Project + "/topics/" + cfg.PubSubTopic
+		}
+		utils.ConnectPubSub(cfg.PubSubTopic)
+	}
+	if cfg.AuditLog != "" {
+		if err := utils.OpenAuditLog(cfg.AuditLog, cfg.Gcp.Project); err != nil {
+			return fmt.Errorf("Error opening audit log %s: %v", cfg.AuditLog, err)
+		}
+	}
+	utils.SetWriteQuota(cfg.WriteQuota)
+	utils.StartWorkers(cfg.Workers)
+	PrintConfig(cfg)
+	if _, _, ok := utils.ParseGcsUrl(cfg.IntentState); ok || cfg.StateBucket != "" || strings.HasPrefix(cfg.LeaderLease, "gs://") {
+		utils.ConnectStorage()
+	}
+	intent, err := utils.LoadIntent(cfg.IntentState)
+	if err != nil {
+		return fmt.Errorf("Error loading intent from %s: %v", cfg.IntentState, err)
+	}
+	cfg.intent = intent
+	intent.SetHistoryLimit(int(cfg.VipHistory))
+	utils.TrackHistory(intent)
+	cfg.active.Store(cfg)
+	return nil
+}
+
+// handleSignals cancels the context of the binary on SIGTERM or SIGINT, and
+// returns a channel that receives on SIGHUP, to reload the configuration.
+// Signals that arrive during a reload are coalesced.
+func handleSignals(cancel context.CancelFunc) <-chan struct{} {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reload := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case sig := <-term:
+				log.Printf("Received %v, stop VIP Manager.", sig)
+				cancel()
+			case <-hup:
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return reload
+}
+
+// run runs vip_manager until stopped, and returns why it stopped early: an
+// invalid configuration, or a server that failed.
+func run(cfg *Config) error {
+	// Configure and print initial state.
+	log.Printf("Start VIP Manager.")
+	if err := setup(cfg); err != nil {
+		return err
+	}
+	if cfg.DnsImport != "" {
+		utils.ConnectDns()
+		return ImportDnsRecords(cfg)
+	}
+	if cfg.MaintenanceTxt || cfg.DnsSync {
+		utils.ConnectDns()
+	}
+
+	HandleRegister(cfg)
+	HandleInstances(cfg)
+	HandleClient(cfg)
+	HandleQuarantine(cfg)
+	HandleFailovers(cfg)
+	HandleVips(cfg)
+	HandleStatus(cfg)
+	HandlePlan(cfg)
+	HandleGuardrail(cfg)
+	HandleProbes(cfg)
+	if cfg.FaultInjection {
+		HandleFaults(cfg)
+	}
+	// Metrics about the process itself, in addition to the defaults (CPU,
+	// RSS, open fds, goroutines): GC and scheduler details.
+	prometheus.Unregister(collectors.NewGoCollector())
+	prometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsScheduler),
+	))
+	http.Handle("/metrics", promhttp.Handler())
+	// A server that fails stops the loops, like SIGTERM.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := handleSignals(cancel)
+	if cfg.Serverless {
+		return ServeReconcile(ctx, cfg, reload)
+	}
+	HandleWake(cfg)
+	failed := make(chan error, 2)
+	serve := func(server func() error) {
+		go func() {
+			failed <- server()
+			cancel()
+		}()
+	}
+	if cfg.Listen != "" {
+		serve(func() error {
+			return http.ListenAndServe(cfg.Listen, nil)
+		})
+	}
+	if cfg.GrpcListen != "" {
+		serve(func() error {
+			return ServeGrpc(cfg)
+		})
+	}
+	if cfg.QuotaSeconds > 0 {
+		go WatchQuotas(ctx, cfg)
+	}
+	if cfg.DnsSync {
+		go SyncDns(ctx, cfg)
+	}
+	if cfg.KubeController {
+		go WatchVipPools(ctx, cfg)
+	}
+	if cfg.Watch != "" {
+		WatchChanges(ctx, cfg)
+	}
+
+	if cfg.lease != nil {
+		cfg.lease.Run(ctx)
+	}
+	RunLoops(ctx, cfg, reload)
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
+	}
+}
+
+// alertRules is a Prometheus rule file, with a rule group per instance group.
+var alertRules = template.Must(template.New("alert_rules").Parse(`# Generated by vip_manager alert-rules.
+groups:
+{{- range .Groups}}
+- name: vip_manager {{.Name}}
+  rules:
+  - alert: VipManagerReconcileStuck
+    expr: 'increase(vip_manager_reconcile_duration_seconds_count{group="{{.Name}}"}[{{$.StuckMinutes}}m]) == 0'
+    for: 5m
+    labels:
+      severity: critical
+    annotations:
+      summary: 'vip_manager has not reconciled instance group {{.Name}} for {{$.StuckMinutes}} minutes.'
+{{- range .Pools}}
+  - record: vip_manager:pool_imbalance
+    expr: 'max(vip_manager_instance_vips{pool="{{.}}"}) - min(vip_manager_instance_vips{pool="{{.}}"})'
+    labels:
+      pool: '{{.}}'
+  - alert: VipManagerUnassignedVips
+    expr: 'vip_manager_pool_vips_spare{pool="{{.}}"} > 0'
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: '{{"{{"}} $value {{"}}"}} virtual IPs of pool {{.}} are not assigned to any instance.'
+{{- if $.Balanced}}
+  - alert: VipManagerImbalance
+    expr: 'vip_manager:pool_imbalance{pool="{{.}}"} > {{$.MaxImbalance}}'
+    for: 30m
+    labels:
+      severity: warning
+    annotations:
+      summary: 'The most and least loaded instances of pool {{.}} differ by {{"{{"}} $value {{"}}"}} virtual IPs.'
+{{- end}}
+  - alert: VipManagerDuplicateVips
+    expr: 'increase(vip_manager_duplicate_vips_total{pool="{{.}}"}[15m]) > 0'
+    labels:
+      severity: critical
+    annotations:
+      summary: 'Virtual IPs of pool {{.}} were found on more than one instance.'
+{{- if $.StrayAlert}}
+  - alert: VipManagerStrayAliasIps
+    expr: 'vip_manager_pool_stray_ips{pool="{{.}}"} > 0'
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: '{{"{{"}} $value {{"}}"}} alias IPs in the alias network of pool {{.}} are not VIPs of the pool.'
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .ExporterJob}}
+- name: metrics_exporter
+  rules:
+  - alert: MetricsExporterDown
+    expr: 'up{job="{{.ExporterJob}}"} == 0'
+    for: 5m
+    labels:
+      severity: warning
+    annotations:
+      summary: 'metrics_exporter on {{"{{"}} $labels.instance {{"}}"}} is down, so vip_manager can not use it.'
+{{- end}}
+`))
+
+// PrintAlertRules writes Prometheus alerting and recording rules for the
+// configured pools: unassigned VIPs, stuck reconcile loops, imbalance, VIPs
+// on several instances, stray alias IPs with -stray_policy alert, and
+// metrics_exporter being down, if
+// vip_manager uses it.
+func PrintAlertRules(w io.Writer, cfg *Config) error {
+	type group struct {
+		Name  string
+		Pools []string
+	}
+	data := struct {
+		Groups []group
+		// A reconcile pass normally runs at least every -idle_interval seconds.
+		StuckMinutes int
+		Balanced     bool
+		MaxImbalance float64
+		StrayAlert   bool
+		ExporterJob  string
+	}{
+		StuckMinutes: int(math.Max(15, math.Ceil(float64(10*cfg.SleepSeconds)/60))),
+		Balanced:     cfg.Placement == PlacementBalanced && !cfg.WeightByCpus,
+		MaxImbalance: cfg.MinImbalance + 1,
+		StrayAlert:   cfg.StrayPolicy == StrayAlert,
+	}
+	if cfg.RebalancePort != 0 || cfg.Gcp.VerifyPort != 0 {
+		data.ExporterJob = cfg.ExporterJob
+	}
+	for _, g := range cfg.Groups {
+		pools := []string{}
+		for _, pool := range g.Pools {
+			pools = append(pools, pool.Name())
+		}
+		data.Groups = append(data.Groups, group{Name: g.Name, Pools: pools})
+	}
+	return alertRules.Execute(w, data)
+}
+
+// adminClient returns a client for the admin API of the running vip_manager
+// at -manager.
+func adminClient(cfg *Config) *client.Client {
+	return client.New(cfg.Manager, cfg.AdminToken)
+}
+
+// Main runs the vip_manager command line: the command in os.Args, "run" by
+// default, with the flags that follow. It exits on errors.
+func Main() {
+	command := CommandRun
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	parse := func() *Config {
+		cfg, err := parseArgs(args)
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return cfg
+	}
+	switch command {
+	case CommandRun:
+		if err := run(parse()); err != nil {
+			log.Fatal(err)
+		}
+	case CommandStatus:
+		cfg := parse()
+		pools, err := adminClient(cfg).Status(context.Background(), "", cfg.Verbose)
+		if err != nil {
+			log.Fatalf("Error getting status: %v", err)
+		}
+		data, _ := json.MarshalIndent(pools, "", "  ")
+		fmt.Println(string(data))
+	case CommandReconcile:
+		cfg := parse()
+		if !cfg.Once {
+			if err := adminClient(cfg).Reconcile(context.Background()); err != nil {
+				log.Fatalf("Error starting reconcile pass: %v", err)
+			}
+			return
+		}
+		if err := setup(cfg); err != nil {
+			log.Fatal(err)
+		}
+		state := ReconcileOnce(context.Background(), cfg)
+		log.Printf("Reconcile made %d changes.", state.Changes)
+		data, _ := json.MarshalIndent(state, "", "  ")
+		fmt.Println(string(data))
+	case CommandPlan:
+		cfg := parse()
+		// Only look: no announcements, proposals or other notifications.
+		cfg.MaintenanceTxt = false
+		cfg.MaintenanceWebhook = ""
+		cfg.ExpansionWebhook = ""
+		cfg.PubSubTopic = ""
+		cfg.AuditLog = ""
+		if err := setup(cfg); err != nil {
+			log.Fatal(err)
+		}
+		// Keep the intent as it is.
+		cfg.intent.Location = ""
+		cfg.plan = NewPlan()
+		ReconcileOnce(context.Background(), cfg)
+		PrintPlan(os.Stdout, cfg.plan)
+	case CommandDrain:
+		cfg := parse()
+		if len(cfg.args) != 1 {
+			log.Fatalf("Please specify the instance to drain: vip_manager drain [-undo] NAME")
+		}
+		drain := adminClient(cfg).Drain
+		if cfg.Undo {
+			drain = adminClient(cfg).Undrain
+		}
+		if err := drain(context.Background(), cfg.args[0]); err != nil {
+			log.Fatalf("Error draining %s: %v", cfg.args[0], err)
+		}
+	case CommandHistory:
+		cfg := parse()
+		if len(cfg.args) != 1 {
+			log.Fatalf("Please specify the VIP: vip_manager history IP")
+		}
+		entries, err := adminClient(cfg).History(context.Background(), cfg.args[0])
+		if err != nil {
+			log.Fatalf("Error getting history of %s: %v", cfg.args[0], err)
+		}
+		for _, entry := range entries {
+			peer := ""
+			if entry.Peer != "" {
+				peer = " (peer " + entry.Peer + ")"
+			}
+			fmt.Printf("%s %-6s %s%s reason: %s result: %s\n", entry.Time.Format(time.RFC3339),
+				entry.Action, entry.Instance, peer, entry.Reason, entry.Result)
+		}
+	case CommandPin:
+		cfg := parse()
+		switch {
+		case cfg.Undo && len(cfg.args) == 1:
+			if err := adminClient(cfg).Unpin(context.Background(), cfg.args[0]); err != nil {
+				log.Fatalf("Error unpinning %s: %v", cfg.args[0], err)
+			}
+		case !cfg.Undo && len(cfg.args) == 2:
+			if err := adminClient(cfg).Move(context.Background(), cfg.args[0], cfg.args[1]); err != nil {
+				log.Fatalf("Error pinning %s: %v", cfg.args[0], err)
+			}
+		default:
+			log.Fatalf("Please specify the VIP and instance: vip_manager pin IP NAME, or vip_manager pin -undo IP")
+		}
+	case CommandValidate:
+		cfg := parse()
+		utils.ChooseZone(cfg.Gcp)
+		if err := checkArgs(cfg); err != nil {
+			log.Fatal(err)
+		}
+		PrintConfig(cfg)
+		log.Printf("Configuration is valid.")
+	case CommandAlerts:
+		cfg := parse()
+		utils.ChooseZone(cfg.Gcp)
+		if err := checkArgs(cfg); err != nil {
+			log.Fatal(err)
+		}
+		if err := PrintAlertRules(os.Stdout, cfg); err != nil {
+			log.Fatalf("Error printing alert rules: %v", err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		fs, _ := newFlagSet(&Config{Gcp: &utils.GcpConfig{}})
+		fs.Usage()
+		os.Exit(2)
+	}
+}
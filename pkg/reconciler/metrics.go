@@ -0,0 +1,144 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Prometheus metrics of the reconciler.
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const MetricsPrefix = "vip_manager_"
+
+var (
+	poolVips = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips",
+		Help: "Number of virtual IPs in the pool.",
+	}, []string{"pool"})
+	poolVipsAssigned = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips_assigned",
+		Help: "Number of virtual IPs in the pool assigned to an instance.",
+	}, []string{"pool"})
+	aliasRangeAddresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "alias_range_addresses",
+		Help: "Number of addresses in the alias network (secondary range) of the pool.",
+	}, []string{"pool", "range"})
+	instancesMissingAliasNetwork = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "instances_missing_alias_network",
+		Help: "Number of instances excluded from the pool, because their subnetwork lacks the alias network.",
+	}, []string{"pool"})
+	mutationsPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "paused",
+		Help: "1 while all changes are paused by the rate-of-change guardrail.",
+	})
+	poolVipsQuarantined = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips_quarantined",
+		Help: "Number of alias IPs removed from the pool, which are in quarantine.",
+	}, []string{"pool"})
+	recommendedInstances = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "recommended_instances",
+		Help: "Recommended number of instances of the group, for its VIPs and load.",
+	}, []string{"group"})
+	groupYieldedInstances = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "group_yielded_instances",
+		Help: "Number of instances of the group that are in another group too, and belong to that one.",
+	}, []string{"group"})
+	poolDuplicateVips = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_duplicate_vips",
+		Help: "Number of VIPs of the pool on more than one instance, as last seen.",
+	}, []string{"pool"})
+	duplicateVipsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: MetricsPrefix + "duplicate_vips_total",
+		Help: "Number of times a VIP of the pool was found on more than one instance.",
+	}, []string{"pool"})
+	poolStrayIps = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_stray_ips",
+		Help: "Number of alias IPs in the alias network of the pool that are not VIPs of the pool.",
+	}, []string{"pool"})
+	poolForeignIps = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_foreign_ips",
+		Help: "Number of alias IPs in the alias network of the pool that it does not own, with -owned_only.",
+	}, []string{"pool"})
+	operationsRefused = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: MetricsPrefix + "operations_refused_total",
+		Help: "Number of alias IP operations refused in strict mode.",
+	}, []string{"pool"})
+	instancesUnhealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "instances_unhealthy",
+		Help: "Number of instances failing the health check of the pool, which receive no VIPs.",
+	}, []string{"pool"})
+	instancesByTemplate = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "instances_by_template",
+		Help: "Number of instances in the pool, per instance template.",
+	}, []string{"pool", "template"})
+	vipFailovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: MetricsPrefix + "vip_failovers_total",
+		Help: "Number of VIPs moved to another instance after failing the VIP check.",
+	}, []string{"pool"})
+	poolVipsFailing = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips_failing",
+		Help: "Number of VIPs failing the VIP check of the pool.",
+	}, []string{"pool"})
+	poolVipsSpare = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips_spare",
+		Help: "Number of virtual IPs in the pool not assigned to any instance.",
+	}, []string{"pool"})
+	instanceVips = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "instance_vips",
+		Help: "Number of virtual IPs of the pool assigned to the instance.",
+	}, []string{"pool", "instance"})
+	pinnedExcess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "instance_pinned_excess_vips",
+		Help: "Number of virtual IPs pinned to the instance beyond its balanced share or the cap, left in place.",
+	}, []string{"pool", "instance"})
+	reconcileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    MetricsPrefix + "reconcile_duration_seconds",
+		Help:    "Duration of reconcile passes over all pools of an instance group.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"group"})
+	gceQuotaLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "gce_quota_limit",
+		Help: "GCE quota limit, by scope (global or region) and metric.",
+	}, []string{"scope", "metric"})
+	gceQuotaHeadroom = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "gce_quota_headroom",
+		Help: "Remaining GCE quota (limit minus usage), by scope (global or region) and metric.",
+	}, []string{"scope", "metric"})
+	poolConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_connections",
+		Help: "Ingress TCP connections to all instances of the pool, by service port, from metrics_exporter.",
+	}, []string{"pool", "port"})
+	instanceConnectionShare = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "instance_connection_share",
+		Help: "Share of the ingress TCP connections of the pool on an instance (0 to 1), by service port.",
+	}, []string{"pool", "instance", "port"})
+	pairActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pair_active",
+		Help: "1 for the active instance of a failover pair.",
+	}, []string{"pool", "instance"})
+	instanceRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: MetricsPrefix + "instance_restarts_total",
+		Help: "Number of instances seen restarted (same instance, started again) or recreated (new instance with the same name), by pool and kind.",
+	}, []string{"pool", "kind"})
+	poolVipsUnplaced = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips_unplaced",
+		Help: "Number of virtual IPs in the pool that could not be assigned, because all instances are at -max_ips_per_instance.",
+	}, []string{"pool"})
+	poolVipsDraining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: MetricsPrefix + "pool_vips_draining",
+		Help: "Number of virtual IPs of the pool whose rebalancing move waits for connections to drain, see -drain_port.",
+	}, []string{"pool"})
+)
@@ -0,0 +1,790 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Reconcile passes besides placement: load aware swaps, rotation, VIP
+// checks and failover, quarantine, duplicates, and drains.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// scrapeLoads scrapes metrics_exporter on all instances, in parallel.
+// Instances that fail are left out.
+func scrapeLoads(instances map[string]*utils.GceInstance, port uint) map[string]*utils.BackendLoad {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	loads := map[string]*utils.BackendLoad{}
+	for name, instance := range instances {
+		if instance.NetworkIp == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(name, ip string) {
+			defer wg.Done()
+			url := "http://" + net.JoinHostPort(ip, strconv.Itoa(int(port))) + "/metrics"
+			load, err := utils.ScrapeLoad(url)
+			if err != nil {
+				log.Printf("Error scraping %s: %v", name, err)
+				return
+			}
+			mu.Lock()
+			loads[name] = load
+			mu.Unlock()
+		}(name, instance.NetworkIp)
+	}
+	wg.Wait()
+	return loads
+}
+
+// AggregateConnections exports the ingress TCP connections per service port
+// of the pool, as a total and as the share of each instance, from
+// metrics_exporter on all instances, every -aggregate_interval.
+func AggregateConnections(ctx context.Context, cfg *Config, pool *Pool) {
+	if cfg.AggregatePort == 0 || time.Since(pool.lastAggregate) < time.Duration(cfg.AggregateSeconds)*time.Second {
+		return
+	}
+	pool.lastAggregate = time.Now()
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return
+	}
+	loads := scrapeLoads(instances, cfg.AggregatePort)
+	totals := map[string]float64{}
+	pool.cpuTotal, pool.cpuInstances = 0, len(loads)
+	for _, load := range loads {
+		for port, connections := range load.ConnectionsByPort {
+			totals[port] += connections
+		}
+		pool.cpuTotal += load.CpuPercent
+	}
+	// Forget instances and ports that are gone.
+	poolConnections.DeletePartialMatch(prometheus.Labels{"pool": pool.Name()})
+	instanceConnectionShare.DeletePartialMatch(prometheus.Labels{"pool": pool.Name()})
+	for port, total := range totals {
+		poolConnections.WithLabelValues(pool.Name(), port).Set(total)
+	}
+	for name, load := range loads {
+		for port, total := range totals {
+			if total > 0 {
+				instanceConnectionShare.WithLabelValues(pool.Name(), name, port).Set(load.ConnectionsByPort[port] / total)
+			}
+		}
+	}
+}
+
+// RecommendSize recommends how many instances a group needs: enough to hold
+// the VIPs of each pool within -max_ips_per_instance, and with
+// -aggregate_port, to keep the average CPU usage at -size_target_cpu. With
+// -size_autoscaler, the recommendation is the minimum of the autoscaler of
+// the managed instance group, so that it never scales in below what the VIPs
+// need.
+func RecommendSize(ctx context.Context, cfg *Config, group *Group) {
+	if !cfg.SizeHints || time.Since(group.lastSizeHint) < time.Duration(cfg.SizeSeconds)*time.Second {
+		return
+	}
+	group.lastSizeHint = time.Now()
+	size := int64(1)
+	for _, pool := range group.Pools {
+		if cfg.MaxIpsPerInstance > 0 {
+			byVips := (int64(len(pool.VIPs)) + int64(cfg.MaxIpsPerInstance) - 1) / int64(cfg.MaxIpsPerInstance)
+			if byVips > size {
+				size = byVips
+			}
+		}
+		if pool.cpuInstances > 0 && cfg.SizeTargetCpu > 0 {
+			byLoad := int64(math.Ceil(pool.cpuTotal / cfg.SizeTargetCpu))
+			if byLoad > size {
+				size = byLoad
+			}
+		}
+	}
+	recommendedInstances.WithLabelValues(group.Name).Set(float64(size))
+	if size != group.sizeHint {
+		log.Printf("Recommend %d instances for group %s", size, group.Name)
+		group.sizeHint = size
+	}
+	pool := group.Pools[0]
+	if !cfg.SizeAutoscaler || pool.RegisteredOnly || pool.Gcp.LabelSelector != "" || pool.Gcp.NodePool != "" || pool.Gcp.NodeSelector != "" || len(pool.pair) > 0 {
+		return
+	}
+	min, changed, err := utils.SetAutoscalerMin(ctx, pool.Gcp, size)
+	if err != nil {
+		log.Printf("Error setting minimum size of group %s: %v", group.Name, err)
+		return
+	}
+	if changed {
+		log.Printf("Set autoscaler minimum of group %s to %d instances", group.Name, min)
+	}
+}
+
+// RebalanceByLoad swaps the busiest VIP of the most loaded instance with the
+// quietest VIP of the least loaded instance, based on CPU usage, or the
+// saturation score with -rebalance_signal saturation, and
+// connections per VIP from metrics_exporter. A swap keeps the number of IPs
+// per instance, so that ReduceIps does not undo it. At most one swap per
+// -rebalance_interval, so that the load settles in between.
+func RebalanceByLoad(ctx context.Context, cfg *Config, pool *Pool) int {
+	if cfg.RebalancePort == 0 || pool.strategy != nil || !utils.InWindows(pool.windows, time.Now()) ||
+		time.Since(pool.lastRebalance) < time.Duration(cfg.RebalanceSeconds)*time.Second {
+		return 0
+	}
+	pool.lastRebalance = time.Now()
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	instances = managedInstances(ctx, cfg, pool, instances)
+	loads := scrapeLoads(instances, cfg.RebalancePort)
+	usage := func(name string) float64 {
+		if cfg.RebalanceSignal == SignalSaturation && loads[name].Saturation >= 0 {
+			return loads[name].Saturation
+		}
+		return loads[name].CpuPercent
+	}
+	hot, cold := "", ""
+	for name := range loads {
+		if hot == "" || usage(name) > usage(hot) {
+			hot = name
+		}
+		if cold == "" || usage(name) < usage(cold) {
+			cold = name
+		}
+	}
+	if hot == "" || usage(hot) < cfg.RebalanceHighCpu || usage(cold) > cfg.RebalanceLowCpu {
+		return 0
+	}
+	busy, quiet := "", ""
+	movable := func(ip string) bool {
+		_, pinned := pinnedTo(cfg, pool, ip)
+		return slices.Contains(pool.VIPs, ip) && !pinned
+	}
+	for _, ip := range *instances[hot].AliasIps {
+		if movable(ip) && (busy == "" || loads[hot].Connections[ip] > loads[hot].Connections[busy]) {
+			busy = ip
+		}
+	}
+	for _, ip := range *instances[cold].AliasIps {
+		if movable(ip) && (quiet == "" || loads[cold].Connections[ip] < loads[cold].Connections[quiet]) {
+			quiet = ip
+		}
+	}
+	if busy == "" || quiet == "" || loads[hot].Connections[busy] <= loads[cold].Connections[quiet] {
+		return 0
+	}
+	if !allowMoves(cfg, pool, 2) {
+		return 0
+	}
+	log.Printf("Rebalance %s: swap %s on %s (%.0f%% %s) with %s on %s (%.0f%% %s)",
+		pool.Name(), busy, hot, usage(hot), cfg.RebalanceSignal, quiet, cold, usage(cold), cfg.RebalanceSignal)
+	moves := []utils.Move{
+		{Pool: pool.Name(), Ip: busy, From: hot, To: cold},
+		{Pool: pool.Name(), Ip: quiet, From: cold, To: hot},
+	}
+	return executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassRebalance)
+}
+
+// RotateVips moves every VIP of the pool to another instance once per
+// occurrence of its rotation window, so that all instances get to warm their
+// caches for all VIPs over time. Each pass swaps one VIP of an instance with
+// one of the next instance by name, which keeps the number of IPs per
+// instance, subject to the cooldown and the guardrail. VIPs not rotated when
+// the window closes wait for the next one.
+func RotateVips(ctx context.Context, cfg *Config, pool *Pool) int {
+	if pool.rotation == nil || pool.strategy != nil {
+		return 0
+	}
+	if !pool.rotation.Contains(time.Now()) {
+		if len(pool.rotated) > 0 {
+			log.Printf("Rotation window of %s closed, rotated %d of %d VIPs", pool.Name(), len(pool.rotated), len(pool.VIPs))
+		}
+		pool.rotated = nil
+		return 0
+	}
+	if pool.rotated == nil {
+		pool.rotated = map[string]bool{}
+	}
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	instances = managedInstances(ctx, cfg, pool, instances)
+	if len(instances) < 2 || coolingDown(cfg, pool, instances) {
+		return 0
+	}
+	names := maps.Keys(instances)
+	sort.Strings(names)
+	pending := func(name string) string {
+		for _, ip := range *instances[name].AliasIps {
+			_, pinned := pinnedTo(cfg, pool, ip)
+			if slices.Contains(pool.VIPs, ip) && !pinned && !pool.rotated[ip] {
+				return ip
+			}
+		}
+		return ""
+	}
+	for i, from := range names {
+		to := names[(i+1)%len(names)]
+		ip, other := pending(from), pending(to)
+		if ip == "" || other == "" {
+			continue
+		}
+		if !allowMoves(cfg, pool, 2) {
+			return 0
+		}
+		log.Printf("Rotate %s: swap %s on %s with %s on %s", pool.Name(), ip, from, other, to)
+		moves := []utils.Move{
+			{Pool: pool.Name(), Ip: ip, From: from, To: to},
+			{Pool: pool.Name(), Ip: other, From: to, To: from},
+		}
+		changes := executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassRebalance)
+		// Moves held back by -drain_port are proposed again in later passes.
+		for _, move := range moves {
+			if _, held := pool.drainSince[move.Ip]; !held {
+				pool.rotated[move.Ip] = true
+			}
+		}
+		return changes
+	}
+	return 0
+}
+
+// FailoverVips checks the VIPs on healthy instances, every HealthInterval. A
+// VIP failing -vip_check_failures checks in a row, e.g. because its alias IP
+// is not configured in the guest, moves to the least loaded other instance.
+// Move windows do not apply. If all VIPs fail, the checks are more likely
+// broken than the VIPs, and nothing moves.
+func FailoverVips(ctx context.Context, cfg *Config, pool *Pool) int {
+	if pool.vipCheck == nil || time.Since(pool.vipChecked) < HealthInterval {
+		return 0
+	}
+	pool.vipChecked = time.Now()
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	managed := withPoolIps(pool, managedInstances(ctx, cfg, pool, instances))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := map[string]error{}
+	owner := map[string]string{}
+	for name, instance := range managed {
+		for _, ip := range *instance.AliasIps {
+			owner[ip] = name
+			wg.Add(1)
+			go func(ip string) {
+				defer wg.Done()
+				err := pool.vipCheck.Probe(ip)
+				if cfg.faults.IsUnreachable(ip) {
+					err = errors.New("simulated failure")
+				}
+				mu.Lock()
+				results[ip] = err
+				mu.Unlock()
+			}(ip)
+		}
+	}
+	wg.Wait()
+	if pool.vipFailures == nil {
+		pool.vipFailures = map[string]int{}
+	}
+	failing := 0
+	for ip := range pool.vipFailures {
+		if _, ok := results[ip]; !ok {
+			delete(pool.vipFailures, ip)
+		}
+	}
+	for ip, err := range results {
+		if err == nil {
+			if pool.vipFailures[ip] > 0 {
+				log.Printf("VIP %s on %s passes check %s again", ip, owner[ip], pool.vipCheck)
+			}
+			delete(pool.vipFailures, ip)
+			continue
+		}
+		if pool.vipFailures[ip] == 0 {
+			log.Printf("VIP %s on %s fails check %s: %v", ip, owner[ip], pool.vipCheck, err)
+		}
+		pool.vipFailures[ip]++
+		failing++
+	}
+	poolVipsFailing.WithLabelValues(pool.Name()).Set(float64(failing))
+	if failing == 0 {
+		return 0
+	}
+	if failing == len(results) && len(results) > 1 {
+		log.Printf("Warning: all %d VIPs of %s fail check %s, no failover", failing, pool.Name(), pool.vipCheck)
+		return 0
+	}
+	weights := instanceWeights(cfg, managed)
+	adds := map[string]utils.Operation{}
+	moves := []utils.Move{}
+	for ip, failures := range pool.vipFailures {
+		if failures < int(cfg.VipCheckFailures) {
+			continue
+		}
+		from := owner[ip]
+		if pinned, _ := pinnedTo(cfg, pool, ip); pinned == from {
+			if failures == int(cfg.VipCheckFailures) {
+				log.Printf("Warning: VIP %s fails, but is pinned to %s", ip, from)
+			}
+			continue
+		}
+		others := map[string]*utils.GceInstance{}
+		for name, instance := range managed {
+			if name != from {
+				others[name] = instance
+			}
+		}
+		to := leastLoaded(cfg, replicaCandidates(cfg, pool, others, adds, ip), weights, adds)
+		if to == "" {
+			log.Printf("Warning: no instance to fail over %s to from %s", ip, from)
+			continue
+		}
+		addOperation(adds, utils.Add, managed[to], ip)
+		moves = append(moves, utils.Move{Pool: pool.Name(), Ip: ip, From: from, To: to})
+	}
+	if len(moves) == 0 || !allowMoves(cfg, pool, len(moves)) {
+		return 0
+	}
+	for _, move := range moves {
+		log.Printf("Fail over %s from %s to %s: %v", move.Ip, move.From, move.To, results[move.Ip])
+		cfg.failovers.Add(Failover{
+			Pool:  pool.Name(),
+			Ip:    move.Ip,
+			From:  move.From,
+			To:    move.To,
+			Error: results[move.Ip].Error(),
+			Time:  time.Now(),
+		})
+		vipFailovers.WithLabelValues(pool.Name()).Inc()
+		delete(pool.vipFailures, move.Ip)
+	}
+	return executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassFailover)
+}
+
+// withPoolIps returns copies of the instances, with only the alias IPs that
+// are VIPs of the pool. Other IPs in the alias network are quarantined.
+func withPoolIps(pool *Pool, instances map[string]*utils.GceInstance) map[string]*utils.GceInstance {
+	copies := map[string]*utils.GceInstance{}
+	for name, instance := range instances {
+		ips := []string{}
+		for _, ip := range *instance.AliasIps {
+			if slices.Contains(pool.VIPs, ip) {
+				ips = append(ips, ip)
+			}
+		}
+		c := *instance
+		c.AliasIps = &ips
+		copies[name] = &c
+	}
+	return copies
+}
+
+// QuarantineVips handles alias IPs that are no longer VIPs of the pool, e.g.
+// after a configuration change. Instead of removing them right away, they are
+// quarantined: they stay in place for -quarantine_grace, so that an
+// accidental edit can be reverted without impact, are then drained, and
+// reported for -quarantine_retention before they are forgotten. With
+// -owned_only, alias IPs that never were VIPs of the pool are left alone.
+// -stray_policy changes what happens to stray alias IPs that are not yet
+// quarantined: they can be ignored, only logged, or removed right away.
+func QuarantineVips(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	now := time.Now()
+	grace := time.Duration(cfg.QuarantineGrace) * time.Second
+	if cfg.StrayPolicy == StrayRemove {
+		grace = 0
+	}
+	retention := time.Duration(cfg.QuarantineRetention) * time.Second
+	quarantined := map[string]utils.Quarantined{}
+	for _, q := range cfg.intent.Quarantined(pool.Name()) {
+		quarantined[q.Ip] = q
+	}
+	stray := map[string]*utils.GceInstance{}
+	foreign := map[string]bool{}
+	strays := map[string]bool{}
+	for _, instance := range instances {
+		// Alias IPs of instances of other groups are theirs.
+		if isIgnored(cfg, instance) || pool.yielded[instance.Name] != "" {
+			continue
+		}
+		for _, ip := range *instance.AliasIps {
+			_, inQuarantine := quarantined[ip]
+			switch {
+			case slices.Contains(pool.VIPs, ip):
+				cfg.intent.Own(pool.Name(), ip)
+			case cfg.OwnedOnly && !inQuarantine && !cfg.intent.Owns(pool.Name(), ip):
+				if !pool.foreign[ip] {
+					log.Printf("Leave %s on %s alone: not owned by pool %s", ip, instance.Name, pool.Name())
+				}
+				foreign[ip] = true
+			case !inQuarantine && cfg.StrayPolicy == StrayIgnore:
+				strays[ip] = true
+			case !inQuarantine && cfg.StrayPolicy == StrayAlert:
+				if !pool.strays[ip] {
+					log.Printf("Warning: stray alias IP %s on %s is not in pool %s", ip, instance.Name, pool.Name())
+				}
+				strays[ip] = true
+			default:
+				stray[ip] = instance
+			}
+		}
+	}
+	pool.foreign = foreign
+	pool.strays = strays
+	poolForeignIps.WithLabelValues(pool.Name()).Set(float64(len(foreign)))
+	poolStrayIps.WithLabelValues(pool.Name()).Set(float64(len(stray) + len(foreign) + len(strays)))
+	operations := map[string]utils.Operation{}
+	for ip, instance := range stray {
+		q, ok := quarantined[ip]
+		if !ok || !q.Drained.IsZero() {
+			log.Printf("Quarantine %s on %s: no longer in pool %s, drain in %v", ip, instance.Name, pool.Name(), grace)
+			q = utils.Quarantined{Pool: pool.Name(), Ip: ip, Instance: instance.Name, Since: now}
+			cfg.intent.SetQuarantined(q)
+			cfg.intent.Delete(pool.Name(), ip, instance.Name)
+			quarantined[ip] = q
+		}
+		if now.Sub(q.Since) >= grace {
+			log.Printf("Drain quarantined %s from %s", ip, instance.Name)
+			addOperation(operations, utils.Remove, instance, ip)
+		}
+	}
+	for ip, q := range quarantined {
+		switch {
+		case slices.Contains(pool.VIPs, ip):
+			log.Printf("Release %s from quarantine: back in pool %s", ip, pool.Name())
+			cfg.intent.DeleteQuarantined(pool.Name(), ip)
+			delete(quarantined, ip)
+		case stray[ip] != nil:
+		case q.Drained.IsZero():
+			q.Drained = now
+			cfg.intent.SetQuarantined(q)
+		case now.Sub(q.Drained) >= retention:
+			log.Printf("Forget quarantined %s, drained from %s at %v", ip, q.Instance, q.Drained)
+			cfg.intent.DeleteQuarantined(pool.Name(), ip)
+			cfg.intent.Disown(pool.Name(), ip)
+			delete(quarantined, ip)
+		}
+	}
+	poolVipsQuarantined.WithLabelValues(pool.Name()).Set(float64(len(quarantined)))
+	changes := executeOperations(ctx, cfg, pool, operations, ClassQuarantine)
+	cfg.intent.Save()
+	return changes
+}
+
+// ResolveDuplicates removes VIPs that are on more than one instance, e.g.
+// after partial failures or manual edits, from all but one of them: the
+// instance the intent places the VIP on, else a managed instance, else the
+// oldest one, and by name among equals.
+func ResolveDuplicates(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	holders := map[string][]*utils.GceInstance{}
+	for _, instance := range instances {
+		if isIgnored(cfg, instance) {
+			continue
+		}
+		for _, ip := range *instance.AliasIps {
+			if slices.Contains(pool.VIPs, ip) {
+				holders[ip] = append(holders[ip], instance)
+			}
+		}
+	}
+	managed := managedInstances(ctx, cfg, pool, instances)
+	operations := map[string]utils.Operation{}
+	duplicates := 0
+	for ip, on := range holders {
+		if len(on) < 2 {
+			continue
+		}
+		duplicates++
+		duplicateVipsTotal.WithLabelValues(pool.Name()).Inc()
+		intended, _ := cfg.intent.Get(pool.Name(), ip)
+		rank := func(instance *utils.GceInstance) string {
+			_, ok := managed[instance.Name]
+			created := instance.Created
+			if created == "" {
+				created = "~"
+			}
+			return fmt.Sprintf("%t %t %s %s", instance.Name != intended, !ok, created, instance.Name)
+		}
+		sort.Slice(on, func(i, j int) bool {
+			return rank(on[i]) < rank(on[j])
+		})
+		names := []string{}
+		for _, instance := range on {
+			names = append(names, instance.Name)
+		}
+		log.Printf("Critical: VIP %s of pool %s is on %d instances %v, keep it on %s", ip, pool.Name(), len(on), names, on[0].Name)
+		for _, instance := range on[1:] {
+			addOperation(operations, utils.Remove, instance, ip)
+		}
+		cfg.intent.Set(pool.Name(), ip, on[0].Name)
+	}
+	poolDuplicateVips.WithLabelValues(pool.Name()).Set(float64(duplicates))
+	if duplicates == 0 {
+		return 0
+	}
+	return executeOperations(ctx, cfg, pool, operations, ClassDuplicate)
+}
+
+// EvacuateExcluded removes the pool VIPs from excluded instances, from
+// instances with an outdated template, and from instances that belong to
+// another group.
+func EvacuateExcluded(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	exportTemplates(pool, instances)
+	outdated := outdatedInstances(cfg, pool, instances)
+	draining := func(instance *utils.GceInstance) bool {
+		return (isExcluded(cfg, instance) || outdated[instance.Name] || pool.yielded[instance.Name] != "" || isTerminating(cfg, instance)) && !isIgnored(cfg, instance)
+	}
+	ready := announceDrains(cfg, pool, instances, draining)
+	// Terminating instances do not wait for the notice, they are gone soon.
+	selected := func(instance *utils.GceInstance) bool {
+		return draining(instance) && (ready[instance.Name] || isTerminating(cfg, instance))
+	}
+	moves := 0
+	for _, instance := range instances {
+		if selected(instance) {
+			for _, ip := range *instance.AliasIps {
+				if slices.Contains(pool.VIPs, ip) {
+					moves++
+				}
+			}
+		}
+	}
+	if moves == 0 || !allowMoves(cfg, pool, moves) {
+		return 0
+	}
+	return removePoolIps(ctx, cfg, pool, instances, selected, ClassEvacuate)
+}
+
+// Announcement is a planned drain of an instance, announced to clients of its
+// VIPs, so that they can e.g. remount before the VIPs move at Start.
+type Announcement struct {
+	Pool      string    `json:"pool"`
+	Instance  string    `json:"instance"`
+	Vips      []string  `json:"vips"`
+	Hostnames []string  `json:"hostnames"`
+	Start     time.Time `json:"start"`
+	// "announce" when the drain is planned, "end" when it is done.
+	Action string `json:"action"`
+}
+
+// announceDrains announces planned drains of instances with pool VIPs, with
+// -maintenance_txt or -maintenance_webhook, and returns the instances that
+// were announced at least -maintenance_notice ago. Announcements end when
+// the instances have no pool VIPs left. Without announcements, all instances
+// are returned.
+func announceDrains(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, draining func(*utils.GceInstance) bool) map[string]bool {
+	ready := map[string]bool{}
+	if !cfg.MaintenanceTxt && cfg.MaintenanceWebhook == "" {
+		for name := range instances {
+			ready[name] = true
+		}
+		return ready
+	}
+	if pool.announced == nil {
+		pool.announced = map[string]Announcement{}
+	}
+	for name, instance := range instances {
+		vips := []string{}
+		if draining(instance) {
+			for _, ip := range *instance.AliasIps {
+				if slices.Contains(pool.VIPs, ip) {
+					vips = append(vips, ip)
+				}
+			}
+		}
+		announcement, announced := pool.announced[name]
+		switch {
+		case len(vips) > 0 && !announced:
+			announcement = Announcement{
+				Pool:      pool.Name(),
+				Instance:  name,
+				Vips:      vips,
+				Hostnames: vipHostnames(cfg, vips),
+				Start:     time.Now().Add(time.Duration(cfg.MaintenanceNotice) * time.Second),
+				Action:    "announce",
+			}
+			log.Printf("Announce drain of %s at %v, for %v", name, announcement.Start.Format(time.RFC3339), announcement.Hostnames)
+			publishAnnouncement(cfg, announcement)
+			pool.announced[name] = announcement
+		case len(vips) > 0:
+			ready[name] = !time.Now().Before(announcement.Start)
+		case announced:
+			log.Printf("End drain announcement of %s", name)
+			announcement.Action = "end"
+			publishAnnouncement(cfg, announcement)
+			delete(pool.announced, name)
+		}
+	}
+	for name, announcement := range pool.announced {
+		if _, ok := instances[name]; !ok {
+			announcement.Action = "end"
+			publishAnnouncement(cfg, announcement)
+			delete(pool.announced, name)
+		}
+	}
+	return ready
+}
+
+// vipHostnames returns the managed DNS names pointing to the VIPs.
+func vipHostnames(cfg *Config, vips []string) []string {
+	hostnames := []string{}
+	for _, record := range cfg.intent.DnsRecords() {
+		for _, ip := range record.Ips {
+			if slices.Contains(vips, ip) {
+				hostnames = append(hostnames, record.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// publishAnnouncement sets or deletes the TXT record _maintenance.HOSTNAME
+// of each hostname, and posts the announcement to the webhook.
+func publishAnnouncement(cfg *Config, announcement Announcement) {
+	if cfg.MaintenanceTxt {
+		value := fmt.Sprintf("start=%s instance=%s", announcement.Start.UTC().Format(time.RFC3339), announcement.Instance)
+		for _, hostname := range announcement.Hostnames {
+			name := MaintenancePrefix + hostname
+			var err error
+			if announcement.Action == "end" {
+				err = utils.DeleteTxtRecord(cfg.Gcp.Project, cfg.DnsZone, name)
+			} else {
+				err = utils.SetTxtRecord(cfg.Gcp.Project, cfg.DnsZone, name, MaintenanceTtl, []string{value})
+			}
+			if err != nil {
+				log.Printf("Error announcing drain of %s: %v", announcement.Instance, err)
+			}
+		}
+	}
+	if cfg.MaintenanceWebhook != "" {
+		if err := utils.PostJSON(cfg.MaintenanceWebhook, announcement); err != nil {
+			log.Printf("Error posting drain announcement of %s: %v", announcement.Instance, err)
+		}
+	}
+}
+
+// MovePinned moves pinned VIPs to their instance, if it can take VIPs. Pins
+// are explicit, so move windows, the cooldown and the cap do not apply.
+func MovePinned(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	managed := managedInstances(ctx, cfg, pool, instances)
+	moves := []utils.Move{}
+	adds := map[string]utils.Operation{}
+	for name, instance := range instances {
+		if isIgnored(cfg, instance) {
+			continue
+		}
+		for _, ip := range *instance.AliasIps {
+			pinned, ok := pinnedTo(cfg, pool, ip)
+			if !ok || pinned == name || managed[pinned] == nil || !slices.Contains(pool.VIPs, ip) {
+				continue
+			}
+			log.Printf("Move %s from %s to %s, where it is pinned", ip, name, pinned)
+			addOperation(adds, utils.Add, managed[pinned], ip)
+			moves = append(moves, utils.Move{Pool: pool.Name(), Ip: ip, From: name, To: pinned})
+		}
+	}
+	if len(moves) == 0 || !allowMoves(cfg, pool, len(moves)) {
+		return 0
+	}
+	return executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassAllocate)
+}
+
+// removePoolIps removes all pool VIPs from the selected instances.
+func removePoolIps(ctx context.Context, cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, selected func(*utils.GceInstance) bool, class string) int {
+	operations := map[string]utils.Operation{}
+	for name, instance := range instances {
+		if !selected(instance) {
+			continue
+		}
+		ips := []string{}
+		for _, ip := range *instance.AliasIps {
+			if slices.Contains(pool.VIPs, ip) {
+				ips = append(ips, ip)
+			}
+		}
+		operations[name] = utils.Operation{
+			Type:     utils.Remove,
+			Instance: instance,
+			Ips:      ips,
+		}
+	}
+	return executeOperations(ctx, cfg, pool, operations, class)
+}
+
+// DetectAnomalies snapshots the VIP assignments of a pool, at most once per
+// -anomaly_interval, and logs warnings for anomalies since the last snapshot.
+func DetectAnomalies(ctx context.Context, cfg *Config, pool *Pool) {
+	if cfg.AnomalySeconds == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(pool.lastSnapshot) < time.Duration(cfg.AnomalySeconds)*time.Second {
+		return
+	}
+	pool.lastSnapshot = now
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return
+	}
+	snapshot := utils.Snapshot{}
+	for name, instance := range instances {
+		snapshot[name] = *instance.AliasIps
+	}
+	for _, anomaly := range pool.detector.Observe(now, snapshot) {
+		log.Printf("Warning: %s: %s", pool.Name(), anomaly.Message)
+	}
+}
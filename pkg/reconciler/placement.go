@@ -0,0 +1,948 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Placement of the VIPs of a pool on its instances: allocation, balancing
+// and the execution of the resulting operations.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/netip"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Return number of operations executed.
+func AllocateIps(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	spare := GetSpareIps(pool, instances)
+	exportUtilization(ctx, pool, instances, spare)
+	assignments := map[string][]string{}
+	for name, instance := range withPoolIps(pool, instances) {
+		assignments[name] = *instance.AliasIps
+	}
+	pool.statusMu.Lock()
+	pool.status.Assignments = assignments
+	pool.status.Spare = spare
+	pool.statusMu.Unlock()
+	ProposeExpansion(cfg, pool)
+	// Balance on the VIPs of the pool only, like ReduceIps, so that stray
+	// alias IPs do not skew the placement.
+	instances = withPoolIps(pool, managedInstances(ctx, cfg, pool, instances))
+	poolVipsUnplaced.WithLabelValues(pool.Name()).Set(0)
+	if len(spare) == 0 || len(instances) == 0 {
+		return 0
+	}
+	// Record current placements, so that they are kept after a restart.
+	for name, instance := range instances {
+		for _, ip := range *instance.AliasIps {
+			if slices.Contains(pool.VIPs, ip) {
+				if _, ok := cfg.intent.Get(pool.Name(), ip); !ok {
+					cfg.intent.Set(pool.Name(), ip, name)
+				}
+			}
+		}
+	}
+	operations := map[string]utils.Operation{}
+	for name, instance := range instances {
+		operations[name] = utils.Operation{
+			Type:     utils.Add,
+			Instance: instance,
+			Ips:      []string{},
+		}
+	}
+	weights := instanceWeights(cfg, instances)
+	totalWeight := 0.0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	var desired map[string]string
+	if pool.strategy != nil {
+		desired = plannedAdds(pool.strategy.Plan(instances, pool))
+	}
+	unplaced := []string{}
+	for _, ip := range spare {
+		// With a placement strategy, use the planned instance. Otherwise
+		// prefer the intended instance, unless it has its share already.
+		// Fall back to the least loaded instance.
+		// Replicas of the VIP rule out instances, see SpreadReplicas.
+		name := ""
+		candidates := replicaCandidates(cfg, pool, instances, operations, ip)
+		if pinned, ok := pinnedTo(cfg, pool, ip); ok && instances[pinned] != nil {
+			// Pins take precedence over the cap. ReduceIps reports the
+			// excess.
+			name = pinned
+		} else if to, ok := desired[ip]; ok {
+			if belowCap(cfg, len(*instances[to].AliasIps)+len(operations[to].Ips)) && candidates[to] != nil {
+				name = to
+			}
+		} else if intended, ok := cfg.intent.Get(pool.Name(), ip); ok {
+			if instance, ok := candidates[intended]; ok {
+				// Max number of IPs for a distribution by weight.
+				share := int(math.Ceil(float64(len(pool.VIPs)) * weights[intended] / totalWeight))
+				ips := len(*instance.AliasIps) + len(operations[intended].Ips)
+				if ips < share && belowCap(cfg, ips) {
+					name = intended
+				}
+			}
+		}
+		if name == "" {
+			name = leastLoaded(cfg, candidates, weights, operations)
+			if name == "" {
+				unplaced = append(unplaced, ip)
+				continue
+			}
+		}
+		// Workaround for golang not supporting map[value].Thing = ...
+		if operation, ok := operations[name]; ok {
+			operation.Ips = append(operation.Ips, ip)
+			operations[name] = operation
+			cfg.intent.Set(pool.Name(), ip, name)
+		}
+	}
+	if len(unplaced) > 0 {
+		log.Printf("Warning: %d VIPs in %s can not be placed, all instances have %d alias IPs: %v",
+			len(unplaced), pool.Name(), cfg.MaxIpsPerInstance, unplaced)
+	}
+	poolVipsUnplaced.WithLabelValues(pool.Name()).Set(float64(len(unplaced)))
+	changes := executeOperations(ctx, cfg, pool, operations, ClassAllocate)
+	cfg.intent.Save()
+	return changes
+}
+
+func ReduceIps(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	instances = withPoolIps(pool, managedInstances(ctx, cfg, pool, instances))
+	if len(instances) == 0 {
+		return 0
+	}
+	target := map[string]int{}
+	for name, instance := range instances {
+		ips := len(*instance.AliasIps)
+		target[name] = ips
+		if ips == 0 {
+			log.Printf("Detected new instance: %s", name)
+		}
+	}
+	if coolingDown(cfg, pool, instances) || !utils.InWindows(pool.windows, time.Now()) {
+		return 0
+	}
+	if pool.strategy != nil {
+		return movePlanned(ctx, cfg, pool, instances)
+	}
+
+	// "Robin Hood" algorithm: Take from the rich and give to the poor,
+	// until the difference is small enough: With equal weights, less than 2.
+	// Wealth is the number of IPs relative to the weight of an instance.
+	// The min_moves planner reaches a distribution as balanced with fewer
+	// moves, if there is one.
+	weights := instanceWeights(cfg, instances)
+	domains := failureDomains(cfg)
+	balance := robinHood
+	if cfg.Planner == PlannerMinMoves {
+		balance = minMovesTarget
+	}
+	spreadDomains(instances, weights, target, domains, balance)
+	// Hysteresis: leave small imbalances alone, but still enforce the cap,
+	// and with -spread_zones or -spread_hosts, spread VIPs over as many zones
+	// and hosts as possible.
+	if imbalance(instances, weights) <= cfg.MinImbalance && !concentrated(instances, domains) {
+		for name, instance := range instances {
+			target[name] = len(*instance.AliasIps)
+		}
+	}
+	// Never keep more than the cap, e.g. after it was lowered.
+	for name, v := range target {
+		if cfg.MaxIpsPerInstance > 0 && v > int(cfg.MaxIpsPerInstance) {
+			target[name] = int(cfg.MaxIpsPerInstance)
+		}
+	}
+
+	reductions := 0
+	for name, instance := range instances {
+		if reduction := len(*instance.AliasIps) - target[name]; reduction > 0 {
+			reductions += reduction
+		}
+	}
+	if !allowMoves(cfg, pool, reductions) {
+		return 0
+	}
+
+	// Instances below target receive the removed IPs, one per missing IP.
+	receivers := []string{}
+	for name, instance := range instances {
+		for ips := len(*instance.AliasIps); ips < target[name]; ips++ {
+			receivers = append(receivers, name)
+		}
+	}
+
+	// Generate operations. Remove IPs intended for other instances first.
+	// Each removed IP with a receiver is a move.
+	removes := map[string]utils.Operation{}
+	moves := []utils.Move{}
+	excess := map[string]int{}
+	defer reportPinExcess(pool, excess)
+	names := maps.Keys(instances)
+	slices.Sort(names)
+	for _, name := range names {
+		instance := instances[name]
+		reduction := len(*instance.AliasIps) - target[name]
+		if reduction > 0 {
+			// VIPs pinned to the instance stay.
+			ips := []string{}
+			for _, ip := range *instance.AliasIps {
+				if pinned, _ := pinnedTo(cfg, pool, ip); pinned != name {
+					ips = append(ips, ip)
+				}
+			}
+			if cfg.Planner == PlannerMinMoves {
+				sortByPlacement(cfg, pool, name, ips)
+			} else {
+				sort.SliceStable(ips, func(i, j int) bool {
+					intended, _ := cfg.intent.Get(pool.Name(), ips[i])
+					return intended != name
+				})
+			}
+			if reduction > len(ips) {
+				// Report, but do not fix, the excess of pins.
+				excess[name] = reduction - len(ips)
+				reduction = len(ips)
+			}
+			for _, ip := range ips[:reduction] {
+				if len(receivers) == 0 {
+					addOperation(removes, utils.Remove, instance, ip)
+					cfg.intent.Delete(pool.Name(), ip, name)
+					continue
+				}
+				// Prefer a receiver the VIP is intended for, and one
+				// without a replica of it.
+				to := 0
+				if cfg.Planner == PlannerMinMoves {
+					if intended, ok := cfg.intent.Get(pool.Name(), ip); ok {
+						if i := slices.Index(receivers, intended); i >= 0 {
+							to = i
+						}
+					}
+				}
+				if candidates := replicaCandidates(cfg, pool, instances, nil, ip); candidates[receivers[to]] == nil {
+					for i, receiver := range receivers {
+						if candidates[receiver] != nil {
+							to = i
+							break
+						}
+					}
+				}
+				moves = append(moves, utils.Move{Pool: pool.Name(), Ip: ip, From: name, To: receivers[to]})
+				receivers = slices.Delete(receivers, to, to+1)
+			}
+		}
+	}
+	return executeMoves(ctx, cfg, pool, instances, moves, removes, ClassRebalance)
+}
+
+// reportPinExcess logs instances that keep more VIPs than their balanced share
+// or the cap because of pins, when that changes, and exports the excess.
+func reportPinExcess(pool *Pool, excess map[string]int) {
+	pinnedExcess.DeletePartialMatch(prometheus.Labels{"pool": pool.Name()})
+	for name, n := range excess {
+		pinnedExcess.WithLabelValues(pool.Name(), name).Set(float64(n))
+		if pool.pinExcess[name] != n {
+			log.Printf("Warning: %d VIPs pinned to %s exceed its share or the cap in %s, left in place", n, name, pool.Name())
+		}
+	}
+	pool.pinExcess = excess
+}
+
+// robinHood moves IPs in target from the richest to the poorest, relative
+// to their weight, until the difference is small enough: With equal weights,
+// less than 2.
+func robinHood(target map[string]int, weights map[string]float64) {
+	for {
+		rich, poor := "", ""
+		for name, v := range target {
+			if v > 0 && (rich == "" || (float64(v)-0.5)/weights[name] > (float64(target[rich])-0.5)/weights[rich]) {
+				rich = name
+			}
+			if poor == "" || (float64(v)+0.5)/weights[name] < (float64(target[poor])+0.5)/weights[poor] {
+				poor = name
+			}
+		}
+		if rich == "" || (float64(target[rich])-0.5)/weights[rich] <= (float64(target[poor])+0.5)/weights[poor] {
+			break
+		}
+		target[rich] = target[rich] - 1
+		target[poor] = target[poor] + 1
+	}
+}
+
+// minMovesTarget sets each target to the share of the instance of all VIPs
+// by weight, rounded down, and gives the VIPs left over to instances that
+// hold more than that already, most first. Of the distributions as balanced
+// as that, it takes the fewest moves to reach.
+func minMovesTarget(target map[string]int, weights map[string]float64) {
+	total, totalWeight := 0, 0.0
+	for name, v := range target {
+		total += v
+		totalWeight += weights[name]
+	}
+	if totalWeight <= 0 {
+		return
+	}
+	current := maps.Clone(target)
+	left := total
+	for name := range target {
+		target[name] = int(math.Floor(float64(total) * weights[name] / totalWeight))
+		left -= target[name]
+	}
+	names := maps.Keys(target)
+	sort.Slice(names, func(i, j int) bool {
+		a, b := current[names[i]]-target[names[i]], current[names[j]]-target[names[j]]
+		if a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	for i := 0; i < left && i < len(names); i++ {
+		target[names[i]]++
+	}
+}
+
+// sortByPlacement orders the VIPs of an instance by how readily they move:
+// VIPs intended for other instances first, then the most recently placed
+// ones, by their history. VIPs that have been on the instance longest stay.
+func sortByPlacement(cfg *Config, pool *Pool, name string, ips []string) {
+	placed := map[string]time.Time{}
+	for _, ip := range ips {
+		if history := cfg.intent.History(ip); len(history) > 0 {
+			placed[ip] = history[len(history)-1].Time
+		}
+	}
+	elsewhere := func(ip string) bool {
+		intended, _ := cfg.intent.Get(pool.Name(), ip)
+		return intended != name
+	}
+	sort.SliceStable(ips, func(i, j int) bool {
+		if a, b := elsewhere(ips[i]), elsewhere(ips[j]); a != b {
+			return a
+		}
+		if a, b := placed[ips[i]], placed[ips[j]]; !a.Equal(b) {
+			return a.After(b)
+		}
+		return ips[i] < ips[j]
+	})
+}
+
+// failureDomains returns the keys to spread VIPs over, outermost first: the
+// zone with -spread_zones, and the host with -spread_hosts.
+func failureDomains(cfg *Config) []func(*utils.GceInstance) string {
+	domains := []func(*utils.GceInstance) string{}
+	if cfg.SpreadZones {
+		domains = append(domains, func(instance *utils.GceInstance) string {
+			return instance.Zone
+		})
+	}
+	if cfg.SpreadHosts {
+		domains = append(domains, hostDomain)
+	}
+	return domains
+}
+
+// hostDomain returns the physical host of an instance, if GCE reports it.
+// Otherwise, instances in the same compact placement policy may share hosts,
+// and count as one host, while other instances, e.g. in a spread placement
+// policy, count as a host of their own.
+func hostDomain(instance *utils.GceInstance) string {
+	if instance.PhysicalHost != "" {
+		return "host/" + instance.PhysicalHost
+	}
+	for _, resourcePolicy := range instance.ResourcePolicies {
+		policy, err := utils.GetPlacementPolicy(context.Background(), resourcePolicy)
+		if err != nil {
+			log.Printf("Error getting placement policy: %v", err)
+			continue
+		}
+		if policy != nil && policy.Collocated {
+			return "policy/" + policy.Name
+		}
+	}
+	return "instance/" + instance.Zone + "/" + instance.Name
+}
+
+// spreadDomains balances target over the failure domains of the first level
+// first, by the total weight of their instances, then over the domains of the
+// next level within each, and finally over the instances within each domain.
+// Without levels, it balances over the instances. balance is the planner,
+// e.g. robinHood.
+func spreadDomains(instances map[string]*utils.GceInstance, weights map[string]float64, target map[string]int, domains []func(*utils.GceInstance) string, balance func(map[string]int, map[string]float64)) {
+	if len(domains) == 0 {
+		balance(target, weights)
+		return
+	}
+	domainTarget, domainWeights := map[string]int{}, map[string]float64{}
+	members := map[string]map[string]*utils.GceInstance{}
+	for name, instance := range instances {
+		domain := domains[0](instance)
+		domainTarget[domain] += target[name]
+		domainWeights[domain] += weights[name]
+		if members[domain] == nil {
+			members[domain] = map[string]*utils.GceInstance{}
+		}
+		members[domain][name] = instance
+	}
+	balance(domainTarget, domainWeights)
+	for domain, domainInstances := range members {
+		memberTarget := map[string]int{}
+		sum := 0
+		for name := range domainInstances {
+			memberTarget[name] = target[name]
+			sum += target[name]
+		}
+		// Give to the poorest, or take from the richest, until the domain
+		// has its target. Then balance within the domain.
+		for ; sum < domainTarget[domain]; sum++ {
+			poor := ""
+			for name, v := range memberTarget {
+				if poor == "" || (float64(v)+0.5)/weights[name] < (float64(memberTarget[poor])+0.5)/weights[poor] {
+					poor = name
+				}
+			}
+			memberTarget[poor]++
+		}
+		for ; sum > domainTarget[domain]; sum-- {
+			rich := ""
+			for name, v := range memberTarget {
+				if v > 0 && (rich == "" || (float64(v)-0.5)/weights[name] > (float64(memberTarget[rich])-0.5)/weights[rich]) {
+					rich = name
+				}
+			}
+			memberTarget[rich]--
+		}
+		spreadDomains(domainInstances, weights, memberTarget, domains[1:], balance)
+		for name, v := range memberTarget {
+			target[name] = v
+		}
+	}
+}
+
+// concentrated returns true if the VIPs are in fewer failure domains (zones
+// or hosts) than they could be, so that an outage of one takes out more of
+// them than necessary.
+func concentrated(instances map[string]*utils.GceInstance, domains []func(*utils.GceInstance) string) bool {
+	for _, domain := range domains {
+		all, withVips := map[string]bool{}, map[string]bool{}
+		vips := 0
+		for _, instance := range instances {
+			key := domain(instance)
+			all[key] = true
+			if ips := len(*instance.AliasIps); ips > 0 {
+				withVips[key] = true
+				vips += ips
+			}
+		}
+		possible := len(all)
+		if vips < possible {
+			possible = vips
+		}
+		if len(withVips) < possible {
+			return true
+		}
+	}
+	return false
+}
+
+// coolingDown returns true within -cooldown of the last moves in the pool, or
+// of instances coming or going, so that the fleet settles before VIPs move
+// again.
+func coolingDown(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance) bool {
+	names := []string{}
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	members := strings.Join(names, ",")
+	if pool.members != "" && members != pool.members {
+		pool.membersChanged = time.Now()
+	}
+	pool.members = members
+	cooldown := time.Duration(cfg.CooldownSeconds) * time.Second
+	return time.Since(pool.lastMove) < cooldown || time.Since(pool.membersChanged) < cooldown
+}
+
+// imbalance returns the difference in number of IPs between the most and
+// least loaded instance, relative to their weights.
+func imbalance(instances map[string]*utils.GceInstance, weights map[string]float64) float64 {
+	totalWeight := 0.0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	meanWeight := totalWeight / float64(len(weights))
+	min, max := math.Inf(1), math.Inf(-1)
+	for name, instance := range instances {
+		load := float64(len(*instance.AliasIps)) / weights[name] * meanWeight
+		min = math.Min(min, load)
+		max = math.Max(max, load)
+	}
+	return max - min
+}
+
+// addOperation adds an IP to the operation for an instance.
+// Workaround for golang not supporting map[value].Thing = ...
+func addOperation(operations map[string]utils.Operation, t utils.Type, instance *utils.GceInstance, ip string) {
+	operation := operations[instance.Name]
+	operation.Type = t
+	operation.Instance = instance
+	operation.Ips = append(operation.Ips, ip)
+	operations[instance.Name] = operation
+}
+
+// setPeer records the other instance of a moved IP, for notifications.
+func setPeer(operations map[string]utils.Operation, name, ip, peer string) {
+	operation := operations[name]
+	if operation.Peers == nil {
+		operation.Peers = map[string]string{}
+	}
+	operation.Peers[ip] = peer
+	operations[name] = operation
+}
+
+// newCycle returns a random ID for a reconcile pass.
+func newCycle() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// executeOperations executes operations with the priority of their class,
+// which is also the reason given in notifications.
+func executeOperations(ctx context.Context, cfg *Config, pool *Pool, operations map[string]utils.Operation, class string) int {
+	if cfg.Strict {
+		refuseForeign(cfg, pool, operations)
+	}
+	for name, operation := range operations {
+		operation.Reason = class
+		operation.Cycle = pool.cycle
+		operations[name] = operation
+	}
+	if cfg.plan != nil {
+		return cfg.plan.record(pool, operations)
+	}
+	return utils.ExecuteParallelPriority(ctx, pool.Gcp, operations, cfg.priorities[class])
+}
+
+// refuseForeign drops operations on instances with alias ranges that
+// vip_manager does not manage, and removes of alias IPs that the pool does not
+// own, in strict mode.
+func refuseForeign(cfg *Config, pool *Pool, operations map[string]utils.Operation) {
+	for name, operation := range operations {
+		if ranges := operation.Instance.WideAliasRanges; len(ranges) > 0 {
+			log.Printf("Strict: refuse to update %s, with unknown alias ranges %v in %s", name, ranges, pool.Name())
+			operationsRefused.WithLabelValues(pool.Name()).Inc()
+			delete(operations, name)
+			continue
+		}
+		if operation.Type != utils.Remove {
+			continue
+		}
+		ips := []string{}
+		for _, ip := range operation.Ips {
+			if slices.Contains(pool.VIPs, ip) || cfg.intent.Owns(pool.Name(), ip) {
+				ips = append(ips, ip)
+			} else {
+				log.Printf("Strict: refuse to remove %s from %s, not owned by pool %s", ip, name, pool.Name())
+				operationsRefused.WithLabelValues(pool.Name()).Inc()
+			}
+		}
+		if len(ips) == 0 {
+			delete(operations, name)
+			continue
+		}
+		operation.Ips = ips
+		operations[name] = operation
+	}
+}
+
+// executeMoves moves VIPs between instances, in two phases: The moves are
+// persisted before the removes, and ended after the adds. Removes without
+// destination may be passed in as well. The class sets the priority.
+func executeMoves(ctx context.Context, cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, moves []utils.Move, removes map[string]utils.Operation, class string) int {
+	moves = withoutReplicaConflicts(cfg, pool, instances, moves)
+	if class == ClassRebalance {
+		moves = drainMoves(cfg, pool, instances, moves)
+	}
+	adds := map[string]utils.Operation{}
+	for _, move := range moves {
+		cfg.intent.BeginMove(move)
+		addOperation(removes, utils.Remove, instances[move.From], move.Ip)
+		addOperation(adds, utils.Add, instances[move.To], move.Ip)
+	}
+	cfg.intent.Save()
+	for _, move := range moves {
+		setPeer(removes, move.From, move.Ip, move.To)
+		setPeer(adds, move.To, move.Ip, move.From)
+	}
+	changes := executeOperations(ctx, cfg, pool, removes, class)
+	changes += executeOperations(ctx, cfg, pool, adds, class)
+	for _, move := range moves {
+		cfg.intent.EndMove(move.Pool, move.Ip)
+	}
+	cfg.intent.Save()
+	if changes > 0 {
+		pool.lastMove = time.Now()
+	}
+	return changes
+}
+
+// drainMoves holds back moves of VIPs with more than -drain_connections
+// connections on their instance, according to its metrics_exporter, until
+// the connections drain, or for at most -drain_timeout. Returns the moves to
+// make now. Held moves are left to later passes, which plan them again, and
+// the hold lasts across passes.
+// Moves from instances whose metrics_exporter does not answer are made.
+func drainMoves(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, moves []utils.Move) []utils.Move {
+	if cfg.DrainPort == 0 {
+		return moves
+	}
+	sources := map[string]*utils.GceInstance{}
+	for _, move := range moves {
+		sources[move.From] = instances[move.From]
+	}
+	loads := scrapeLoads(sources, cfg.DrainPort)
+	if pool.drainSince == nil {
+		pool.drainSince = map[string]time.Time{}
+	}
+	now := time.Now()
+	timeout := time.Duration(cfg.DrainSeconds) * time.Second
+	ready := []utils.Move{}
+	for _, move := range moves {
+		load, ok := loads[move.From]
+		if !ok {
+			delete(pool.drainSince, move.Ip)
+			ready = append(ready, move)
+			continue
+		}
+		connections := vipConnections(load, move.Ip)
+		since, holding := pool.drainSince[move.Ip]
+		switch {
+		case connections <= float64(cfg.DrainConnections):
+			delete(pool.drainSince, move.Ip)
+			ready = append(ready, move)
+		case holding && now.Sub(since) >= timeout:
+			log.Printf("Move %s from %s to %s with %v connections left, after waiting %v for them to drain",
+				move.Ip, move.From, move.To, connections, timeout)
+			delete(pool.drainSince, move.Ip)
+			ready = append(ready, move)
+		case !holding:
+			log.Printf("Hold move of %s from %s to %s until its %v connections drain, for up to %v",
+				move.Ip, move.From, move.To, connections, timeout)
+			pool.drainSince[move.Ip] = now
+		}
+	}
+	// Forget holds of moves that were not planned again.
+	for ip, since := range pool.drainSince {
+		if now.Sub(since) >= timeout {
+			delete(pool.drainSince, ip)
+		}
+	}
+	poolVipsDraining.WithLabelValues(pool.Name()).Set(float64(len(pool.drainSince)))
+	return ready
+}
+
+// vipConnections returns the ingress connections to a VIP, or to all
+// addresses of a block of VIPs.
+func vipConnections(load *utils.BackendLoad, vip string) float64 {
+	prefix, err := netip.ParsePrefix(vip)
+	if err != nil {
+		return load.Connections[vip]
+	}
+	total := 0.0
+	for ip, connections := range load.Connections {
+		if addr, err := netip.ParseAddr(ip); err == nil && prefix.Contains(addr) {
+			total += connections
+		}
+	}
+	return total
+}
+
+// rendezvousScore ranks an instance for a VIP (weighted rendezvous hashing).
+// The score only depends on the VIP, and the name and weight of the
+// instance, so instances coming or going only move their own VIPs.
+func rendezvousScore(ip, instance string, weight float64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(ip + "/" + instance))
+	// Uniform in (0, 1).
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// desiredPlacement places each VIP on the instance with the highest
+// rendezvous score that is below its share of the pool by weight, and below
+// the cap (consistent hashing with bounded loads). VIPs are placed in sorted
+// order, so the outcome does not depend on map iteration order.
+func desiredPlacement(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, weights map[string]float64) map[string]string {
+	totalWeight := 0.0
+	names := []string{}
+	for name := range instances {
+		totalWeight += weights[name]
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vips := append([]string{}, pool.VIPs...)
+	sort.Strings(vips)
+	count := map[string]int{}
+	desired := map[string]string{}
+	for _, ip := range vips {
+		ranked := append([]string{}, names...)
+		sort.SliceStable(ranked, func(i, j int) bool {
+			return rendezvousScore(ip, ranked[i], weights[ranked[i]]) > rendezvousScore(ip, ranked[j], weights[ranked[j]])
+		})
+		for _, name := range ranked {
+			share := int(math.Ceil(float64(len(vips)) * weights[name] / totalWeight))
+			if count[name] < share && belowCap(cfg, count[name]) {
+				desired[ip] = name
+				count[name]++
+				break
+			}
+		}
+	}
+	return desired
+}
+
+// movePlanned moves VIPs to the instance the placement strategy of the pool
+// plans for them.
+func movePlanned(ctx context.Context, cfg *Config, pool *Pool, instances map[string]*utils.GceInstance) int {
+	planned := plannedAdds(pool.strategy.Plan(instances, pool))
+	moves := []utils.Move{}
+	for name, instance := range instances {
+		for _, ip := range *instance.AliasIps {
+			if _, pinned := pinnedTo(cfg, pool, ip); pinned {
+				continue
+			}
+			if to, ok := planned[ip]; ok && to != name && instances[to] != nil {
+				moves = append(moves, utils.Move{Pool: pool.Name(), Ip: ip, From: name, To: to})
+			}
+		}
+	}
+	if len(moves) == 0 || !allowMoves(cfg, pool, len(moves)) {
+		return 0
+	}
+	return executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassRebalance)
+}
+
+func hasIp(instance *utils.GceInstance, ip string) bool {
+	return instance != nil && slices.Contains(*instance.AliasIps, ip)
+}
+
+// ResumeMoves completes or rolls back moves that were interrupted, e.g. by a
+// restart between remove and add. A VIP still on the source instance stays
+// there, and a VIP on neither instance is added to the destination.
+func ResumeMoves(ctx context.Context, cfg *Config, pool *Pool) int {
+	moves := cfg.intent.Moves(pool.Name())
+	if len(moves) == 0 {
+		return 0
+	}
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	managed := managedInstances(ctx, cfg, pool, instances)
+	operations := map[string]utils.Operation{}
+	for _, move := range moves {
+		switch {
+		case hasIp(instances[move.From], move.Ip):
+			log.Printf("Roll back move of %s from %s to %s", move.Ip, move.From, move.To)
+			cfg.intent.Set(pool.Name(), move.Ip, move.From)
+		case hasIp(instances[move.To], move.Ip):
+		case managed[move.To] != nil:
+			log.Printf("Complete move of %s from %s to %s", move.Ip, move.From, move.To)
+			operation := operations[move.To]
+			operation.Type = utils.Add
+			operation.Instance = managed[move.To]
+			operation.Ips = append(operation.Ips, move.Ip)
+			operations[move.To] = operation
+			setPeer(operations, move.To, move.Ip, move.From)
+		default:
+			// The destination is gone. AllocateIps places the VIP.
+			log.Printf("Abandon move of %s from %s to %s", move.Ip, move.From, move.To)
+		}
+		cfg.intent.EndMove(pool.Name(), move.Ip)
+	}
+	changes := executeOperations(ctx, cfg, pool, operations, ClassResume)
+	cfg.intent.Save()
+	return changes
+}
+
+// isPaused returns true while the guardrail pauses all changes.
+func isPaused(cfg *Config) bool {
+	paused, _ := cfg.guard.Paused()
+	if paused {
+		mutationsPaused.Set(1)
+	} else {
+		mutationsPaused.Set(0)
+	}
+	return paused
+}
+
+// allowMoves checks a number of VIP moves in a pool against the guardrail.
+func allowMoves(cfg *Config, pool *Pool, moves int) bool {
+	if cfg.guard.Allow(pool.Name(), moves, len(pool.VIPs), cfg.MaxMoveFraction) {
+		return true
+	}
+	mutationsPaused.Set(1)
+	return false
+}
+
+// ReconcilePool runs a single pass over a pool. Returns number of operations
+// executed.
+func ReconcilePool(ctx context.Context, cfg *Config, pool *Pool) int {
+	if isPaused(cfg) {
+		return 0
+	}
+	pool.cycle = newCycle()
+	defer func() { pool.cycle = "" }()
+	if cfg.CurrentTemplateOnly && !pool.RegisteredOnly && pool.Gcp.LabelSelector == "" && pool.Gcp.NodePool == "" && pool.Gcp.NodeSelector == "" {
+		template, err := utils.GetGroupTemplate(ctx, pool.Gcp)
+		if err != nil {
+			log.Printf("Error getting instance template: %v", err)
+		} else if template != pool.currentTemplate {
+			log.Printf("Instance group %s rolls out template %s", pool.Gcp.GceInstanceGroup, path.Base(template))
+			pool.currentTemplate = template
+		}
+	}
+	changes := ResumeMoves(ctx, cfg, pool)
+	changes += QuarantineVips(ctx, cfg, pool)
+	changes += ResolveDuplicates(ctx, cfg, pool)
+	if len(pool.pair) > 0 {
+		changes += ReconcilePair(ctx, cfg, pool)
+	} else {
+		changes += EvacuateExcluded(ctx, cfg, pool)
+		changes += MovePinned(ctx, cfg, pool)
+		changes += SpreadReplicas(ctx, cfg, pool)
+		changes += AllocateIps(ctx, cfg, pool)
+		changes += ReduceIps(ctx, cfg, pool)
+		changes += FailoverVips(ctx, cfg, pool)
+		changes += RebalanceByLoad(ctx, cfg, pool)
+		changes += RotateVips(ctx, cfg, pool)
+	}
+	pool.statusMu.Lock()
+	pool.status.LastReconcile = time.Now()
+	pool.status.LastChanges = changes
+	pool.status.LastCycle = pool.cycle
+	pool.statusMu.Unlock()
+	// Persist the VIP history of the pass.
+	cfg.intent.Save()
+	return changes
+}
+
+// ReconcilePair keeps all VIPs of a failover pair on its active instance:
+// the instance holding most of them, as long as it is running, healthy and
+// not excluded, otherwise the other one, preferring the first of the pair.
+// With a primary, the first instance is active whenever it has been available
+// for -failback_delay, and the standby only takes over in the meantime.
+// There is no balancing: the standby holds no VIPs.
+func ReconcilePair(ctx context.Context, cfg *Config, pool *Pool) int {
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	spare := GetSpareIps(pool, instances)
+	exportUtilization(ctx, pool, instances, spare)
+	assignments := map[string][]string{}
+	for name, instance := range withPoolIps(pool, instances) {
+		assignments[name] = *instance.AliasIps
+	}
+	pool.statusMu.Lock()
+	pool.status.Assignments = assignments
+	pool.status.Spare = spare
+	pool.statusMu.Unlock()
+
+	managed := managedInstances(ctx, cfg, pool, instances)
+	active, held := "", -1
+	for _, member := range pool.pair {
+		name := path.Base(member)
+		if _, ok := managed[name]; ok && len(assignments[name]) > held {
+			active, held = name, len(assignments[name])
+		}
+	}
+	if pool.pairPrimary {
+		primary := path.Base(pool.pair[0])
+		if _, ok := managed[primary]; !ok {
+			pool.primarySince = time.Time{}
+		} else {
+			if pool.primarySince.IsZero() {
+				pool.primarySince = time.Now()
+			}
+			failback := time.Since(pool.primarySince) >= time.Duration(cfg.FailbackSeconds)*time.Second
+			if active != primary && (failback || active == "") {
+				active = primary
+			}
+		}
+	}
+	if active != pool.active {
+		pairActive.DeletePartialMatch(prometheus.Labels{"pool": pool.Name()})
+		if active == "" {
+			log.Printf("Warning: no instance of pair %s can take VIPs", pool.Name())
+		} else {
+			log.Printf("Instance %s is active in pair %s", active, pool.Name())
+			pairActive.WithLabelValues(pool.Name(), active).Set(1)
+		}
+		pool.active = active
+	}
+	if active == "" {
+		return 0
+	}
+	adds := map[string]utils.Operation{}
+	for _, ip := range spare {
+		addOperation(adds, utils.Add, managed[active], ip)
+		cfg.intent.Set(pool.Name(), ip, active)
+	}
+	changes := executeOperations(ctx, cfg, pool, adds, ClassAllocate)
+	moves := []utils.Move{}
+	for name, ips := range assignments {
+		if name != active {
+			for _, ip := range ips {
+				moves = append(moves, utils.Move{Pool: pool.Name(), Ip: ip, From: name, To: active})
+			}
+		}
+	}
+	if len(moves) > 0 {
+		log.Printf("Fail over %d VIPs of pair %s to %s", len(moves), pool.Name(), active)
+		vipFailovers.WithLabelValues(pool.Name()).Add(float64(len(moves)))
+		changes += executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassFailover)
+	}
+	cfg.intent.Save()
+	return changes
+}
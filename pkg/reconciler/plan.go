@@ -0,0 +1,283 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Plans: the operations a pass would execute, without executing them.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Plan is what a reconcile pass would do, for the plan command: the
+// operations it would execute, and the VIPs of each instance before and
+// after. GetInstances applies the recorded operations, so that each step of
+// the pass sees the outcome of the previous ones, like in a real pass.
+type Plan struct {
+	Steps []PlanStep
+	pools map[string]*plannedPool
+}
+
+// PlanStep is one VIP added to or removed from an instance.
+type PlanStep struct {
+	Pool     string
+	Instance string
+	Ip       string
+	Type     utils.Type
+	// The reconcile step, e.g. "allocate" or "rebalance".
+	Reason string
+}
+
+type plannedPool struct {
+	pool   *Pool
+	before map[string][]string
+	after  map[string][]string
+	// Recorded operations, applied in order.
+	operations []utils.Operation
+}
+
+func NewPlan() *Plan {
+	return &Plan{pools: map[string]*plannedPool{}}
+}
+
+// record adds the operations to the plan, and returns their number.
+func (p *Plan) record(pool *Pool, operations map[string]utils.Operation) int {
+	planned := p.pools[pool.Name()]
+	if planned == nil {
+		// GetInstances failed.
+		return 0
+	}
+	names := maps.Keys(operations)
+	slices.Sort(names)
+	count := 0
+	for _, name := range names {
+		operation := operations[name]
+		if len(operation.Ips) == 0 {
+			continue
+		}
+		count++
+		for _, ip := range operation.Ips {
+			p.Steps = append(p.Steps, PlanStep{
+				Pool:     pool.Name(),
+				Instance: name,
+				Ip:       ip,
+				Type:     operation.Type,
+				Reason:   operation.Reason,
+			})
+		}
+		planned.operations = append(planned.operations, operation)
+	}
+	return count
+}
+
+// apply returns copies of the instances with the recorded operations
+// applied, and keeps track of the VIPs of the pool on each instance.
+func (p *Plan) apply(pool *Pool, instances map[string]*utils.GceInstance) map[string]*utils.GceInstance {
+	planned := p.pools[pool.Name()]
+	if planned == nil {
+		planned = &plannedPool{pool: pool, before: map[string][]string{}}
+		for name, instance := range withPoolIps(pool, instances) {
+			planned.before[name] = *instance.AliasIps
+		}
+		p.pools[pool.Name()] = planned
+	}
+	copies := map[string]*utils.GceInstance{}
+	for name, instance := range instances {
+		c := *instance
+		ips := slices.Clone(*instance.AliasIps)
+		c.AliasIps = &ips
+		copies[name] = &c
+	}
+	for _, operation := range planned.operations {
+		instance, ok := copies[operation.Instance.Name]
+		if !ok {
+			continue
+		}
+		ips := []string{}
+		for _, ip := range *instance.AliasIps {
+			if operation.Type != utils.Remove || !slices.Contains(operation.Ips, ip) {
+				ips = append(ips, ip)
+			}
+		}
+		if operation.Type == utils.Add {
+			for _, ip := range operation.Ips {
+				if !slices.Contains(ips, ip) {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		instance.AliasIps = &ips
+	}
+	planned.after = map[string][]string{}
+	for name, instance := range withPoolIps(pool, copies) {
+		planned.after[name] = *instance.AliasIps
+	}
+	return copies
+}
+
+// PlanResponse is the outcome of GET /plan: the operations a reconcile pass
+// would execute now.
+type PlanResponse struct {
+	Time    time.Time     `json:"time"`
+	Steps   []PlannedStep `json:"steps"`
+	Adds    int           `json:"adds"`
+	Removes int           `json:"removes"`
+	// Why the pass would pause all changes instead, if it would.
+	Paused string `json:"paused,omitempty"`
+}
+
+// PlannedStep is one VIP to add to or remove from an instance.
+type PlannedStep struct {
+	Pool     string `json:"pool"`
+	Instance string `json:"instance"`
+	Ip       string `json:"ip"`
+	// "add" or "remove".
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	// Removes break the connections to the VIP on the instance.
+	Disruptive bool `json:"disruptive"`
+}
+
+// planMu serializes plans, which read all instances.
+var planMu sync.Mutex
+
+// PlanNow plans a pass over all pools against the live state, like the plan
+// command, without changing anything: the pass runs on new pools, with a
+// copy of the intent and of the guardrail, and without notifications. With a
+// pool name, only the steps of that pool are returned.
+func PlanNow(ctx context.Context, cfg *Config, pool string) (*PlanResponse, error) {
+	planMu.Lock()
+	defer planMu.Unlock()
+	planCfg := *cfg
+	planCfg.MaintenanceTxt = false
+	planCfg.MaintenanceWebhook = ""
+	planCfg.ExpansionWebhook = ""
+	planCfg.intent = cfg.intent.Copy()
+	planCfg.guard = cfg.guard.DryRun()
+	planCfg.plan = NewPlan()
+	groups, err := buildGroups(&planCfg, cfg.GroupConfigs)
+	if err != nil {
+		return nil, err
+	}
+	planCfg.Groups = groups
+	for _, group := range groups {
+		for _, pool := range group.Pools {
+			ReconcilePool(ctx, &planCfg, pool)
+		}
+	}
+	resp := &PlanResponse{Time: time.Now(), Steps: []PlannedStep{}}
+	for _, step := range planCfg.plan.Steps {
+		if pool != "" && step.Pool != pool {
+			continue
+		}
+		action := strings.ToLower(step.Type.String())
+		resp.Steps = append(resp.Steps, PlannedStep{
+			Pool:       step.Pool,
+			Instance:   step.Instance,
+			Ip:         step.Ip,
+			Action:     action,
+			Reason:     step.Reason,
+			Disruptive: step.Type == utils.Remove,
+		})
+		if step.Type == utils.Remove {
+			resp.Removes++
+		} else {
+			resp.Adds++
+		}
+	}
+	if paused, reason := planCfg.guard.Paused(); paused {
+		resp.Paused = reason
+	}
+	return resp, nil
+}
+
+// HandlePlan serves GET /plan, the operations a reconcile pass would execute
+// now, e.g. for change management systems that gate disruptive changes.
+func HandlePlan(cfg *Config) {
+	http.HandleFunc("/plan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Use GET to plan", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		resp, err := PlanNow(r.Context(), cfg.active.Load(), r.URL.Query().Get("pool"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// PrintPlan writes the plan like a diff: "+" for VIPs to add, "-" for VIPs
+// to remove, followed by the number of VIPs of each instance before and
+// after.
+func PrintPlan(w io.Writer, plan *Plan) {
+	adds, removes := 0, 0
+	names := maps.Keys(plan.pools)
+	slices.Sort(names)
+	for _, name := range names {
+		planned := plan.pools[name]
+		fmt.Fprintf(w, "Pool %s:\n", name)
+		changed := false
+		for _, step := range plan.Steps {
+			if step.Pool != name {
+				continue
+			}
+			changed = true
+			sign := "+"
+			if step.Type == utils.Remove {
+				sign = "-"
+				removes++
+			} else {
+				adds++
+			}
+			fmt.Fprintf(w, "  %s %-15s %s (%s)\n", sign, step.Ip, step.Instance, step.Reason)
+		}
+		if !changed {
+			fmt.Fprintf(w, "  No changes.\n")
+		}
+		instances := maps.Keys(planned.before)
+		for instance := range planned.after {
+			if _, ok := planned.before[instance]; !ok {
+				instances = append(instances, instance)
+			}
+		}
+		slices.Sort(instances)
+		for _, instance := range instances {
+			before, after := len(planned.before[instance]), len(planned.after[instance])
+			marker := " "
+			if before != after {
+				marker = "~"
+			}
+			fmt.Fprintf(w, "  %s %-40s %3d -> %d VIPs\n", marker, instance, before, after)
+		}
+	}
+	fmt.Fprintf(w, "Plan: %d to add, %d to remove.\n", adds, removes)
+}
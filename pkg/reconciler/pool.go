@@ -0,0 +1,544 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Instance groups and their pools, and the state kept across passes and
+// configuration reloads.
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Exclusions are instances excluded through the admin API. They survive
+// configuration reloads.
+type Exclusions struct {
+	mu        sync.Mutex
+	instances map[string]bool
+}
+
+func (e *Exclusions) Contains(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.instances[name]
+}
+
+func (e *Exclusions) Set(name string, excluded bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if excluded {
+		e.instances[name] = true
+	} else {
+		delete(e.instances, name)
+	}
+}
+
+// Faults are simulated failures, set through the admin API with
+// -fault_injection. They survive configuration reloads.
+type Faults struct {
+	mu sync.Mutex
+	// Instances failing health checks, and VIPs failing -vip_check.
+	Unhealthy   map[string]bool `json:"unhealthy"`
+	Unreachable map[string]bool `json:"unreachable"`
+	// Delay before each alias IP operation.
+	DelaySeconds uint `json:"delay_seconds"`
+}
+
+func (f *Faults) IsUnhealthy(instance string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Unhealthy[instance]
+}
+
+func (f *Faults) IsUnreachable(ip string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Unreachable[ip]
+}
+
+// Copy returns a copy, e.g. for JSON encoding.
+func (f *Faults) Copy() *Faults {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &Faults{Unhealthy: maps.Clone(f.Unhealthy), Unreachable: maps.Clone(f.Unreachable), DelaySeconds: f.DelaySeconds}
+}
+
+// Pins are VIPs pinned to instances through the admin API, by pool and VIP.
+// They survive configuration reloads, and override pins in the configuration
+// file, see pinnedTo.
+type Pins struct {
+	mu   sync.Mutex
+	pins map[string]map[string]string
+}
+
+// Get returns the instance a VIP is pinned to.
+func (p *Pins) Get(pool, ip string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	instance, ok := p.pins[pool][ip]
+	return instance, ok
+}
+
+// Set pins a VIP to an instance, or unpins it if the instance is empty.
+func (p *Pins) Set(pool, ip, instance string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if instance == "" {
+		delete(p.pins[pool], ip)
+		return
+	}
+	if p.pins[pool] == nil {
+		p.pins[pool] = map[string]string{}
+	}
+	p.pins[pool][ip] = instance
+}
+
+// Pin is a VIP pinned to an instance, for the admin API.
+type Pin struct {
+	Pool     string `json:"pool"`
+	Vip      string `json:"vip"`
+	Instance string `json:"instance"`
+	// "admin" or "config".
+	Source string `json:"source"`
+}
+
+// List returns the pins of a pool.
+func (p *Pins) List(pool string) []Pin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pins := []Pin{}
+	for ip, instance := range p.pins[pool] {
+		pins = append(pins, Pin{Pool: pool, Vip: ip, Instance: instance, Source: "admin"})
+	}
+	return pins
+}
+
+// Failover is a VIP that stopped answering on its instance, and was moved
+// to another one.
+type Failover struct {
+	Pool  string    `json:"pool"`
+	Ip    string    `json:"ip"`
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// Failovers are the most recent failovers, newest last. They survive
+// configuration reloads.
+type Failovers struct {
+	mu     sync.Mutex
+	events []Failover
+}
+
+func (f *Failovers) Add(event Failover) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	if len(f.events) > MaxFailovers {
+		f.events = f.events[len(f.events)-MaxFailovers:]
+	}
+}
+
+func (f *Failovers) List() []Failover {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Failover{}, f.events...)
+}
+
+// Group is an instance group with one or more independent pools of virtual
+// IPs.
+type Group struct {
+	Name  string
+	Pools []*Pool
+
+	// Wakes up the reconcile loop, e.g. after an instance refresh.
+	wake chan struct{}
+	// Instances to refresh at the start of the next pass.
+	mu      sync.Mutex
+	refresh map[string]bool
+	// Last recommended size, see RecommendSize.
+	sizeHint     int64
+	lastSizeHint time.Time
+	// Rank of the group for instances in several groups, see Claims.
+	precedence int
+	index      int
+}
+
+// Refresh asks the reconcile loop to forget cached state of an instance, and
+// to start a pass right away.
+func (g *Group) Refresh(name string) {
+	g.mu.Lock()
+	g.refresh[name] = true
+	g.mu.Unlock()
+	g.Wake()
+}
+
+// Wake asks the reconcile loop to start a pass right away.
+func (g *Group) Wake() {
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+}
+
+// affectedBy returns whether a change may change the instances of the group:
+// a change to its instance group, to one of its instances, or to an instance
+// named after it, as managed instance groups name new instances.
+func (g *Group) affectedBy(change utils.Change) bool {
+	for _, pool := range g.Pools {
+		if change.Project != pool.Gcp.Project {
+			continue
+		}
+		group := pool.Gcp.GceInstanceGroup
+		switch change.Kind {
+		case "instanceGroupManagers", "regionInstanceGroupManagers", "instanceGroups", "regionInstanceGroups":
+			if change.Name == group {
+				return true
+			}
+		case "instances":
+			if (group != "" && strings.HasPrefix(change.Name, group+"-")) || pool.hasInstance(change.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claims tracks which groups see an instance, so that an instance in several
+// groups belongs to one of them: the group with the highest precedence, and
+// among equals the first one in the configuration. Groups reconcile
+// concurrently. Claims of groups that stopped seeing an instance expire.
+type Claims struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	// When each group last saw each instance, by instance and group name.
+	seen     map[string]map[string]time.Time
+	rank     map[string][2]int
+	conflict map[string]bool
+}
+
+func NewClaims(ttl time.Duration) *Claims {
+	return &Claims{
+		ttl:      ttl,
+		seen:     map[string]map[string]time.Time{},
+		rank:     map[string][2]int{},
+		conflict: map[string]bool{},
+	}
+}
+
+// Observe records that the group sees the instances, and returns those that
+// belong to another group, with that group.
+func (c *Claims) Observe(group *Group, instances map[string]*utils.GceInstance) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.rank[group.Name] = [2]int{-group.precedence, group.index}
+	yielded := map[string]string{}
+	for name := range instances {
+		if c.seen[name] == nil {
+			c.seen[name] = map[string]time.Time{}
+		}
+		c.seen[name][group.Name] = now
+		owner, groups := group.Name, []string{}
+		for other, seen := range c.seen[name] {
+			if now.Sub(seen) > c.ttl {
+				delete(c.seen[name], other)
+				continue
+			}
+			groups = append(groups, other)
+			a, b := c.rank[other], c.rank[owner]
+			if a[0] < b[0] || (a[0] == b[0] && a[1] < b[1]) {
+				owner = other
+			}
+		}
+		if len(groups) > 1 && !c.conflict[name] {
+			sort.Strings(groups)
+			log.Printf("Warning: instance %s is in groups %v, it belongs to %s", name, groups, owner)
+		}
+		c.conflict[name] = len(groups) > 1
+		if owner != group.Name {
+			yielded[name] = owner
+		}
+	}
+	groupYieldedInstances.WithLabelValues(group.Name).Set(float64(len(yielded)))
+	return yielded
+}
+
+// takeRefresh returns the instances to refresh, and clears them.
+func (g *Group) takeRefresh() map[string]bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	refresh := g.refresh
+	g.refresh = map[string]bool{}
+	return refresh
+}
+
+// Pool is a set of virtual IPs in one alias network (secondary range), spread
+// over the instances of one instance group.
+type Pool struct {
+	Gcp            *utils.GcpConfig
+	VIPs           []string
+	RegisteredOnly bool
+	// Rebalancing moves only happen within these windows, if any.
+	windows []utils.Window
+	// Instances must pass the health check, if any, to receive VIPs.
+	health        *utils.HealthCheck
+	healthy       map[string]bool
+	healthChecked time.Time
+	// VIPs failing the VIP check, if any, and their consecutive failures.
+	vipCheck    *utils.HealthCheck
+	vipFailures map[string]int
+	vipChecked  time.Time
+
+	detector     *utils.AnomalyDetector
+	lastSnapshot time.Time
+	// Number of addresses in the alias network, 0 if unknown.
+	rangeSize  int
+	rangeCidr  string
+	subnetwork string
+	// Last expansion proposal, to only send it once.
+	proposal *ExpansionProposal
+	// Whether subnetworks have the alias network, by subnetwork URL.
+	hasAliasNetwork map[string]bool
+	// Instances reported as missing the alias network.
+	missingAliasNetwork map[string]bool
+	lastRebalance       time.Time
+	lastAggregate       time.Time
+	// Instance template the group rolls out, with -current_template_only.
+	currentTemplate string
+	// For the cooldown: when VIPs last moved, and when instances last came
+	// or went.
+	lastMove       time.Time
+	members        string
+	membersChanged time.Time
+
+	// For the status API, which reads it concurrently.
+	statusMu sync.Mutex
+	status   PoolStatus
+	// ID of the current reconcile pass, for the audit log.
+	cycle string
+	// Last seen incarnation of each instance.
+	incarnations map[string]Incarnation
+	// Announced drains, by instance.
+	announced map[string]Announcement
+	// Foreign alias IPs, as last reported, with -owned_only.
+	foreign map[string]bool
+	// Stray alias IPs left in place, as last reported, with -stray_policy
+	// alert or ignore.
+	strays map[string]bool
+	// Total CPU usage in percent of the instances scraped by
+	// AggregateConnections, and their number.
+	cpuTotal     float64
+	cpuInstances int
+	// Pins from the configuration file, instance by VIP.
+	pins map[string]string
+	// Excess VIPs pinned to each instance, as last reported.
+	pinExcess map[string]int
+	// The instances of a failover pair, and the active one.
+	pair        []string
+	pairPrimary bool
+	pairInGroup bool
+	active      string
+	// Since when the primary of a pair is available, zero if it is not.
+	primarySince time.Time
+
+	// The group of the pool, and its instances that belong to another group,
+	// with that group, see Claims.
+	group   *Group
+	yielded map[string]string
+
+	// Rebalancing moves held back until the connections to the VIP drain,
+	// by VIP, with the time the hold started, see drainMoves.
+	drainSince map[string]time.Time
+
+	// Window to rotate VIPs in, if any, and the VIPs rotated since it
+	// opened, see RotateVips.
+	rotation *utils.Window
+	rotated  map[string]bool
+
+	// Placement strategy, nil for balanced placement.
+	strategy Strategy
+
+	// The other replicas of the same service, by VIP.
+	replicas map[string][]string
+}
+
+// PoolStatus is the state of a pool as of the last reconcile pass.
+type PoolStatus struct {
+	Pool string `json:"pool"`
+	// Pool VIPs by instance.
+	Assignments   map[string][]string `json:"assignments"`
+	Spare         []string            `json:"spare"`
+	LastReconcile time.Time           `json:"last_reconcile"`
+	LastChanges   int                 `json:"last_changes"`
+	LastCycle     string              `json:"last_cycle"`
+	// State of each instance, see instanceState.
+	States map[string]string `json:"states,omitempty"`
+}
+
+// Summarized returns the status with IPs summarized into CIDR blocks.
+func (s PoolStatus) Summarized() PoolStatus {
+	assignments := map[string][]string{}
+	for name, vips := range s.Assignments {
+		assignments[name] = utils.SummarizeIps(vips)
+	}
+	s.Assignments = assignments
+	s.Spare = utils.SummarizeIps(s.Spare)
+	return s
+}
+
+// VipStatus is the state of one VIP, for GET /status/vips.
+type VipStatus struct {
+	Pool string `json:"pool"`
+	Vip  string `json:"vip"`
+	// "assigned" or "spare".
+	State    string `json:"state"`
+	Instance string `json:"instance,omitempty"`
+	// State of the instance, see instanceState.
+	Health string `json:"health,omitempty"`
+}
+
+// Vips returns the state of each VIP of the pool, ordered by address.
+func (s PoolStatus) Vips() []VipStatus {
+	vips := []VipStatus{}
+	for name, ips := range s.Assignments {
+		for _, ip := range ips {
+			vips = append(vips, VipStatus{Pool: s.Pool, Vip: ip, State: "assigned", Instance: name, Health: s.States[name]})
+		}
+	}
+	for _, ip := range s.Spare {
+		vips = append(vips, VipStatus{Pool: s.Pool, Vip: ip, State: "spare"})
+	}
+	sort.Slice(vips, func(i, j int) bool {
+		a, errA := vipAddr(vips[i].Vip)
+		b, errB := vipAddr(vips[j].Vip)
+		if errA != nil || errB != nil {
+			return vips[i].Vip < vips[j].Vip
+		}
+		return a.Less(b)
+	})
+	return vips
+}
+
+// Status returns a copy of the status of the pool.
+func (p *Pool) Status() PoolStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	status := p.status
+	status.Pool = p.Name()
+	return status
+}
+
+// ExpansionProposal suggests a larger alias network for a pool. It is never
+// applied automatically.
+type ExpansionProposal struct {
+	Pool          string
+	Subnetwork    string
+	RangeName     string
+	CurrentCidr   string
+	SuggestedCidr string
+	Utilization   float64
+}
+
+func (p *Pool) Name() string {
+	return p.Gcp.GceInstanceGroup + "/" + p.Gcp.AliasNetwork
+}
+
+// hasInstance returns whether the instance was in the pool in the last pass.
+func (p *Pool) hasInstance(name string) bool {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	_, ok := p.status.States[name]
+	return ok
+}
+
+// addresses returns the number of addresses of the VIPs, which are blocks of
+// IPv4 addresses with -block_prefix.
+func (p *Pool) addresses() int {
+	if p.Gcp.BlockBits > 0 {
+		return len(p.VIPs) << (32 - p.Gcp.BlockBits)
+	}
+	return len(p.VIPs)
+}
+
+// keepPoolState carries the state of each pool over to the pool of the same
+// name in the groups of a new configuration, on reload. Call it once the
+// passes of the old configuration completed.
+func keepPoolState(groups, old []*Group) {
+	pools := map[string]*Pool{}
+	for _, group := range old {
+		for _, pool := range group.Pools {
+			pools[pool.Name()] = pool
+		}
+	}
+	for _, group := range groups {
+		for _, pool := range group.Pools {
+			if previous, ok := pools[pool.Name()]; ok {
+				pool.keepState(previous)
+			}
+		}
+	}
+}
+
+// keepState takes over the state of the pool in the previous configuration:
+// the cooldown, drains, anomaly history and status continue. Health results
+// only carry over if the check is the same.
+func (p *Pool) keepState(old *Pool) {
+	if reflect.DeepEqual(p.health, old.health) {
+		p.healthy = old.healthy
+		p.healthChecked = old.healthChecked
+	}
+	if reflect.DeepEqual(p.vipCheck, old.vipCheck) {
+		p.vipFailures = old.vipFailures
+		p.vipChecked = old.vipChecked
+	}
+	old.detector.MaxMoves = p.detector.MaxMoves
+	p.detector = old.detector
+	p.lastSnapshot = old.lastSnapshot
+	p.proposal = old.proposal
+	p.hasAliasNetwork = old.hasAliasNetwork
+	p.missingAliasNetwork = old.missingAliasNetwork
+	p.lastRebalance = old.lastRebalance
+	p.lastAggregate = old.lastAggregate
+	p.currentTemplate = old.currentTemplate
+	p.lastMove = old.lastMove
+	p.members = old.members
+	p.membersChanged = old.membersChanged
+	p.incarnations = old.incarnations
+	p.announced = old.announced
+	p.foreign = old.foreign
+	p.strays = old.strays
+	p.cpuTotal = old.cpuTotal
+	p.cpuInstances = old.cpuInstances
+	p.pinExcess = old.pinExcess
+	if slices.Equal(p.pair, old.pair) {
+		p.active = old.active
+		p.primarySince = old.primarySince
+	}
+	p.drainSince = old.drainSince
+	p.rotated = old.rotated
+	old.statusMu.Lock()
+	p.status = old.status
+	old.statusMu.Unlock()
+}
@@ -0,0 +1,74 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+)
+
+func newTestPool(alias string, health *utils.HealthCheck) *Pool {
+	return &Pool{
+		Gcp:        &utils.GcpConfig{GceInstanceGroup: testGroup, AliasNetwork: alias},
+		health:     health,
+		healthy:    map[string]bool{},
+		drainSince: map[string]time.Time{},
+		announced:  map[string]Announcement{},
+		detector:   utils.NewAnomalyDetector(5, time.Hour),
+	}
+}
+
+func TestKeepPoolState(t *testing.T) {
+	moved := time.Now().Add(-time.Minute)
+	old := newTestPool(testAlias, &utils.HealthCheck{Type: utils.HealthTcp, Port: 80})
+	old.lastMove = moved
+	old.healthy["vm-1"] = true
+	old.drainSince["10.1.0.1"] = moved
+	old.announced["vm-1"] = Announcement{}
+	old.status.LastChanges = 3
+	other := newTestPool("other-range", nil)
+	other.lastMove = moved
+
+	same := newTestPool(testAlias, &utils.HealthCheck{Type: utils.HealthTcp, Port: 80})
+	same.detector.MaxMoves = 10
+	added := newTestPool("new-range", nil)
+	keepPoolState(
+		[]*Group{{Name: testGroup, Pools: []*Pool{same, added}}},
+		[]*Group{{Name: testGroup, Pools: []*Pool{old, other}}})
+
+	if !same.lastMove.Equal(moved) {
+		t.Errorf("cooldown not kept: last move %v, want %v", same.lastMove, moved)
+	}
+	if !same.healthy["vm-1"] || len(same.drainSince) != 1 || len(same.announced) != 1 {
+		t.Errorf("health, drains or announcements not kept: %v %v %v", same.healthy, same.drainSince, same.announced)
+	}
+	if same.Status().LastChanges != 3 {
+		t.Errorf("status not kept: %+v", same.Status())
+	}
+	if same.detector != old.detector || same.detector.MaxMoves != 10 {
+		t.Errorf("want the anomaly history kept, with the new maximum of moves")
+	}
+	if !added.lastMove.IsZero() {
+		t.Errorf("a new pool took over the state of another one")
+	}
+
+	changed := newTestPool(testAlias, &utils.HealthCheck{Type: utils.HealthTcp, Port: 81})
+	keepPoolState([]*Group{{Pools: []*Pool{changed}}}, []*Group{{Pools: []*Pool{old}}})
+	if len(changed.healthy) != 0 {
+		t.Errorf("health results kept after the health check changed: %v", changed.healthy)
+	}
+}
@@ -0,0 +1,84 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+)
+
+// Reconciler manages the VIPs of the configured instance groups, for programs
+// that embed VIP Manager rather than run the vip_manager binary. It does not
+// serve HTTP or gRPC, the embedding program owns those. Each Reconciler has
+// its own configuration, but the cloud provider clients and the workers that
+// execute operations are shared by the process.
+type Reconciler struct {
+	cfg *Config
+}
+
+// ParseArgs parses vip_manager command line flags, without the program name,
+// into a configuration for New.
+func ParseArgs(args []string) (*Config, error) {
+	return parseArgs(args)
+}
+
+// New connects to the cloud provider, checks the configuration from
+// ParseArgs, and loads the intent.
+func New(cfg *Config) (*Reconciler, error) {
+	if err := setup(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.MaintenanceTxt || cfg.DnsSync {
+		utils.ConnectDns()
+	}
+	return &Reconciler{cfg: cfg}, nil
+}
+
+// Run reconciles the instance groups until ctx is canceled, then waits for
+// in-flight operations like on SIGTERM. It leaves signals to the embedding
+// program, and the goroutines it starts, e.g. the leader election, stop with
+// it.
+func (r *Reconciler) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if r.cfg.DnsSync {
+		go SyncDns(ctx, r.cfg)
+	}
+	if r.cfg.KubeController {
+		go WatchVipPools(ctx, r.cfg)
+	}
+	if r.cfg.lease != nil {
+		r.cfg.lease.Run(ctx)
+	}
+	RunLoops(ctx, r.cfg, nil)
+}
+
+// ReconcileOnce runs a single pass over all instance groups, and returns the
+// resulting assignments.
+func (r *Reconciler) ReconcileOnce(ctx context.Context) *State {
+	return ReconcileOnce(ctx, r.cfg.active.Load())
+}
+
+// Status returns the state of each pool as of its last reconcile pass.
+func (r *Reconciler) Status() []PoolStatus {
+	pools := []PoolStatus{}
+	for _, group := range r.cfg.active.Load().Groups {
+		for _, pool := range group.Pools {
+			pools = append(pools, pool.Status())
+		}
+	}
+	return pools
+}
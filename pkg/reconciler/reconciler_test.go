@@ -0,0 +1,196 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"github.com/bjornleffler/loadbalancing/utils"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testZone  = "us-central1-a"
+	testGroup = "vips"
+	testAlias = "vip-range"
+)
+
+// newTestReconciler runs a reconciler for the managed instance group
+// testGroup against fake, with extra flags.
+func newTestReconciler(t *testing.T, fake *utils.FakeCompute, vips string, args ...string) *Reconciler {
+	t.Helper()
+	utils.UseCompute(fake)
+	cfg, err := ParseArgs(append([]string{
+		"-project=test-project",
+		"-zone=" + testZone,
+		"-gce_instance_group=" + testGroup,
+		"-alias_network=" + testAlias,
+		"-vips=" + vips,
+		"-workers=1",
+	}, args...))
+	if err != nil {
+		t.Fatalf("ParseArgs: %v", err)
+	}
+	r, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r
+}
+
+// addInstance adds a running instance of testGroup with alias IPs in
+// testAlias.
+func addInstance(fake *utils.FakeCompute, name string, ips ...string) {
+	ranges := []*computepb.AliasIpRange{}
+	for _, ip := range ips {
+		ranges = append(ranges, &computepb.AliasIpRange{
+			IpCidrRange:         proto.String(ip + "/32"),
+			SubnetworkRangeName: proto.String(testAlias),
+		})
+	}
+	fake.AddInstance(testZone, testZone, testGroup, &computepb.Instance{
+		Name: proto.String(name),
+		NetworkInterfaces: []*computepb.NetworkInterface{{
+			NetworkIP:     proto.String("10.0.0.1"),
+			AliasIpRanges: ranges,
+		}},
+	})
+}
+
+// testPool returns the only pool of the reconciler.
+func testPool(t *testing.T, r *Reconciler) *Pool {
+	t.Helper()
+	cfg := r.cfg.active.Load()
+	if len(cfg.Groups) != 1 || len(cfg.Groups[0].Pools) != 1 {
+		t.Fatalf("want 1 group with 1 pool, got %d groups", len(cfg.Groups))
+	}
+	return cfg.Groups[0].Pools[0]
+}
+
+// aliasIps returns the alias IPs of the instances in fake, by name.
+func aliasIps(t *testing.T, fake *utils.FakeCompute, names ...string) map[string][]string {
+	t.Helper()
+	ips := map[string][]string{}
+	for _, name := range names {
+		instance, err := fake.GetInstance(context.Background(), "", testZone, name)
+		if err != nil {
+			t.Fatalf("GetInstance(%s): %v", name, err)
+		}
+		for _, nic := range instance.GetNetworkInterfaces() {
+			for _, r := range nic.GetAliasIpRanges() {
+				ips[name] = append(ips[name], r.GetIpCidrRange())
+			}
+		}
+		sort.Strings(ips[name])
+	}
+	return ips
+}
+
+func TestAllocateIps(t *testing.T) {
+	fake := utils.NewFakeCompute()
+	addInstance(fake, "vm-1")
+	addInstance(fake, "vm-2")
+	r := newTestReconciler(t, fake, "10.1.0.1,10.1.0.2,10.1.0.3,10.1.0.4")
+	ctx := context.Background()
+
+	if changes := AllocateIps(ctx, r.cfg, testPool(t, r)); changes != 2 {
+		t.Errorf("AllocateIps made %d changes, want 2", changes)
+	}
+	ips := aliasIps(t, fake, "vm-1", "vm-2")
+	if len(ips["vm-1"]) != 2 || len(ips["vm-2"]) != 2 {
+		t.Errorf("want 2 VIPs on each instance, got %v", ips)
+	}
+	if changes := AllocateIps(ctx, r.cfg, testPool(t, r)); changes != 0 {
+		t.Errorf("AllocateIps with all VIPs placed made %d changes, want 0", changes)
+	}
+}
+
+func TestReduceIps(t *testing.T) {
+	fake := utils.NewFakeCompute()
+	addInstance(fake, "vm-1", "10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4")
+	addInstance(fake, "vm-2")
+	r := newTestReconciler(t, fake, "10.1.0.1,10.1.0.2,10.1.0.3,10.1.0.4", "-max_move_fraction=0")
+	ctx := context.Background()
+
+	if changes := ReduceIps(ctx, r.cfg, testPool(t, r)); changes == 0 {
+		t.Errorf("ReduceIps made no changes")
+	}
+	if ips := aliasIps(t, fake, "vm-1"); len(ips["vm-1"]) != 2 {
+		t.Errorf("want 2 VIPs left on vm-1, got %v", ips["vm-1"])
+	}
+	AllocateIps(ctx, r.cfg, testPool(t, r))
+	if ips := aliasIps(t, fake, "vm-2"); len(ips["vm-2"]) != 2 {
+		t.Errorf("want 2 VIPs on vm-2 after allocation, got %v", ips["vm-2"])
+	}
+}
+
+func TestReconcilePool(t *testing.T) {
+	fake := utils.NewFakeCompute()
+	names := []string{}
+	for i := 1; i <= 3; i++ {
+		names = append(names, fmt.Sprintf("vm-%d", i))
+		addInstance(fake, names[i-1])
+	}
+	r := newTestReconciler(t, fake, "10.1.0.0/29", "-max_move_fraction=0")
+	ctx := context.Background()
+
+	if changes := ReconcilePool(ctx, r.cfg, testPool(t, r)); changes == 0 {
+		t.Errorf("ReconcilePool made no changes")
+	}
+	placed := map[string]string{}
+	for name, ips := range aliasIps(t, fake, names...) {
+		if len(ips) < 2 || len(ips) > 3 {
+			t.Errorf("%s has %d VIPs, want 2 or 3: %v", name, len(ips), ips)
+		}
+		for _, ip := range ips {
+			if other, ok := placed[ip]; ok {
+				t.Errorf("VIP %s is on %s and %s", ip, other, name)
+			}
+			placed[ip] = name
+		}
+	}
+	if len(placed) != 8 {
+		t.Errorf("placed %d VIPs, want 8", len(placed))
+	}
+	if changes := ReconcilePool(ctx, r.cfg, testPool(t, r)); changes != 0 {
+		t.Errorf("second ReconcilePool made %d changes, want 0", changes)
+	}
+	if status := r.Status(); len(status) != 1 || len(status[0].Spare) != 0 {
+		t.Errorf("want a pool without spare VIPs, got %+v", status)
+	}
+}
+
+func TestRunStopsWithContext(t *testing.T) {
+	fake := utils.NewFakeCompute()
+	addInstance(fake, "vm-1")
+	r := newTestReconciler(t, fake, "10.1.0.1,10.1.0.2")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Run did not return after its context was canceled")
+	}
+}
@@ -0,0 +1,145 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"log"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// replicaHolders returns the instances, and zones, that hold a replica of ip,
+// or receive one in operations.
+func replicaHolders(pool *Pool, instances map[string]*utils.GceInstance, operations map[string]utils.Operation, ip string) (map[string]bool, map[string]bool) {
+	names, zones := map[string]bool{}, map[string]bool{}
+	for name, instance := range instances {
+		ips := append(append([]string{}, *instance.AliasIps...), operations[name].Ips...)
+		for _, replica := range pool.replicas[ip] {
+			if slices.Contains(ips, replica) {
+				names[name] = true
+				zones[instance.Zone] = true
+			}
+		}
+	}
+	return names, zones
+}
+
+// replicaCandidates returns the instances that can take ip without a replica
+// of it, and with -spread_zones, of those the ones in zones without a
+// replica, if any.
+func replicaCandidates(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, operations map[string]utils.Operation, ip string) map[string]*utils.GceInstance {
+	if len(pool.replicas[ip]) == 0 {
+		return instances
+	}
+	names, zones := replicaHolders(pool, instances, operations, ip)
+	candidates, spread := map[string]*utils.GceInstance{}, map[string]*utils.GceInstance{}
+	for name, instance := range instances {
+		if names[name] {
+			continue
+		}
+		candidates[name] = instance
+		if !zones[instance.Zone] {
+			spread[name] = instance
+		}
+	}
+	if cfg.SpreadZones && len(spread) > 0 {
+		return spread
+	}
+	return candidates
+}
+
+// withoutReplicaConflicts drops moves to instances that hold, or receive in
+// an earlier move, a replica of the moved VIP, unless it is pinned there.
+func withoutReplicaConflicts(cfg *Config, pool *Pool, instances map[string]*utils.GceInstance, moves []utils.Move) []utils.Move {
+	if len(pool.replicas) == 0 {
+		return moves
+	}
+	adds := map[string]utils.Operation{}
+	allowed := []utils.Move{}
+	for _, move := range moves {
+		names, _ := replicaHolders(pool, instances, adds, move.Ip)
+		if pinned, _ := pinnedTo(cfg, pool, move.Ip); names[move.To] && pinned != move.To {
+			log.Printf("Skip move of %s to %s, which holds a replica of it", move.Ip, move.To)
+			continue
+		}
+		if instance := instances[move.To]; instance != nil {
+			addOperation(adds, utils.Add, instance, move.Ip)
+		}
+		allowed = append(allowed, move)
+	}
+	return allowed
+}
+
+// SpreadReplicas moves VIPs away from replicas of the same service on their
+// instance, or with -spread_zones in their zone, to an instance that can take
+// them, subject to the cap. Of two replicas, the one that sorts last moves.
+// Like pins, replicas are explicit, so move windows and the cooldown do not
+// apply.
+func SpreadReplicas(ctx context.Context, cfg *Config, pool *Pool) int {
+	if len(pool.replicas) == 0 {
+		return 0
+	}
+	instances, err := GetInstances(ctx, cfg, pool)
+	if err != nil {
+		log.Printf("Error getting instances: %v", err)
+		return 0
+	}
+	managed := withPoolIps(pool, managedInstances(ctx, cfg, pool, instances))
+	weights := instanceWeights(cfg, managed)
+	adds := map[string]utils.Operation{}
+	moves := []utils.Move{}
+	names := maps.Keys(managed)
+	slices.Sort(names)
+	for _, name := range names {
+		instance := managed[name]
+		for _, ip := range *instance.AliasIps {
+			if _, pinned := pinnedTo(cfg, pool, ip); pinned {
+				continue
+			}
+			conflict := false
+			for _, replica := range pool.replicas[ip] {
+				for other, holder := range managed {
+					if replica < ip && slices.Contains(*holder.AliasIps, replica) &&
+						(other == name || (cfg.SpreadZones && holder.Zone == instance.Zone)) {
+						conflict = true
+					}
+				}
+			}
+			if !conflict {
+				continue
+			}
+			candidates := replicaCandidates(cfg, pool, managed, adds, ip)
+			if _, ok := candidates[name]; ok {
+				// The zone can not be avoided, and the instance has no replica.
+				continue
+			}
+			to := leastLoaded(cfg, candidates, weights, adds)
+			if to == "" {
+				log.Printf("Warning: no instance to separate %s from its replicas in %s", ip, pool.Name())
+				continue
+			}
+			log.Printf("Move %s from %s to %s, away from its replicas", ip, name, to)
+			addOperation(adds, utils.Add, managed[to], ip)
+			moves = append(moves, utils.Move{Pool: pool.Name(), Ip: ip, From: name, To: to})
+		}
+	}
+	if len(moves) == 0 || !allowMoves(cfg, pool, len(moves)) {
+		return 0
+	}
+	return executeMoves(ctx, cfg, pool, instances, moves, map[string]utils.Operation{}, ClassAllocate)
+}
@@ -0,0 +1,148 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// replicaSets returns the replicas of each VIP, like the replicas of a pool
+// in the configuration file.
+func replicaSets(sets ...[]string) map[string][]string {
+	replicas := map[string][]string{}
+	for _, set := range sets {
+		for _, ip := range set {
+			for _, other := range set {
+				if other != ip {
+					replicas[ip] = append(replicas[ip], other)
+				}
+			}
+		}
+	}
+	return replicas
+}
+
+func TestWithoutReplicaConflicts(t *testing.T) {
+	held := map[string][]string{
+		"vm-1": {"10.1.0.1", "10.1.0.3"},
+		"vm-2": {"10.1.0.2"},
+		"vm-3": nil,
+	}
+	for _, test := range []struct {
+		name     string
+		replicas map[string][]string
+		pins     map[string]string
+		moves    []utils.Move
+		want     []utils.Move
+	}{
+		{
+			name:  "no replicas",
+			moves: []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-2"}},
+			want:  []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-2"}},
+		},
+		{
+			name:     "to a replica",
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.2"}),
+			moves:    []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-2"}},
+			want:     []utils.Move{},
+		},
+		{
+			name:     "away from a replica",
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.2"}),
+			moves:    []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-3"}},
+			want:     []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-3"}},
+		},
+		{
+			name:     "to a replica of an earlier move",
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.3"}),
+			moves: []utils.Move{
+				{Ip: "10.1.0.1", From: "vm-1", To: "vm-3"},
+				{Ip: "10.1.0.3", From: "vm-1", To: "vm-3"},
+			},
+			want: []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-3"}},
+		},
+		{
+			name:     "pinned to a replica",
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.2"}),
+			pins:     map[string]string{"10.1.0.1": "vm-2"},
+			moves:    []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-2"}},
+			want:     []utils.Move{{Ip: "10.1.0.1", From: "vm-1", To: "vm-2"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReconciler(t, utils.NewFakeCompute(), "10.1.0.1,10.1.0.2,10.1.0.3")
+			pool := testPool(t, r)
+			pool.replicas = test.replicas
+			pool.pins = test.pins
+			got := withoutReplicaConflicts(r.cfg, pool, testInstances(held), test.moves)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("withoutReplicaConflicts(%v) = %v, want %v", test.moves, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSpreadReplicas(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		held     map[string][]string
+		replicas map[string][]string
+		pins     map[string]string
+		want     map[string][]string
+	}{
+		{
+			name:     "replicas on one instance",
+			held:     map[string][]string{"vm-1": {"10.1.0.1", "10.1.0.2"}, "vm-2": {"10.1.0.3"}, "vm-3": nil},
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.2"}),
+			want:     map[string][]string{"vm-1": {"10.1.0.1/32"}, "vm-2": {"10.1.0.3/32"}, "vm-3": {"10.1.0.2/32"}},
+		},
+		{
+			name:     "replicas apart",
+			held:     map[string][]string{"vm-1": {"10.1.0.1", "10.1.0.3"}, "vm-2": {"10.1.0.2"}, "vm-3": nil},
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.2"}),
+			want:     map[string][]string{"vm-1": {"10.1.0.1/32", "10.1.0.3/32"}, "vm-2": {"10.1.0.2/32"}},
+		},
+		{
+			name:     "pinned together",
+			held:     map[string][]string{"vm-1": {"10.1.0.1", "10.1.0.2"}, "vm-2": {"10.1.0.3"}, "vm-3": nil},
+			replicas: replicaSets([]string{"10.1.0.1", "10.1.0.2"}),
+			pins:     map[string]string{"10.1.0.2": "vm-1"},
+			want:     map[string][]string{"vm-1": {"10.1.0.1/32", "10.1.0.2/32"}, "vm-2": {"10.1.0.3/32"}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fake := utils.NewFakeCompute()
+			names := maps.Keys(test.held)
+			slices.Sort(names)
+			for _, name := range names {
+				addInstance(fake, name, test.held[name]...)
+			}
+			r := newTestReconciler(t, fake, "10.1.0.1,10.1.0.2,10.1.0.3", "-max_move_fraction=0")
+			pool := testPool(t, r)
+			pool.replicas = test.replicas
+			pool.pins = test.pins
+
+			SpreadReplicas(context.Background(), r.cfg, pool)
+			if got := aliasIps(t, fake, names...); !maps.EqualFunc(got, test.want, slices.Equal[string]) {
+				t.Errorf("alias IPs %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Single reconcile passes, for serverless mode and the reconcile command.
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+)
+
+// State is the outcome of a reconcile pass in serverless mode. It is kept in
+// GCS, since serverless instances do not keep state between invocations.
+type State struct {
+	Time    time.Time
+	Changes int
+	// Alias IPs by instance name, by pool name.
+	Pools map[string]map[string][]string
+}
+
+func loadState(cfg *Config) *State {
+	if cfg.StateBucket == "" {
+		return nil
+	}
+	data, err := utils.ReadObject(cfg.StateBucket, cfg.StateObject)
+	if err == utils.ErrObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		log.Printf("Error reading state: %v", err)
+		return nil
+	}
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		log.Printf("Error parsing state: %v", err)
+		return nil
+	}
+	return state
+}
+
+func saveState(cfg *Config, state *State) {
+	if cfg.StateBucket == "" {
+		return
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding state: %v", err)
+		return
+	}
+	if err := utils.WriteObject(cfg.StateBucket, cfg.StateObject, data); err != nil {
+		log.Printf("Error writing state: %v", err)
+	}
+}
+
+// ReconcileOnce runs a single pass over all instance groups.
+func ReconcileOnce(ctx context.Context, cfg *Config) *State {
+	state := &State{
+		Time:  time.Now(),
+		Pools: map[string]map[string][]string{},
+	}
+	for _, group := range cfg.Groups {
+		start := time.Now()
+		for _, pool := range group.Pools {
+			state.Changes += ReconcilePool(ctx, cfg, pool)
+			instances, err := GetInstances(ctx, cfg, pool)
+			if err != nil {
+				log.Printf("Error getting instances: %v", err)
+				continue
+			}
+			assigned := map[string][]string{}
+			for name, instance := range instances {
+				assigned[name] = *instance.AliasIps
+			}
+			state.Pools[pool.Name()] = assigned
+		}
+		reconcileDuration.WithLabelValues(group.Name).Observe(time.Since(start).Seconds())
+	}
+	return state
+}
+
+// ServeReconcile handles HTTP triggered reconcile passes, e.g. from Cloud
+// Scheduler, which must carry the admin token. Passes are serialized. On
+// reload, e.g. on SIGHUP, the configuration is reloaded between passes.
+// When done is canceled, e.g. on SIGTERM, in-flight passes complete, and it
+// returns. Also returns when the server fails.
+func ServeReconcile(done context.Context, cfg *Config, reload <-chan struct{}) error {
+	var mu sync.Mutex
+	go func() {
+		for range reload {
+			mu.Lock()
+			newCfg, err := reloadConfig(cfg)
+			if err != nil {
+				log.Printf("Error reloading configuration, keeping the current one: %v", err)
+			} else {
+				keepPoolState(newCfg.Groups, cfg.Groups)
+				cfg = newCfg
+				cfg.active.Store(cfg)
+				PrintConfig(cfg)
+			}
+			mu.Unlock()
+		}
+	}()
+	listen := cfg.Listen
+	http.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST to reconcile", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, cfg.AdminToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if previous := loadState(cfg); previous != nil {
+			log.Printf("Previous reconcile at %v made %d changes.", previous.Time, previous.Changes)
+		}
+		state := ReconcileOnce(r.Context(), cfg)
+		log.Printf("Reconcile made %d changes.", state.Changes)
+		saveState(cfg, state)
+		if cfg.DnsSync {
+			syncDns(cfg)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+	// Let in-flight passes complete before exiting.
+	server := &http.Server{Addr: listen}
+	go func() {
+		<-done.Done()
+		log.Printf("Stop serving, wait for in-flight requests to complete.")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownSeconds)*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down: %v", err)
+		}
+	}()
+	log.Printf("Serve reconcile requests on %s", listen)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	log.Printf("Stop VIP Manager.")
+	return nil
+}
@@ -0,0 +1,259 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Strategy places the VIPs of a pool on its instances, for placements other
+// than PlacementBalanced. Plan gets the instances that may hold VIPs, with
+// the VIPs of the pool they hold, and returns the operations to reach the
+// desired placement: an Add for each spare VIP to place, and for each VIP to
+// move, a Remove from its instance and an Add to the other one. Removes
+// without an Add are ignored, VIPs stay assigned. The reconciler executes the
+// plan subject to pins, the cap, the cooldown, move windows and the
+// guardrail, so Plan only decides where VIPs go.
+type Strategy interface {
+	Plan(instances map[string]*utils.GceInstance, pool *Pool) []utils.Operation
+}
+
+const (
+	PlacementEven     = "even"
+	PlacementWeighted = "weighted"
+	PlacementLoad     = "load"
+)
+
+// Strategies by placement name.
+var strategies = map[string]func(cfg *Config) Strategy{
+	PlacementEven: func(cfg *Config) Strategy {
+		return &shareStrategy{cfg: cfg, weights: func(instances map[string]*utils.GceInstance) map[string]float64 {
+			weights := map[string]float64{}
+			for name := range instances {
+				weights[name] = 1
+			}
+			return weights
+		}}
+	},
+	PlacementWeighted: func(cfg *Config) Strategy {
+		return &shareStrategy{cfg: cfg, weights: func(instances map[string]*utils.GceInstance) map[string]float64 {
+			return instanceWeights(cfg, instances)
+		}}
+	},
+	PlacementRendezvous: func(cfg *Config) Strategy {
+		return &rendezvousStrategy{cfg: cfg}
+	},
+	PlacementLoad: func(cfg *Config) Strategy {
+		return &shareStrategy{cfg: cfg, weights: func(instances map[string]*utils.GceInstance) map[string]float64 {
+			return loadWeights(cfg, instances)
+		}}
+	},
+}
+
+// RegisterStrategy adds a placement strategy, for programs that embed the
+// reconciler. The factory runs for each pool whenever the configuration is
+// loaded, with -placement NAME.
+func RegisterStrategy(name string, factory func(cfg *Config) Strategy) {
+	strategies[name] = factory
+}
+
+// placements returns the names of all placements.
+func placements() []string {
+	names := append(maps.Keys(strategies), PlacementBalanced)
+	slices.Sort(names)
+	return names
+}
+
+// newStrategy returns the strategy of the configured placement, nil for
+// balanced placement.
+func newStrategy(cfg *Config) Strategy {
+	if factory, ok := strategies[cfg.Placement]; ok && cfg.Placement != PlacementBalanced {
+		return factory(cfg)
+	}
+	return nil
+}
+
+// rendezvousStrategy places each VIP on its desired instance, see
+// desiredPlacement.
+type rendezvousStrategy struct {
+	cfg *Config
+}
+
+func (s *rendezvousStrategy) Plan(instances map[string]*utils.GceInstance, pool *Pool) []utils.Operation {
+	desired := desiredPlacement(s.cfg, pool, instances, instanceWeights(s.cfg, instances))
+	current := map[string]string{}
+	for name, instance := range instances {
+		for _, ip := range *instance.AliasIps {
+			current[ip] = name
+		}
+	}
+	adds, removes := map[string]utils.Operation{}, map[string]utils.Operation{}
+	for ip, to := range desired {
+		if from, ok := current[ip]; ok {
+			if from == to {
+				continue
+			}
+			addOperation(removes, utils.Remove, instances[from], ip)
+		}
+		addOperation(adds, utils.Add, instances[to], ip)
+	}
+	return planOperations(removes, adds)
+}
+
+// shareStrategy gives each instance its share of the VIPs of a pool by
+// weight, rounded up, and below the cap. Instances keep the VIPs intended for
+// them first, and give up the rest of what exceeds their share. Those, and
+// the spare VIPs, go to the instances furthest below their share.
+type shareStrategy struct {
+	cfg     *Config
+	weights func(instances map[string]*utils.GceInstance) map[string]float64
+}
+
+func (s *shareStrategy) Plan(instances map[string]*utils.GceInstance, pool *Pool) []utils.Operation {
+	weights := s.weights(instances)
+	totalWeight := 0.0
+	for _, weight := range weights {
+		totalWeight += weight
+	}
+	if totalWeight <= 0 {
+		return nil
+	}
+	share := map[string]int{}
+	for name := range instances {
+		share[name] = int(math.Ceil(float64(len(pool.VIPs)) * weights[name] / totalWeight))
+		if s.cfg.MaxIpsPerInstance > 0 && share[name] > int(s.cfg.MaxIpsPerInstance) {
+			share[name] = int(s.cfg.MaxIpsPerInstance)
+		}
+	}
+	names := maps.Keys(instances)
+	slices.Sort(names)
+	count := map[string]int{}
+	// VIPs to place, with the instance that holds them, if any.
+	from := map[string]string{}
+	placed := map[string]bool{}
+	for _, name := range names {
+		ips := append([]string{}, *instances[name].AliasIps...)
+		sort.SliceStable(ips, func(i, j int) bool {
+			return s.keeps(pool, name, ips[i]) && !s.keeps(pool, name, ips[j])
+		})
+		for _, ip := range ips {
+			placed[ip] = true
+			if _, pinned := pinnedTo(s.cfg, pool, ip); pinned || count[name] < share[name] {
+				count[name]++
+			} else {
+				from[ip] = name
+			}
+		}
+	}
+	for _, ip := range pool.VIPs {
+		if !placed[ip] {
+			from[ip] = ""
+		}
+	}
+	ips := maps.Keys(from)
+	slices.Sort(ips)
+	adds, removes := map[string]utils.Operation{}, map[string]utils.Operation{}
+	for _, ip := range ips {
+		to := ""
+		for _, name := range names {
+			if count[name] < share[name] && (to == "" ||
+				(float64(count[name])+0.5)/weights[name] < (float64(count[to])+0.5)/weights[to]) {
+				to = name
+			}
+		}
+		if to == "" {
+			// All instances have their share, the VIP stays where it is.
+			continue
+		}
+		count[to]++
+		if from[ip] != "" {
+			addOperation(removes, utils.Remove, instances[from[ip]], ip)
+		}
+		addOperation(adds, utils.Add, instances[to], ip)
+	}
+	return planOperations(removes, adds)
+}
+
+// keeps returns true if an instance holding a VIP should keep it rather than
+// others: pinned VIPs, and VIPs intended for it.
+func (s *shareStrategy) keeps(pool *Pool, name, ip string) bool {
+	if pinned, ok := pinnedTo(s.cfg, pool, ip); ok {
+		return pinned == name
+	}
+	intended, _ := s.cfg.intent.Get(pool.Name(), ip)
+	return intended == name
+}
+
+// loadWeights weighs instances by how idle they are, according to
+// -rebalance_signal from metrics_exporter, in steps of 10% so that small
+// changes in load do not move VIPs. Instances that do not report their load
+// count as half busy.
+func loadWeights(cfg *Config, instances map[string]*utils.GceInstance) map[string]float64 {
+	loads := scrapeLoads(instances, cfg.RebalancePort)
+	weights := instanceWeights(cfg, instances)
+	for name := range weights {
+		idle := 0.5
+		if load, ok := loads[name]; ok {
+			usage := load.CpuPercent
+			if cfg.RebalanceSignal == SignalSaturation && load.Saturation >= 0 {
+				usage = load.Saturation
+			}
+			idle = math.Round(10-usage/10) / 10
+		}
+		weights[name] *= math.Max(idle, 0.1)
+	}
+	return weights
+}
+
+// planOperations returns the removes, then the adds, ordered by instance.
+func planOperations(removes, adds map[string]utils.Operation) []utils.Operation {
+	operations := []utils.Operation{}
+	for _, ops := range []map[string]utils.Operation{removes, adds} {
+		names := maps.Keys(ops)
+		slices.Sort(names)
+		for _, name := range names {
+			operations = append(operations, ops[name])
+		}
+	}
+	return operations
+}
+
+// plannedAdds returns the instance a plan adds each VIP to.
+func plannedAdds(plan []utils.Operation) map[string]string {
+	to := map[string]string{}
+	for _, operation := range plan {
+		if operation.Type == utils.Add && operation.Instance != nil {
+			for _, ip := range operation.Ips {
+				to[ip] = operation.Instance.Name
+			}
+		}
+	}
+	return to
+}
+
+// checkPlacement checks that a placement is balanced or has a strategy.
+func checkPlacement(placement string) error {
+	if _, ok := strategies[placement]; !ok && placement != PlacementBalanced {
+		return fmt.Errorf("unknown placement %q, use one of %s", placement, strings.Join(placements(), ", "))
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package reconciler
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/bjornleffler/loadbalancing/utils"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// testInstances returns instances holding VIPs, by name.
+func testInstances(held map[string][]string) map[string]*utils.GceInstance {
+	instances := map[string]*utils.GceInstance{}
+	for name, ips := range held {
+		ips := append([]string{}, ips...)
+		instances[name] = &utils.GceInstance{Name: name, Zone: testZone, AliasIps: &ips}
+	}
+	return instances
+}
+
+// applyPlan returns the VIPs each instance holds after a plan, sorted.
+func applyPlan(instances map[string]*utils.GceInstance, plan []utils.Operation) map[string][]string {
+	held := map[string][]string{}
+	for name, instance := range instances {
+		held[name] = append([]string{}, *instance.AliasIps...)
+	}
+	for _, operation := range plan {
+		name := operation.Instance.Name
+		for _, ip := range operation.Ips {
+			if operation.Type == utils.Add {
+				held[name] = append(held[name], ip)
+			} else {
+				if i := slices.Index(held[name], ip); i >= 0 {
+					held[name] = slices.Delete(held[name], i, i+1)
+				}
+			}
+		}
+	}
+	for name := range held {
+		sort.Strings(held[name])
+	}
+	return held
+}
+
+// counts returns the number of VIPs each instance holds.
+func counts(held map[string][]string) map[string]int {
+	count := map[string]int{}
+	for name, ips := range held {
+		count[name] = len(ips)
+	}
+	return count
+}
+
+func TestShareStrategy(t *testing.T) {
+	vips := []string{"10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4"}
+	for _, test := range []struct {
+		name    string
+		args    []string
+		held    map[string][]string
+		weights map[string]float64
+		pins    map[string]string
+		want    map[string]int
+		moves   int
+	}{
+		{
+			name: "spare VIPs",
+			held: map[string][]string{"vm-1": nil, "vm-2": nil},
+			want: map[string]int{"vm-1": 2, "vm-2": 2},
+		},
+		{
+			name:  "above share",
+			held:  map[string][]string{"vm-1": vips, "vm-2": nil},
+			want:  map[string]int{"vm-1": 2, "vm-2": 2},
+			moves: 2,
+		},
+		{
+			name:  "at share",
+			held:  map[string][]string{"vm-1": vips[:2], "vm-2": vips[2:]},
+			want:  map[string]int{"vm-1": 2, "vm-2": 2},
+			moves: 0,
+		},
+		{
+			name:    "by weight",
+			held:    map[string][]string{"vm-1": vips[:2], "vm-2": vips[2:]},
+			weights: map[string]float64{"vm-1": 3, "vm-2": 1},
+			want:    map[string]int{"vm-1": 3, "vm-2": 1},
+			moves:   1,
+		},
+		{
+			name:  "pinned",
+			held:  map[string][]string{"vm-1": vips, "vm-2": nil},
+			pins:  map[string]string{"10.1.0.1": "vm-1", "10.1.0.2": "vm-1", "10.1.0.3": "vm-1"},
+			want:  map[string]int{"vm-1": 3, "vm-2": 1},
+			moves: 1,
+		},
+		{
+			name: "cap",
+			args: []string{"-max_ips_per_instance=1"},
+			held: map[string][]string{"vm-1": nil, "vm-2": nil},
+			want: map[string]int{"vm-1": 1, "vm-2": 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReconciler(t, utils.NewFakeCompute(), "10.1.0.1,10.1.0.2,10.1.0.3,10.1.0.4", test.args...)
+			pool := testPool(t, r)
+			pool.pins = test.pins
+			strategy := &shareStrategy{cfg: r.cfg, weights: func(instances map[string]*utils.GceInstance) map[string]float64 {
+				weights := map[string]float64{}
+				for name := range instances {
+					weights[name] = 1
+					if weight, ok := test.weights[name]; ok {
+						weights[name] = weight
+					}
+				}
+				return weights
+			}}
+			instances := testInstances(test.held)
+			plan := strategy.Plan(instances, pool)
+			held := applyPlan(instances, plan)
+			if got := counts(held); !maps.Equal(got, test.want) {
+				t.Errorf("VIPs per instance %v, want %v: %v", got, test.want, held)
+			}
+			removes := 0
+			for _, operation := range plan {
+				if operation.Type == utils.Remove {
+					removes += len(operation.Ips)
+				}
+			}
+			if removes != test.moves {
+				t.Errorf("%d moves, want %d: %v", removes, test.moves, plan)
+			}
+			for ip, name := range test.pins {
+				if !slices.Contains(held[name], ip) {
+					t.Errorf("pinned VIP %s left %s: %v", ip, name, held)
+				}
+			}
+			if again := strategy.Plan(testInstances(held), pool); len(again) != 0 {
+				t.Errorf("second plan not empty: %v", again)
+			}
+		})
+	}
+}
+
+func TestRendezvousStrategy(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		vips string
+		held map[string][]string
+	}{
+		{
+			name: "spare VIPs",
+			vips: "10.1.0.0/29",
+			held: map[string][]string{"vm-1": nil, "vm-2": nil, "vm-3": nil},
+		},
+		{
+			name: "all on one instance",
+			vips: "10.1.0.0/29",
+			held: map[string][]string{
+				"vm-1": {"10.1.0.0", "10.1.0.1", "10.1.0.2", "10.1.0.3", "10.1.0.4", "10.1.0.5", "10.1.0.6", "10.1.0.7"},
+				"vm-2": nil,
+			},
+		},
+		{
+			name: "instance added",
+			vips: "10.1.0.0/29",
+			held: map[string][]string{
+				"vm-1": {"10.1.0.0", "10.1.0.1", "10.1.0.2", "10.1.0.3"},
+				"vm-2": {"10.1.0.4", "10.1.0.5", "10.1.0.6", "10.1.0.7"},
+				"vm-3": nil,
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestReconciler(t, utils.NewFakeCompute(), test.vips, "-placement=rendezvous")
+			pool := testPool(t, r)
+			strategy := newStrategy(r.cfg)
+			instances := testInstances(test.held)
+			held := applyPlan(instances, strategy.Plan(instances, pool))
+
+			share := int(math.Ceil(float64(len(pool.VIPs)) / float64(len(instances))))
+			placed := map[string]string{}
+			for name, ips := range held {
+				if len(ips) > share {
+					t.Errorf("%s holds %d VIPs, above its share of %d", name, len(ips), share)
+				}
+				for _, ip := range ips {
+					if other, ok := placed[ip]; ok {
+						t.Errorf("VIP %s is on %s and %s", ip, other, name)
+					}
+					placed[ip] = name
+				}
+			}
+			if len(placed) != len(pool.VIPs) {
+				t.Errorf("placed %d VIPs, want %d: %v", len(placed), len(pool.VIPs), held)
+			}
+			if again := strategy.Plan(testInstances(held), pool); len(again) != 0 {
+				t.Errorf("second plan not empty: %v", again)
+			}
+			// The placement does not depend on where the VIPs are.
+			empty := map[string][]string{}
+			for name := range test.held {
+				empty[name] = nil
+			}
+			instances = testInstances(empty)
+			if fresh := applyPlan(instances, strategy.Plan(instances, pool)); !maps.EqualFunc(fresh, held, slices.Equal[string]) {
+				t.Errorf("placement from scratch %v, want %v", fresh, held)
+			}
+		})
+	}
+}
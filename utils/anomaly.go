@@ -0,0 +1,120 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Anomaly detection compares successive snapshots of VIP assignments, to catch
+// misconfigurations that a steady state view hides.
+
+import (
+	"fmt"
+	"time"
+)
+
+// Snapshot maps instance names to the alias IPs they hold. Instances that are
+// running but hold no alias IPs are present with an empty list.
+type Snapshot map[string][]string
+
+type AnomalyKind int
+
+const (
+	// A VIP moved between instances too often.
+	FrequentMoves AnomalyKind = iota
+	// A running instance lost all of its VIPs.
+	LostAllIps
+)
+
+func (k AnomalyKind) String() string {
+	switch k {
+	case FrequentMoves:
+		return "FrequentMoves"
+	case LostAllIps:
+		return "LostAllIps"
+	default:
+		return "Unknown"
+	}
+}
+
+type Anomaly struct {
+	Kind     AnomalyKind
+	Instance string
+	Ip       string
+	Message  string
+}
+
+type AnomalyDetector struct {
+	// Max number of times a VIP may move in MoveWindow.
+	MaxMoves   int
+	MoveWindow time.Duration
+
+	previous  Snapshot
+	lastOwner map[string]string
+	moves     map[string][]time.Time
+}
+
+func NewAnomalyDetector(maxMoves int, moveWindow time.Duration) *AnomalyDetector {
+	return &AnomalyDetector{
+		MaxMoves:   maxMoves,
+		MoveWindow: moveWindow,
+		lastOwner:  map[string]string{},
+		moves:      map[string][]time.Time{},
+	}
+}
+
+// Observe compares a snapshot with the previous one and returns anomalies.
+func (d *AnomalyDetector) Observe(now time.Time, current Snapshot) []Anomaly {
+	anomalies := []Anomaly{}
+
+	// Instances that held VIPs, are still running, but hold none now.
+	for name, ips := range d.previous {
+		currentIps, running := current[name]
+		if len(ips) > 0 && running && len(currentIps) == 0 {
+			anomalies = append(anomalies, Anomaly{
+				Kind:     LostAllIps,
+				Instance: name,
+				Message:  fmt.Sprintf("Instance %s lost all %d alias IPs while still running", name, len(ips)),
+			})
+		}
+	}
+
+	// VIPs that changed owner. Unassigned VIPs keep their last owner, so
+	// that A -> unassigned -> B counts as one move.
+	for name, ips := range current {
+		for _, ip := range ips {
+			last, ok := d.lastOwner[ip]
+			d.lastOwner[ip] = name
+			if !ok || last == name {
+				continue
+			}
+			recent := []time.Time{now}
+			for _, t := range d.moves[ip] {
+				if now.Sub(t) < d.MoveWindow {
+					recent = append(recent, t)
+				}
+			}
+			d.moves[ip] = recent
+			if len(recent) > d.MaxMoves {
+				anomalies = append(anomalies, Anomaly{
+					Kind:     FrequentMoves,
+					Instance: name,
+					Ip:       ip,
+					Message: fmt.Sprintf("VIP %s moved %d times in %v, now to %s",
+						ip, len(recent), d.MoveWindow, name),
+				})
+			}
+		}
+	}
+	d.previous = current
+	return anomalies
+}
@@ -0,0 +1,166 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Append-only audit log of alias IP operations, as JSON lines in a local file
+// or as Cloud Logging entries.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	logging "google.golang.org/api/logging/v2"
+)
+
+const loggingPrefix = "logging://"
+
+// Entries per Cloud Logging write request.
+const maxAuditBatch = 100
+
+// AuditRecord is an operation, when planned or when done. Event is "planned",
+// or the result of the operation.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	Event        string    `json:"event"`
+	Cycle        string    `json:"cycle,omitempty"`
+	Project      string    `json:"project"`
+	Pool         string    `json:"pool"`
+	Zone         string    `json:"zone"`
+	Instance     string    `json:"instance"`
+	Type         string    `json:"type"`
+	Ips          []string  `json:"ips"`
+	Reason       string    `json:"reason,omitempty"`
+	GceOperation string    `json:"gce_operation,omitempty"`
+}
+
+var (
+	auditMu      sync.Mutex
+	auditFile    *os.File
+	auditLog     string
+	auditEntries chan AuditRecord
+)
+
+// OpenAuditLog records all operations from now on in a local file, or in
+// Cloud Logging with logging://LOG_ID, as the log
+// projects/PROJECT/logs/LOG_ID.
+func OpenAuditLog(dest, project string) error {
+	if strings.HasPrefix(dest, loggingPrefix) {
+		c, err := defaultClient(context.Background(), logging.LoggingWriteScope)
+		if err != nil {
+			return err
+		}
+		service, err := logging.New(c)
+		if err != nil {
+			return err
+		}
+		auditLog = fmt.Sprintf("projects/%s/logs/%s", project, strings.TrimPrefix(dest, loggingPrefix))
+		auditEntries = make(chan AuditRecord, maxPendingEvents)
+		go writeAuditEntries(service)
+		return nil
+	}
+	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+// audit records an operation in the audit log, if any.
+func audit(cfg *GcpConfig, operation Operation, event string) {
+	if auditFile == nil && auditEntries == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:         time.Now(),
+		Event:        event,
+		Cycle:        operation.Cycle,
+		Project:      cfg.Project,
+		Pool:         cfg.GceInstanceGroup + "/" + cfg.AliasNetwork,
+		Zone:         operation.Instance.Zone,
+		Instance:     operation.Instance.Name,
+		Type:         strings.ToLower(operation.Type.String()),
+		Ips:          operation.Ips,
+		Reason:       operation.Reason,
+		GceOperation: operation.GceOperation,
+	}
+	if auditEntries != nil {
+		select {
+		case auditEntries <- record:
+		default:
+			log.Printf("Warning: Cloud Logging is behind, dropped audit record for %s %v on %s", record.Type, record.Ips, record.Instance)
+		}
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding audit record: %v", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditFile.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing audit log %s: %v", auditFile.Name(), err)
+	}
+}
+
+// writeAuditEntries writes queued records to Cloud Logging in batches.
+func writeAuditEntries(service *logging.Service) {
+	for record := range auditEntries {
+		records := []AuditRecord{record}
+	batch:
+		for len(records) < maxAuditBatch {
+			select {
+			case record := <-auditEntries:
+				records = append(records, record)
+			default:
+				break batch
+			}
+		}
+		entries := []*logging.LogEntry{}
+		for _, record := range records {
+			data, err := json.Marshal(record)
+			if err != nil {
+				log.Printf("Error encoding audit record: %v", err)
+				continue
+			}
+			severity := "INFO"
+			if record.Event == "failed" {
+				severity = "WARNING"
+			}
+			entries = append(entries, &logging.LogEntry{
+				Timestamp:   record.Time.Format(time.RFC3339Nano),
+				Severity:    severity,
+				JsonPayload: data,
+				Labels:      map[string]string{"pool": record.Pool, "instance": record.Instance},
+			})
+		}
+		req := &logging.WriteLogEntriesRequest{
+			LogName:  auditLog,
+			Resource: &logging.MonitoredResource{Type: "global"},
+			Entries:  entries,
+		}
+		if _, err := service.Entries.Write(req).Context(context.Background()).Do(); err != nil {
+			countApiError("entries.write")
+			log.Printf("Error writing %d audit records to %s: %v", len(entries), auditLog, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The autoscaler of a managed instance group, to keep the group large enough
+// for its VIPs.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrNoAutoscaler = errors.New("no autoscaler")
+
+// SetAutoscalerMin sets the minimum number of replicas of the autoscaler of
+// the managed instance group, capped at its maximum. Returns the minimum,
+// and whether it changed.
+func SetAutoscalerMin(ctx context.Context, cfg *GcpConfig, replicas int64) (int64, bool, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	manager, err := computeClient.GetInstanceGroupManager(ctx, cfg.Project, cfg.Region, cfg.Zone, cfg.GceInstanceGroup)
+	if err != nil {
+		if cfg.Region != "" {
+			countApiError("regionInstanceGroupManagers.get")
+		} else {
+			countApiError("instanceGroupManagers.get")
+		}
+		return 0, false, fmt.Errorf("Error getting instance group manager %s: %v", cfg.GceInstanceGroup, err)
+	}
+	url := manager.GetStatus().GetAutoscaler()
+	if url == "" {
+		return 0, false, fmt.Errorf("instance group %s: %w", cfg.GceInstanceGroup, ErrNoAutoscaler)
+	}
+	name := path.Base(url)
+
+	autoscaler, err := computeClient.GetAutoscaler(ctx, cfg.Project, cfg.Region, cfg.Zone, name)
+	if err != nil {
+		if cfg.Region != "" {
+			countApiError("regionAutoscalers.get")
+		} else {
+			countApiError("autoscalers.get")
+		}
+		return 0, false, fmt.Errorf("Error getting autoscaler %s: %v", name, err)
+	}
+	policy := autoscaler.GetAutoscalingPolicy()
+	if policy == nil {
+		return 0, false, fmt.Errorf("autoscaler %s has no policy", name)
+	}
+	if max := int64(policy.GetMaxNumReplicas()); max > 0 && replicas > max {
+		replicas = max
+	}
+	if int64(policy.GetMinNumReplicas()) == replicas {
+		return replicas, false, nil
+	}
+
+	patch := &computepb.Autoscaler{
+		Name: proto.String(name),
+		AutoscalingPolicy: &computepb.AutoscalingPolicy{
+			MinNumReplicas: proto.Int32(int32(replicas)),
+		},
+	}
+	countWrite()
+	if _, err := computeClient.PatchAutoscaler(ctx, cfg.Project, cfg.Region, cfg.Zone, patch); err != nil {
+		if cfg.Region != "" {
+			countApiError("regionAutoscalers.patch")
+		} else {
+			countApiError("autoscalers.patch")
+		}
+		return 0, false, fmt.Errorf("Error updating autoscaler %s: %v", name, err)
+	}
+	return replicas, true, nil
+}
@@ -0,0 +1,66 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSetAutoscalerMin(t *testing.T) {
+	fake := NewFakeCompute()
+	UseCompute(fake)
+	fake.SetGroupManager(testZone, "vips", &computepb.InstanceGroupManager{
+		Status: &computepb.InstanceGroupManagerStatus{Autoscaler: proto.String("zones/" + testZone + "/autoscalers/vips-as")},
+	})
+	fake.AddAutoscaler(testZone, &computepb.Autoscaler{
+		Name: proto.String("vips-as"),
+		AutoscalingPolicy: &computepb.AutoscalingPolicy{
+			MinNumReplicas: proto.Int32(1),
+			MaxNumReplicas: proto.Int32(5),
+		},
+	})
+	cfg := testConfig()
+	cfg.GceInstanceGroup = "vips"
+
+	for _, test := range []struct {
+		replicas, want int64
+		changed        bool
+	}{
+		{replicas: 3, want: 3, changed: true},
+		{replicas: 3, want: 3, changed: false},
+		{replicas: 8, want: 5, changed: true},
+	} {
+		got, changed, err := SetAutoscalerMin(context.Background(), cfg, test.replicas)
+		if err != nil {
+			t.Fatalf("SetAutoscalerMin(%d): %v", test.replicas, err)
+		}
+		if got != test.want || changed != test.changed {
+			t.Errorf("SetAutoscalerMin(%d) = %d, %v, want %d, %v", test.replicas, got, changed, test.want, test.changed)
+		}
+		if min := fake.Autoscaler(testZone, "vips-as").GetAutoscalingPolicy().GetMinNumReplicas(); int64(min) != test.want {
+			t.Errorf("autoscaler minimum %d, want %d", min, test.want)
+		}
+	}
+
+	fake.SetGroupManager(testZone, "vips", &computepb.InstanceGroupManager{})
+	if _, _, err := SetAutoscalerMin(context.Background(), cfg, 3); !errors.Is(err, ErrNoAutoscaler) {
+		t.Errorf("SetAutoscalerMin without autoscaler: %v, want ErrNoAutoscaler", err)
+	}
+}
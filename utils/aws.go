@@ -0,0 +1,447 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// VIPs on AWS: secondary private IPs of the network interfaces of the
+// instances of an Auto Scaling group. Requests go to the EC2 Query API,
+// signed with Signature Version 4, with credentials from the environment or
+// the instance metadata service.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	ec2ApiVersion = "2016-11-15"
+	awsMetadata   = "http://169.254.169.254/latest"
+)
+
+// UseAws manages VIPs on AWS instead of GCE. The fields of GcpConfig map
+// to AWS: Region is the AWS region, Zone an optional availability zone,
+// GceInstanceGroup the Auto Scaling group, and AliasNetwork the ID of the
+// subnet of the VIPs. Project is not used. Instances are named by instance
+// ID, and their alias IPs are the secondary private IPs of their network
+// interface in the subnet.
+func UseAws() {
+	provider = awsProvider{}
+}
+
+type awsProvider struct{}
+
+var awsClient = &http.Client{Timeout: 30 * time.Second}
+
+type awsCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+var (
+	awsCredentialsMu sync.Mutex
+	// From the instance metadata service, until shortly before they expire.
+	awsRoleCredentials *awsCredentials
+)
+
+// getAwsCredentials returns credentials from AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or else those of the IAM role
+// of the instance.
+func getAwsCredentials() (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyId:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	awsCredentialsMu.Lock()
+	defer awsCredentialsMu.Unlock()
+	if awsRoleCredentials != nil && time.Until(awsRoleCredentials.Expiration) > 5*time.Minute {
+		return awsRoleCredentials, nil
+	}
+	// IMDSv2: get a session token first.
+	req, err := http.NewRequest(http.MethodPut, awsMetadata+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	token, err := awsMetadataRequest(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting instance metadata token: %v", err)
+	}
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequest(http.MethodGet, awsMetadata+"/meta-data/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return awsMetadataRequest(req)
+	}
+	roles, err := get("iam/security-credentials/")
+	if err != nil {
+		return nil, fmt.Errorf("Error getting IAM role of the instance: %v", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return nil, errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID, or attach an IAM role to the instance")
+	}
+	data, err := get("iam/security-credentials/" + role)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting credentials of IAM role %s: %v", role, err)
+	}
+	credentials := &awsCredentials{}
+	if err := json.Unmarshal(data, credentials); err != nil {
+		return nil, fmt.Errorf("Error parsing credentials of IAM role %s: %v", role, err)
+	}
+	awsRoleCredentials = credentials
+	return credentials, nil
+}
+
+func awsMetadataRequest(req *http.Request) ([]byte, error) {
+	resp, err := awsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", req.URL.Path, resp.Status)
+	}
+	return body, nil
+}
+
+type ec2Error struct {
+	Code    string `xml:"Errors>Error>Code"`
+	Message string `xml:"Errors>Error>Message"`
+}
+
+// ec2Request calls an action of the EC2 Query API in the region, and decodes
+// the XML response into out.
+func ec2Request(ctx context.Context, cfg *GcpConfig, action string, params url.Values, out any) error {
+	credentials, err := getAwsCredentials()
+	if err != nil {
+		return err
+	}
+	params.Set("Action", action)
+	params.Set("Version", ec2ApiVersion)
+	body := params.Encode()
+	host := "ec2." + cfg.Region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAws(req, credentials, cfg.Region, "ec2", host, body, time.Now())
+	resp, err := awsClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %v", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := ec2Error{}
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("%s: %s: %s", action, e.Code, e.Message)
+		}
+		return fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("Error parsing %s response: %v", action, err)
+	}
+	return nil
+}
+
+// signAws adds a Signature Version 4 Authorization header to a request with
+// the body.
+func signAws(req *http.Request, credentials *awsCredentials, region, service, host, body string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.Token)
+	}
+	headers := map[string]string{
+		"content-type": req.Header.Get("Content-Type"),
+		"host":         host,
+		"x-amz-date":   amzDate,
+	}
+	if credentials.Token != "" {
+		headers["x-amz-security-token"] = credentials.Token
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders, signedHeaders, sha256Hex(body),
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex(canonicalRequest),
+	}, "\n")
+	key := []byte("AWS4" + credentials.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.AccessKeyId, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+type ec2Instance struct {
+	InstanceId       string `xml:"instanceId"`
+	InstanceType     string `xml:"instanceType"`
+	LaunchTime       string `xml:"launchTime"`
+	AvailabilityZone string `xml:"placement>availabilityZone"`
+	State            string `xml:"instanceState>name"`
+	Tags             []struct {
+		Key   string `xml:"key"`
+		Value string `xml:"value"`
+	} `xml:"tagSet>item"`
+	NetworkInterfaces []struct {
+		NetworkInterfaceId string `xml:"networkInterfaceId"`
+		SubnetId           string `xml:"subnetId"`
+		PrivateIpAddress   string `xml:"privateIpAddress"`
+		DeviceIndex        int    `xml:"attachment>deviceIndex"`
+		PrivateIpAddresses []struct {
+			PrivateIpAddress string `xml:"privateIpAddress"`
+			Primary          bool   `xml:"primary"`
+		} `xml:"privateIpAddressesSet>item"`
+	} `xml:"networkInterfaceSet>item"`
+}
+
+type describeInstancesResponse struct {
+	Reservations []struct {
+		Instances []ec2Instance `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+// describeInstances returns the instances matching the parameters, e.g.
+// filters, following pages.
+func describeInstances(ctx context.Context, cfg *GcpConfig, params url.Values) ([]ec2Instance, error) {
+	instances := []ec2Instance{}
+	for {
+		resp := describeInstancesResponse{}
+		if err := ec2Request(ctx, cfg, "DescribeInstances", params, &resp); err != nil {
+			countApiError("ec2.describeInstances")
+			return instances, err
+		}
+		for _, reservation := range resp.Reservations {
+			instances = append(instances, reservation.Instances...)
+		}
+		if resp.NextToken == "" {
+			return instances, nil
+		}
+		params.Set("NextToken", resp.NextToken)
+	}
+}
+
+// newAwsInstance converts an EC2 instance. Its alias IPs are the secondary
+// private IPs of its network interface in the subnet of the alias network.
+// Without one, the network interface is empty, so that the instance lacks
+// the alias network.
+func newAwsInstance(cfg *GcpConfig, resp ec2Instance) *GceInstance {
+	instance := &GceInstance{
+		Name:        resp.InstanceId,
+		Zone:        resp.AvailabilityZone,
+		AliasIps:    &[]string{},
+		Labels:      map[string]string{},
+		MachineType: resp.InstanceType,
+		Created:     resp.LaunchTime,
+		Started:     resp.LaunchTime,
+		Status:      strings.ToUpper(resp.State),
+	}
+	if resp.State == "stopped" {
+		// Like stopped GCE instances.
+		instance.Status = "TERMINATED"
+	}
+	for _, tag := range resp.Tags {
+		instance.Labels[tag.Key] = tag.Value
+	}
+	for _, i := range resp.NetworkInterfaces {
+		if i.DeviceIndex == 0 {
+			instance.NetworkIp = i.PrivateIpAddress
+		}
+		if i.SubnetId != cfg.AliasNetwork {
+			continue
+		}
+		instance.NetworkInterface = i.NetworkInterfaceId
+		instance.Subnetwork = i.SubnetId
+		instance.AliasNetwork = i.SubnetId
+		for _, address := range i.PrivateIpAddresses {
+			if !address.Primary {
+				*instance.AliasIps = append(*instance.AliasIps, address.PrivateIpAddress)
+			}
+		}
+	}
+	return instance
+}
+
+func (awsProvider) GetInstance(ctx context.Context, cfg *GcpConfig, zone, name string) (*GceInstance, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	instances, err := describeInstances(ctx, cfg, url.Values{"InstanceId.1": {name}})
+	if err != nil {
+		return nil, fmt.Errorf("Error getting instance %s: %v", name, err)
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("Error getting instance %s: not found", name)
+	}
+	return newAwsInstance(cfg, instances[0]), nil
+}
+
+// ListGroup returns the instances of the Auto Scaling group, except
+// terminated ones, in the zone if set.
+func (awsProvider) ListGroup(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	params := url.Values{
+		"Filter.1.Name":    {"tag:aws:autoscaling:groupName"},
+		"Filter.1.Value.1": {cfg.GceInstanceGroup},
+		"Filter.2.Name":    {"instance-state-name"},
+	}
+	for i, state := range []string{"pending", "running", "stopping", "stopped"} {
+		params.Set("Filter.2.Value."+strconv.Itoa(i+1), state)
+	}
+	if cfg.Zone != "" {
+		params.Set("Filter.3.Name", "availability-zone")
+		params.Set("Filter.3.Value.1", cfg.Zone)
+	}
+	instances := map[string]*GceInstance{}
+	list, err := describeInstances(ctx, cfg, params)
+	if err != nil {
+		return instances, fmt.Errorf("Error listing instances of Auto Scaling group %s: %v", cfg.GceInstanceGroup, err)
+	}
+	for _, item := range list {
+		instances[item.InstanceId] = newAwsInstance(cfg, item)
+	}
+	return instances, nil
+}
+
+type ec2Response struct {
+	RequestId string `xml:"requestId"`
+}
+
+// UpdateAliasIPs assigns and unassigns secondary private IPs, and returns the
+// ID of the last request. Assigned IPs are taken over from other network
+// interfaces, e.g. of a failed instance.
+func (awsProvider) UpdateAliasIPs(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	if instance.NetworkInterface == "" {
+		return "", fmt.Errorf("instance %s has no network interface in subnet %s", instance.Name, cfg.AliasNetwork)
+	}
+	unassign, assign := url.Values{}, url.Values{}
+	for _, ip := range *instance.AliasIps {
+		if !slices.Contains(ips, ip) {
+			unassign.Add("PrivateIpAddress."+strconv.Itoa(len(unassign)+1), ip)
+		}
+	}
+	for _, ip := range ips {
+		if !slices.Contains(*instance.AliasIps, ip) {
+			assign.Add("PrivateIpAddress."+strconv.Itoa(len(assign)+1), ip)
+		}
+	}
+	requestId := ""
+	if len(unassign) > 0 {
+		unassign.Set("NetworkInterfaceId", instance.NetworkInterface)
+		resp := ec2Response{}
+		countWrite()
+		if err := ec2Request(ctx, cfg, "UnassignPrivateIpAddresses", unassign, &resp); err != nil {
+			countApiError("ec2.unassignPrivateIpAddresses")
+			log.Printf("Error unassigning private IPs: %v", err)
+			return "", err
+		}
+		requestId = resp.RequestId
+	}
+	if len(assign) > 0 {
+		assign.Set("NetworkInterfaceId", instance.NetworkInterface)
+		assign.Set("AllowReassignment", "true")
+		resp := ec2Response{}
+		countWrite()
+		if err := ec2Request(ctx, cfg, "AssignPrivateIpAddresses", assign, &resp); err != nil {
+			countApiError("ec2.assignPrivateIpAddresses")
+			log.Printf("Error assigning private IPs: %v", err)
+			return "", err
+		}
+		requestId = resp.RequestId
+	}
+	return requestId, nil
+}
+
+type describeSubnetsResponse struct {
+	Subnets []struct {
+		CidrBlock string `xml:"cidrBlock"`
+	} `xml:"subnetSet>item"`
+}
+
+// AliasRange returns the CIDR of the subnet of the VIPs.
+func (awsProvider) AliasRange(ctx context.Context, cfg *GcpConfig, subnetwork string) (string, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp := describeSubnetsResponse{}
+	if err := ec2Request(ctx, cfg, "DescribeSubnets", url.Values{"SubnetId.1": {cfg.AliasNetwork}}, &resp); err != nil {
+		countApiError("ec2.describeSubnets")
+		return "", fmt.Errorf("Error getting subnet %s: %v", cfg.AliasNetwork, err)
+	}
+	if len(resp.Subnets) == 0 {
+		return "", fmt.Errorf("Subnet %s: %w", cfg.AliasNetwork, ErrNoSecondaryRange)
+	}
+	return resp.Subnets[0].CidrBlock, nil
+}
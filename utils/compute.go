@@ -0,0 +1,399 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The Compute Engine API calls of the GCE provider, through the Cloud Client
+// Library for Compute, behind an interface, so that the reconciler can run
+// against FakeCompute.
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	computeapi "cloud.google.com/go/compute/apiv1"
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/proto"
+)
+
+// ComputeClient is the part of the Compute Engine API that the GCE provider
+// uses. Calls on instance groups take a region for regional groups, and a
+// zone otherwise.
+type ComputeClient interface {
+	GetInstance(ctx context.Context, project, zone, name string) (*computepb.Instance, error)
+	// ListInstances lists the instances matching filter in the zone, or in
+	// all zones of the region.
+	ListInstances(ctx context.Context, project, region, zone, filter string) ([]*computepb.Instance, error)
+	// ListInstanceGroups returns the names of the instance groups in the
+	// zone.
+	ListInstanceGroups(ctx context.Context, project, zone string) ([]string, error)
+	// ListGroupInstances returns the URLs of the running instances of an
+	// instance group.
+	ListGroupInstances(ctx context.Context, project, region, zone, group string) ([]string, error)
+	ListManagedInstances(ctx context.Context, project, region, zone, group string) ([]*computepb.ManagedInstance, error)
+	GetInstanceGroupManager(ctx context.Context, project, region, zone, group string) (*computepb.InstanceGroupManager, error)
+	UpdateNetworkInterface(ctx context.Context, project, zone, instance, networkInterface string, nic *computepb.NetworkInterface) (*computepb.Operation, error)
+	// WaitOperation waits for a zonal operation to complete, or for a
+	// while, and returns it, done or not.
+	WaitOperation(ctx context.Context, project, zone, name string) (*computepb.Operation, error)
+	GetSubnetwork(ctx context.Context, project, region, name string) (*computepb.Subnetwork, error)
+	GetMachineType(ctx context.Context, project, zone, name string) (*computepb.MachineType, error)
+	GetResourcePolicy(ctx context.Context, project, region, name string) (*computepb.ResourcePolicy, error)
+	GetAutoscaler(ctx context.Context, project, region, zone, name string) (*computepb.Autoscaler, error)
+	// PatchAutoscaler updates the fields of the autoscaler that are set.
+	PatchAutoscaler(ctx context.Context, project, region, zone string, autoscaler *computepb.Autoscaler) (*computepb.Operation, error)
+	ListForwardingRules(ctx context.Context, project, region, filter string) ([]*computepb.ForwardingRule, error)
+	SetForwardingRuleTarget(ctx context.Context, project, region, rule, target string) (*computepb.Operation, error)
+	GetTargetInstance(ctx context.Context, project, zone, name string) (*computepb.TargetInstance, error)
+	InsertTargetInstance(ctx context.Context, project, zone string, target *computepb.TargetInstance) (*computepb.Operation, error)
+	GetProject(ctx context.Context, project string) (*computepb.Project, error)
+	GetRegion(ctx context.Context, project, region string) (*computepb.Region, error)
+	// ListOperations lists the operations matching filter in all scopes of
+	// the project.
+	ListOperations(ctx context.Context, project, filter string) ([]*computepb.Operation, error)
+}
+
+// Set by ConnectCompute, or UseCompute.
+var computeClient ComputeClient
+
+// UseCompute makes the GCE provider use client, e.g. a FakeCompute, instead
+// of the Compute Engine API. Call it before ConnectCompute, which then does
+// not connect.
+func UseCompute(client ComputeClient) {
+	computeClient = client
+}
+
+// libraryClient calls the Compute Engine API through the REST clients of the
+// Cloud Client Library, one per resource.
+type libraryClient struct {
+	instances                   *computeapi.InstancesClient
+	instanceGroups              *computeapi.InstanceGroupsClient
+	regionInstanceGroups        *computeapi.RegionInstanceGroupsClient
+	instanceGroupManagers       *computeapi.InstanceGroupManagersClient
+	regionInstanceGroupManagers *computeapi.RegionInstanceGroupManagersClient
+	zoneOperations              *computeapi.ZoneOperationsClient
+	subnetworks                 *computeapi.SubnetworksClient
+	machineTypes                *computeapi.MachineTypesClient
+	resourcePolicies            *computeapi.ResourcePoliciesClient
+	autoscalers                 *computeapi.AutoscalersClient
+	regionAutoscalers           *computeapi.RegionAutoscalersClient
+	forwardingRules             *computeapi.ForwardingRulesClient
+	targetInstances             *computeapi.TargetInstancesClient
+	projects                    *computeapi.ProjectsClient
+	regions                     *computeapi.RegionsClient
+	globalOperations            *computeapi.GlobalOperationsClient
+}
+
+// newLibraryClient creates the REST clients on the HTTP client c,
+// so that they share its rate limit and retries.
+func newLibraryClient(ctx context.Context, c *http.Client) (*libraryClient, error) {
+	opts := []option.ClientOption{option.WithHTTPClient(c)}
+	var err error
+	client := &libraryClient{}
+	if client.instances, err = computeapi.NewInstancesRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.instanceGroups, err = computeapi.NewInstanceGroupsRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.regionInstanceGroups, err = computeapi.NewRegionInstanceGroupsRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.instanceGroupManagers, err = computeapi.NewInstanceGroupManagersRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.regionInstanceGroupManagers, err = computeapi.NewRegionInstanceGroupManagersRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.zoneOperations, err = computeapi.NewZoneOperationsRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.subnetworks, err = computeapi.NewSubnetworksRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.machineTypes, err = computeapi.NewMachineTypesRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.resourcePolicies, err = computeapi.NewResourcePoliciesRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.autoscalers, err = computeapi.NewAutoscalersRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.regionAutoscalers, err = computeapi.NewRegionAutoscalersRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.forwardingRules, err = computeapi.NewForwardingRulesRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.targetInstances, err = computeapi.NewTargetInstancesRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.projects, err = computeapi.NewProjectsRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.regions, err = computeapi.NewRegionsRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	if client.globalOperations, err = computeapi.NewGlobalOperationsRESTClient(ctx, opts...); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func (c *libraryClient) GetInstance(ctx context.Context, project, zone, name string) (*computepb.Instance, error) {
+	return c.instances.Get(ctx, &computepb.GetInstanceRequest{Project: project, Zone: zone, Instance: name})
+}
+
+func (c *libraryClient) ListInstances(ctx context.Context, project, region, zone, filter string) ([]*computepb.Instance, error) {
+	instances := []*computepb.Instance{}
+	if region == "" {
+		it := c.instances.List(ctx, &computepb.ListInstancesRequest{Project: project, Zone: zone, Filter: proto.String(filter)})
+		for {
+			instance, err := it.Next()
+			if err == iterator.Done {
+				return instances, nil
+			}
+			if err != nil {
+				return instances, err
+			}
+			instances = append(instances, instance)
+		}
+	}
+	it := c.instances.AggregatedList(ctx, &computepb.AggregatedListInstancesRequest{Project: project, Filter: proto.String(filter)})
+	for {
+		pair, err := it.Next()
+		if err == iterator.Done {
+			return instances, nil
+		}
+		if err != nil {
+			return instances, err
+		}
+		// Scopes are "zones/ZONE".
+		if strings.HasPrefix(strings.TrimPrefix(pair.Key, "zones/"), region+"-") {
+			instances = append(instances, pair.Value.GetInstances()...)
+		}
+	}
+}
+
+func (c *libraryClient) ListInstanceGroups(ctx context.Context, project, zone string) ([]string, error) {
+	names := []string{}
+	it := c.instanceGroups.List(ctx, &computepb.ListInstanceGroupsRequest{Project: project, Zone: zone})
+	for {
+		instanceGroup, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return names, err
+		}
+		names = append(names, instanceGroup.GetName())
+	}
+}
+
+func (c *libraryClient) ListGroupInstances(ctx context.Context, project, region, zone, group string) ([]string, error) {
+	var it *computeapi.InstanceWithNamedPortsIterator
+	if region != "" {
+		it = c.regionInstanceGroups.ListInstances(ctx, &computepb.ListInstancesRegionInstanceGroupsRequest{
+			Project:       project,
+			Region:        region,
+			InstanceGroup: group,
+			RegionInstanceGroupsListInstancesRequestResource: &computepb.RegionInstanceGroupsListInstancesRequest{
+				InstanceState: proto.String("RUNNING"),
+			},
+		})
+	} else {
+		it = c.instanceGroups.ListInstances(ctx, &computepb.ListInstancesInstanceGroupsRequest{
+			Project:       project,
+			Zone:          zone,
+			InstanceGroup: group,
+			InstanceGroupsListInstancesRequestResource: &computepb.InstanceGroupsListInstancesRequest{
+				InstanceState: proto.String("RUNNING"),
+			},
+		})
+	}
+	urls := []string{}
+	for {
+		instance, err := it.Next()
+		if err == iterator.Done {
+			return urls, nil
+		}
+		if err != nil {
+			return urls, err
+		}
+		urls = append(urls, instance.GetInstance())
+	}
+}
+
+func (c *libraryClient) ListManagedInstances(ctx context.Context, project, region, zone, group string) ([]*computepb.ManagedInstance, error) {
+	var it *computeapi.ManagedInstanceIterator
+	if region != "" {
+		it = c.regionInstanceGroupManagers.ListManagedInstances(ctx, &computepb.ListManagedInstancesRegionInstanceGroupManagersRequest{
+			Project:              project,
+			Region:               region,
+			InstanceGroupManager: group,
+		})
+	} else {
+		it = c.instanceGroupManagers.ListManagedInstances(ctx, &computepb.ListManagedInstancesInstanceGroupManagersRequest{
+			Project:              project,
+			Zone:                 zone,
+			InstanceGroupManager: group,
+		})
+	}
+	instances := []*computepb.ManagedInstance{}
+	for {
+		instance, err := it.Next()
+		if err == iterator.Done {
+			return instances, nil
+		}
+		if err != nil {
+			return instances, err
+		}
+		instances = append(instances, instance)
+	}
+}
+
+func (c *libraryClient) GetInstanceGroupManager(ctx context.Context, project, region, zone, group string) (*computepb.InstanceGroupManager, error) {
+	if region != "" {
+		return c.regionInstanceGroupManagers.Get(ctx, &computepb.GetRegionInstanceGroupManagerRequest{Project: project, Region: region, InstanceGroupManager: group})
+	}
+	return c.instanceGroupManagers.Get(ctx, &computepb.GetInstanceGroupManagerRequest{Project: project, Zone: zone, InstanceGroupManager: group})
+}
+
+func (c *libraryClient) UpdateNetworkInterface(ctx context.Context, project, zone, instance, networkInterface string, nic *computepb.NetworkInterface) (*computepb.Operation, error) {
+	op, err := c.instances.UpdateNetworkInterface(ctx, &computepb.UpdateNetworkInterfaceInstanceRequest{
+		Project:                  project,
+		Zone:                     zone,
+		Instance:                 instance,
+		NetworkInterface:         networkInterface,
+		NetworkInterfaceResource: nic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Proto(), nil
+}
+
+func (c *libraryClient) WaitOperation(ctx context.Context, project, zone, name string) (*computepb.Operation, error) {
+	return c.zoneOperations.Wait(ctx, &computepb.WaitZoneOperationRequest{Project: project, Zone: zone, Operation: name})
+}
+
+func (c *libraryClient) GetSubnetwork(ctx context.Context, project, region, name string) (*computepb.Subnetwork, error) {
+	return c.subnetworks.Get(ctx, &computepb.GetSubnetworkRequest{Project: project, Region: region, Subnetwork: name})
+}
+
+func (c *libraryClient) GetMachineType(ctx context.Context, project, zone, name string) (*computepb.MachineType, error) {
+	return c.machineTypes.Get(ctx, &computepb.GetMachineTypeRequest{Project: project, Zone: zone, MachineType: name})
+}
+
+func (c *libraryClient) GetResourcePolicy(ctx context.Context, project, region, name string) (*computepb.ResourcePolicy, error) {
+	return c.resourcePolicies.Get(ctx, &computepb.GetResourcePolicyRequest{Project: project, Region: region, ResourcePolicy: name})
+}
+
+func (c *libraryClient) GetAutoscaler(ctx context.Context, project, region, zone, name string) (*computepb.Autoscaler, error) {
+	if region != "" {
+		return c.regionAutoscalers.Get(ctx, &computepb.GetRegionAutoscalerRequest{Project: project, Region: region, Autoscaler: name})
+	}
+	return c.autoscalers.Get(ctx, &computepb.GetAutoscalerRequest{Project: project, Zone: zone, Autoscaler: name})
+}
+
+func (c *libraryClient) PatchAutoscaler(ctx context.Context, project, region, zone string, autoscaler *computepb.Autoscaler) (*computepb.Operation, error) {
+	var op *computeapi.Operation
+	var err error
+	if region != "" {
+		op, err = c.regionAutoscalers.Patch(ctx, &computepb.PatchRegionAutoscalerRequest{
+			Project:            project,
+			Region:             region,
+			Autoscaler:         autoscaler.Name,
+			AutoscalerResource: autoscaler,
+		})
+	} else {
+		op, err = c.autoscalers.Patch(ctx, &computepb.PatchAutoscalerRequest{
+			Project:            project,
+			Zone:               zone,
+			Autoscaler:         autoscaler.Name,
+			AutoscalerResource: autoscaler,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return op.Proto(), nil
+}
+
+func (c *libraryClient) ListForwardingRules(ctx context.Context, project, region, filter string) ([]*computepb.ForwardingRule, error) {
+	rules := []*computepb.ForwardingRule{}
+	it := c.forwardingRules.List(ctx, &computepb.ListForwardingRulesRequest{Project: project, Region: region, Filter: proto.String(filter)})
+	for {
+		rule, err := it.Next()
+		if err == iterator.Done {
+			return rules, nil
+		}
+		if err != nil {
+			return rules, err
+		}
+		rules = append(rules, rule)
+	}
+}
+
+func (c *libraryClient) SetForwardingRuleTarget(ctx context.Context, project, region, rule, target string) (*computepb.Operation, error) {
+	op, err := c.forwardingRules.SetTarget(ctx, &computepb.SetTargetForwardingRuleRequest{
+		Project:                 project,
+		Region:                  region,
+		ForwardingRule:          rule,
+		TargetReferenceResource: &computepb.TargetReference{Target: proto.String(target)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return op.Proto(), nil
+}
+
+func (c *libraryClient) GetTargetInstance(ctx context.Context, project, zone, name string) (*computepb.TargetInstance, error) {
+	return c.targetInstances.Get(ctx, &computepb.GetTargetInstanceRequest{Project: project, Zone: zone, TargetInstance: name})
+}
+
+func (c *libraryClient) InsertTargetInstance(ctx context.Context, project, zone string, target *computepb.TargetInstance) (*computepb.Operation, error) {
+	op, err := c.targetInstances.Insert(ctx, &computepb.InsertTargetInstanceRequest{Project: project, Zone: zone, TargetInstanceResource: target})
+	if err != nil {
+		return nil, err
+	}
+	return op.Proto(), nil
+}
+
+func (c *libraryClient) GetProject(ctx context.Context, project string) (*computepb.Project, error) {
+	return c.projects.Get(ctx, &computepb.GetProjectRequest{Project: project})
+}
+
+func (c *libraryClient) GetRegion(ctx context.Context, project, region string) (*computepb.Region, error) {
+	return c.regions.Get(ctx, &computepb.GetRegionRequest{Project: project, Region: region})
+}
+
+func (c *libraryClient) ListOperations(ctx context.Context, project, filter string) ([]*computepb.Operation, error) {
+	operations := []*computepb.Operation{}
+	it := c.globalOperations.AggregatedList(ctx, &computepb.AggregatedListGlobalOperationsRequest{Project: project, Filter: proto.String(filter)})
+	for {
+		pair, err := it.Next()
+		if err == iterator.Done {
+			return operations, nil
+		}
+		if err != nil {
+			return operations, err
+		}
+		operations = append(operations, pair.Value.GetOperations()...)
+	}
+}
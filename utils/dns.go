@@ -0,0 +1,127 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Cloud DNS records pointing to VIPs.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"google.golang.org/api/dns/v1"
+)
+
+var dnsService *dns.Service
+
+// DnsRecord is an A or AAAA record set. Names are fully qualified, with a
+// trailing dot.
+type DnsRecord struct {
+	Name string   `json:"name"`
+	Type string   `json:"type"`
+	Ttl  int64    `json:"ttl"`
+	Ips  []string `json:"ips"`
+}
+
+func ConnectDns() {
+	c, err := defaultClient(context.Background(), dns.NdevClouddnsReadwriteScope)
+	if err != nil {
+		log.Printf("Error getting Default GCP client: %v", err)
+	}
+	dnsService, err = dns.New(c)
+	if err != nil {
+		log.Fatalf("Error connecting to Cloud DNS: %v", err)
+		os.Exit(1)
+	}
+}
+
+// ListDnsRecords lists the A and AAAA records of a managed zone.
+func ListDnsRecords(project, zone string) ([]DnsRecord, error) {
+	records := []DnsRecord{}
+	req := dnsService.ResourceRecordSets.List(project, zone)
+	err := req.Pages(context.Background(), func(page *dns.ResourceRecordSetsListResponse) error {
+		for _, rrset := range page.Rrsets {
+			if rrset.Type != "A" && rrset.Type != "AAAA" {
+				continue
+			}
+			records = append(records, DnsRecord{
+				Name: rrset.Name,
+				Type: rrset.Type,
+				Ttl:  rrset.Ttl,
+				Ips:  rrset.Rrdatas,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		countApiError("resourceRecordSets.list")
+		return records, err
+	}
+	return records, nil
+}
+
+// SetDnsRecord creates or replaces an A or AAAA record set.
+func SetDnsRecord(project, zone string, record DnsRecord) error {
+	rrset := &dns.ResourceRecordSet{Name: record.Name, Type: record.Type, Ttl: record.Ttl, Rrdatas: record.Ips}
+	_, err := dnsService.ResourceRecordSets.Create(project, zone, rrset).Context(context.Background()).Do()
+	if isStatus(err, http.StatusConflict) {
+		_, err = dnsService.ResourceRecordSets.Patch(project, zone, record.Name, record.Type, rrset).Context(context.Background()).Do()
+	}
+	if err != nil {
+		countApiError("resourceRecordSets.create")
+		return fmt.Errorf("Error setting %s record %s: %v", record.Type, record.Name, err)
+	}
+	return nil
+}
+
+// DeleteDnsRecord deletes an A or AAAA record set, if it exists.
+func DeleteDnsRecord(project, zone string, record DnsRecord) error {
+	_, err := dnsService.ResourceRecordSets.Delete(project, zone, record.Name, record.Type).Context(context.Background()).Do()
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		countApiError("resourceRecordSets.delete")
+		return fmt.Errorf("Error deleting %s record %s: %v", record.Type, record.Name, err)
+	}
+	return nil
+}
+
+// SetTxtRecord creates or replaces a TXT record set. Values are quoted.
+func SetTxtRecord(project, zone, name string, ttl int64, values []string) error {
+	rrset := &dns.ResourceRecordSet{Name: name, Type: "TXT", Ttl: ttl}
+	for _, value := range values {
+		rrset.Rrdatas = append(rrset.Rrdatas, strconv.Quote(value))
+	}
+	_, err := dnsService.ResourceRecordSets.Create(project, zone, rrset).Context(context.Background()).Do()
+	if isStatus(err, http.StatusConflict) {
+		_, err = dnsService.ResourceRecordSets.Patch(project, zone, name, "TXT", rrset).Context(context.Background()).Do()
+	}
+	if err != nil {
+		countApiError("resourceRecordSets.create")
+		return fmt.Errorf("Error setting TXT record %s: %v", name, err)
+	}
+	return nil
+}
+
+// DeleteTxtRecord deletes a TXT record set, if it exists.
+func DeleteTxtRecord(project, zone, name string) error {
+	_, err := dnsService.ResourceRecordSets.Delete(project, zone, name, "TXT").Context(context.Background()).Do()
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		countApiError("resourceRecordSets.delete")
+		return fmt.Errorf("Error deleting TXT record %s: %v", name, err)
+	}
+	return nil
+}
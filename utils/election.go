@@ -0,0 +1,119 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// PeerElection implements leader election between replicas running on the
+// members of an instance group, without shared storage: the leader is the
+// member with the lowest name among those whose manager answers on its
+// port. A member that stops answering loses leadership within one interval.
+
+import (
+	"context"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Leader is implemented by Lease, KubeLease and PeerElection.
+type Leader interface {
+	IsLeader() bool
+	// Run takes part in the election in the background, until ctx is
+	// canceled.
+	Run(ctx context.Context)
+}
+
+type PeerElection struct {
+	Gcp      *GcpConfig
+	Self     string
+	Port     int
+	Interval time.Duration
+
+	mu     sync.Mutex
+	leader string
+}
+
+func NewPeerElection(cfg *GcpConfig, self string, port int, interval time.Duration) *PeerElection {
+	return &PeerElection{
+		Gcp:      cfg,
+		Self:     self,
+		Port:     port,
+		Interval: interval,
+	}
+}
+
+// IsLeader returns true while this member is the leader.
+func (e *PeerElection) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader == e.Self
+}
+
+// Run elects the leader in the background, until ctx is canceled.
+func (e *PeerElection) Run(ctx context.Context) {
+	go func() {
+		for {
+			leader, err := e.elect(ctx)
+			if err != nil {
+				log.Printf("Error electing leader of %s: %v", e.Gcp.GceInstanceGroup, err)
+				// Without a view of the peers, assume nobody leads.
+				leader = ""
+			}
+			e.mu.Lock()
+			previous := e.leader
+			e.leader = leader
+			e.mu.Unlock()
+			if leader != previous {
+				log.Printf("Leader of %s: %q (self: %s)", e.Gcp.GceInstanceGroup, leader, e.Self)
+			}
+			select {
+			case <-ctx.Done():
+				e.mu.Lock()
+				e.leader = ""
+				e.mu.Unlock()
+				return
+			case <-time.After(e.Interval):
+			}
+		}
+	}()
+}
+
+// elect returns the lowest named member whose manager answers, including
+// this one.
+func (e *PeerElection) elect(ctx context.Context) (string, error) {
+	instances, err := GetInstancesFromMIG(ctx, e.Gcp)
+	if err != nil {
+		return "", err
+	}
+	names := []string{}
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == e.Self {
+			return name, nil
+		}
+		address := net.JoinHostPort(instances[name].NetworkIp, strconv.Itoa(e.Port))
+		if conn, err := net.DialTimeout("tcp", address, HealthTimeout); err == nil {
+			conn.Close()
+			return name, nil
+		}
+	}
+	// Not a running member yet, e.g. while starting up.
+	return "", nil
+}
@@ -0,0 +1,581 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"golang.org/x/exp/slices"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/protobuf/proto"
+)
+
+// FakeCompute is an in-memory ComputeClient, to run the reconciler without
+// GCE, see UseCompute. It holds a single project, and ignores the project of
+// calls. Instance groups are in a zone, or in a region for regional groups.
+// Updates of network interfaces check the fingerprint like GCE, and complete
+// immediately, like all writes.
+type FakeCompute struct {
+	mu sync.Mutex
+	// By "ZONE/NAME".
+	instances    map[string]*computepb.Instance
+	machineTypes map[string]*computepb.MachineType
+	// Instances by "ZONE/NAME", by "LOCATION/GROUP".
+	groups   map[string][]string
+	managers map[string]*computepb.InstanceGroupManager
+	// Health of instances in managed instance groups by "ZONE/NAME",
+	// e.g. "HEALTHY".
+	health map[string]string
+	// By "REGION/NAME".
+	subnetworks      map[string]*computepb.Subnetwork
+	resourcePolicies map[string]*computepb.ResourcePolicy
+	forwardingRules  map[string]*computepb.ForwardingRule
+	// By "LOCATION/NAME", a zone or region.
+	autoscalers map[string]*computepb.Autoscaler
+	// By "ZONE/NAME".
+	targetInstances map[string]*computepb.TargetInstance
+	project         *computepb.Project
+	// By name.
+	regions    map[string]*computepb.Region
+	operations map[string]*computepb.Operation
+	calls      map[string]int
+	// Numbers operations and fingerprints.
+	serial int
+}
+
+func NewFakeCompute() *FakeCompute {
+	return &FakeCompute{
+		instances:        map[string]*computepb.Instance{},
+		machineTypes:     map[string]*computepb.MachineType{},
+		groups:           map[string][]string{},
+		managers:         map[string]*computepb.InstanceGroupManager{},
+		health:           map[string]string{},
+		subnetworks:      map[string]*computepb.Subnetwork{},
+		resourcePolicies: map[string]*computepb.ResourcePolicy{},
+		forwardingRules:  map[string]*computepb.ForwardingRule{},
+		autoscalers:      map[string]*computepb.Autoscaler{},
+		targetInstances:  map[string]*computepb.TargetInstance{},
+		project:          &computepb.Project{},
+		regions:          map[string]*computepb.Region{},
+		operations:       map[string]*computepb.Operation{},
+		calls:            map[string]int{},
+	}
+}
+
+// AddInstance adds or replaces an instance in a zone, and adds it to the
+// instance group at location, a zone or region, if any. Instances are
+// RUNNING unless they have another status.
+func (f *FakeCompute) AddInstance(zone, location, group string, instance *computepb.Instance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance = cloneInstance(instance)
+	instance.Zone = proto.String("zones/" + zone)
+	instance.SelfLink = proto.String("zones/" + zone + "/instances/" + instance.GetName())
+	if instance.GetStatus() == "" {
+		instance.Status = proto.String("RUNNING")
+	}
+	for i, nic := range instance.NetworkInterfaces {
+		if nic.GetName() == "" {
+			nic.Name = proto.String(fmt.Sprintf("nic%d", i))
+		}
+		if nic.GetFingerprint() == "" {
+			nic.Fingerprint = proto.String(f.fingerprint())
+		}
+	}
+	key := zone + "/" + instance.GetName()
+	f.instances[key] = instance
+	if group != "" && !slices.Contains(f.groups[location+"/"+group], key) {
+		f.groups[location+"/"+group] = append(f.groups[location+"/"+group], key)
+	}
+}
+
+// RemoveInstance deletes an instance, and removes it from its groups.
+func (f *FakeCompute) RemoveInstance(zone, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := zone + "/" + name
+	delete(f.instances, key)
+	delete(f.health, key)
+	for group, keys := range f.groups {
+		if i := slices.Index(keys, key); i >= 0 {
+			f.groups[group] = slices.Delete(keys, i, i+1)
+		}
+	}
+}
+
+// SetHealth sets the health state of an instance in its managed instance
+// group, e.g. "HEALTHY" or "UNHEALTHY".
+func (f *FakeCompute) SetHealth(zone, name, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.health[zone+"/"+name] = state
+}
+
+// SetGroupManager sets the instance group manager of a group at location,
+// e.g. with the instance template it rolls out.
+func (f *FakeCompute) SetGroupManager(location, group string, manager *computepb.InstanceGroupManager) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.managers[location+"/"+group] = proto.Clone(manager).(*computepb.InstanceGroupManager)
+}
+
+func (f *FakeCompute) AddSubnetwork(region string, subnetwork *computepb.Subnetwork) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subnetworks[region+"/"+subnetwork.GetName()] = proto.Clone(subnetwork).(*computepb.Subnetwork)
+}
+
+func (f *FakeCompute) AddMachineType(zone string, machineType *computepb.MachineType) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.machineTypes[zone+"/"+machineType.GetName()] = proto.Clone(machineType).(*computepb.MachineType)
+}
+
+func (f *FakeCompute) AddResourcePolicy(region string, policy *computepb.ResourcePolicy) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.resourcePolicies[region+"/"+policy.GetName()] = proto.Clone(policy).(*computepb.ResourcePolicy)
+}
+
+// AddAutoscaler adds the autoscaler of a managed instance group at location,
+// a zone or region. Set the autoscaler in the status of the group manager,
+// see SetGroupManager.
+func (f *FakeCompute) AddAutoscaler(location string, autoscaler *computepb.Autoscaler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.autoscalers[location+"/"+autoscaler.GetName()] = proto.Clone(autoscaler).(*computepb.Autoscaler)
+}
+
+// Autoscaler returns the autoscaler at location, or nil.
+func (f *FakeCompute) Autoscaler(location, name string) *computepb.Autoscaler {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	autoscaler, ok := f.autoscalers[location+"/"+name]
+	if !ok {
+		return nil
+	}
+	return proto.Clone(autoscaler).(*computepb.Autoscaler)
+}
+
+func (f *FakeCompute) AddForwardingRule(region string, rule *computepb.ForwardingRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forwardingRules[region+"/"+rule.GetName()] = proto.Clone(rule).(*computepb.ForwardingRule)
+}
+
+// ForwardingRule returns the forwarding rule in region, or nil.
+func (f *FakeCompute) ForwardingRule(region, name string) *computepb.ForwardingRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule, ok := f.forwardingRules[region+"/"+name]
+	if !ok {
+		return nil
+	}
+	return proto.Clone(rule).(*computepb.ForwardingRule)
+}
+
+// SetProject sets the project, e.g. with its quotas.
+func (f *FakeCompute) SetProject(project *computepb.Project) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.project = proto.Clone(project).(*computepb.Project)
+}
+
+func (f *FakeCompute) AddRegion(region *computepb.Region) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.regions[region.GetName()] = proto.Clone(region).(*computepb.Region)
+}
+
+// Calls returns the number of calls of a method, e.g.
+// "UpdateNetworkInterface".
+func (f *FakeCompute) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func (f *FakeCompute) GetInstance(ctx context.Context, project, zone, name string) (*computepb.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetInstance"]++
+	instance, ok := f.instances[zone+"/"+name]
+	if !ok {
+		return nil, notFound("instance", name)
+	}
+	return cloneInstance(instance), nil
+}
+
+func (f *FakeCompute) ListInstances(ctx context.Context, project, region, zone, filter string) ([]*computepb.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["ListInstances"]++
+	match, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	instances := []*computepb.Instance{}
+	for key, instance := range f.instances {
+		at, _, _ := strings.Cut(key, "/")
+		if (at == zone || (region != "" && strings.HasPrefix(at, region+"-"))) && match(instance) {
+			instances = append(instances, cloneInstance(instance))
+		}
+	}
+	return instances, nil
+}
+
+func (f *FakeCompute) ListInstanceGroups(ctx context.Context, project, zone string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["ListInstanceGroups"]++
+	names := []string{}
+	for key := range f.groups {
+		if location, group, _ := strings.Cut(key, "/"); location == zone {
+			names = append(names, group)
+		}
+	}
+	return names, nil
+}
+
+func (f *FakeCompute) ListGroupInstances(ctx context.Context, project, region, zone, group string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["ListGroupInstances"]++
+	keys, ok := f.groups[groupLocation(region, zone)+"/"+group]
+	if !ok {
+		return nil, notFound("instance group", group)
+	}
+	urls := []string{}
+	for _, key := range keys {
+		if instance := f.instances[key]; instance.GetStatus() == "RUNNING" {
+			urls = append(urls, instance.GetSelfLink())
+		}
+	}
+	return urls, nil
+}
+
+func (f *FakeCompute) ListManagedInstances(ctx context.Context, project, region, zone, group string) ([]*computepb.ManagedInstance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["ListManagedInstances"]++
+	keys, ok := f.groups[groupLocation(region, zone)+"/"+group]
+	if !ok {
+		return nil, notFound("instance group manager", group)
+	}
+	managed := []*computepb.ManagedInstance{}
+	for _, key := range keys {
+		instance := &computepb.ManagedInstance{
+			Instance:       proto.String(f.instances[key].GetSelfLink()),
+			InstanceStatus: proto.String(f.instances[key].GetStatus()),
+		}
+		if state, ok := f.health[key]; ok {
+			instance.InstanceHealth = []*computepb.ManagedInstanceInstanceHealth{{DetailedHealthState: proto.String(state)}}
+		}
+		managed = append(managed, instance)
+	}
+	return managed, nil
+}
+
+func (f *FakeCompute) GetInstanceGroupManager(ctx context.Context, project, region, zone, group string) (*computepb.InstanceGroupManager, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetInstanceGroupManager"]++
+	manager, ok := f.managers[groupLocation(region, zone)+"/"+group]
+	if !ok {
+		return nil, notFound("instance group manager", group)
+	}
+	return proto.Clone(manager).(*computepb.InstanceGroupManager), nil
+}
+
+func (f *FakeCompute) UpdateNetworkInterface(ctx context.Context, project, zone, instance, networkInterface string, nic *computepb.NetworkInterface) (*computepb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["UpdateNetworkInterface"]++
+	resp, ok := f.instances[zone+"/"+instance]
+	if !ok {
+		return nil, notFound("instance", instance)
+	}
+	for _, current := range resp.NetworkInterfaces {
+		if current.GetName() != networkInterface {
+			continue
+		}
+		if nic.GetFingerprint() != current.GetFingerprint() {
+			return nil, &googleapi.Error{
+				Code:    http.StatusPreconditionFailed,
+				Message: "Invalid fingerprint.",
+				Errors:  []googleapi.ErrorItem{{Reason: "conditionNotMet", Message: "Invalid fingerprint."}},
+			}
+		}
+		current.AliasIpRanges = []*computepb.AliasIpRange{}
+		for _, r := range nic.GetAliasIpRanges() {
+			current.AliasIpRanges = append(current.AliasIpRanges, proto.Clone(r).(*computepb.AliasIpRange))
+		}
+		current.Fingerprint = proto.String(f.fingerprint())
+		return f.operation("updateNetworkInterface", resp.GetSelfLink()), nil
+	}
+	return nil, notFound("network interface", networkInterface)
+}
+
+func (f *FakeCompute) WaitOperation(ctx context.Context, project, zone, name string) (*computepb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["WaitOperation"]++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	operation, ok := f.operations[name]
+	if !ok {
+		return nil, notFound("operation", name)
+	}
+	return proto.Clone(operation).(*computepb.Operation), nil
+}
+
+func (f *FakeCompute) GetSubnetwork(ctx context.Context, project, region, name string) (*computepb.Subnetwork, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetSubnetwork"]++
+	subnetwork, ok := f.subnetworks[region+"/"+name]
+	if !ok {
+		return nil, notFound("subnetwork", name)
+	}
+	return proto.Clone(subnetwork).(*computepb.Subnetwork), nil
+}
+
+func (f *FakeCompute) GetMachineType(ctx context.Context, project, zone, name string) (*computepb.MachineType, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetMachineType"]++
+	machineType, ok := f.machineTypes[zone+"/"+name]
+	if !ok {
+		return nil, notFound("machine type", name)
+	}
+	return proto.Clone(machineType).(*computepb.MachineType), nil
+}
+
+func (f *FakeCompute) GetResourcePolicy(ctx context.Context, project, region, name string) (*computepb.ResourcePolicy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetResourcePolicy"]++
+	policy, ok := f.resourcePolicies[region+"/"+name]
+	if !ok {
+		return nil, notFound("resource policy", name)
+	}
+	return proto.Clone(policy).(*computepb.ResourcePolicy), nil
+}
+
+func (f *FakeCompute) GetAutoscaler(ctx context.Context, project, region, zone, name string) (*computepb.Autoscaler, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetAutoscaler"]++
+	autoscaler, ok := f.autoscalers[groupLocation(region, zone)+"/"+name]
+	if !ok {
+		return nil, notFound("autoscaler", name)
+	}
+	return proto.Clone(autoscaler).(*computepb.Autoscaler), nil
+}
+
+func (f *FakeCompute) PatchAutoscaler(ctx context.Context, project, region, zone string, autoscaler *computepb.Autoscaler) (*computepb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["PatchAutoscaler"]++
+	current, ok := f.autoscalers[groupLocation(region, zone)+"/"+autoscaler.GetName()]
+	if !ok {
+		return nil, notFound("autoscaler", autoscaler.GetName())
+	}
+	proto.Merge(current, autoscaler)
+	return f.operation("patch", current.GetSelfLink()), nil
+}
+
+// ListForwardingRules supports the label terms of the filters of
+// ListInstances.
+func (f *FakeCompute) ListForwardingRules(ctx context.Context, project, region, filter string) ([]*computepb.ForwardingRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["ListForwardingRules"]++
+	match, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	rules := []*computepb.ForwardingRule{}
+	for key, rule := range f.forwardingRules {
+		at, _, _ := strings.Cut(key, "/")
+		if at == region && match(&computepb.Instance{Labels: rule.Labels}) {
+			rules = append(rules, proto.Clone(rule).(*computepb.ForwardingRule))
+		}
+	}
+	return rules, nil
+}
+
+func (f *FakeCompute) SetForwardingRuleTarget(ctx context.Context, project, region, rule, target string) (*computepb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["SetForwardingRuleTarget"]++
+	resp, ok := f.forwardingRules[region+"/"+rule]
+	if !ok {
+		return nil, notFound("forwarding rule", rule)
+	}
+	resp.Target = proto.String(target)
+	return f.operation("setTarget", resp.GetSelfLink()), nil
+}
+
+func (f *FakeCompute) GetTargetInstance(ctx context.Context, project, zone, name string) (*computepb.TargetInstance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetTargetInstance"]++
+	target, ok := f.targetInstances[zone+"/"+name]
+	if !ok {
+		return nil, notFound("target instance", name)
+	}
+	return proto.Clone(target).(*computepb.TargetInstance), nil
+}
+
+func (f *FakeCompute) InsertTargetInstance(ctx context.Context, project, zone string, target *computepb.TargetInstance) (*computepb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["InsertTargetInstance"]++
+	key := zone + "/" + target.GetName()
+	if _, ok := f.targetInstances[key]; ok {
+		return nil, &googleapi.Error{
+			Code:    http.StatusConflict,
+			Message: fmt.Sprintf("The target instance %s already exists", target.GetName()),
+		}
+	}
+	target = proto.Clone(target).(*computepb.TargetInstance)
+	target.Zone = proto.String("zones/" + zone)
+	target.SelfLink = proto.String("zones/" + zone + "/targetInstances/" + target.GetName())
+	f.targetInstances[key] = target
+	return f.operation("insert", target.GetSelfLink()), nil
+}
+
+func (f *FakeCompute) GetProject(ctx context.Context, project string) (*computepb.Project, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetProject"]++
+	return proto.Clone(f.project).(*computepb.Project), nil
+}
+
+func (f *FakeCompute) GetRegion(ctx context.Context, project, region string) (*computepb.Region, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["GetRegion"]++
+	resp, ok := f.regions[region]
+	if !ok {
+		return nil, notFound("region", region)
+	}
+	return proto.Clone(resp).(*computepb.Region), nil
+}
+
+// ListOperations ignores the filter, and returns all operations.
+func (f *FakeCompute) ListOperations(ctx context.Context, project, filter string) ([]*computepb.Operation, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls["ListOperations"]++
+	operations := []*computepb.Operation{}
+	for _, operation := range f.operations {
+		operations = append(operations, proto.Clone(operation).(*computepb.Operation))
+	}
+	return operations, nil
+}
+
+// operation records a write of the resource at target, which is done.
+func (f *FakeCompute) operation(kind, target string) *computepb.Operation {
+	f.serial++
+	operation := &computepb.Operation{
+		Name:          proto.String(fmt.Sprintf("operation-%d", f.serial)),
+		OperationType: proto.String(kind),
+		Status:        computepb.Operation_DONE.Enum(),
+		TargetLink:    proto.String(target),
+	}
+	f.operations[operation.GetName()] = operation
+	return proto.Clone(operation).(*computepb.Operation)
+}
+
+func (f *FakeCompute) fingerprint() string {
+	f.serial++
+	return fmt.Sprintf("fingerprint-%d", f.serial)
+}
+
+// groupLocation is the region of regional instance groups, or the zone.
+func groupLocation(region, zone string) string {
+	if region != "" {
+		return region
+	}
+	return zone
+}
+
+func notFound(kind, name string) error {
+	return &googleapi.Error{
+		Code:    http.StatusNotFound,
+		Message: fmt.Sprintf("The %s %s was not found", kind, name),
+	}
+}
+
+// cloneInstance copies an instance, so that callers do not change the fake
+// through it.
+func cloneInstance(instance *computepb.Instance) *computepb.Instance {
+	return proto.Clone(instance).(*computepb.Instance)
+}
+
+// parseFilter supports the filters of GetInstancesByLabels: terms
+// `status = "VALUE"`, `labels.KEY = "VALUE"` and `labels.KEY:*`, joined by
+// " AND ".
+func parseFilter(filter string) (func(*computepb.Instance) bool, error) {
+	terms := []func(*computepb.Instance) bool{}
+	for _, term := range strings.Split(filter, " AND ") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		if strings.HasPrefix(term, "labels.") && strings.HasSuffix(term, ":*") {
+			key := strings.TrimSuffix(strings.TrimPrefix(term, "labels."), ":*")
+			terms = append(terms, func(instance *computepb.Instance) bool {
+				_, ok := instance.Labels[key]
+				return ok
+			})
+			continue
+		}
+		field, value, ok := strings.Cut(term, " = ")
+		if !ok || len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+			return nil, fmt.Errorf("unsupported filter %q", term)
+		}
+		value = value[1 : len(value)-1]
+		switch {
+		case field == "status":
+			terms = append(terms, func(instance *computepb.Instance) bool {
+				return instance.GetStatus() == value
+			})
+		case strings.HasPrefix(field, "labels."):
+			key := strings.TrimPrefix(field, "labels.")
+			terms = append(terms, func(instance *computepb.Instance) bool {
+				return instance.Labels[key] == value
+			})
+		default:
+			return nil, fmt.Errorf("unsupported filter %q", term)
+		}
+	}
+	return func(instance *computepb.Instance) bool {
+		for _, term := range terms {
+			if !term(instance) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
@@ -0,0 +1,273 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// VIPs as GCE protocol forwarding rules, e.g. across VPC peering, where
+// alias IPs do not reach. Each VIP is the address of a regional forwarding
+// rule whose target is a target instance, and moves by pointing the rule to
+// the target instance of another instance.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/proto"
+)
+
+// ForwardingPoolLabel labels the forwarding rules of a pool, with the alias
+// network of the pool as value.
+const ForwardingPoolLabel = "vip-manager-pool"
+
+// UseForwarding manages VIPs as protocol forwarding rules instead of alias
+// IPs. Instances are the GCE instances of the managed instance group, and
+// their alias IPs the addresses of the forwarding rules in the region that
+// target them, among the rules labelled ForwardingPoolLabel=AliasNetwork.
+// Target instances are created as needed, named like their instance.
+func UseForwarding() {
+	provider = forwardingProvider{}
+}
+
+type forwardingProvider struct{}
+
+var (
+	forwardingMu sync.Mutex
+	// Instance URL by target instance URL, as they never change.
+	targetInstances = map[string]string{}
+	// VIPs removed from an instance, by alias network. A forwarding rule
+	// always has a target, so a removed VIP keeps its target until it is
+	// added to another instance, but no longer counts as on the instance.
+	released = map[string]map[string]bool{}
+)
+
+func forwardingRegion(cfg *GcpConfig) string {
+	if cfg.Region != "" {
+		return cfg.Region
+	}
+	return ZoneRegion(cfg.Zone)
+}
+
+// listForwardingRules returns the forwarding rules of the pool.
+func listForwardingRules(ctx context.Context, cfg *GcpConfig) ([]*computepb.ForwardingRule, error) {
+	filter := fmt.Sprintf("labels.%s = %q", ForwardingPoolLabel, cfg.AliasNetwork)
+	rules, err := computeClient.ListForwardingRules(ctx, cfg.Project, forwardingRegion(cfg), filter)
+	if err != nil {
+		countApiError("forwardingRules.list")
+		return rules, fmt.Errorf("Error listing forwarding rules of %s: %v", cfg.AliasNetwork, err)
+	}
+	return rules, nil
+}
+
+// targetOf returns the URL of the instance a forwarding rule points to, or
+// "" if it points to something else.
+func targetOf(ctx context.Context, cfg *GcpConfig, rule *computepb.ForwardingRule) string {
+	forwardingMu.Lock()
+	instance, ok := targetInstances[rule.GetTarget()]
+	forwardingMu.Unlock()
+	if ok {
+		return instance
+	}
+	zone, name := parseInstanceUrl(rule.GetTarget())
+	resp, err := computeClient.GetTargetInstance(ctx, cfg.Project, zone, name)
+	if err != nil {
+		countApiError("targetInstances.get")
+		log.Printf("Error getting target %s of forwarding rule %s: %v", name, rule.GetName(), err)
+		return ""
+	}
+	forwardingMu.Lock()
+	targetInstances[rule.GetTarget()] = resp.GetInstance()
+	forwardingMu.Unlock()
+	return resp.GetInstance()
+}
+
+// withForwardedIps sets the alias IPs of the instances to the addresses of
+// the forwarding rules that target them, except released ones.
+func withForwardedIps(ctx context.Context, cfg *GcpConfig, rules []*computepb.ForwardingRule, instances map[string]*GceInstance) {
+	for _, instance := range instances {
+		instance.AliasIps = &[]string{}
+		instance.AliasNetwork = cfg.AliasNetwork
+		instance.OtherNetworks = nil
+		instance.WideAliasRanges = nil
+	}
+	forwardingMu.Lock()
+	pool := released[cfg.AliasNetwork]
+	forwardingMu.Unlock()
+	for _, rule := range rules {
+		if rule.GetTarget() == "" || pool[rule.GetIPAddress()] {
+			continue
+		}
+		zone, name := parseInstanceUrl(targetOf(ctx, cfg, rule))
+		if instance, ok := instances[name]; ok && instance.Zone == zone {
+			*instance.AliasIps = append(*instance.AliasIps, rule.GetIPAddress())
+		}
+	}
+}
+
+func (forwardingProvider) GetInstance(ctx context.Context, cfg *GcpConfig, zone, name string) (*GceInstance, error) {
+	instance, err := gceProvider{}.GetInstance(ctx, cfg, zone, name)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	rules, err := listForwardingRules(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	withForwardedIps(ctx, cfg, rules, map[string]*GceInstance{name: instance})
+	return instance, nil
+}
+
+// ListGroup returns the instances of the managed instance group, listing the
+// forwarding rules once.
+func (forwardingProvider) ListGroup(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
+	instances := map[string]*GceInstance{}
+	zones, err := ListInstancesInGroup(ctx, cfg)
+	if err != nil {
+		log.Printf("Error listing instances in group: %v", err)
+		return instances, err
+	}
+	for name, zone := range zones {
+		instance, err := gceProvider{}.GetInstance(ctx, cfg, zone, name)
+		if err != nil {
+			log.Printf("Error getting instance: %v", err)
+			continue
+		}
+		instances[name] = instance
+	}
+	callCtx, cancel := callContext(ctx)
+	defer cancel()
+	rules, err := listForwardingRules(callCtx, cfg)
+	if err != nil {
+		return map[string]*GceInstance{}, err
+	}
+	withForwardedIps(callCtx, cfg, rules, instances)
+	return instances, nil
+}
+
+// ensureTargetInstance returns the URL of the target instance of an
+// instance, and creates it if needed.
+func ensureTargetInstance(ctx context.Context, cfg *GcpConfig, instance *GceInstance) (string, error) {
+	link := fmt.Sprintf("projects/%s/zones/%s/instances/%s", cfg.Project, instance.Zone, instance.Name)
+	resp, err := computeClient.GetTargetInstance(ctx, cfg.Project, instance.Zone, instance.Name)
+	if err == nil {
+		return resp.GetSelfLink(), nil
+	}
+	if !isStatus(err, http.StatusNotFound) {
+		countApiError("targetInstances.get")
+		return "", fmt.Errorf("Error getting target instance %s: %v", instance.Name, err)
+	}
+	log.Printf("Create target instance %s for forwarding rules", instance.Name)
+	countWrite()
+	op, err := computeClient.InsertTargetInstance(ctx, cfg.Project, instance.Zone, &computepb.TargetInstance{
+		Name:     proto.String(instance.Name),
+		Instance: proto.String(link),
+	})
+	if err != nil {
+		countApiError("targetInstances.insert")
+		return "", fmt.Errorf("Error creating target instance %s: %v", instance.Name, err)
+	}
+	for op.GetStatus() != computepb.Operation_DONE {
+		op, err = computeClient.WaitOperation(ctx, cfg.Project, instance.Zone, op.GetName())
+		if err != nil {
+			countApiError("zoneOperations.wait")
+			return "", fmt.Errorf("Error creating target instance %s: %v", instance.Name, err)
+		}
+	}
+	if err := operationError(op); err != nil {
+		return "", fmt.Errorf("Error creating target instance %s: %v", instance.Name, err)
+	}
+	return op.GetTargetLink(), nil
+}
+
+// UpdateAliasIPs points the forwarding rules of added VIPs to the target
+// instance of the instance, and releases removed VIPs, see released. Returns
+// the name of the last operation.
+func (forwardingProvider) UpdateAliasIPs(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	forwardingMu.Lock()
+	if released[cfg.AliasNetwork] == nil {
+		released[cfg.AliasNetwork] = map[string]bool{}
+	}
+	for _, ip := range *instance.AliasIps {
+		if !slices.Contains(ips, ip) {
+			released[cfg.AliasNetwork][ip] = true
+		}
+	}
+	forwardingMu.Unlock()
+	added := []string{}
+	for _, ip := range ips {
+		if !slices.Contains(*instance.AliasIps, ip) {
+			added = append(added, ip)
+		}
+	}
+	if len(added) == 0 {
+		return "", nil
+	}
+	target, err := ensureTargetInstance(ctx, cfg, instance)
+	if err != nil {
+		return "", err
+	}
+	rules, err := listForwardingRules(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	name := ""
+	for _, ip := range added {
+		i := slices.IndexFunc(rules, func(rule *computepb.ForwardingRule) bool { return rule.GetIPAddress() == ip })
+		if i < 0 {
+			return name, fmt.Errorf("no forwarding rule with address %s labelled %s=%s", ip, ForwardingPoolLabel, cfg.AliasNetwork)
+		}
+		countWrite()
+		op, err := computeClient.SetForwardingRuleTarget(ctx, cfg.Project, forwardingRegion(cfg), rules[i].GetName(), target)
+		if err != nil {
+			countApiError("forwardingRules.setTarget")
+			log.Printf("Error setting target of forwarding rule %s: %v", rules[i].GetName(), err)
+			return name, err
+		}
+		forwardingMu.Lock()
+		delete(released[cfg.AliasNetwork], ip)
+		forwardingMu.Unlock()
+		name = op.GetName()
+	}
+	return name, nil
+}
+
+// AliasRange returns the CIDR of the subnetwork of the forwarding rules,
+// for internal ones.
+func (forwardingProvider) AliasRange(ctx context.Context, cfg *GcpConfig, subnetwork string) (string, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	rules, err := listForwardingRules(ctx, cfg)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range rules {
+		if rule.GetSubnetwork() == "" {
+			continue
+		}
+		resp, err := getSubnetwork(ctx, rule.GetSubnetwork())
+		if err != nil {
+			return "", err
+		}
+		return resp.GetIpCidrRange(), nil
+	}
+	return "", fmt.Errorf("Forwarding rules %s: %w", cfg.AliasNetwork, ErrNoSecondaryRange)
+}
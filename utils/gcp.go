@@ -16,36 +16,156 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
+	"net/http"
+	"net/netip"
+	"path"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"cloud.google.com/go/compute/apiv1/computepb"
 	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/exp/slices"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
-	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/protobuf/proto"
 )
 
 type GcpConfig struct {
 	Project          string
 	Zone             string
+	Region           string
 	GceInstanceGroup string
 	AliasNetwork     string
 	WaitSeconds      uint
+	// Port of metrics_exporter on the instances, to verify added alias IPs
+	// from the guest side, for up to VerifySeconds. 0 disables.
+	VerifyPort    uint
+	VerifySeconds uint
+	// Select instances by labels, "KEY=VALUE,...", instead of the managed
+	// instance group GceInstanceGroup, which is then just a name.
+	LabelSelector string
+	// Use the managed instance groups of a GKE node pool, by resource name,
+	// instead of GceInstanceGroup, which is then just a name.
+	NodePool string
+	// Use the Kubernetes nodes matching a label selector, "KEY=VALUE,...",
+	// from within the cluster, see ConnectKube.
+	NodeSelector string
+	// Subnetwork with the alias network, as a self-link
+	// projects/PROJECT/regions/REGION/subnetworks/NAME. With Shared VPC, the
+	// project is the host project. Selects the network interface of
+	// instances with several. Empty uses the network interfaces as they are.
+	Subnetwork string
+	// Prefix length of the blocks of VIPs assigned as a whole, e.g. 28.
+	// Alias ranges of that length are then VIPs, as "CIDR" strings, instead
+	// of being expanded to single IPs. 0 for single IPs.
+	BlockBits int
+	// Webhook to notify of VIPs added or removed, with the payload rendered
+	// by MoveTemplate, if set.
+	MoveWebhook  string
+	MoveTemplate *template.Template
 }
 
 var (
-	ctx            = context.Background()
-	computeService *compute.Service
+	ErrNoSecondaryRange = errors.New("no such secondary range")
 )
 
+// OAuth scopes of the Compute Engine API.
+const (
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+	computeScope       = "https://www.googleapis.com/auth/compute"
+)
+
+// DefaultCallTimeout is the deadline of a single call to list, get or update
+// instances, including its retries.
+const DefaultCallTimeout = 2 * time.Minute
+
+var callTimeout = DefaultCallTimeout
+
+// SetCallTimeout sets the deadline of calls to list, get or update instances,
+// so that a hung call can not stall a reconcile loop. 0 for no deadline.
+func SetCallTimeout(timeout time.Duration) {
+	callTimeout = timeout
+}
+
+// callContext returns the context of a single call, with the call deadline.
+func callContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if callTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, callTimeout)
+}
+
+// isStatus returns whether err is a Google API error with the HTTP status
+// code.
+func isStatus(err error, code int) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
+
 type GceInstance struct {
 	Name               string
+	Zone               string
 	NetworkInterface   string
+	NetworkIp          string
 	NetworkFingerprint string
+	Subnetwork         string
 	AliasNetwork       string
 	AliasIps           *[]string
 	OtherNetworks      []Network
+	Labels             map[string]string
+	// Machine type URL.
+	MachineType string
+	// Instance template URL, empty if unknown.
+	Template string
+	// The ID changes when the instance is recreated with the same name, the
+	// start time (RFC 3339) when it is stopped and started, or reset.
+	Id      uint64
+	Created string
+	Started string
+	// E.g. RUNNING, or TERMINATED when stopped.
+	Status string
+	// Opaque ID of the physical host, if GCE reports it, e.g. with a compact
+	// placement policy, and URLs of attached resource policies.
+	PhysicalHost     string
+	ResourcePolicies []string
+	// Ranges in the alias network wider than one address, which vip_manager
+	// never assigns, e.g. added by hand or by another tool.
+	WideAliasRanges []string
+}
+
+// Set by SetImpersonation.
+var impersonateServiceAccount string
+
+// SetImpersonation makes the clients of all Google APIs impersonate the
+// service account, e.g. a dedicated one with permission to update network
+// interfaces, instead of using the default credentials directly. Those need
+// the Service Account Token Creator role on the service account. Call it
+// before connecting to any API.
+func SetImpersonation(serviceAccount string) {
+	impersonateServiceAccount = serviceAccount
+}
+
+// defaultClient returns an HTTP client with the default credentials, or with
+// those of the impersonated service account, see SetImpersonation.
+func defaultClient(ctx context.Context, scopes ...string) (*http.Client, error) {
+	if impersonateServiceAccount == "" {
+		return google.DefaultClient(ctx, scopes...)
+	}
+	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+		TargetPrincipal: impersonateServiceAccount,
+		Scopes:          scopes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error impersonating service account %s: %v", impersonateServiceAccount, err)
+	}
+	return oauth2.NewClient(ctx, ts), nil
 }
 
 type Network struct {
@@ -53,26 +173,35 @@ type Network struct {
 	Cidr string
 }
 
-func ConnectCompute() {
-	c, err := google.DefaultClient(ctx, compute.CloudPlatformScope)
-	if err != nil {
-		log.Printf("Error getting Default GCP client: %v", err)
+// ConnectCompute connects to the Compute Engine API, with the default
+// credentials or the impersonated service account.
+func ConnectCompute(ctx context.Context) error {
+	if computeClient != nil {
+		// Set by UseCompute, e.g. to a FakeCompute without credentials.
+		return nil
 	}
-	computeService, err = compute.New(c)
+	c, err := defaultClient(ctx, cloudPlatformScope)
 	if err != nil {
-		log.Fatalf("Error conencting to GCP compute service: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("Error getting Default GCP client: %v", err)
+	}
+	if apiLimiter != nil {
+		c.Transport = &limitTransport{base: c.Transport, limiter: apiLimiter}
 	}
+	c.Transport = &retryTransport{base: c.Transport}
+	if computeClient, err = newLibraryClient(ctx, c); err != nil {
+		return fmt.Errorf("Error connecting to the Compute Engine API: %v", err)
+	}
+	return nil
 }
 
 // GetProject gets the GCP project ID from GCP credentials.
-func ChooseProject(cfg *GcpConfig) {
+func ChooseProject(ctx context.Context, cfg *GcpConfig) {
 	if cfg.Project != "" {
 		return
 	}
 	log.Printf("Get project from GCP credentials.")
 	credentials, err :=
-		google.FindDefaultCredentials(ctx, compute.ComputeScope)
+		google.FindDefaultCredentials(ctx, computeScope)
 	// TODO(leffler): Explain how to specify credentials.
 	msg := "Failed to get project id. Please specify using command line."
 	if err != nil {
@@ -81,65 +210,167 @@ func ChooseProject(cfg *GcpConfig) {
 	cfg.Project = credentials.ProjectID
 }
 
+// Self describes the instance this process runs on, and its managed
+// instance group, from the metadata server.
+type Self struct {
+	Project  string
+	Zone     string
+	Region   string
+	Group    string
+	Instance string
+}
+
+// GetSelf reads the instance and its group from the metadata server. The
+// "created-by" attribute is the instance group manager URL:
+// projects/NUMBER/zones/ZONE/instanceGroupManagers/NAME, or regions/REGION
+// for regional groups.
+func GetSelf() (*Self, error) {
+	self := &Self{}
+	var err error
+	if self.Project, err = metadata.ProjectID(); err != nil {
+		return nil, fmt.Errorf("Error getting project from metadata: %v", err)
+	}
+	if self.Instance, err = metadata.InstanceName(); err != nil {
+		return nil, fmt.Errorf("Error getting instance name from metadata: %v", err)
+	}
+	createdBy, err := metadata.InstanceAttributeValue("created-by")
+	if err != nil {
+		return nil, fmt.Errorf("Error getting instance group from metadata, instance %s is not in a managed instance group: %v", self.Instance, err)
+	}
+	parts := strings.Split(createdBy, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "zones":
+			self.Zone = parts[i+1]
+		case "regions":
+			self.Region = parts[i+1]
+		case "instanceGroupManagers":
+			self.Group = parts[i+1]
+		}
+	}
+	if self.Group == "" {
+		return nil, fmt.Errorf("Instance %s is not created by an instance group manager: %s", self.Instance, createdBy)
+	}
+	return self, nil
+}
+
 func ChooseZone(cfg *GcpConfig) {
-	if cfg.Zone != "" {
+	if cfg.Zone != "" || cfg.Region != "" {
+		// Regional instance groups span several zones.
 		return
 	}
 	cfg.Zone, _ = metadata.Zone()
 }
 
-func ListInstanceGroups(cfg *GcpConfig) (names []string, err error) {
-	req := computeService.InstanceGroups.List(cfg.Project, cfg.Zone)
-	err = req.Pages(ctx, func(page *compute.InstanceGroupList) error {
-		for _, instanceGroup := range page.Items {
-			names = append(names, instanceGroup.Name)
-		}
-		return nil
-	})
+func ListInstanceGroups(ctx context.Context, cfg *GcpConfig) (names []string, err error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	names, err = computeClient.ListInstanceGroups(ctx, cfg.Project, cfg.Zone)
 	if err != nil {
+		countApiError("instanceGroups.list")
 		log.Printf("Error listing instance groups: %v", err)
 		return names, err
 	}
 	return names, nil
 }
 
-func ListInstancesInGroup(cfg *GcpConfig) (names []string, err error) {
-	rb := &compute.InstanceGroupsListInstancesRequest{
-		InstanceState: "RUNNING",
+// ListInstancesInGroup lists running instances in the instance group. The
+// result maps instance names to zones, since instances of a regional group
+// live in several zones.
+func ListInstancesInGroup(ctx context.Context, cfg *GcpConfig) (zones map[string]string, err error) {
+	if cfg.NodePool != "" {
+		return listInstancesInNodePool(ctx, cfg)
 	}
-	req := computeService.InstanceGroups.ListInstances(cfg.Project, cfg.Zone, cfg.GceInstanceGroup, rb)
-	err = req.Pages(ctx, func(page *compute.InstanceGroupsListInstances) error {
-		for _, instance := range page.Items {
-			url := strings.Split(instance.Instance, "/")
-			names = append(names, url[len(url)-1])
-		}
-		return nil
-	})
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	zones = map[string]string{}
+	urls, err := computeClient.ListGroupInstances(ctx, cfg.Project, cfg.Region, cfg.Zone, cfg.GceInstanceGroup)
 	if err != nil {
-		log.Printf("Error listing instances: %v", err)
-		return names, err
+		if cfg.Region != "" {
+			countApiError("regionInstanceGroups.listInstances")
+			log.Printf("Error listing instances in region %s: %v", cfg.Region, err)
+		} else {
+			countApiError("instanceGroups.listInstances")
+			log.Printf("Error listing instances: %v", err)
+		}
+		return zones, err
 	}
-	return names, nil
+	for _, url := range urls {
+		zone, name := parseInstanceUrl(url)
+		zones[name] = zone
+	}
+	return zones, nil
+}
+
+// parseInstanceUrl extracts zone and instance name from an instance URL:
+// .../projects/PROJECT/zones/ZONE/instances/NAME
+func parseInstanceUrl(url string) (zone, name string) {
+	parts := strings.Split(url, "/")
+	name = parts[len(parts)-1]
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "zones" {
+			zone = parts[i+1]
+		}
+	}
+	return zone, name
 }
 
-func GetInstance(cfg *GcpConfig, name string) (*GceInstance, error) {
-	resp, err := computeService.Instances.Get(cfg.Project, cfg.Zone, name).Context(ctx).Do()
+// gceProvider manages alias IP ranges of GCE instances in managed instance
+// groups.
+type gceProvider struct{}
+
+func (gceProvider) GetInstance(ctx context.Context, cfg *GcpConfig, zone, name string) (*GceInstance, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp, err := computeClient.GetInstance(ctx, cfg.Project, zone, name)
 	if err != nil {
+		countApiError("instances.get")
 		return nil, fmt.Errorf("Error getting instance %s: %v", name, err)
 	}
+	return newGceInstance(cfg, zone, resp), nil
+}
+
+func newGceInstance(cfg *GcpConfig, zone string, resp *computepb.Instance) *GceInstance {
 	instance := GceInstance{
-		Name:     resp.Name,
-		AliasIps: &[]string{},
+		Name:        resp.GetName(),
+		Zone:        zone,
+		AliasIps:    &[]string{},
+		Labels:      resp.GetLabels(),
+		MachineType: resp.GetMachineType(),
+		Id:          resp.GetId(),
+		Created:     resp.GetCreationTimestamp(),
+		Started:     resp.GetLastStartTimestamp(),
+		Status:      resp.GetStatus(),
+	}
+	instance.ResourcePolicies = resp.GetResourcePolicies()
+	instance.PhysicalHost = resp.GetResourceStatus().GetPhysicalHost()
+	for _, item := range resp.GetMetadata().GetItems() {
+		if item.GetKey() == "instance-template" && item.Value != nil {
+			instance.Template = item.GetValue()
+		}
 	}
-	interfaces := resp.NetworkInterfaces
+	interfaces := resp.GetNetworkInterfaces()
 	for _, i := range interfaces {
-		instance.NetworkInterface = i.Name
-		instance.NetworkFingerprint = i.Fingerprint
-		for _, alias := range i.AliasIpRanges {
-			if alias.SubnetworkRangeName == cfg.AliasNetwork {
+		if cfg.Subnetwork != "" && !SameSubnetwork(i.GetSubnetwork(), cfg.Subnetwork) {
+			continue
+		}
+		instance.NetworkInterface = i.GetName()
+		instance.NetworkIp = i.GetNetworkIP()
+		instance.NetworkFingerprint = i.GetFingerprint()
+		instance.Subnetwork = i.GetSubnetwork()
+		for _, alias := range i.GetAliasIpRanges() {
+			if alias.GetSubnetworkRangeName() == cfg.AliasNetwork {
 				// Manage our alias network.
-				instance.AliasNetwork = alias.SubnetworkRangeName
-				ips, err := ExpandNetworkPrefix(alias.IpCidrRange)
+				instance.AliasNetwork = alias.GetSubnetworkRangeName()
+				prefix, err := netip.ParsePrefix(alias.GetIpCidrRange())
+				if err == nil && cfg.BlockBits > 0 && prefix.Bits() == cfg.BlockBits {
+					*instance.AliasIps = append(*instance.AliasIps, prefix.Masked().String())
+					continue
+				}
+				if err == nil && !prefix.IsSingleIP() {
+					instance.WideAliasRanges = append(instance.WideAliasRanges, alias.GetIpCidrRange())
+				}
+				ips, err := ExpandNetworkPrefix(alias.GetIpCidrRange())
 				if err != nil {
 					log.Printf("Failed to expand network prefix: %v", err)
 				}
@@ -149,25 +380,47 @@ func GetInstance(cfg *GcpConfig, name string) (*GceInstance, error) {
 			} else {
 				// Track other alias networks.
 				network := Network{
-					Name: alias.SubnetworkRangeName,
-					Cidr: alias.IpCidrRange,
+					Name: alias.GetSubnetworkRangeName(),
+					Cidr: alias.GetIpCidrRange(),
 				}
 				instance.OtherNetworks = append(instance.OtherNetworks, network)
 			}
 		}
 	}
-	return &instance, nil
+	return &instance
 }
 
-func GetInstancesFromMIG(cfg *GcpConfig) (map[string]*GceInstance, error) {
+// GetGroupTemplate returns the instance template URL that the managed
+// instance group rolls out. During a rollout with several versions, this is
+// the last (newest) version.
+func GetGroupTemplate(ctx context.Context, cfg *GcpConfig) (string, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp, err := computeClient.GetInstanceGroupManager(ctx, cfg.Project, cfg.Region, cfg.Zone, cfg.GceInstanceGroup)
+	if err != nil {
+		if cfg.Region != "" {
+			countApiError("regionInstanceGroupManagers.get")
+		} else {
+			countApiError("instanceGroupManagers.get")
+		}
+		return "", fmt.Errorf("Error getting instance group manager %s: %v", cfg.GceInstanceGroup, err)
+	}
+	template := resp.GetInstanceTemplate()
+	if versions := resp.GetVersions(); len(versions) > 0 {
+		template = versions[len(versions)-1].GetInstanceTemplate()
+	}
+	return template, nil
+}
+
+func (gceProvider) ListGroup(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
 	instances := map[string]*GceInstance{}
-	names, err := ListInstancesInGroup(cfg)
+	zones, err := ListInstancesInGroup(ctx, cfg)
 	if err != nil {
 		log.Printf("Error listing instances in group: %v", err)
 		return instances, err
 	}
-	for _, name := range names {
-		instance, err := GetInstance(cfg, name)
+	for name, zone := range zones {
+		instance, err := GetInstance(ctx, cfg, zone, name)
 		if err != nil {
 			log.Printf("Error getting instance: %v", err)
 			continue
@@ -177,12 +430,269 @@ func GetInstancesFromMIG(cfg *GcpConfig) (map[string]*GceInstance, error) {
 	return instances, nil
 }
 
-func UpdateAliasIPs(cfg *GcpConfig, instance *GceInstance, ips []string) error {
-	ipRanges := []*compute.AliasIpRange{}
+// GetInstancesByLabels lists the running instances matching the label
+// selector of the configuration, "KEY=VALUE,..." or "KEY" for any value, in
+// the zone, or in all zones of the region.
+func GetInstancesByLabels(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	filters := []string{`status = "RUNNING"`}
+	for _, term := range strings.Split(cfg.LabelSelector, ",") {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(term), "=")
+		if hasValue {
+			filters = append(filters, fmt.Sprintf("labels.%s = %q", key, value))
+		} else {
+			filters = append(filters, fmt.Sprintf("labels.%s:*", key))
+		}
+	}
+	filter := strings.Join(filters, " AND ")
+	instances := map[string]*GceInstance{}
+	items, err := computeClient.ListInstances(ctx, cfg.Project, cfg.Region, cfg.Zone, filter)
+	if err != nil {
+		if cfg.Region != "" {
+			countApiError("instances.aggregatedList")
+		} else {
+			countApiError("instances.list")
+		}
+		return instances, fmt.Errorf("Error listing instances with labels %s: %v", cfg.LabelSelector, err)
+	}
+	for _, item := range items {
+		// The zone is a URL.
+		instances[item.GetName()] = newGceInstance(cfg, path.Base(item.GetZone()), item)
+	}
+	return instances, nil
+}
+
+// SubnetworkLink returns the self-link of a subnetwork, given as a self-link or
+// URL, or as a NAME in the project and region. With Shared VPC, the project
+// is the host project.
+func SubnetworkLink(project, region, subnetwork string) (string, error) {
+	if i := strings.Index(subnetwork, "projects/"); i >= 0 {
+		link := subnetwork[i:]
+		parts := strings.Split(link, "/")
+		if len(parts) != 6 || parts[2] != "regions" || parts[4] != "subnetworks" {
+			return "", fmt.Errorf("invalid subnetwork %s, expected projects/PROJECT/regions/REGION/subnetworks/NAME", subnetwork)
+		}
+		return link, nil
+	}
+	if strings.Contains(subnetwork, "/") {
+		return "", fmt.Errorf("invalid subnetwork %s, expected projects/PROJECT/regions/REGION/subnetworks/NAME or NAME", subnetwork)
+	}
+	if project == "" || region == "" {
+		return "", fmt.Errorf("subnetwork %s needs a project and region", subnetwork)
+	}
+	return fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", project, region, subnetwork), nil
+}
+
+// SameSubnetwork returns true if two subnetwork URLs or self-links refer to
+// the same subnetwork.
+func SameSubnetwork(a, b string) bool {
+	trim := func(s string) string {
+		if i := strings.Index(s, "projects/"); i >= 0 {
+			return s[i:]
+		}
+		return s
+	}
+	return trim(a) == trim(b)
+}
+
+// ZoneRegion returns the region of a zone, e.g. us-central1 for us-central1-a.
+func ZoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// GetSecondaryRange returns the CIDR of a secondary range of a subnetwork.
+// The subnetwork is a URL: .../projects/PROJECT/regions/REGION/subnetworks/NAME
+func GetSecondaryRange(ctx context.Context, subnetwork, rangeName string) (string, error) {
+	resp, err := getSubnetwork(ctx, subnetwork)
+	if err != nil {
+		return "", err
+	}
+	for _, secondary := range resp.GetSecondaryIpRanges() {
+		if secondary.GetRangeName() == rangeName {
+			return secondary.GetIpCidrRange(), nil
+		}
+	}
+	return "", fmt.Errorf("Subnetwork %s range %s: %w", resp.GetName(), rangeName, ErrNoSecondaryRange)
+}
+
+// getSubnetwork gets a subnetwork by URL.
+func getSubnetwork(ctx context.Context, subnetwork string) (*computepb.Subnetwork, error) {
+	parts := strings.Split(subnetwork, "/")
+	var project, region string
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "regions":
+			region = parts[i+1]
+		}
+	}
+	name := parts[len(parts)-1]
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp, err := computeClient.GetSubnetwork(ctx, project, region, name)
+	if err != nil {
+		countApiError("subnetworks.get")
+		return nil, fmt.Errorf("Error getting subnetwork %s: %v", name, err)
+	}
+	return resp, nil
+}
+
+func (gceProvider) AliasRange(ctx context.Context, cfg *GcpConfig, subnetwork string) (string, error) {
+	return GetSecondaryRange(ctx, subnetwork, cfg.AliasNetwork)
+}
+
+var (
+	machineTypeCpusMu sync.Mutex
+	// Number of vCPUs by machine type URL. Machine types never change.
+	machineTypeCpus = map[string]int{}
+)
+
+// GetMachineTypeCpus returns the number of vCPUs of a machine type. The
+// machine type is a URL: .../projects/PROJECT/zones/ZONE/machineTypes/NAME
+func GetMachineTypeCpus(ctx context.Context, machineType string) (int, error) {
+	machineTypeCpusMu.Lock()
+	defer machineTypeCpusMu.Unlock()
+	if cpus, ok := machineTypeCpus[machineType]; ok {
+		return cpus, nil
+	}
+	parts := strings.Split(machineType, "/")
+	var project, zone string
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "zones":
+			zone = parts[i+1]
+		}
+	}
+	name := parts[len(parts)-1]
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp, err := computeClient.GetMachineType(ctx, project, zone, name)
+	if err != nil {
+		countApiError("machineTypes.get")
+		return 0, fmt.Errorf("Error getting machine type %s: %v", name, err)
+	}
+	machineTypeCpus[machineType] = int(resp.GetGuestCpus())
+	return int(resp.GetGuestCpus()), nil
+}
+
+// PlacementPolicy is a group placement resource policy: compact (collocated)
+// instances are close to each other, possibly on shared hosts; spread
+// instances are in separate availability domains.
+type PlacementPolicy struct {
+	Name                string
+	Collocated          bool
+	AvailabilityDomains int
+}
+
+var (
+	placementPoliciesMu sync.Mutex
+	// Group placement policies by URL, nil for other resource policies.
+	// Policies in use can not be changed.
+	placementPolicies = map[string]*PlacementPolicy{}
+)
+
+// GetPlacementPolicy returns the group placement policy of a resource policy
+// URL: .../projects/PROJECT/regions/REGION/resourcePolicies/NAME, or nil for
+// other resource policies, e.g. snapshot schedules.
+func GetPlacementPolicy(ctx context.Context, resourcePolicy string) (*PlacementPolicy, error) {
+	placementPoliciesMu.Lock()
+	defer placementPoliciesMu.Unlock()
+	if policy, ok := placementPolicies[resourcePolicy]; ok {
+		return policy, nil
+	}
+	parts := strings.Split(resourcePolicy, "/")
+	var project, region string
+	for i := 0; i < len(parts)-1; i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "regions":
+			region = parts[i+1]
+		}
+	}
+	name := parts[len(parts)-1]
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp, err := computeClient.GetResourcePolicy(ctx, project, region, name)
+	if err != nil {
+		countApiError("resourcePolicies.get")
+		return nil, fmt.Errorf("Error getting resource policy %s: %v", name, err)
+	}
+	var policy *PlacementPolicy
+	if group := resp.GetGroupPlacementPolicy(); group != nil {
+		policy = &PlacementPolicy{
+			Name:                resp.GetName(),
+			Collocated:          group.GetCollocation() == "COLLOCATED",
+			AvailabilityDomains: int(group.GetAvailabilityDomainCount()),
+		}
+	}
+	placementPolicies[resourcePolicy] = policy
+	return policy, nil
+}
+
+// Conflicting updates of a network interface in a row, after which
+// UpdateAliasIPs gives up.
+const fingerprintRetries = 3
+
+// UpdateAliasIPs sets the alias IPs of an instance, and returns the name of
+// the GCE operation. When someone else updated the network interface since
+// the instance was read, the fingerprint is stale, and the update fails with
+// 412: re-read the instance, apply the changes to its current alias IPs, and
+// retry. instance itself is left as it is.
+func (p gceProvider) UpdateAliasIPs(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		name, err := updateNetworkInterface(ctx, cfg, instance, ips)
+		if err == nil {
+			return name, nil
+		}
+		if !isStatus(err, http.StatusPreconditionFailed) || attempt >= fingerprintRetries {
+			countApiError("instances.updateNetworkInterface")
+			log.Printf("Error updating network interfaces: %v", err)
+			return "", err
+		}
+		fingerprintConflicts.Inc()
+		log.Printf("Network interface of instance %s changed concurrently, retrying: %v", instance.Name, err)
+		current, err := p.GetInstance(ctx, cfg, instance.Zone, instance.Name)
+		if err != nil {
+			return "", err
+		}
+		ips = mergeAliasIPs(*instance.AliasIps, ips, *current.AliasIps)
+		instance = current
+	}
+}
+
+// mergeAliasIPs applies the changes from before to after onto current: the
+// alias IPs added in after are added, and the ones removed are removed.
+func mergeAliasIPs(before, after, current []string) []string {
+	merged := []string{}
+	for _, ip := range current {
+		if slices.Contains(after, ip) || !slices.Contains(before, ip) {
+			merged = append(merged, ip)
+		}
+	}
+	for _, ip := range after {
+		if !slices.Contains(before, ip) && !slices.Contains(merged, ip) {
+			merged = append(merged, ip)
+		}
+	}
+	return merged
+}
+
+func updateNetworkInterface(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	ipRanges := []*computepb.AliasIpRange{}
 	for _, network := range instance.OtherNetworks {
-		ipRanges = append(ipRanges, &compute.AliasIpRange{
-			IpCidrRange:         network.Cidr,
-			SubnetworkRangeName: network.Name,
+		ipRanges = append(ipRanges, &computepb.AliasIpRange{
+			IpCidrRange:         proto.String(network.Cidr),
+			SubnetworkRangeName: proto.String(network.Name),
 		})
 	}
 	for _, ip := range ips {
@@ -190,25 +700,72 @@ func UpdateAliasIPs(cfg *GcpConfig, instance *GceInstance, ips []string) error {
 			// Respect per GCE VM limit of 100 alias networks.
 			break
 		}
-		ipRanges = append(ipRanges, &compute.AliasIpRange{
-			IpCidrRange:         ip + "/32",
-			SubnetworkRangeName: cfg.AliasNetwork,
+		cidr := ip + "/32"
+		if strings.Contains(ip, "/") {
+			// A block of VIPs.
+			cidr = ip
+		}
+		ipRanges = append(ipRanges, &computepb.AliasIpRange{
+			IpCidrRange:         proto.String(cidr),
+			SubnetworkRangeName: proto.String(cfg.AliasNetwork),
 		})
 	}
-	rb := &compute.NetworkInterface{
-		Fingerprint:   instance.NetworkFingerprint,
+	rb := &computepb.NetworkInterface{
+		Fingerprint:   proto.String(instance.NetworkFingerprint),
 		AliasIpRanges: ipRanges,
 	}
 
-	_, err := computeService.Instances.UpdateNetworkInterface(
-		cfg.Project, cfg.Zone, instance.Name, instance.NetworkInterface, rb).Context(ctx).Do()
-
+	countWrite()
+	resp, err := computeClient.UpdateNetworkInterface(ctx, cfg.Project, instance.Zone, instance.Name, instance.NetworkInterface, rb)
 	if err != nil {
-		log.Printf("Error updating network interfaces: %v", err)
-		return err
+		return "", err
 	}
+	return resp.GetName(), nil
+}
 
-	// TODO: Change code below to process the `resp` object:
-	// fmt.Printf("Response: %#v\n", resp)
-	return nil
+// WaitOperation waits for a zonal operation, for up to WaitSeconds, and
+// returns its error, e.g. of a quota or a missing permission, if it failed.
+// Operations that are still running then are left alone. Errors of the wait
+// itself are returned too, as the outcome of the update is unknown, and so is
+// the error of ctx once it is done.
+func (gceProvider) WaitOperation(ctx context.Context, cfg *GcpConfig, zone, name string) error {
+	if cfg.WaitSeconds == 0 {
+		return nil
+	}
+	start := time.Now()
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.WaitSeconds)*time.Second)
+	defer cancel()
+	for {
+		// Returns when the operation is done, or after up to two minutes.
+		op, err := computeClient.WaitOperation(waitCtx, cfg.Project, zone, name)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && waitCtx.Err() != nil {
+			log.Printf("Operation %s still running after %v. Ignoring.", name, time.Since(start))
+			return nil
+		}
+		if err != nil {
+			countApiError("zoneOperations.wait")
+			return fmt.Errorf("Error waiting for operation %s: %v", name, err)
+		}
+		if op.GetStatus() == computepb.Operation_DONE {
+			log.Printf("Operation %s done in %v.", name, time.Since(start))
+			return operationError(op)
+		}
+	}
+}
+
+// operationError returns the errors of a done operation, if any.
+func operationError(op *computepb.Operation) error {
+	errs := op.GetError().GetErrors()
+	if len(errs) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, e := range errs {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.GetCode(), e.GetMessage()))
+	}
+	return fmt.Errorf("Operation %s failed with HTTP %d %s: %s", op.GetName(),
+		op.GetHttpErrorStatusCode(), op.GetHttpErrorMessage(), strings.Join(messages, "; "))
 }
@@ -0,0 +1,184 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/compute/apiv1/computepb"
+	"golang.org/x/exp/slices"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testZone  = "us-central1-a"
+	testAlias = "vip-range"
+)
+
+func testConfig() *GcpConfig {
+	return &GcpConfig{Project: "test-project", Zone: testZone, AliasNetwork: testAlias, WaitSeconds: 1}
+}
+
+// newTestInstance adds an instance with alias IPs in testAlias, and in
+// another alias network, to a fake.
+func newTestInstance(fake *FakeCompute, name string, ips ...string) {
+	ranges := []*computepb.AliasIpRange{{
+		IpCidrRange:         proto.String("10.2.0.0/28"),
+		SubnetworkRangeName: proto.String("other-range"),
+	}}
+	for _, ip := range ips {
+		ranges = append(ranges, &computepb.AliasIpRange{
+			IpCidrRange:         proto.String(ip + "/32"),
+			SubnetworkRangeName: proto.String(testAlias),
+		})
+	}
+	fake.AddInstance(testZone, "", "", &computepb.Instance{
+		Name:              proto.String(name),
+		NetworkInterfaces: []*computepb.NetworkInterface{{AliasIpRanges: ranges}},
+	})
+}
+
+func sorted(ips []string) []string {
+	ips = slices.Clone(ips)
+	sort.Strings(ips)
+	return ips
+}
+
+func TestUpdateAliasIPs(t *testing.T) {
+	fake := NewFakeCompute()
+	UseCompute(fake)
+	newTestInstance(fake, "vm-1", "10.1.0.1")
+	cfg := testConfig()
+	ctx := context.Background()
+	instance, err := gceProvider{}.GetInstance(ctx, cfg, testZone, "vm-1")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+
+	name, err := gceProvider{}.UpdateAliasIPs(ctx, cfg, instance, []string{"10.1.0.1", "10.1.0.2"})
+	if err != nil {
+		t.Fatalf("UpdateAliasIPs: %v", err)
+	}
+	if err := (gceProvider{}).WaitOperation(ctx, cfg, testZone, name); err != nil {
+		t.Errorf("WaitOperation(%s): %v", name, err)
+	}
+	updated, err := gceProvider{}.GetInstance(ctx, cfg, testZone, "vm-1")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if got, want := sorted(*updated.AliasIps), []string{"10.1.0.1", "10.1.0.2"}; !slices.Equal(got, want) {
+		t.Errorf("alias IPs %v, want %v", got, want)
+	}
+	if len(updated.OtherNetworks) != 1 {
+		t.Errorf("other alias networks %v, want other-range kept", updated.OtherNetworks)
+	}
+}
+
+func TestUpdateAliasIPsFingerprintConflict(t *testing.T) {
+	fake := NewFakeCompute()
+	UseCompute(fake)
+	newTestInstance(fake, "vm-1", "10.1.0.1", "10.1.0.2")
+	cfg := testConfig()
+	ctx := context.Background()
+	stale, err := gceProvider{}.GetInstance(ctx, cfg, testZone, "vm-1")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	// Someone else adds 10.1.0.3 in the meantime.
+	current, err := gceProvider{}.GetInstance(ctx, cfg, testZone, "vm-1")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if _, err := updateNetworkInterface(ctx, cfg, current, []string{"10.1.0.1", "10.1.0.2", "10.1.0.3"}); err != nil {
+		t.Fatalf("updateNetworkInterface: %v", err)
+	}
+
+	// Remove 10.1.0.1 and add 10.1.0.4 based on the stale instance.
+	if _, err := (gceProvider{}).UpdateAliasIPs(ctx, cfg, stale, []string{"10.1.0.2", "10.1.0.4"}); err != nil {
+		t.Fatalf("UpdateAliasIPs: %v", err)
+	}
+	if got := fake.Calls("UpdateNetworkInterface"); got != 3 {
+		t.Errorf("%d updates, want 3 with one retry", got)
+	}
+	if got, want := sorted(*stale.AliasIps), []string{"10.1.0.1", "10.1.0.2"}; !slices.Equal(got, want) {
+		t.Errorf("UpdateAliasIPs changed the alias IPs of its argument to %v", got)
+	}
+	updated, err := gceProvider{}.GetInstance(ctx, cfg, testZone, "vm-1")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	if got, want := sorted(*updated.AliasIps), []string{"10.1.0.2", "10.1.0.3", "10.1.0.4"}; !slices.Equal(got, want) {
+		t.Errorf("alias IPs %v, want %v", got, want)
+	}
+}
+
+func TestWaitOperationError(t *testing.T) {
+	UseCompute(NewFakeCompute())
+	if err := (gceProvider{}).WaitOperation(context.Background(), testConfig(), testZone, "missing"); err == nil {
+		t.Errorf("WaitOperation of a missing operation returned no error")
+	}
+}
+
+func TestWaitOperationCanceled(t *testing.T) {
+	fake := NewFakeCompute()
+	UseCompute(fake)
+	newTestInstance(fake, "vm-1", "10.1.0.1")
+	cfg := testConfig()
+	instance, err := gceProvider{}.GetInstance(context.Background(), cfg, testZone, "vm-1")
+	if err != nil {
+		t.Fatalf("GetInstance: %v", err)
+	}
+	name, err := gceProvider{}.UpdateAliasIPs(context.Background(), cfg, instance, []string{"10.1.0.2"})
+	if err != nil {
+		t.Fatalf("UpdateAliasIPs: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := (gceProvider{}).WaitOperation(ctx, cfg, testZone, name); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitOperation with a canceled context: %v, want context.Canceled", err)
+	}
+}
+
+func TestMergeAliasIPs(t *testing.T) {
+	for _, test := range []struct {
+		before, after, current, want []string
+	}{
+		{
+			before:  []string{"a", "b"},
+			after:   []string{"a", "b", "c"},
+			current: []string{"a", "b", "d"},
+			want:    []string{"a", "b", "d", "c"},
+		},
+		{
+			before:  []string{"a", "b"},
+			after:   []string{"b"},
+			current: []string{"a", "b", "d"},
+			want:    []string{"b", "d"},
+		},
+		{
+			before:  []string{"a", "b"},
+			after:   []string{"a", "b"},
+			current: []string{"b"},
+			want:    []string{"b"},
+		},
+	} {
+		if got := mergeAliasIPs(test.before, test.after, test.current); !slices.Equal(got, test.want) {
+			t.Errorf("mergeAliasIPs(%v, %v, %v) = %v, want %v", test.before, test.after, test.current, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// GKE node pools as instance groups: the nodes of a node pool are the
+// instances of its managed instance groups, one per zone.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/container/v1"
+)
+
+// NodePoolResolveInterval is how long the managed instance groups of a node
+// pool are cached. They change when the node pool gains a zone, or during
+// blue-green upgrades.
+const NodePoolResolveInterval = 5 * time.Minute
+
+var (
+	containerService *container.Service
+
+	nodePoolsMu sync.Mutex
+	nodePools   = map[string]resolvedNodePool{}
+)
+
+type resolvedNodePool struct {
+	groups   []string
+	resolved time.Time
+}
+
+func ConnectGke() {
+	c, err := defaultClient(context.Background(), container.CloudPlatformScope)
+	if err != nil {
+		log.Printf("Error getting Default GCP client: %v", err)
+	}
+	containerService, err = container.New(c)
+	if err != nil {
+		log.Fatalf("Error connecting to GKE: %v", err)
+		os.Exit(1)
+	}
+}
+
+// NodePoolName returns the resource name of a node pool,
+// projects/PROJECT/locations/LOCATION/clusters/CLUSTER/nodePools/NODE_POOL,
+// given as such or as CLUSTER/NODE_POOL in the location.
+func NodePoolName(project, location, nodePool string) (string, error) {
+	if strings.HasPrefix(nodePool, "projects/") {
+		return nodePool, nil
+	}
+	cluster, pool, ok := strings.Cut(nodePool, "/")
+	if !ok || cluster == "" || pool == "" || strings.Contains(pool, "/") {
+		return "", fmt.Errorf("invalid node pool %q, expected CLUSTER/NODE_POOL", nodePool)
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s/nodePools/%s", project, location, cluster, pool), nil
+}
+
+// nodePoolGroups returns the URLs of the managed instance groups of the node
+// pool of the configuration.
+func nodePoolGroups(ctx context.Context, cfg *GcpConfig) ([]string, error) {
+	nodePoolsMu.Lock()
+	resolved, ok := nodePools[cfg.NodePool]
+	nodePoolsMu.Unlock()
+	if ok && time.Since(resolved.resolved) < NodePoolResolveInterval {
+		return resolved.groups, nil
+	}
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	resp, err := containerService.Projects.Locations.Clusters.NodePools.Get(cfg.NodePool).Context(context.Background()).Do()
+	if err != nil {
+		countApiError("nodePools.get")
+		return nil, fmt.Errorf("Error getting node pool %s: %v", cfg.NodePool, err)
+	}
+	nodePoolsMu.Lock()
+	nodePools[cfg.NodePool] = resolvedNodePool{groups: resp.InstanceGroupUrls, resolved: time.Now()}
+	nodePoolsMu.Unlock()
+	return resp.InstanceGroupUrls, nil
+}
+
+// listInstancesInNodePool lists running instances in the managed instance
+// groups of the node pool.
+func listInstancesInNodePool(ctx context.Context, cfg *GcpConfig) (map[string]string, error) {
+	zones := map[string]string{}
+	groups, err := nodePoolGroups(ctx, cfg)
+	if err != nil {
+		return zones, err
+	}
+	for _, url := range groups {
+		groupCfg := *cfg
+		groupCfg.NodePool = ""
+		groupCfg.Region = ""
+		groupCfg.Zone, groupCfg.GceInstanceGroup = parseInstanceUrl(url)
+		groupZones, err := ListInstancesInGroup(ctx, &groupCfg)
+		if err != nil {
+			return zones, err
+		}
+		for name, zone := range groupZones {
+			zones[name] = zone
+		}
+	}
+	return zones, nil
+}
@@ -0,0 +1,109 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Guardrail pauses all mutations when a pass wants to move too large a
+// fraction of the VIPs at once, which is a sign of bad input data or an API
+// anomaly. Mutations resume once an operator confirms.
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type Guardrail struct {
+	// After a resume, larger moves are allowed for this long, so that the
+	// pass that tripped the guardrail can proceed.
+	Approval time.Duration
+
+	mu            sync.Mutex
+	paused        bool
+	reason        string
+	approvedUntil time.Time
+	// Pauses without logging, for plans.
+	dryRun bool
+}
+
+func NewGuardrail(approval time.Duration) *Guardrail {
+	return &Guardrail{Approval: approval}
+}
+
+// DryRun returns a copy of the guardrail to plan a pass with, which pauses
+// quietly, and leaves the guardrail alone.
+func (g *Guardrail) DryRun() *Guardrail {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return &Guardrail{
+		Approval:      g.Approval,
+		paused:        g.paused,
+		reason:        g.reason,
+		approvedUntil: g.approvedUntil,
+		dryRun:        true,
+	}
+}
+
+// Paused returns whether mutations are paused, and why.
+func (g *Guardrail) Paused() (bool, string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.reason
+}
+
+// Allow returns true if a pass may move the given number of a pool's VIPs.
+// Moving more than maxFraction of them pauses mutations, unless approved.
+// A maxFraction of 0 disables the limit.
+func (g *Guardrail) Allow(pool string, moves, total int, maxFraction float64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return false
+	}
+	if maxFraction <= 0 || total == 0 || float64(moves) <= maxFraction*float64(total) {
+		return true
+	}
+	if time.Now().Before(g.approvedUntil) {
+		return true
+	}
+	g.paused = true
+	g.reason = fmt.Sprintf("pool %s wants to move %d of %d VIPs", pool, moves, total)
+	if g.dryRun {
+		return false
+	}
+	log.Printf("ALERT: Pausing all changes, %s. Resume with POST /resume once confirmed.", g.reason)
+	return false
+}
+
+// Pause stops all mutations until Resume.
+func (g *Guardrail) Pause(reason string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+	g.reason = reason
+	log.Printf("Pausing all changes: %s", reason)
+}
+
+// Resume allows mutations again, including large moves for a while.
+func (g *Guardrail) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		log.Printf("Resuming changes, paused because %s", g.reason)
+	}
+	g.paused = false
+	g.reason = ""
+	g.approvedUntil = time.Now().Add(g.Approval)
+}
@@ -0,0 +1,179 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// HealthCheck probes whether an instance or VIP serves traffic, so that an
+// instance only receives VIPs once it does, and a VIP that stops answering
+// can fail over.
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HealthTcp  = "tcp"
+	HealthHttp = "http"
+	// NFSv3 NULL RPC over TCP, port 2049 unless given.
+	HealthNfs = "nfs"
+	// The health state of the managed instance group (autohealing).
+	HealthGce = "gce"
+
+	HealthTimeout = 2 * time.Second
+	NfsPort       = 2049
+)
+
+type HealthCheck struct {
+	Type string
+	Port int
+	Path string
+}
+
+var healthClient = http.Client{Timeout: HealthTimeout}
+
+// ParseHealthCheck parses "tcp:PORT", "http:PORT/PATH", "nfs[:PORT]" or
+// "gce".
+func ParseHealthCheck(s string) (*HealthCheck, error) {
+	if s == HealthGce {
+		return &HealthCheck{Type: HealthGce}, nil
+	}
+	if s == HealthNfs {
+		return &HealthCheck{Type: HealthNfs, Port: NfsPort}, nil
+	}
+	kind, rest, ok := strings.Cut(s, ":")
+	if !ok || (kind != HealthTcp && kind != HealthHttp && kind != HealthNfs) {
+		return nil, fmt.Errorf("invalid health check %q, expected tcp:PORT, http:PORT/PATH, nfs or gce", s)
+	}
+	port, path, _ := strings.Cut(rest, "/")
+	number, err := strconv.Atoi(port)
+	if err != nil || number <= 0 || number > 65535 {
+		return nil, fmt.Errorf("invalid port in health check %q", s)
+	}
+	check := &HealthCheck{Type: kind, Port: number}
+	if kind == HealthHttp {
+		check.Path = "/" + path
+	}
+	return check, nil
+}
+
+func (h *HealthCheck) String() string {
+	switch h.Type {
+	case HealthGce:
+		return HealthGce
+	case HealthHttp:
+		return fmt.Sprintf("%s:%d%s", h.Type, h.Port, h.Path)
+	default:
+		return fmt.Sprintf("%s:%d", h.Type, h.Port)
+	}
+}
+
+// Probe checks an instance or VIP by IP, with a TCP connect, an HTTP GET
+// that must return 2xx, or an NFS NULL RPC that must succeed.
+func (h *HealthCheck) Probe(ip string) error {
+	address := net.JoinHostPort(ip, strconv.Itoa(h.Port))
+	switch h.Type {
+	case HealthTcp:
+		conn, err := net.DialTimeout("tcp", address, HealthTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case HealthNfs:
+		return nfsNull(address)
+	}
+	resp, err := healthClient.Get("http://" + address + h.Path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("health check %s returned %s", h, resp.Status)
+	}
+	return nil
+}
+
+// nfsNull calls the NFSv3 NULL procedure over TCP (RFC 1813, RFC 5531).
+func nfsNull(address string) error {
+	conn, err := net.DialTimeout("tcp", address, HealthTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(HealthTimeout))
+	const xid = 0x766d6e67
+	// XID, CALL, RPC version 2, program NFS, version 3, procedure NULL,
+	// AUTH_NULL credentials and verifier.
+	call := []uint32{xid, 0, 2, 100003, 3, 0, 0, 0, 0, 0}
+	request := make([]byte, 4+4*len(call))
+	// Record marking: last fragment, and its length.
+	binary.BigEndian.PutUint32(request, 0x80000000|uint32(4*len(call)))
+	for i, v := range call {
+		binary.BigEndian.PutUint32(request[4+4*i:], v)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	// Record mark, XID, REPLY, MSG_ACCEPTED, verifier flavor and length.
+	reply := make([]byte, 24)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(reply[4:]) != xid || binary.BigEndian.Uint32(reply[8:]) != 1 {
+		return fmt.Errorf("invalid NFS NULL reply from %s", address)
+	}
+	if binary.BigEndian.Uint32(reply[12:]) != 0 {
+		return fmt.Errorf("NFS NULL call to %s denied", address)
+	}
+	// Skip the verifier body, then read the accept status.
+	body := make([]byte, binary.BigEndian.Uint32(reply[20:])+4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return err
+	}
+	if status := binary.BigEndian.Uint32(body[len(body)-4:]); status != 0 {
+		return fmt.Errorf("NFS NULL call to %s failed with status %d", address, status)
+	}
+	return nil
+}
+
+// GetManagedInstanceHealth returns whether instances of the managed instance
+// group are healthy, according to its health check. Instances without
+// health state, e.g. when the group has no health check, are healthy.
+func GetManagedInstanceHealth(ctx context.Context, cfg *GcpConfig) (map[string]bool, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	healthy := map[string]bool{}
+	instances, err := computeClient.ListManagedInstances(ctx, cfg.Project, cfg.Region, cfg.Zone, cfg.GceInstanceGroup)
+	for _, instance := range instances {
+		_, name := parseInstanceUrl(instance.GetInstance())
+		healthy[name] = true
+		for _, health := range instance.GetInstanceHealth() {
+			if health.GetDetailedHealthState() != "HEALTHY" {
+				healthy[name] = false
+			}
+		}
+	}
+	if err != nil {
+		countApiError("instanceGroupManagers.listManagedInstances")
+		return healthy, fmt.Errorf("Error listing managed instances of %s: %v", cfg.GceInstanceGroup, err)
+	}
+	return healthy, nil
+}
@@ -0,0 +1,399 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Intent records which VIP is intended for which instance, and persists it in
+// a local file or GCS object, so that a restarted manager keeps placements.
+// It also records moves in progress, so that a restarted manager can complete
+// or roll back a move that was interrupted between remove and add, VIPs in
+// quarantine after they were removed from their pool, the DNS records
+// pointing to VIPs that vip_manager manages, the recent history of each
+// VIP, and which alias IPs the deployment owns.
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Intent struct {
+	// Local file or gs://BUCKET/OBJECT. Empty keeps intent in memory only.
+	Location string
+
+	mu sync.Mutex
+	// Instance name by VIP, by pool name.
+	pools      map[string]map[string]string
+	moves      []Move
+	quarantine []Quarantined
+	records    []DnsRecord
+	// Most recent changes by VIP, at most historyLimit per VIP.
+	history      map[string][]VipHistory
+	historyLimit int
+	// Alias IPs that were VIPs of a pool, by pool name. Other alias IPs
+	// belong to someone else.
+	owned map[string]map[string]bool
+	dirty bool
+}
+
+// Move is a VIP moving from one instance to another, i.e. a remove followed
+// by an add.
+type Move struct {
+	Pool string `json:"pool"`
+	Ip   string `json:"ip"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Quarantined is a VIP that was removed from its pool, while still assigned
+// to an instance. It is drained after a grace period, and reported until it
+// is forgotten.
+type Quarantined struct {
+	Pool     string    `json:"pool"`
+	Ip       string    `json:"ip"`
+	Instance string    `json:"instance"`
+	Since    time.Time `json:"since"`
+	// When the VIP was no longer seen on an instance. Zero until then.
+	Drained time.Time `json:"drained"`
+}
+
+// VipHistory is an executed change of a VIP: added to or removed from an
+// instance.
+type VipHistory struct {
+	Time     time.Time `json:"time"`
+	Pool     string    `json:"pool"`
+	Action   string    `json:"action"`
+	Instance string    `json:"instance"`
+	// For moves, the other instance: the source of adds, the destination of
+	// removes.
+	Peer   string `json:"peer,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Result string `json:"result"`
+}
+
+// intentState is the persisted format.
+type intentState struct {
+	Pools      map[string]map[string]string `json:"pools"`
+	Moves      []Move                       `json:"moves,omitempty"`
+	Quarantine []Quarantined                `json:"quarantine,omitempty"`
+	Records    []DnsRecord                  `json:"dns_records,omitempty"`
+	History    map[string][]VipHistory      `json:"history,omitempty"`
+	Owned      map[string][]string          `json:"owned,omitempty"`
+}
+
+// LoadIntent reads persisted intent. A missing location yields an empty
+// intent.
+func LoadIntent(location string) (*Intent, error) {
+	intent := &Intent{
+		Location: location,
+		pools:    map[string]map[string]string{},
+		history:  map[string][]VipHistory{},
+		owned:    map[string]map[string]bool{},
+	}
+	if location == "" {
+		return intent, nil
+	}
+	data, err := ReadLocation(location)
+	if err == ErrObjectNotFound {
+		return intent, nil
+	}
+	if err != nil {
+		return intent, err
+	}
+	state := intentState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return intent, err
+	}
+	if state.Pools == nil {
+		// Older format, without moves.
+		if err := json.Unmarshal(data, &intent.pools); err != nil {
+			return intent, err
+		}
+		return intent, nil
+	}
+	intent.pools = state.Pools
+	intent.moves = state.Moves
+	intent.quarantine = state.Quarantine
+	intent.records = state.Records
+	if state.History != nil {
+		intent.history = state.History
+	}
+	for pool, ips := range state.Owned {
+		intent.owned[pool] = map[string]bool{}
+		for _, ip := range ips {
+			intent.owned[pool][ip] = true
+		}
+	}
+	return intent, nil
+}
+
+// Get returns the instance intended for a VIP.
+func (i *Intent) Get(pool, ip string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	instance, ok := i.pools[pool][ip]
+	return instance, ok
+}
+
+// Set records the instance intended for a VIP.
+func (i *Intent) Set(pool, ip, instance string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.pools[pool] == nil {
+		i.pools[pool] = map[string]string{}
+	}
+	if i.pools[pool][ip] != instance {
+		i.pools[pool][ip] = instance
+		i.dirty = true
+	}
+}
+
+// Delete forgets the intent for a VIP, if it is for the given instance.
+func (i *Intent) Delete(pool, ip, instance string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if current, ok := i.pools[pool][ip]; ok && current == instance {
+		delete(i.pools[pool], ip)
+		i.dirty = true
+	}
+}
+
+// BeginMove records a move in progress, and intends the VIP for the
+// destination. Call Save before executing the move.
+func (i *Intent) BeginMove(move Move) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.pools[move.Pool] == nil {
+		i.pools[move.Pool] = map[string]string{}
+	}
+	i.pools[move.Pool][move.Ip] = move.To
+	i.moves = append(i.moves, move)
+	i.dirty = true
+}
+
+// EndMove forgets a move, once it completed or was rolled back.
+func (i *Intent) EndMove(pool, ip string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for j, move := range i.moves {
+		if move.Pool == pool && move.Ip == ip {
+			i.moves = append(i.moves[:j], i.moves[j+1:]...)
+			i.dirty = true
+			return
+		}
+	}
+}
+
+// Moves returns the moves in progress for a pool.
+func (i *Intent) Moves(pool string) []Move {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	moves := []Move{}
+	for _, move := range i.moves {
+		if move.Pool == pool {
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// Quarantined returns the quarantined VIPs of a pool, or of all pools if
+// pool is empty.
+func (i *Intent) Quarantined(pool string) []Quarantined {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	quarantined := []Quarantined{}
+	for _, q := range i.quarantine {
+		if pool == "" || q.Pool == pool {
+			quarantined = append(quarantined, q)
+		}
+	}
+	return quarantined
+}
+
+// SetQuarantined adds or updates a quarantined VIP.
+func (i *Intent) SetQuarantined(q Quarantined) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.dirty = true
+	for j := range i.quarantine {
+		if i.quarantine[j].Pool == q.Pool && i.quarantine[j].Ip == q.Ip {
+			i.quarantine[j] = q
+			return
+		}
+	}
+	i.quarantine = append(i.quarantine, q)
+}
+
+// DeleteQuarantined forgets a quarantined VIP.
+func (i *Intent) DeleteQuarantined(pool, ip string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for j, q := range i.quarantine {
+		if q.Pool == pool && q.Ip == ip {
+			i.quarantine = append(i.quarantine[:j], i.quarantine[j+1:]...)
+			i.dirty = true
+			return
+		}
+	}
+}
+
+// DnsRecords returns the managed DNS records.
+func (i *Intent) DnsRecords() []DnsRecord {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]DnsRecord{}, i.records...)
+}
+
+// SetDnsRecord adds or updates a managed DNS record, by name and type.
+func (i *Intent) SetDnsRecord(record DnsRecord) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.dirty = true
+	for j := range i.records {
+		if i.records[j].Name == record.Name && i.records[j].Type == record.Type {
+			i.records[j] = record
+			return
+		}
+	}
+	i.records = append(i.records, record)
+}
+
+// Own records that an alias IP belongs to a pool.
+func (i *Intent) Own(pool, ip string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.owned[pool] == nil {
+		i.owned[pool] = map[string]bool{}
+	}
+	if !i.owned[pool][ip] {
+		i.owned[pool][ip] = true
+		i.dirty = true
+	}
+}
+
+// Owns returns true if an alias IP belongs to a pool.
+func (i *Intent) Owns(pool, ip string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.owned[pool][ip]
+}
+
+// Disown forgets that an alias IP belongs to a pool.
+func (i *Intent) Disown(pool, ip string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.owned[pool][ip] {
+		delete(i.owned[pool], ip)
+		i.dirty = true
+	}
+}
+
+// SetHistoryLimit sets how many changes to keep per VIP. 0 keeps none.
+func (i *Intent) SetHistoryLimit(limit int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.historyLimit = limit
+	for ip, entries := range i.history {
+		if len(entries) > limit {
+			i.history[ip] = entries[len(entries)-limit:]
+			i.dirty = true
+		}
+		if len(i.history[ip]) == 0 {
+			delete(i.history, ip)
+		}
+	}
+}
+
+// AddHistory records a change of a VIP, dropping the oldest beyond the limit.
+func (i *Intent) AddHistory(ip string, entry VipHistory) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.historyLimit == 0 {
+		return
+	}
+	entries := append(i.history[ip], entry)
+	if len(entries) > i.historyLimit {
+		entries = entries[len(entries)-i.historyLimit:]
+	}
+	i.history[ip] = entries
+	i.dirty = true
+}
+
+// History returns the recorded changes of a VIP, oldest first.
+func (i *Intent) History(ip string) []VipHistory {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]VipHistory{}, i.history[ip]...)
+}
+
+// Copy returns a deep copy of the intent, kept in memory only, e.g. to plan
+// a pass without changing the intent.
+func (i *Intent) Copy() *Intent {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	c := &Intent{
+		pools:        map[string]map[string]string{},
+		moves:        append([]Move{}, i.moves...),
+		quarantine:   append([]Quarantined{}, i.quarantine...),
+		records:      append([]DnsRecord{}, i.records...),
+		history:      map[string][]VipHistory{},
+		historyLimit: i.historyLimit,
+		owned:        map[string]map[string]bool{},
+	}
+	for pool, vips := range i.pools {
+		c.pools[pool] = map[string]string{}
+		for ip, instance := range vips {
+			c.pools[pool][ip] = instance
+		}
+	}
+	for ip, history := range i.history {
+		c.history[ip] = append([]VipHistory{}, history...)
+	}
+	for pool, ips := range i.owned {
+		c.owned[pool] = map[string]bool{}
+		for ip := range ips {
+			c.owned[pool][ip] = true
+		}
+	}
+	return c
+}
+
+// Save persists the intent, if it changed.
+func (i *Intent) Save() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.Location == "" || !i.dirty {
+		return
+	}
+	owned := map[string][]string{}
+	for pool, ips := range i.owned {
+		for ip := range ips {
+			owned[pool] = append(owned[pool], ip)
+		}
+		sort.Strings(owned[pool])
+	}
+	data, err := json.MarshalIndent(intentState{Pools: i.pools, Moves: i.moves, Quarantine: i.quarantine, Records: i.records, History: i.history, Owned: owned}, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding intent: %v", err)
+		return
+	}
+	if err := WriteLocation(i.Location, data); err != nil {
+		log.Printf("Error writing intent to %s: %v", i.Location, err)
+		return
+	}
+	i.dirty = false
+}
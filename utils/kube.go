@@ -0,0 +1,256 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Kubernetes API access from within a cluster, with the service account of
+// the pod: nodes as instances, and VIPPool custom resources as pools.
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	kubeServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// API group and version of the VIPPool custom resource.
+	VipPoolGroup   = "loadbalancing.bjornleffler.github.io"
+	VipPoolVersion = "v1alpha1"
+)
+
+var kube *kubeClient
+
+type kubeClient struct {
+	host string
+	// Read on every request, as it is rotated.
+	tokenFile string
+	client    *http.Client
+}
+
+// ConnectKube connects to the API server of the cluster the pod runs in.
+func ConnectKube() {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		log.Fatalf("Error connecting to Kubernetes: not running in a cluster, KUBERNETES_SERVICE_HOST is not set")
+	}
+	ca, err := os.ReadFile(kubeServiceAccount + "/ca.crt")
+	if err != nil {
+		log.Fatalf("Error connecting to Kubernetes: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		log.Fatalf("Error connecting to Kubernetes: no certificates in %s/ca.crt", kubeServiceAccount)
+	}
+	kube = &kubeClient{
+		host:      "https://" + net.JoinHostPort(host, port),
+		tokenFile: kubeServiceAccount + "/token",
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}
+}
+
+// KubeNamespace returns the namespace of the pod.
+func KubeNamespace() string {
+	namespace, err := os.ReadFile(kubeServiceAccount + "/namespace")
+	if err != nil {
+		return "default"
+	}
+	return strings.TrimSpace(string(namespace))
+}
+
+// kubeStatusError is a failed API call, with the HTTP status code.
+type kubeStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+// IsKubeStatus returns true if the error is a failed API call with the code.
+func IsKubeStatus(err error, code int) bool {
+	var statusErr *kubeStatusError
+	return errors.As(err, &statusErr) && statusErr.Code == code
+}
+
+// kubeRequest calls the API server, with in as JSON body if not nil, and
+// decodes the response into out if not nil.
+func kubeRequest(ctx context.Context, method, path, contentType string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, kube.host+path, body)
+	if err != nil {
+		return err
+	}
+	token, err := os.ReadFile(kube.tokenFile)
+	if err != nil {
+		return fmt.Errorf("Error reading service account token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := kube.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = resp.Status
+		}
+		return fmt.Errorf("%s %s: %w", method, path, &kubeStatusError{Code: resp.StatusCode, Message: status.Message})
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("Error parsing %s response: %v", path, err)
+		}
+	}
+	return nil
+}
+
+type kubeNode struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		// gce://PROJECT/ZONE/NAME on GKE.
+		ProviderID string `json:"providerID"`
+	} `json:"spec"`
+}
+
+// GetInstancesByNodes returns the running instances of the Kubernetes nodes
+// matching the node selector of the configuration, "KEY=VALUE,...".
+func GetInstancesByNodes(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
+	instances := map[string]*GceInstance{}
+	nodes := struct {
+		Items []kubeNode `json:"items"`
+	}{}
+	path := "/api/v1/nodes?labelSelector=" + url.QueryEscape(cfg.NodeSelector)
+	callCtx, cancel := callContext(ctx)
+	defer cancel()
+	if err := kubeRequest(callCtx, http.MethodGet, path, "", nil, &nodes); err != nil {
+		countApiError("nodes.list")
+		return instances, fmt.Errorf("Error listing nodes %s: %v", cfg.NodeSelector, err)
+	}
+	for _, node := range nodes.Items {
+		parts := strings.Split(strings.TrimPrefix(node.Spec.ProviderID, "gce://"), "/")
+		if !strings.HasPrefix(node.Spec.ProviderID, "gce://") || len(parts) != 3 {
+			log.Printf("Warning: node %s is not a GCE instance: %q", node.Metadata.Name, node.Spec.ProviderID)
+			continue
+		}
+		instance, err := GetInstance(ctx, cfg, parts[1], parts[2])
+		if err != nil {
+			log.Printf("Error getting instance of node %s: %v", node.Metadata.Name, err)
+			continue
+		}
+		if instance.Status == "RUNNING" {
+			instances[instance.Name] = instance
+		}
+	}
+	return instances, nil
+}
+
+// VipPool is the VIPPool custom resource: a pool of VIPs in an alias range,
+// spread over the nodes matching a node selector.
+type VipPool struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		// VIPs, e.g. 10.0.16.0/27.
+		Cidr           string            `json:"cidr"`
+		AliasRangeName string            `json:"aliasRangeName"`
+		NodeSelector   map[string]string `json:"nodeSelector"`
+	} `json:"spec"`
+}
+
+// VipPoolStatus is the status subresource of a VIPPool.
+type VipPoolStatus struct {
+	ObservedGeneration int64               `json:"observedGeneration"`
+	Vips               int                 `json:"vips"`
+	Assigned           int                 `json:"assigned"`
+	Spare              []string            `json:"spare,omitempty"`
+	Assignments        map[string][]string `json:"assignments,omitempty"`
+	LastReconcile      time.Time           `json:"lastReconcile,omitempty"`
+	// Why the pool can not be reconciled, if it can not.
+	Error string `json:"error,omitempty"`
+}
+
+func vipPoolPath(name string) string {
+	path := "/apis/" + VipPoolGroup + "/" + VipPoolVersion + "/vippools"
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+// ListVipPools lists the VIPPool resources of the cluster.
+func ListVipPools(ctx context.Context) ([]VipPool, error) {
+	pools := struct {
+		Items []VipPool `json:"items"`
+	}{}
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	if err := kubeRequest(ctx, http.MethodGet, vipPoolPath(""), "", nil, &pools); err != nil {
+		countApiError("vippools.list")
+		return nil, fmt.Errorf("Error listing VIPPools: %v", err)
+	}
+	return pools.Items, nil
+}
+
+// SetVipPoolStatus replaces the status of a VIPPool.
+func SetVipPoolStatus(ctx context.Context, name string, status VipPoolStatus) error {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	// A JSON patch, since a merge patch would keep nodes that are gone.
+	patch := []map[string]any{{"op": "add", "path": "/status", "value": status}}
+	if err := kubeRequest(ctx, http.MethodPatch, vipPoolPath(name)+"/status", "application/json-patch+json", patch, nil); err != nil {
+		countApiError("vippools.patchStatus")
+		return fmt.Errorf("Error updating status of VIPPool %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// KubeLease implements leader election with a coordination.k8s.io Lease, for
+// replicas in a Kubernetes cluster. Updates carry the resource version, so
+// only one holder can acquire or renew the lease.
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MicroTime of the Kubernetes API.
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+type kubeLeaseObject struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+type KubeLease struct {
+	Namespace string
+	Name      string
+	Holder    string
+	Duration  time.Duration
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func NewKubeLease(namespace, name, holder string, duration time.Duration) *KubeLease {
+	return &KubeLease{
+		Namespace: namespace,
+		Name:      name,
+		Holder:    holder,
+		Duration:  duration,
+	}
+}
+
+// IsLeader returns true while this process holds an unexpired lease.
+func (l *KubeLease) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.expires)
+}
+
+// Run acquires and renews the lease in the background, until ctx is
+// canceled. It then stops renewing, and no longer leads.
+func (l *KubeLease) Run(ctx context.Context) {
+	go func() {
+		leader := false
+		for {
+			start := time.Now()
+			acquired, err := l.tryAcquire(start)
+			if err != nil {
+				log.Printf("Error acquiring lease %s/%s: %v", l.Namespace, l.Name, err)
+			}
+			if acquired {
+				// Count from before the write, to stay on the safe side.
+				l.mu.Lock()
+				l.expires = start.Add(l.Duration)
+				l.mu.Unlock()
+			}
+			isLeader := l.IsLeader()
+			if isLeader && !leader {
+				log.Printf("Became leader: %s", l.Holder)
+			} else if !isLeader && leader {
+				log.Printf("Lost leadership: %s", l.Holder)
+			}
+			leader = isLeader
+			select {
+			case <-ctx.Done():
+				l.mu.Lock()
+				l.expires = time.Time{}
+				l.mu.Unlock()
+				if leader {
+					log.Printf("Stop leading: %s", l.Holder)
+				}
+				return
+			case <-time.After(l.Duration / 3):
+			}
+		}
+	}()
+}
+
+func (l *KubeLease) tryAcquire(now time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), l.Duration/3)
+	defer cancel()
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + l.Namespace + "/leases"
+	lease := kubeLeaseObject{}
+	err := kubeRequest(ctx, http.MethodGet, path+"/"+l.Name, "", nil, &lease)
+	switch {
+	case IsKubeStatus(err, http.StatusNotFound):
+		lease.ApiVersion = "coordination.k8s.io/v1"
+		lease.Kind = "Lease"
+		lease.Metadata.Name = l.Name
+		lease.Metadata.Namespace = l.Namespace
+	case err != nil:
+		return false, err
+	default:
+		renewed, err := time.Parse(time.RFC3339Nano, lease.Spec.RenewTime)
+		duration := time.Duration(lease.Spec.LeaseDurationSeconds) * time.Second
+		if lease.Spec.HolderIdentity != l.Holder && err == nil && now.Before(renewed.Add(duration)) {
+			return false, nil
+		}
+	}
+	if lease.Spec.HolderIdentity != l.Holder {
+		if lease.Spec.HolderIdentity != "" {
+			lease.Spec.LeaseTransitions++
+		}
+		lease.Spec.HolderIdentity = l.Holder
+		lease.Spec.AcquireTime = now.UTC().Format(kubeMicroTime)
+	}
+	lease.Spec.RenewTime = now.UTC().Format(kubeMicroTime)
+	lease.Spec.LeaseDurationSeconds = int(l.Duration / time.Second)
+	if lease.Metadata.ResourceVersion == "" {
+		err = kubeRequest(ctx, http.MethodPost, path, "application/json", lease, nil)
+	} else {
+		err = kubeRequest(ctx, http.MethodPut, path+"/"+l.Name, "application/json", lease, nil)
+	}
+	if IsKubeStatus(err, http.StatusConflict) {
+		// Another replica got there first.
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,125 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Lease implements leader election with a lease object in GCS. Writes use
+// generation preconditions, so only one holder can acquire or renew the lease.
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+type leaseRecord struct {
+	Holder  string
+	Expires time.Time
+}
+
+type Lease struct {
+	Bucket   string
+	Object   string
+	Holder   string
+	Duration time.Duration
+
+	mu      sync.Mutex
+	expires time.Time
+}
+
+func NewLease(bucket, object, holder string, duration time.Duration) *Lease {
+	return &Lease{
+		Bucket:   bucket,
+		Object:   object,
+		Holder:   holder,
+		Duration: duration,
+	}
+}
+
+// IsLeader returns true while this process holds an unexpired lease.
+func (l *Lease) IsLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.expires)
+}
+
+// Run acquires and renews the lease in the background, until ctx is
+// canceled. It then stops renewing, and no longer leads.
+func (l *Lease) Run(ctx context.Context) {
+	go func() {
+		leader := false
+		for {
+			start := time.Now()
+			acquired, err := l.tryAcquire(start)
+			if err != nil {
+				log.Printf("Error acquiring lease gs://%s/%s: %v", l.Bucket, l.Object, err)
+			}
+			if acquired {
+				// Count from before the write, to stay on the safe side.
+				l.mu.Lock()
+				l.expires = start.Add(l.Duration)
+				l.mu.Unlock()
+			}
+			isLeader := l.IsLeader()
+			if isLeader && !leader {
+				log.Printf("Became leader: %s", l.Holder)
+			} else if !isLeader && leader {
+				log.Printf("Lost leadership: %s", l.Holder)
+			}
+			leader = isLeader
+			select {
+			case <-ctx.Done():
+				l.mu.Lock()
+				l.expires = time.Time{}
+				l.mu.Unlock()
+				if leader {
+					log.Printf("Stop leading: %s", l.Holder)
+				}
+				return
+			case <-time.After(l.Duration / 3):
+			}
+		}
+	}()
+}
+
+func (l *Lease) tryAcquire(now time.Time) (bool, error) {
+	data, generation, err := ReadObjectGeneration(l.Bucket, l.Object)
+	switch {
+	case err == ErrObjectNotFound:
+		generation = 0
+	case err != nil:
+		return false, err
+	default:
+		record := leaseRecord{}
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("Error parsing lease, taking it over: %v", err)
+		} else if record.Holder != l.Holder && now.Before(record.Expires) {
+			return false, nil
+		}
+	}
+	data, err = json.Marshal(leaseRecord{
+		Holder:  l.Holder,
+		Expires: now.Add(l.Duration),
+	})
+	if err != nil {
+		return false, err
+	}
+	err = WriteObjectIfGeneration(l.Bucket, l.Object, data, generation)
+	if err == ErrGenerationMismatch {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,65 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Metrics about GCE API calls and alias IP operations, exported by
+// vip_manager.
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsPrefix = "vip_manager_"
+
+var (
+	operationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "operations_total",
+		Help: "Number of alias IP operations, by type (add, remove) and result (executed, failed, unverified, noop).",
+	}, []string{"type", "result"})
+	queuedOperations = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "queued_operations",
+		Help: "Number of alias IP operations waiting for a worker, by priority.",
+	}, []string{"priority"})
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "gce_api_errors_total",
+		Help: "Number of failed GCE API calls, by method.",
+	}, []string{"method"})
+	apiRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "gce_api_retries_total",
+		Help: "Number of retried GCE API requests, after transient failures.",
+	})
+	fingerprintConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "fingerprint_conflicts_total",
+		Help: "Number of network interface updates retried after a concurrent update changed the fingerprint.",
+	})
+	apiThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: metricsPrefix + "gce_api_throttled_seconds_total",
+		Help: "Seconds GCE API requests waited for the client side rate limit.",
+	})
+	gceWritesLastMinute = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "gce_writes_last_minute",
+		Help: "Number of GCE API write requests by vip_manager in the last minute.",
+	})
+	gceWriteQuota = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: metricsPrefix + "gce_write_quota_per_minute",
+		Help: "GCE API write requests per minute allowed in the project, from -write_quota. 0 if unknown.",
+	})
+)
+
+// countApiError counts a failed GCE API call.
+func countApiError(method string) {
+	apiErrors.WithLabelValues(method).Inc()
+}
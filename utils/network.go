@@ -15,8 +15,12 @@ package utils
 // limitations under the License.
 
 import (
+	"fmt"
 	"net"
 	"net/netip"
+	"sort"
+
+	"golang.org/x/exp/slices"
 )
 
 func increment(ip net.IP) {
@@ -41,3 +45,82 @@ func ExpandNetworkPrefix(prefix string) (addrs []netip.Addr, err error) {
 	}
 	return addrs, nil
 }
+
+// SplitNetworkPrefix carves a network prefix into the blocks of the given
+// prefix length, in order, e.g. 10.0.0.0/27 into 10.0.0.0/28 and
+// 10.0.0.16/28.
+func SplitNetworkPrefix(prefix string, bits int) ([]netip.Prefix, error) {
+	network, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	network = network.Masked()
+	if bits < 1 || bits < network.Bits() || bits > network.Addr().BitLen() {
+		return nil, fmt.Errorf("%s can not be split into /%d blocks", network, bits)
+	}
+	blocks := []netip.Prefix{}
+	for addr, ok := network.Addr(), true; ok && network.Contains(addr); addr, ok = nextBlock(addr, bits) {
+		blocks = append(blocks, netip.PrefixFrom(addr, bits))
+	}
+	return blocks, nil
+}
+
+// nextBlock returns the first address of the /bits block after the one of
+// addr, or false at the end of the address space.
+func nextBlock(addr netip.Addr, bits int) (netip.Addr, bool) {
+	b := addr.As16()
+	// Position of the last bit of the prefix, in the 16 byte form.
+	pos := 128 - addr.BitLen() + bits - 1
+	carry := uint16(1) << (7 - pos%8)
+	for i := pos / 8; i >= 0 && carry > 0; i-- {
+		sum := uint16(b[i]) + carry
+		b[i], carry = byte(sum), sum>>8
+	}
+	next := netip.AddrFrom16(b)
+	if addr.Is4() {
+		if !next.Is4In6() {
+			return netip.Addr{}, false
+		}
+		next = next.Unmap()
+	}
+	return next, carry == 0
+}
+
+// SummarizeIps summarizes addresses into the fewest CIDR blocks, e.g.
+// "10.0.1.0/28 (16 addresses)". Single addresses are listed as is, and so are
+// strings that are not addresses.
+func SummarizeIps(ips []string) (summary []string) {
+	addrs := []netip.Addr{}
+	for _, ip := range ips {
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			summary = append(summary, ip)
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Less(addrs[j]) })
+	addrs = slices.Compact(addrs)
+	// Length of the run of consecutive addresses from each address on.
+	runs := make([]int, len(addrs))
+	for i := len(addrs) - 1; i >= 0; i-- {
+		runs[i] = 1
+		if i+1 < len(addrs) && addrs[i].Next() == addrs[i+1] {
+			runs[i] = runs[i+1] + 1
+		}
+	}
+	for i := 0; i < len(addrs); {
+		addr := addrs[i]
+		bits, size := addr.BitLen(), 1
+		for size*2 <= runs[i] && netip.PrefixFrom(addr, bits-1).Masked().Addr() == addr {
+			bits, size = bits-1, size*2
+		}
+		if size == 1 {
+			summary = append(summary, addr.String())
+		} else {
+			summary = append(summary, fmt.Sprintf("%s (%d addresses)", netip.PrefixFrom(addr, bits), size))
+		}
+		i += size
+	}
+	return summary
+}
@@ -17,7 +17,13 @@ package utils
 // Operation abstracts operations to add/remove alias IPs to GCE VMs.
 
 import (
+	"container/heap"
+	"context"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -30,15 +36,102 @@ const (
 	Remove
 )
 
-var (
-	in  = make(chan Operation)
-	out = make(chan int)
+// Priorities of operations in the worker queue. Lower values run first, so
+// that urgent operations, e.g. evacuating a failed instance, do not wait
+// behind a backlog of routine rebalancing.
+const (
+	PriorityUrgent  = 0
+	PriorityDefault = 1
+	PriorityLow     = 2
 )
 
+var queue = newRequestQueue()
+
 type Operation struct {
 	Type     Type
 	Instance *GceInstance
 	Ips      []string
+	// Why the operation runs, e.g. "failover", and for moves, the other
+	// instance per IP: the source of adds, the destination of removes. For
+	// notifications only.
+	Reason string
+	Peers  map[string]string
+	// The reconcile pass that planned the operation, if any, and the GCE
+	// operation that executed it, set by Execute. For the audit log.
+	Cycle        string
+	GceOperation string
+}
+
+// request is an operation queued for the workers. Each caller of
+// ExecuteParallel has its own context, configuration and result channel, so
+// that several reconcile loops can share the workers.
+type request struct {
+	ctx       context.Context
+	cfg       *GcpConfig
+	operation Operation
+	out       chan int
+	priority  int
+	// Order of arrival, for FIFO order within a priority.
+	seq uint64
+}
+
+// requestQueue is a priority queue of requests. Workers block in pop until
+// a request is available.
+type requestQueue struct {
+	mu       sync.Mutex
+	nonEmpty *sync.Cond
+	requests requestHeap
+	seq      uint64
+}
+
+func newRequestQueue() *requestQueue {
+	q := &requestQueue{}
+	q.nonEmpty = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *requestQueue) push(r request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	r.seq = q.seq
+	heap.Push(&q.requests, r)
+	queuedOperations.WithLabelValues(strconv.Itoa(r.priority)).Inc()
+	q.nonEmpty.Signal()
+}
+
+func (q *requestQueue) pop() request {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.requests) == 0 {
+		q.nonEmpty.Wait()
+	}
+	r := heap.Pop(&q.requests).(request)
+	queuedOperations.WithLabelValues(strconv.Itoa(r.priority)).Dec()
+	return r
+}
+
+// requestHeap implements heap.Interface.
+type requestHeap []request
+
+func (h requestHeap) Len() int { return len(h) }
+
+func (h requestHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority < h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h requestHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *requestHeap) Push(x any) { *h = append(*h, x.(request)) }
+
+func (h *requestHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
 }
 
 func (t Type) String() string {
@@ -52,27 +145,54 @@ func (t Type) String() string {
 	}
 }
 
-func StartWorkers(cfg *GcpConfig, workers uint) {
-	for i := 0; i < int(workers); i++ {
-		go Worker(i, cfg, in, out)
+// Delay before each operation, to simulate a slow API.
+var operationDelay atomic.Int64
+
+// SetOperationDelay delays all operations from now on, e.g. for game days.
+func SetOperationDelay(delay time.Duration) {
+	operationDelay.Store(int64(delay))
+}
+
+// Workers started so far. They are shared by all configurations of the
+// process, and run until it exits.
+var (
+	workersMu sync.Mutex
+	workers   int
+)
+
+// StartWorkers starts workers until there are at least n, so that calling it
+// again, e.g. for another reconciler, does not add more.
+func StartWorkers(n uint) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for ; workers < int(n); workers++ {
+		go Worker(workers)
 	}
 }
 
-func Worker(i int, cfg *GcpConfig, in chan Operation, out chan int) {
+func Worker(i int) {
 	for {
-		operation := <-in
-		out <- Execute(cfg, operation)
+		r := queue.pop()
+		r.out <- Execute(r.ctx, r.cfg, r.operation)
 	}
 }
 
-func ExecuteParallel(cfg *GcpConfig, operations map[string]Operation) int {
+func ExecuteParallel(ctx context.Context, cfg *GcpConfig, operations map[string]Operation) int {
+	return ExecuteParallelPriority(ctx, cfg, operations, PriorityDefault)
+}
+
+// ExecuteParallelPriority queues operations with a priority, and waits for
+// them to complete. Operations still queued when the context is done fail.
+func ExecuteParallelPriority(ctx context.Context, cfg *GcpConfig, operations map[string]Operation, priority int) int {
 	changes := 0
 	inFlight := 0
+	out := make(chan int, len(operations))
 	for _, operation := range operations {
 		if len(operation.Ips) > 0 {
 			log.Printf("Instance: %v %v ips: %v",
 				operation.Instance.Name, operation.Type.String(), operation.Ips)
-			in <- operation
+			audit(cfg, operation, "planned")
+			queue.push(request{ctx: ctx, cfg: cfg, operation: operation, out: out, priority: priority})
 			inFlight++
 		}
 	}
@@ -82,10 +202,92 @@ func ExecuteParallel(cfg *GcpConfig, operations map[string]Operation) int {
 	return changes
 }
 
-func Execute(cfg *GcpConfig, operation Operation) int {
-	instance, err := GetInstance(cfg, operation.Instance.Name)
+// OperationRecord is an executed operation, for the status API.
+type OperationRecord struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Type     string    `json:"type"`
+	Ips      []string  `json:"ips"`
+	Result   string    `json:"result"`
+}
+
+const MaxRecentOperations = 100
+
+var (
+	recentMu         sync.Mutex
+	recentOperations []OperationRecord
+)
+
+// recordOperation counts an operation by result, remembers it, and publishes
+// it.
+func recordOperation(cfg *GcpConfig, operation Operation, start time.Time, result string) {
+	publishOperation(cfg, operation, start, result)
+	audit(cfg, operation, result)
+	t := strings.ToLower(operation.Type.String())
+	operationsTotal.WithLabelValues(t, result).Inc()
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	recentOperations = append(recentOperations, OperationRecord{
+		Time:     time.Now(),
+		Instance: operation.Instance.Name,
+		Type:     t,
+		Ips:      operation.Ips,
+		Result:   result,
+	})
+	if len(recentOperations) > MaxRecentOperations {
+		recentOperations = recentOperations[len(recentOperations)-MaxRecentOperations:]
+	}
+}
+
+// history records executed operations per VIP, if set.
+var history atomic.Pointer[Intent]
+
+// TrackHistory records executed operations in the per-VIP history of the
+// intent.
+func TrackHistory(intent *Intent) {
+	history.Store(intent)
+}
+
+// recordHistory adds an executed operation to the history of its VIPs.
+func recordHistory(cfg *GcpConfig, operation Operation, result string) {
+	intent := history.Load()
+	if intent == nil {
+		return
+	}
+	for _, ip := range operation.Ips {
+		intent.AddHistory(ip, VipHistory{
+			Time:     time.Now(),
+			Pool:     cfg.GceInstanceGroup + "/" + cfg.AliasNetwork,
+			Action:   strings.ToLower(operation.Type.String()),
+			Instance: operation.Instance.Name,
+			Peer:     operation.Peers[ip],
+			Reason:   operation.Reason,
+			Result:   result,
+		})
+	}
+}
+
+// RecentOperations returns the most recent operations, newest last.
+func RecentOperations() []OperationRecord {
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	return append([]OperationRecord{}, recentOperations...)
+}
+
+func Execute(ctx context.Context, cfg *GcpConfig, operation Operation) int {
+	start := time.Now()
+	if delay := operationDelay.Load(); delay > 0 {
+		time.Sleep(time.Duration(delay))
+	}
+	if err := ctx.Err(); err != nil {
+		log.Printf("Skip operation on instance %s: %v", operation.Instance.Name, err)
+		recordOperation(cfg, operation, start, "failed")
+		return 0
+	}
+	instance, err := GetInstance(ctx, cfg, operation.Instance.Zone, operation.Instance.Name)
 	if err != nil {
 		log.Printf("Error getting instance: %v", err)
+		recordOperation(cfg, operation, start, "failed")
 		return 0
 	}
 	var newState []string
@@ -107,14 +309,36 @@ func Execute(cfg *GcpConfig, operation Operation) int {
 	}
 	if len(*instance.AliasIps) == len(newState) {
 		// No actual changes.
+		recordOperation(cfg, operation, start, "noop")
 		return 0
 	}
-	err = UpdateAliasIPs(cfg, instance, newState)
+	operation.GceOperation, err = UpdateAliasIPs(ctx, cfg, instance, newState)
 	if err != nil {
 		log.Printf("Error updating alias ips for instance %s", instance.Name)
+		recordOperation(cfg, operation, start, "failed")
 		return 0
 	}
-	WaitForUpdate(cfg, instance.Name, newState)
+	if waiter, ok := provider.(OperationWaiter); ok && operation.GceOperation != "" {
+		if err := waiter.WaitOperation(ctx, cfg, instance.Zone, operation.GceOperation); err != nil {
+			log.Printf("Error updating alias ips for instance %s: %v", instance.Name, err)
+			recordOperation(cfg, operation, start, "failed")
+			return 0
+		}
+	} else {
+		WaitForUpdate(ctx, cfg, instance.Zone, instance.Name, newState)
+	}
+	if operation.Type == Add && cfg.VerifyPort != 0 {
+		if err := VerifyAliases(cfg, instance, operation.Ips); err != nil {
+			log.Printf("Warning: instance %s does not serve %v yet: %v", instance.Name, operation.Ips, err)
+			recordOperation(cfg, operation, start, "unverified")
+			recordHistory(cfg, operation, "unverified")
+			notifyVipEvents(cfg, operation)
+			return 0
+		}
+	}
+	recordOperation(cfg, operation, start, "executed")
+	recordHistory(cfg, operation, "executed")
+	notifyVipEvents(cfg, operation)
 	return 1
 }
 
@@ -131,11 +355,13 @@ func exponentialBackoff(elapsedSeconds int) time.Duration {
 	}
 }
 
-func WaitForUpdate(cfg *GcpConfig, instanceName string, newState []string) {
+// WaitForUpdate polls an instance until it has as many alias IPs as newState,
+// for providers without operations to wait on.
+func WaitForUpdate(ctx context.Context, cfg *GcpConfig, zone, instanceName string, newState []string) {
 	start := time.Now()
 	elapsedSeconds := 0
 	for uint(elapsedSeconds) < cfg.WaitSeconds {
-		instance, err := GetInstance(cfg, instanceName)
+		instance, err := GetInstance(ctx, cfg, zone, instanceName)
 		if err != nil {
 			log.Printf("Error waiting for operation to complete. Ignoring: %v", err)
 			return
@@ -144,7 +370,12 @@ func WaitForUpdate(cfg *GcpConfig, instanceName string, newState []string) {
 			log.Printf("Instance: %s updated in %v.", instance.Name, time.Since(start))
 			return
 		}
-		time.Sleep(exponentialBackoff(elapsedSeconds))
+		select {
+		case <-ctx.Done():
+			log.Printf("Stop waiting for instance %s update: %v", instanceName, ctx.Err())
+			return
+		case <-time.After(exponentialBackoff(elapsedSeconds)):
+		}
 		elapsedSeconds = int(time.Since(start).Seconds())
 	}
 	log.Printf("Waited %d seconds for instance update, then gave up.", elapsedSeconds)
@@ -0,0 +1,70 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestRequestQueue(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		priorities []int
+		// Indexes of the pushed requests, in the order they are popped.
+		want []int
+	}{
+		{name: "one priority", priorities: []int{1, 1, 1}, want: []int{0, 1, 2}},
+		{name: "by priority", priorities: []int{2, 0, 1}, want: []int{1, 2, 0}},
+		{name: "FIFO within priority", priorities: []int{1, 0, 1, 0, 2, 1}, want: []int{1, 3, 0, 2, 5, 4}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			q := newRequestQueue()
+			for _, priority := range test.priorities {
+				q.push(request{priority: priority})
+			}
+			got := []int{}
+			for range test.priorities {
+				// The queue numbers requests from 1, in the order of arrival.
+				got = append(got, int(q.pop().seq)-1)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("popped %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestQueueBlocks(t *testing.T) {
+	q := newRequestQueue()
+	popped := make(chan request)
+	go func() { popped <- q.pop() }()
+	select {
+	case r := <-popped:
+		t.Fatalf("pop returned %v from an empty queue", r)
+	case <-time.After(10 * time.Millisecond):
+	}
+	q.push(request{priority: 3})
+	select {
+	case r := <-popped:
+		if r.priority != 3 {
+			t.Errorf("popped priority %d, want 3", r.priority)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("pop did not return after a push")
+	}
+}
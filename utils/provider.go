@@ -0,0 +1,70 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The cloud that hosts the instances and their alias IPs. GCE is the
+// default, see UseAws for AWS.
+
+import "context"
+
+// Provider lists instances and updates their alias IPs. GcpConfig and
+// GceInstance describe instances of any provider, see the provider for how
+// their fields map.
+type Provider interface {
+	// GetInstance returns an instance, with its alias IPs in the alias
+	// network.
+	GetInstance(ctx context.Context, cfg *GcpConfig, zone, name string) (*GceInstance, error)
+	// ListGroup returns the instances of the instance group, by name.
+	ListGroup(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error)
+	// UpdateAliasIPs sets the alias IPs of an instance in the alias network,
+	// and returns the name of the operation, if any.
+	UpdateAliasIPs(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error)
+	// AliasRange returns the CIDR of the alias network in the subnetwork.
+	AliasRange(ctx context.Context, cfg *GcpConfig, subnetwork string) (string, error)
+}
+
+// OperationWaiter is implemented by providers whose UpdateAliasIPs returns an
+// operation that can be waited on. For other providers, vip_manager polls the
+// instance until its alias IPs change.
+type OperationWaiter interface {
+	// WaitOperation waits for an operation of UpdateAliasIPs on an instance
+	// in the zone to complete, and returns its error, if it failed.
+	WaitOperation(ctx context.Context, cfg *GcpConfig, zone, name string) error
+}
+
+// Set once at startup, before the workers start.
+var provider Provider = gceProvider{}
+
+func GetInstance(ctx context.Context, cfg *GcpConfig, zone, name string) (*GceInstance, error) {
+	return provider.GetInstance(ctx, cfg, zone, name)
+}
+
+// GetInstancesFromMIG returns the instances of the instance group: the
+// managed instance group on GCE.
+func GetInstancesFromMIG(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
+	return provider.ListGroup(ctx, cfg)
+}
+
+// UpdateAliasIPs sets the alias IPs of an instance, and returns the name of
+// the operation.
+func UpdateAliasIPs(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error) {
+	return provider.UpdateAliasIPs(ctx, cfg, instance, ips)
+}
+
+// GetAliasRange returns the CIDR of the alias network of the pool, in the
+// subnetwork of its instances.
+func GetAliasRange(ctx context.Context, cfg *GcpConfig, subnetwork string) (string, error) {
+	return provider.AliasRange(ctx, cfg, subnetwork)
+}
@@ -0,0 +1,135 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Alias IP operations published to Cloud Pub/Sub, for downstream consumers
+// and auditing.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/api/pubsub/v1"
+)
+
+// Events waiting to be published. When Pub/Sub falls behind, further events
+// are dropped rather than holding up the workers.
+const maxPendingEvents = 1000
+
+// Messages per publish request.
+const maxPublishBatch = 100
+
+var (
+	pubsubService *pubsub.Service
+	pubsubTopic   string
+	pubsubEvents  chan OperationEvent
+)
+
+// OperationEvent is an executed alias IP operation.
+type OperationEvent struct {
+	Time            time.Time `json:"time"`
+	Project         string    `json:"project"`
+	Pool            string    `json:"pool"`
+	Zone            string    `json:"zone"`
+	Instance        string    `json:"instance"`
+	Type            string    `json:"type"`
+	Ips             []string  `json:"ips"`
+	Reason          string    `json:"reason"`
+	Result          string    `json:"result"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// ConnectPubSub publishes all operations from now on to a topic, named
+// projects/PROJECT/topics/TOPIC.
+func ConnectPubSub(topic string) {
+	c, err := defaultClient(context.Background(), pubsub.PubsubScope)
+	if err != nil {
+		log.Printf("Error getting Default GCP client: %v", err)
+	}
+	pubsubService, err = pubsub.New(c)
+	if err != nil {
+		log.Fatalf("Error connecting to Cloud Pub/Sub: %v", err)
+		os.Exit(1)
+	}
+	pubsubTopic = topic
+	pubsubEvents = make(chan OperationEvent, maxPendingEvents)
+	go publishEvents()
+}
+
+// publishOperation queues an event for an operation, if publishing is on.
+func publishOperation(cfg *GcpConfig, operation Operation, start time.Time, result string) {
+	if pubsubEvents == nil {
+		return
+	}
+	event := OperationEvent{
+		Time:            time.Now(),
+		Project:         cfg.Project,
+		Pool:            cfg.GceInstanceGroup + "/" + cfg.AliasNetwork,
+		Zone:            operation.Instance.Zone,
+		Instance:        operation.Instance.Name,
+		Type:            strings.ToLower(operation.Type.String()),
+		Ips:             operation.Ips,
+		Reason:          operation.Reason,
+		Result:          result,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	select {
+	case pubsubEvents <- event:
+	default:
+		log.Printf("Warning: Pub/Sub is behind, dropped event for %s %v on %s", event.Type, event.Ips, event.Instance)
+	}
+}
+
+// publishEvents publishes queued events in batches.
+func publishEvents() {
+	for event := range pubsubEvents {
+		events := []OperationEvent{event}
+	batch:
+		for len(events) < maxPublishBatch {
+			select {
+			case event := <-pubsubEvents:
+				events = append(events, event)
+			default:
+				break batch
+			}
+		}
+		messages := []*pubsub.PubsubMessage{}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error encoding event: %v", err)
+				continue
+			}
+			messages = append(messages, &pubsub.PubsubMessage{
+				Data: base64.StdEncoding.EncodeToString(data),
+				Attributes: map[string]string{
+					"pool":   event.Pool,
+					"type":   event.Type,
+					"result": event.Result,
+				},
+			})
+		}
+		req := &pubsub.PublishRequest{Messages: messages}
+		if _, err := pubsubService.Projects.Topics.Publish(pubsubTopic, req).Context(context.Background()).Do(); err != nil {
+			countApiError("topics.publish")
+			log.Printf("Error publishing %d events to %s: %v", len(messages), pubsubTopic, err)
+		}
+	}
+}
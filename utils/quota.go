@@ -0,0 +1,101 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// GCE quotas, and the rate of GCE API writes by vip_manager itself.
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Quota is a GCE quota of the project (scope "global"), or of a region.
+type Quota struct {
+	Scope  string
+	Metric string
+	Limit  float64
+	Usage  float64
+}
+
+// GetQuotas returns the quotas of the project, and of the region of the
+// configured zone or region.
+func GetQuotas(ctx context.Context, cfg *GcpConfig) ([]Quota, error) {
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	quotas := []Quota{}
+	project, err := computeClient.GetProject(ctx, cfg.Project)
+	if err != nil {
+		countApiError("projects.get")
+		return nil, fmt.Errorf("Error getting project %s: %v", cfg.Project, err)
+	}
+	for _, q := range project.GetQuotas() {
+		quotas = append(quotas, Quota{Scope: "global", Metric: q.GetMetric(), Limit: q.GetLimit(), Usage: q.GetUsage()})
+	}
+	region := cfg.Region
+	if region == "" {
+		region = cfg.Zone[:strings.LastIndex(cfg.Zone, "-")]
+	}
+	resp, err := computeClient.GetRegion(ctx, cfg.Project, region)
+	if err != nil {
+		countApiError("regions.get")
+		return nil, fmt.Errorf("Error getting region %s: %v", region, err)
+	}
+	for _, q := range resp.GetQuotas() {
+		quotas = append(quotas, Quota{Scope: region, Metric: q.GetMetric(), Limit: q.GetLimit(), Usage: q.GetUsage()})
+	}
+	return quotas, nil
+}
+
+// Warn when vip_manager uses this fraction of the write quota.
+const writeWarning = 0.8
+
+// Writes in the last minute, against the per minute quota of GCE API writes
+// shared with other automation in the project.
+var (
+	writesMu    sync.Mutex
+	writes      []time.Time
+	writeQuota  float64
+	writeWarned time.Time
+)
+
+// SetWriteQuota sets the GCE API write requests per minute of the project.
+// 0 for unknown.
+func SetWriteQuota(perMinute float64) {
+	writesMu.Lock()
+	defer writesMu.Unlock()
+	writeQuota = perMinute
+	gceWriteQuota.Set(perMinute)
+}
+
+// countWrite counts a GCE API write, and warns when vip_manager alone uses
+// most of the write quota, at most once a minute.
+func countWrite() {
+	writesMu.Lock()
+	defer writesMu.Unlock()
+	now := time.Now()
+	writes = append(writes, now)
+	for len(writes) > 0 && now.Sub(writes[0]) >= time.Minute {
+		writes = writes[1:]
+	}
+	gceWritesLastMinute.Set(float64(len(writes)))
+	if writeQuota > 0 && float64(len(writes)) >= writeWarning*writeQuota && now.Sub(writeWarned) >= time.Minute {
+		writeWarned = now
+		log.Printf("Warning: %d GCE API writes in the last minute, %.0f%% of the quota of %.0f per minute", len(writes), 100*float64(len(writes))/writeQuota, writeQuota)
+	}
+}
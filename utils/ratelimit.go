@@ -0,0 +1,106 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Client side rate limit of GCE API requests, so that the reconcile workers
+// and instance discovery together stay below the project quota, instead of
+// running into rate limit errors.
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket: it allows Qps requests per second on
+// average, and bursts of up to Burst requests.
+type RateLimiter struct {
+	mu     sync.Mutex
+	qps    float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a rate limiter with a full bucket. Burst is at
+// least 1.
+func NewRateLimiter(qps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{qps: qps, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// reserve takes a token, and returns how long to wait until it is available.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.qps
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.qps * float64(time.Second))
+}
+
+// Wait blocks until a request is allowed, or the context is done.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	wait := l.reserve()
+	if wait <= 0 {
+		return nil
+	}
+	apiThrottled.Add(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// apiLimiter limits all GCE API requests, nil if unlimited.
+var apiLimiter *RateLimiter
+
+// SetApiRateLimit limits GCE API requests to qps per second, with bursts of
+// up to burst requests. 0 qps is unlimited. Call it before ConnectCompute.
+func SetApiRateLimit(qps float64, burst int) {
+	if qps <= 0 {
+		apiLimiter = nil
+		return
+	}
+	apiLimiter = NewRateLimiter(qps, burst)
+}
+
+// limitTransport waits for the rate limiter before each request, including
+// retries.
+type limitTransport struct {
+	base    http.RoundTripper
+	limiter *RateLimiter
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
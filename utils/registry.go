@@ -0,0 +1,95 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Registry keeps track of backends that registered themselves, in addition to
+// (or instead of) instance group discovery.
+
+import (
+	"sync"
+	"time"
+)
+
+// Registration is sent by a backend to register itself.
+type Registration struct {
+	// GCE instance name and zone.
+	Name string `json:"name"`
+	Zone string `json:"zone"`
+	// Instance group to join.
+	Group        string   `json:"group"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Weight       float64  `json:"weight,omitempty"`
+	// Cordoned backends receive no new VIPs.
+	Cordoned bool      `json:"cordoned,omitempty"`
+	Expires  time.Time `json:"expires"`
+
+	// Why the backend is about to be stopped, e.g. "preempted" or
+	// "maintenance". Terminating backends are drained right away.
+	Terminating string `json:"terminating,omitempty"`
+}
+
+type Registry struct {
+	// Registrations expire unless renewed within TTL.
+	TTL time.Duration
+
+	mu            sync.Mutex
+	registrations map[string]Registration
+}
+
+func NewRegistry(ttl time.Duration) *Registry {
+	return &Registry{
+		TTL:           ttl,
+		registrations: map[string]Registration{},
+	}
+}
+
+// Register adds or renews a registration.
+func (r *Registry) Register(registration Registration) Registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registration.Expires = time.Now().Add(r.TTL)
+	r.registrations[registration.Name] = registration
+	return registration
+}
+
+// Get returns the unexpired registration of an instance, if any.
+func (r *Registry) Get(name string) (Registration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	registration, ok := r.registrations[name]
+	if !ok || time.Now().After(registration.Expires) {
+		return Registration{}, false
+	}
+	return registration, true
+}
+
+// List returns unexpired registrations for an instance group. Expired
+// registrations are forgotten.
+func (r *Registry) List(group string) []Registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	registrations := []Registration{}
+	for name, registration := range r.registrations {
+		if now.After(registration.Expires) {
+			delete(r.registrations, name)
+			continue
+		}
+		if registration.Group == group {
+			registrations = append(registrations, registration)
+		}
+	}
+	return registrations
+}
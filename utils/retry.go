@@ -0,0 +1,189 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Retries of GCE API calls. Transient failures, i.e. rate limits, server
+// errors and, for reads, network errors, are retried with exponential backoff
+// and jitter, up to a cap. Calls that still fail count against an error
+// budget, and hold off further reconcile passes, see FailureBackoff.
+
+import (
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is how GCE API calls are retried.
+type RetryPolicy struct {
+	// Attempts per call, including the first one.
+	Attempts int
+	// Backoff before the first retry, doubling with every retry up to Max.
+	Base time.Duration
+	Max  time.Duration
+	// Fraction of calls in a minute that may fail before a warning.
+	Budget float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 4,
+	Base:     500 * time.Millisecond,
+	Max:      30 * time.Second,
+	Budget:   0.05,
+}
+
+var (
+	retryPolicy = DefaultRetryPolicy
+
+	callsMu sync.Mutex
+	// Outcomes of the calls in the last minute, and failures in a row.
+	calls          []apiCall
+	failuresInRow  int
+	budgetWarned   time.Time
+	failureBackoff time.Duration
+)
+
+type apiCall struct {
+	time time.Time
+	ok   bool
+}
+
+// SetRetryPolicy sets the retry policy of GCE API calls. Call it before
+// ConnectCompute.
+func SetRetryPolicy(policy RetryPolicy) {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	retryPolicy = policy
+}
+
+// Backoff returns a random delay before retry number attempt, starting at 0:
+// up to Base times 2^attempt, capped at Max (full jitter), so that retries of
+// many callers spread out.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	limit := p.Max
+	if attempt < 30 && p.Base<<attempt < limit {
+		limit = p.Base << attempt
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)) + 1)
+}
+
+// Jitter returns d randomized by up to fraction in either direction, so that
+// periodic work of many loops and managers spreads out.
+func Jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + fraction*(2*rand.Float64()-1)))
+}
+
+// retryTransport retries transient failures of GCE API requests. Writes are
+// only retried when rate limited, since other failures may have executed.
+type retryTransport struct {
+	base http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	policy := retryPolicy
+	read := req.Method == http.MethodGet || req.Method == http.MethodHead
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err := t.base.RoundTrip(req)
+		transient := false
+		switch {
+		case err != nil:
+			transient = read
+		case resp.StatusCode == http.StatusTooManyRequests:
+			transient = true
+		case resp.StatusCode >= 500:
+			transient = read
+		}
+		if !transient || attempt+1 >= policy.Attempts || (req.Body != nil && req.GetBody == nil) {
+			recordCall(err == nil && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500)
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		apiRetries.Inc()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(policy.Backoff(attempt)):
+		}
+	}
+}
+
+// recordCall records the outcome of a call after retries, and warns when
+// more calls failed in the last minute than the error budget allows, at most
+// once a minute.
+func recordCall(ok bool) {
+	callsMu.Lock()
+	defer callsMu.Unlock()
+	now := time.Now()
+	calls = append(calls, apiCall{time: now, ok: ok})
+	for len(calls) > 0 && now.Sub(calls[0].time) >= time.Minute {
+		calls = calls[1:]
+	}
+	if ok {
+		failuresInRow = 0
+		failureBackoff = 0
+		return
+	}
+	failuresInRow++
+	failureBackoff = retryPolicy.Backoff(failuresInRow)
+	failed := 0
+	for _, call := range calls {
+		if !call.ok {
+			failed++
+		}
+	}
+	if float64(failed) > retryPolicy.Budget*float64(len(calls)) && now.Sub(budgetWarned) >= time.Minute {
+		budgetWarned = now
+		log.Printf("Warning: %d of %d GCE API calls failed in the last minute, after retries, above the error budget of %.0f%%",
+			failed, len(calls), 100*retryPolicy.Budget)
+	}
+}
+
+// ApiReachable returns whether the last GCE API call succeeded, after retries,
+// or none was made yet.
+func ApiReachable() bool {
+	callsMu.Lock()
+	defer callsMu.Unlock()
+	return failuresInRow == 0
+}
+
+// FailureBackoff returns how long to hold off the next reconcile pass, after
+// GCE API calls failed despite retries: exponential in the number of failed
+// calls in a row, with jitter, up to the Max of the retry policy. 0 after a
+// call succeeded.
+func FailureBackoff() time.Duration {
+	callsMu.Lock()
+	defer callsMu.Unlock()
+	return failureBackoff
+}
@@ -0,0 +1,86 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Scrape reads the load of a backend from its metrics_exporter, for load
+// aware rebalancing.
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+const ExporterPrefix = "metrics_exporter_"
+
+var scrapeClient = http.Client{Timeout: 5 * time.Second}
+
+// BackendLoad is the load of a backend, as reported by metrics_exporter.
+type BackendLoad struct {
+	CpuPercent float64
+	// Composite saturation score in percent, -1 for older exporters.
+	Saturation float64
+	// Ingress TCP connections by local IP, i.e. by VIP.
+	Connections map[string]float64
+	// Ingress TCP connections by local port, i.e. by service.
+	ConnectionsByPort map[string]float64
+}
+
+// ScrapeLoad scrapes the metrics_exporter at url.
+func ScrapeLoad(url string) (*BackendLoad, error) {
+	resp, err := scrapeClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Scrape %s failed: %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing metrics from %s: %v", url, err)
+	}
+	cpu := families[ExporterPrefix+"cpu_usage_percent"].GetMetric()
+	if len(cpu) == 0 {
+		return nil, fmt.Errorf("No CPU usage in metrics from %s", url)
+	}
+	load := &BackendLoad{
+		CpuPercent:        cpu[0].GetGauge().GetValue(),
+		Saturation:        -1,
+		Connections:       map[string]float64{},
+		ConnectionsByPort: map[string]float64{},
+	}
+	if score := families[ExporterPrefix+"saturation_score"].GetMetric(); len(score) > 0 {
+		load.Saturation = score[0].GetGauge().GetValue()
+	}
+	for _, metric := range families[ExporterPrefix+"ingress_tcp_connections_by_local_ip"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "ip" {
+				load.Connections[label.GetValue()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	for _, metric := range families[ExporterPrefix+"ingress_tcp_connections_by_port"].GetMetric() {
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "port" {
+				load.ConnectionsByPort[label.GetValue()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return load, nil
+}
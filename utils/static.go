@@ -0,0 +1,264 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// VIPs without a cloud API: hosts and networks from a static inventory
+// file, e.g. of a bare-metal NFS cluster. metrics_exporter on each host adds
+// and removes the addresses, and announces them, e.g. with gratuitous ARP.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Inventory lists the hosts by group, and the networks of the VIPs.
+//
+//	{
+//	  "groups": [{"name": "nfs", "hosts": [
+//	    {"name": "nfs-1", "zone": "rack-a", "agent": "10.0.0.11:9001"}]}],
+//	  "networks": [{"name": "vips", "cidr": "10.0.16.0/24"}]
+//	}
+type Inventory struct {
+	Groups   []InventoryGroup   `json:"groups"`
+	Networks []InventoryNetwork `json:"networks"`
+}
+
+type InventoryGroup struct {
+	Name  string          `json:"name"`
+	Hosts []InventoryHost `json:"hosts"`
+}
+
+// InventoryHost is a host, with the address of its metrics_exporter.
+type InventoryHost struct {
+	Name   string            `json:"name"`
+	Zone   string            `json:"zone"`
+	Agent  string            `json:"agent"`
+	Labels map[string]string `json:"labels"`
+}
+
+type InventoryNetwork struct {
+	Name string `json:"name"`
+	Cidr string `json:"cidr"`
+}
+
+// AgentAddresses is the body of GET and PUT /addresses of metrics_exporter:
+// the single addresses in the network on the host.
+type AgentAddresses struct {
+	Network   string   `json:"network"`
+	Addresses []string `json:"addresses"`
+}
+
+// UseStatic manages VIPs on the hosts of the inventory file instead of GCE.
+// The fields of GcpConfig map to it: GceInstanceGroup is a group, and
+// AliasNetwork a network of the inventory. The file is read on every listing,
+// so that hosts can be added or removed without a restart. token is the
+// bearer token of the agents.
+func UseStatic(path, token string) error {
+	p := &staticProvider{path: path, token: token}
+	if _, err := p.load(); err != nil {
+		return err
+	}
+	provider = p
+	return nil
+}
+
+type staticProvider struct {
+	path  string
+	token string
+}
+
+func (p *staticProvider) load() (*Inventory, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading inventory: %v", err)
+	}
+	inventory := &Inventory{}
+	if err := json.Unmarshal(data, inventory); err != nil {
+		return nil, fmt.Errorf("Error parsing inventory %s: %v", p.path, err)
+	}
+	for _, network := range inventory.Networks {
+		if _, err := netip.ParsePrefix(network.Cidr); err != nil {
+			return nil, fmt.Errorf("Inventory %s: network %s: %v", p.path, network.Name, err)
+		}
+	}
+	for _, group := range inventory.Groups {
+		for _, host := range group.Hosts {
+			if host.Name == "" || host.Agent == "" {
+				return nil, fmt.Errorf("Inventory %s: group %s: hosts need a name and an agent", p.path, group.Name)
+			}
+		}
+	}
+	return inventory, nil
+}
+
+func (p *staticProvider) network(inventory *Inventory, name string) (string, error) {
+	for _, network := range inventory.Networks {
+		if network.Name == name {
+			return network.Cidr, nil
+		}
+	}
+	return "", fmt.Errorf("Inventory %s: network %s: %w", p.path, name, ErrNoSecondaryRange)
+}
+
+var agentClient = &http.Client{Timeout: 10 * time.Second}
+
+// agentRequest calls the /addresses endpoint of the agent of a host.
+func (p *staticProvider) agentRequest(ctx context.Context, method string, host InventoryHost, body *AgentAddresses) (*AgentAddresses, error) {
+	u := "http://" + host.Agent + "/addresses?network=" + url.QueryEscape(body.Network)
+	var reader io.Reader
+	if method == http.MethodPut {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s %s", method, u, resp.Status, strings.TrimSpace(string(data)))
+	}
+	addresses := &AgentAddresses{}
+	if err := json.Unmarshal(data, addresses); err != nil {
+		return nil, fmt.Errorf("Error parsing addresses from %s: %v", host.Agent, err)
+	}
+	return addresses, nil
+}
+
+// newStaticInstance asks the agent of a host for its addresses in the alias
+// network.
+func (p *staticProvider) newStaticInstance(ctx context.Context, cfg *GcpConfig, inventory *Inventory, host InventoryHost) (*GceInstance, error) {
+	cidr, err := p.network(inventory, cfg.AliasNetwork)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := p.agentRequest(ctx, http.MethodGet, host, &AgentAddresses{Network: cidr})
+	if err != nil {
+		countApiError("agent.get")
+		return nil, fmt.Errorf("Error getting addresses of %s: %v", host.Name, err)
+	}
+	ips := addresses.Addresses
+	sort.Strings(ips)
+	labels := host.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	return &GceInstance{
+		Name:             host.Name,
+		Zone:             host.Zone,
+		NetworkInterface: host.Agent,
+		AliasNetwork:     cfg.AliasNetwork,
+		AliasIps:         &ips,
+		Labels:           labels,
+		Status:           "RUNNING",
+	}, nil
+}
+
+func (p *staticProvider) GetInstance(ctx context.Context, cfg *GcpConfig, zone, name string) (*GceInstance, error) {
+	inventory, err := p.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range inventory.Groups {
+		for _, host := range group.Hosts {
+			if host.Name == name {
+				return p.newStaticInstance(ctx, cfg, inventory, host)
+			}
+		}
+	}
+	return nil, fmt.Errorf("Error getting instance %s: not in inventory %s", name, p.path)
+}
+
+// ListGroup returns the hosts of the group whose agents answer. Hosts whose
+// agents do not answer are left out, like stopped instances.
+func (p *staticProvider) ListGroup(ctx context.Context, cfg *GcpConfig) (map[string]*GceInstance, error) {
+	instances := map[string]*GceInstance{}
+	inventory, err := p.load()
+	if err != nil {
+		return instances, err
+	}
+	for _, group := range inventory.Groups {
+		if group.Name != cfg.GceInstanceGroup {
+			continue
+		}
+		for _, host := range group.Hosts {
+			instance, err := p.newStaticInstance(ctx, cfg, inventory, host)
+			if err != nil {
+				if errors.Is(err, ErrNoSecondaryRange) {
+					return instances, err
+				}
+				log.Printf("Leave out %s: %v", host.Name, err)
+				continue
+			}
+			instances[host.Name] = instance
+		}
+		return instances, nil
+	}
+	return instances, fmt.Errorf("Inventory %s has no group %s", p.path, cfg.GceInstanceGroup)
+}
+
+// UpdateAliasIPs sets the addresses of the host in the alias network through
+// its agent.
+func (p *staticProvider) UpdateAliasIPs(ctx context.Context, cfg *GcpConfig, instance *GceInstance, ips []string) (string, error) {
+	inventory, err := p.load()
+	if err != nil {
+		return "", err
+	}
+	cidr, err := p.network(inventory, cfg.AliasNetwork)
+	if err != nil {
+		return "", err
+	}
+	host := InventoryHost{Name: instance.Name, Agent: instance.NetworkInterface}
+	countWrite()
+	if _, err := p.agentRequest(ctx, http.MethodPut, host, &AgentAddresses{Network: cidr, Addresses: ips}); err != nil {
+		countApiError("agent.put")
+		log.Printf("Error updating addresses of %s: %v", instance.Name, err)
+		return "", err
+	}
+	return "", nil
+}
+
+func (p *staticProvider) AliasRange(ctx context.Context, cfg *GcpConfig, subnetwork string) (string, error) {
+	inventory, err := p.load()
+	if err != nil {
+		return "", err
+	}
+	return p.network(inventory, cfg.AliasNetwork)
+}
@@ -0,0 +1,142 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Storage keeps small state objects in Google Cloud Storage (GCS).
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+var (
+	storageService *storage.Service
+
+	ErrObjectNotFound     = errors.New("object not found")
+	ErrGenerationMismatch = errors.New("object generation mismatch")
+)
+
+func ConnectStorage() {
+	c, err := defaultClient(context.Background(), storage.DevstorageReadWriteScope)
+	if err != nil {
+		log.Printf("Error getting Default GCP client: %v", err)
+	}
+	storageService, err = storage.New(c)
+	if err != nil {
+		log.Fatalf("Error connecting to GCS: %v", err)
+	}
+}
+
+// ReadObject reads a GCS object. Returns ErrObjectNotFound if the object
+// does not exist.
+func ReadObject(bucket, name string) ([]byte, error) {
+	data, _, err := ReadObjectGeneration(bucket, name)
+	return data, err
+}
+
+// ReadObjectGeneration reads a GCS object and its generation, for use with
+// WriteObjectIfGeneration.
+func ReadObjectGeneration(bucket, name string) ([]byte, int64, error) {
+	resp, err := storageService.Objects.Get(bucket, name).Context(context.Background()).Download()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, 0, ErrObjectNotFound
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	generation, err := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Failed to parse generation of %s: %v", name, err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	return data, generation, err
+}
+
+// WriteObject creates or replaces a GCS object.
+func WriteObject(bucket, name string, data []byte) error {
+	object := &storage.Object{
+		Name:        name,
+		ContentType: "application/json",
+	}
+	_, err := storageService.Objects.Insert(bucket, object).
+		Media(bytes.NewReader(data)).Context(context.Background()).Do()
+	return err
+}
+
+// ParseGcsUrl splits gs://BUCKET/OBJECT into bucket and object. Returns ok
+// false if the location is not a GCS URL.
+func ParseGcsUrl(location string) (bucket, object string, ok bool) {
+	if !strings.HasPrefix(location, "gs://") {
+		return "", "", false
+	}
+	bucket, object, ok = strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+	return bucket, object, ok && bucket != "" && object != ""
+}
+
+// ReadLocation reads a local file, or a GCS object given as
+// gs://BUCKET/OBJECT. Returns ErrObjectNotFound if it does not exist.
+func ReadLocation(location string) ([]byte, error) {
+	if bucket, object, ok := ParseGcsUrl(location); ok {
+		return ReadObject(bucket, object)
+	}
+	data, err := os.ReadFile(location)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return data, err
+}
+
+// WriteLocation writes a local file, or a GCS object given as
+// gs://BUCKET/OBJECT. Local files are replaced atomically.
+func WriteLocation(location string, data []byte) error {
+	if bucket, object, ok := ParseGcsUrl(location); ok {
+		return WriteObject(bucket, object, data)
+	}
+	tmp := location + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, location)
+}
+
+// WriteObjectIfGeneration replaces a GCS object, only if its generation is
+// unchanged. Generation 0 means the object must not exist. Returns
+// ErrGenerationMismatch if someone else wrote the object first.
+func WriteObjectIfGeneration(bucket, name string, data []byte, generation int64) error {
+	object := &storage.Object{
+		Name:        name,
+		ContentType: "application/json",
+	}
+	_, err := storageService.Objects.Insert(bucket, object).IfGenerationMatch(generation).
+		Media(bytes.NewReader(data)).Context(context.Background()).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return ErrGenerationMismatch
+	}
+	return err
+}
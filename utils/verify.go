@@ -0,0 +1,91 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Verification of alias IP assignments from the guest side. The control
+// plane may report an update as done while the dataplane lags behind, so
+// after adding alias IPs, ask metrics_exporter on the instance whether the
+// metadata server lists them, and whether the guest routes them locally.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type AliasStatus struct {
+	Ip       string `json:"ip"`
+	Metadata bool   `json:"metadata"`
+	Local    bool   `json:"local"`
+}
+
+var verifyClient = http.Client{Timeout: 5 * time.Second}
+
+// GetAliasStatus asks metrics_exporter on the instance about alias IPs.
+func GetAliasStatus(ip string, port uint, aliases []string) ([]AliasStatus, error) {
+	query := url.Values{"ip": aliases}
+	address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+	resp, err := verifyClient.Get("http://" + address + "/aliases?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s/aliases: %s", address, resp.Status)
+	}
+	statuses := []AliasStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// VerifyAliases waits until the instance sees the alias IPs in the metadata
+// server and routes them locally, for at most cfg.VerifySeconds.
+func VerifyAliases(cfg *GcpConfig, instance *GceInstance, aliases []string) error {
+	if instance.NetworkIp == "" {
+		return fmt.Errorf("instance %s has no network IP", instance.Name)
+	}
+	start := time.Now()
+	elapsedSeconds := 0
+	var err error
+	for {
+		var statuses []AliasStatus
+		statuses, err = GetAliasStatus(instance.NetworkIp, cfg.VerifyPort, aliases)
+		if err == nil {
+			pending := []string{}
+			for _, status := range statuses {
+				if !status.Metadata || !status.Local {
+					pending = append(pending, status.Ip)
+				}
+			}
+			if len(pending) == 0 && len(statuses) == len(aliases) {
+				log.Printf("Instance: %s serves %v after %v.", instance.Name, aliases, time.Since(start))
+				return nil
+			}
+			err = fmt.Errorf("not yet in metadata or routed locally: %v", pending)
+		}
+		if uint(elapsedSeconds) >= cfg.VerifySeconds {
+			return err
+		}
+		time.Sleep(exponentialBackoff(elapsedSeconds))
+		elapsedSeconds = int(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Changes to instances and instance groups, from Compute operations or from
+// Cloud Asset feed notifications, to reconcile right away instead of waiting
+// for the next pass.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/api/pubsub/v1"
+)
+
+// Change is a change to a GCE resource, e.g. an instance that was created,
+// stopped or preempted, or a managed instance group that was resized.
+type Change struct {
+	Project string
+	// Zone or region, empty for global resources.
+	Location string
+	// Collection, e.g. "instances" or "instanceGroupManagers".
+	Kind string
+	Name string
+}
+
+func (c Change) String() string {
+	return c.Kind + " " + c.Name
+}
+
+// parseChange parses a resource name or URL, e.g.
+// https://www.googleapis.com/compute/v1/projects/P/zones/Z/instances/NAME.
+func parseChange(name string) (Change, bool) {
+	i := strings.Index(name, "projects/")
+	if i < 0 {
+		return Change{}, false
+	}
+	parts := strings.Split(name[i:], "/")
+	switch len(parts) {
+	case 4:
+		return Change{Project: parts[1], Kind: parts[2], Name: parts[3]}, true
+	case 6:
+		return Change{Project: parts[1], Location: parts[3], Kind: parts[4], Name: parts[5]}, true
+	}
+	return Change{}, false
+}
+
+// OperationWatcher lists the changes of Compute operations that started since
+// its previous poll of a project.
+type OperationWatcher struct {
+	// Insert time of the latest operation seen, by project.
+	since map[string]time.Time
+}
+
+func NewOperationWatcher() *OperationWatcher {
+	return &OperationWatcher{since: map[string]time.Time{}}
+}
+
+// Poll returns the changes of the operations in the project since the
+// previous poll, none on the first poll. Alias IP updates are left out, they
+// are mostly vip_manager's own.
+func (w *OperationWatcher) Poll(ctx context.Context, project string) ([]Change, error) {
+	since, ok := w.since[project]
+	if !ok {
+		w.since[project] = time.Now()
+		return nil, nil
+	}
+	// Operation times have the offset of the zone, so compare the day on
+	// the server, and the time here.
+	filter := fmt.Sprintf(`(insertTime > "%s") (operationType != "updateNetworkInterface")`,
+		since.UTC().AddDate(0, 0, -1).Format("2006-01-02"))
+	changes := []Change{}
+	latest := since
+	ctx, cancel := callContext(ctx)
+	defer cancel()
+	operations, err := computeClient.ListOperations(ctx, project, filter)
+	if err != nil {
+		countApiError("globalOperations.aggregatedList")
+		return nil, fmt.Errorf("Error listing operations of project %s: %v", project, err)
+	}
+	for _, op := range operations {
+		inserted, err := time.Parse(time.RFC3339, op.GetInsertTime())
+		if err != nil || !inserted.After(since) {
+			continue
+		}
+		if inserted.After(latest) {
+			latest = inserted
+		}
+		if change, ok := parseChange(op.GetTargetLink()); ok {
+			changes = append(changes, change)
+		}
+	}
+	w.since[project] = latest
+	return changes, nil
+}
+
+// assetNotification is a Cloud Asset feed notification. Only the name of
+// the asset matters.
+type assetNotification struct {
+	Asset struct {
+		Name string `json:"name"`
+	} `json:"asset"`
+}
+
+// WatchAssetFeed pulls Cloud Asset feed notifications from a Pub/Sub
+// subscription, named projects/PROJECT/subscriptions/SUBSCRIPTION, and calls
+// changed for each. Never returns.
+func WatchAssetFeed(subscription string, changed func(Change)) {
+	c, err := defaultClient(context.Background(), pubsub.PubsubScope)
+	if err != nil {
+		log.Printf("Error getting Default GCP client: %v", err)
+	}
+	service, err := pubsub.New(c)
+	if err != nil {
+		log.Fatalf("Error connecting to Cloud Pub/Sub: %v", err)
+	}
+	for {
+		resp, err := service.Projects.Subscriptions.Pull(subscription, &pubsub.PullRequest{MaxMessages: 100}).Context(context.Background()).Do()
+		if err != nil {
+			countApiError("subscriptions.pull")
+			log.Printf("Error pulling from %s: %v", subscription, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		ackIds := []string{}
+		for _, received := range resp.ReceivedMessages {
+			ackIds = append(ackIds, received.AckId)
+			data, err := base64.StdEncoding.DecodeString(received.Message.Data)
+			if err != nil {
+				log.Printf("Error decoding asset notification: %v", err)
+				continue
+			}
+			var notification assetNotification
+			if err := json.Unmarshal(data, &notification); err != nil {
+				log.Printf("Error decoding asset notification: %v", err)
+				continue
+			}
+			if change, ok := parseChange(notification.Asset.Name); ok {
+				changed(change)
+			}
+		}
+		if len(ackIds) == 0 {
+			continue
+		}
+		ack := &pubsub.AcknowledgeRequest{AckIds: ackIds}
+		if _, err := service.Projects.Subscriptions.Acknowledge(subscription, ack).Context(context.Background()).Do(); err != nil {
+			countApiError("subscriptions.acknowledge")
+			log.Printf("Error acknowledging %d messages on %s: %v", len(ackIds), subscription, err)
+		}
+	}
+}
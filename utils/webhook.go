@@ -0,0 +1,99 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var webhookClient = http.Client{Timeout: 10 * time.Second}
+
+// PostJSON posts a JSON encoded payload to a webhook URL.
+func PostJSON(url string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return post(url, data)
+}
+
+func post(url string, data []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s failed: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// VipEvent is a VIP added to or removed from an instance. For moves, the
+// other instance is set as well.
+type VipEvent struct {
+	Time        time.Time `json:"time"`
+	Pool        string    `json:"pool"`
+	Ip          string    `json:"ip"`
+	Action      string    `json:"action"`
+	Instance    string    `json:"instance"`
+	OldInstance string    `json:"old_instance"`
+	NewInstance string    `json:"new_instance"`
+	Reason      string    `json:"reason"`
+}
+
+// notifyVipEvents posts an event per IP of an executed operation to the
+// move webhook, in the background. Without template, the event is posted as
+// JSON.
+func notifyVipEvents(cfg *GcpConfig, operation Operation) {
+	if cfg.MoveWebhook == "" {
+		return
+	}
+	for _, ip := range operation.Ips {
+		event := VipEvent{
+			Time:     time.Now(),
+			Pool:     cfg.GceInstanceGroup + "/" + cfg.AliasNetwork,
+			Ip:       ip,
+			Action:   strings.ToLower(operation.Type.String()),
+			Instance: operation.Instance.Name,
+			Reason:   operation.Reason,
+		}
+		if operation.Type == Add {
+			event.OldInstance, event.NewInstance = operation.Peers[ip], operation.Instance.Name
+		} else {
+			event.OldInstance, event.NewInstance = operation.Instance.Name, operation.Peers[ip]
+		}
+		go func() {
+			data, err := json.Marshal(event)
+			if cfg.MoveTemplate != nil {
+				var buf bytes.Buffer
+				err = cfg.MoveTemplate.Execute(&buf, event)
+				data = buf.Bytes()
+			}
+			if err == nil {
+				err = post(cfg.MoveWebhook, data)
+			}
+			if err != nil {
+				log.Printf("Error notifying %s of %s %s on %s: %v", cfg.MoveWebhook, event.Action, event.Ip, event.Instance, err)
+			}
+		}()
+	}
+}
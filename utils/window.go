@@ -0,0 +1,123 @@
+package utils
+
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Window is a recurring time window, e.g. for disruptive VIP moves. The
+// format is "DAYS HH:MM-HH:MM" in UTC, where DAYS is "*", a day like "Sat",
+// or a comma separated list of days and ranges like "Mon-Fri,Sun". A window
+// ending before it starts wraps past midnight, into the next day.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Window struct {
+	// Days the window starts.
+	Days [7]bool
+	// Start and end, as time of day.
+	Start time.Duration
+	End   time.Duration
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func ParseWindow(s string) (Window, error) {
+	window := Window{}
+	days, times, ok := strings.Cut(strings.TrimSpace(s), " ")
+	if !ok {
+		return window, fmt.Errorf("invalid window %q, expected \"DAYS HH:MM-HH:MM\"", s)
+	}
+	for _, item := range strings.Split(days, ",") {
+		if item == "*" {
+			window.Days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		first, last, isRange := strings.Cut(item, "-")
+		if !isRange {
+			last = first
+		}
+		from, ok := weekdays[strings.ToLower(first)]
+		if !ok {
+			return window, fmt.Errorf("invalid day %q in window %q", first, s)
+		}
+		to, ok := weekdays[strings.ToLower(last)]
+		if !ok {
+			return window, fmt.Errorf("invalid day %q in window %q", last, s)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			window.Days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(times), "-")
+	if !ok {
+		return window, fmt.Errorf("invalid times %q in window %q, expected HH:MM-HH:MM", times, s)
+	}
+	var err error
+	if window.Start, err = parseTimeOfDay(start); err != nil {
+		return window, fmt.Errorf("invalid start in window %q: %v", s, err)
+	}
+	if window.End, err = parseTimeOfDay(end); err != nil {
+		return window, fmt.Errorf("invalid end in window %q: %v", s, err)
+	}
+	return window, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if t is within the window.
+func (w Window) Contains(t time.Time) bool {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	now := t.Sub(midnight)
+	if w.Start <= w.End {
+		return w.Days[t.Weekday()] && now >= w.Start && now < w.End
+	}
+	// Wraps past midnight: started today, or yesterday.
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.Days[t.Weekday()] && now >= w.Start) || (w.Days[yesterday] && now < w.End)
+}
+
+// InWindows returns true if t is within any of the windows, or if there are
+// no windows.
+func InWindows(windows []Window, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}